@@ -3,6 +3,7 @@ package main
 import (
     "strconv"
     "sort"
+    "time"
 )
 
 type SortedSetEntry struct {
@@ -40,6 +41,8 @@ func getRedisValueType(rv RedisValue) string {
         return "array"
     case map[string]struct{}:
         return "set"
+    case map[string]string:
+        return "hash"
     case RedisStream:
         return "stream"
     case SortedSet:
@@ -60,12 +63,12 @@ func addStreamEntry(key, id string, fields map[string]string) {
     }
     redisStream.Entries = append(redisStream.Entries, StreamEntry{ID: id, Fields: fields})
 
+    store[key] = RedisValue{value: redisStream}
+
     client, ok := popBlockingClient(key, blockingQueueForXread)
     if ok {
-        client.notify <- struct{}{}
+        client.notify <- id
     }
-
-    store[key] = RedisValue{value: redisStream}
 }
 
 func getOrCreateSortedSet(key string) SortedSet {
@@ -159,6 +162,46 @@ func removeFromSortedSet(key string, member string) (SortedSet, *SortedSetEntry)
     return sortedSet, removedEntry
 }
 
+// copyRedisValue returns a copy that shares nothing the handlers modify in place
+func copyRedisValue(rv RedisValue) RedisValue {
+    switch v := rv.value.(type) {
+    case []string:
+        return RedisValue{value: append([]string{}, v...)}
+    case map[string]struct{}:
+        set := make(map[string]struct{}, len(v))
+        for member := range v {
+            set[member] = struct{}{}
+        }
+        return RedisValue{value: set}
+    case map[string]string:
+        hash := make(map[string]string, len(v))
+        for field, value := range v {
+            hash[field] = value
+        }
+        return RedisValue{value: hash}
+    case SortedSet:
+        entries := make(map[string]float64, len(v.Entries))
+        for member, score := range v.Entries {
+            entries[member] = score
+        }
+        return RedisValue{value: SortedSet{Entries: entries, Sorted: append([]SortedSetEntry{}, v.Sorted...)}}
+    case RedisStream:
+        // entries are only ever appended and never changed in place
+        return RedisValue{value: RedisStream{Entries: append([]StreamEntry{}, v.Entries...)}}
+    }
+    return rv
+}
+
+// emptyKeyspace drops every key, clients watching any of them will have EXEC fail
+func emptyKeyspace() {
+    for key := range store {
+        touchWatchedKey(key)
+    }
+    detachSnapshots()
+    store = make(map[string]RedisValue)
+    ttl = make(map[string]time.Time)
+}
+
 func setGenericValue[T any](key string, value T) {
     store[key] = RedisValue{value: value}
 }
@@ -179,15 +222,24 @@ func addToList(key string, value []string, prepend bool) []string {
     }
     
     store[key] = RedisValue{value: arr}
-    
-    client, ok := popBlockingClient(key, blockingQueueForBlop)
-    if ok {
-        client.notify <- struct{}{}
-    }
-    
+    serveBlockedPoppers(key, arr)
     return arr
 }
 
+// hands values straight to clients blocked on the list, in the order they blocked
+func serveBlockedPoppers(key string, list []string) {
+    for len(list) > 0 {
+        client, ok := popBlockingClient(key, blockingQueueForBlop)
+        if !ok {
+            return
+        }
+        var val string
+        list, val = removeFromList(key, list, 0)
+        alsoPropagate([]string{"LPOP", key})
+        client.notify <- val
+    }
+}
+
 func removeFromList(key string, list []string, index int) ([]string, string) {
     var removedVal string
     if index < 0 || index >= len(list) {
@@ -268,6 +320,15 @@ func getSet(key string) ([]string, bool) {
     return set, true
 }
 
+func getHash(key string) (map[string]string, bool) {
+    val, ok := store[key]
+    if !ok {
+        return nil, false
+    }
+    hash, ok := val.value.(map[string]string)
+    return hash, ok
+}
+
 func getStream(key string) (RedisStream, bool) {
     val, ok := store[key]
     if !ok {
@@ -1,26 +1,33 @@
 package main
 
 import (
-	"net"
 	"crypto/sha256"
 	"encoding/hex"
-)
+	"fmt"
+	"sort"
+	"strings"
 
-var loggedInUsers = make(map[net.Conn]string)
+	"github.com/DeanLogan/redis-clone/app/resp"
+)
 
 type aclUser struct {
-    Username string
-    Flags    map[string]struct{}
-    Password map[string]struct{}
+    Username    string
+    Flags       map[string]struct{}
+    Password    map[string]struct{}
+    AllCommands bool            // +@all, Commands holds the exceptions either way
+    Commands    map[string]bool // command name -> allowed
 }
 
 func newAclUser(username string) aclUser {
     user := aclUser{
         Username: username,
         Flags: map[string]struct{}{
+            "on":     {},
             "nopass": {},
         },
-        Password: make(map[string]struct{}),
+        Password:    make(map[string]struct{}),
+        AllCommands: true,
+        Commands:    make(map[string]bool),
     }
 	if config.Users == nil {
 		config.Users = make(map[string]aclUser)
@@ -29,21 +36,111 @@ func newAclUser(username string) aclUser {
     return user
 }
 
-func mapToSlice(mp map[string]struct{}) []RespValue {
-    properties := []RespValue{}
+func mapToSlice(mp map[string]struct{}) []resp.RespValue {
+    properties := []resp.RespValue{}
     for property := range mp {
-        properties = append(properties, RespValue{BULK, property})
+        properties = append(properties, resp.BulkString(property))
     }
 	return properties
 }
 
-func (user aclUser) toGetUser() []RespValue {
-    return []RespValue{
-        {Type: BULK, Value: "flags"},
-        {Type: ARRAY, Value: mapToSlice(user.Flags)},
-        {Type: BULK, Value: "passwords"},
-        {Type: ARRAY, Value:  mapToSlice(user.Password)},
+func (user aclUser) toGetUser() resp.RespValue {
+    return resp.Map(
+        resp.KV("flags", resp.Array(mapToSlice(user.Flags)...)),
+        resp.KV("passwords", resp.Array(mapToSlice(user.Password)...)),
+        resp.KV("commands", resp.BulkString(user.commandRules())),
+        // every user reaches every key and channel, see applyRule
+        resp.KV("keys", resp.BulkString("~*")),
+        resp.KV("channels", resp.BulkString("&*")),
+    )
+}
+
+// clone copies the user so rules can be tried on it without touching the original
+func (user aclUser) clone() aclUser {
+    copied := user
+    copied.Flags = make(map[string]struct{}, len(user.Flags))
+    for flag := range user.Flags {
+        copied.Flags[flag] = struct{}{}
+    }
+    copied.Password = make(map[string]struct{}, len(user.Password))
+    for hash := range user.Password {
+        copied.Password[hash] = struct{}{}
+    }
+    copied.Commands = make(map[string]bool, len(user.Commands))
+    for name, allowed := range user.Commands {
+        copied.Commands[name] = allowed
+    }
+    return copied
+}
+
+// commandRules describes the command permissions like ACL GETUSER does in redis, "-@all +psync +replconf"
+func (user aclUser) commandRules() string {
+    rules := []string{"-@all"}
+    if user.AllCommands {
+        rules[0] = "+@all"
+    }
+    names := make([]string, 0, len(user.Commands))
+    for name := range user.Commands {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    for _, name := range names {
+        if user.Commands[name] {
+            rules = append(rules, "+"+strings.ToLower(name))
+        } else {
+            rules = append(rules, "-"+strings.ToLower(name))
+        }
+    }
+    return strings.Join(rules, " ")
+}
+
+func (user aclUser) canRun(command string) bool {
+    if allowed, ok := user.Commands[command]; ok {
+        return allowed
+    }
+    return user.AllCommands
+}
+
+// applyRule applies one ACL SETUSER rule: on, off, >pass, <pass, nopass,
+// resetpass, +@all, -@all, +command or -command. Keys and channels aren't
+// restricted here, so only the patterns that allow all of them are accepted.
+func (user *aclUser) applyRule(rule string) error {
+    switch lower := strings.ToLower(rule); {
+    case lower == "on":
+        user.Flags["on"] = struct{}{}
+        delete(user.Flags, "off")
+    case lower == "off":
+        user.Flags["off"] = struct{}{}
+        delete(user.Flags, "on")
+    case lower == "~*" || lower == "allkeys" || lower == "&*" || lower == "allchannels":
+    case strings.HasPrefix(rule, "~") || strings.HasPrefix(rule, "%") || strings.HasPrefix(rule, "&") || lower == "resetkeys" || lower == "resetchannels":
+        return fmt.Errorf("Error in ACL SETUSER modifier '%s': only ~* and &* are supported for keys and channels", rule)
+    case lower == "nopass":
+        user.Password = make(map[string]struct{})
+        user.Flags["nopass"] = struct{}{}
+    case lower == "resetpass":
+        user.Password = make(map[string]struct{})
+        delete(user.Flags, "nopass")
+    case lower == "+@all" || lower == "allcommands":
+        user.AllCommands = true
+        user.Commands = make(map[string]bool)
+    case lower == "-@all" || lower == "nocommands":
+        user.AllCommands = false
+        user.Commands = make(map[string]bool)
+    case strings.HasPrefix(rule, ">"):
+        user.setPassword(rule)
+    case strings.HasPrefix(rule, "<"):
+        delete(user.Password, generatePasswordHash(rule[1:]))
+    case len(rule) > 1 && (rule[0] == '+' || rule[0] == '-'):
+        name := strings.ToUpper(rule[1:])
+        if _, ok := commandTable[name]; !ok {
+            return fmt.Errorf("Error in ACL SETUSER modifier '%s': Unknown command", rule)
+        }
+        user.Commands[name] = rule[0] == '+'
+    default:
+        return fmt.Errorf("Error in ACL SETUSER modifier '%s': Syntax error", rule)
     }
+    return nil
 }
 
 func (user aclUser) setPassword(raw string) {
@@ -57,15 +154,16 @@ func (user aclUser) setPassword(raw string) {
     delete(user.Flags, "nopass")
 }
 
-func (user aclUser) authenticate(conn net.Conn, password string) bool {
+func (user aclUser) authenticate(c *client, password string) bool {
     passwordHash := generatePasswordHash(password)
     _, passwordCorrect := user.Password[passwordHash]
     _, nopassSet := user.Flags["nopass"]
+    _, enabled := user.Flags["on"]
     
-    if !passwordCorrect && !nopassSet {
+    if !enabled || (!passwordCorrect && !nopassSet) {
         return false
     }
-    loggedInUsers[conn] = user.Username
+    c.user = user.Username
     return true
 }
 
@@ -2,11 +2,38 @@ package main
 
 import (
 	"fmt"
+	"io"
 	"os"
 	"bufio"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 )
 
+// the incremental file that writes are currently appended to, nil when AOF is off
+var aofFile *os.File
+var aofLastFsync time.Time
+var aofDirPath string
+var aofManifest []manifestEntry
+
+// sizes used by the auto-aof-rewrite thresholds, the base size is the total
+// size of the AOF right after the last rewrite (or at startup)
+var aofCurrentSize int64
+var aofBaseSize int64
+var aofRewriteInProgress bool
+var aofLastRewriteStatus = "ok"
+var aofInTransaction bool // between the MULTI and EXEC of a propagated transaction
+
+// set while the AOF is being replayed so the replayed writes are not logged again
+var loadingAof bool
+
+type manifestEntry struct {
+	filename string
+	seq      int
+	fileType string // b: base, h: history, i: incremental
+}
+
 func createAofDir() (string, error) {
 	aofDir := filepath.Join(config.Dir, config.AppendDirName)
 	if err := os.MkdirAll(aofDir, 0755); err != nil {
@@ -15,46 +42,536 @@ func createAofDir() (string, error) {
 	return aofDir, nil
 }
 
-func createEmptyIncFile(aofDir string) {
+// createEmptyIncFile starts the next incremental file and records it in the manifest
+func createEmptyIncFile(aofDir string) (string, error) {
     filename := fmt.Sprintf("%s.%d.incr.aof", config.AppendFilename, config.AofIncrFileCount)
 	
     if err := os.WriteFile(filepath.Join(aofDir, filename), []byte(""), 0644); err != nil {
-        fmt.Println(err)
-		os.Exit(1)
+        return "", err
     }
 	
-	appendManifestEntry(aofDir, filename, config.AofIncrFileCount)
+	entries := append(append([]manifestEntry{}, aofManifest...), manifestEntry{filename, config.AofIncrFileCount, "i"})
+	if err := writeManifest(aofDir, entries); err != nil {
+		return "", err
+	}
+	aofManifest = entries
 	config.AofIncrFileCount++
+	return filename, nil
 }
 
-func appendManifestEntry(aofDir string, filename string, seq int) error {
-    manifestPath := filepath.Join(aofDir, fmt.Sprintf("%s.manifest", config.AppendFilename))
-    line := fmt.Sprintf("file %s seq %d type i", filename, seq)
-    return appendLine(manifestPath, line)
+// writeManifest replaces the manifest through a temp file and a rename so a
+// crash never leaves a half written manifest behind
+func writeManifest(aofDir string, entries []manifestEntry) error {
+	contents := ""
+	for _, entry := range entries {
+		contents += fmt.Sprintf("file %s seq %d type %s\n", entry.filename, entry.seq, entry.fileType)
+	}
+
+	tmpPath := manifestPath(aofDir) + ".tmp"
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	if _, err := file.WriteString(contents); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, manifestPath(aofDir))
 }
 
-func createManifestFile(aofDir string) {
-	filename := fmt.Sprintf("%s.manifest", config.AppendFilename)
-	writeToFile(aofDir+"/"+filename, "")
+func manifestPath(aofDir string) string {
+	return filepath.Join(aofDir, fmt.Sprintf("%s.manifest", config.AppendFilename))
 }
 
-func writeToFile(filepath string, contents string) {
-	err := os.WriteFile(filepath, []byte(contents), 0644)
+// readManifest parses lines of the form "file <name> seq <n> type <b|h|i>",
+// a missing manifest is not an error and just returns no entries
+func readManifest(aofDir string) ([]manifestEntry, error) {
+	data, err := os.ReadFile(manifestPath(aofDir))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
 	if err != nil {
-		fmt.Println(err)
+		return nil, err
+	}
+
+	entries := []manifestEntry{}
+	for lineNum, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields)%2 != 0 {
+			return nil, fmt.Errorf("invalid manifest line %d: %q", lineNum+1, line)
+		}
+		entry := manifestEntry{}
+		for i := 0; i < len(fields); i += 2 {
+			switch fields[i] {
+			case "file":
+				entry.filename = fields[i+1]
+			case "seq":
+				entry.seq, err = strconv.Atoi(fields[i+1])
+				if err != nil {
+					return nil, fmt.Errorf("invalid manifest line %d: %q", lineNum+1, line)
+				}
+			case "type":
+				entry.fileType = fields[i+1]
+			}
+		}
+		if entry.filename == "" || entry.fileType == "" {
+			return nil, fmt.Errorf("invalid manifest line %d: %q", lineNum+1, line)
+		}
+		entries = append(entries, entry)
 	}
+	return entries, nil
 }
 
-func appendLine(path string, line string) error {
-    file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-    if err != nil {
-        return err
-    }
-    defer file.Close()
+// setupAppendOnly loads an existing AOF, or starts a fresh one, and opens the
+// last incremental file for appending. It runs before the executor starts.
+func setupAppendOnly() error {
+	aofDir, err := createAofDir()
+	if err != nil {
+		return err
+	}
+	aofDirPath = aofDir
 
-    writer := bufio.NewWriter(file)
-    if _, err := writer.WriteString(line + "\n"); err != nil {
-        return err
-    }
-    return writer.Flush()
-}
\ No newline at end of file
+	entries, err := readManifest(aofDir)
+	if err != nil {
+		return err
+	}
+	aofManifest = entries
+
+	if len(entries) > 0 {
+		if err := loadAppendOnlyFiles(aofDir, entries); err != nil {
+			return err
+		}
+	}
+
+	var current manifestEntry
+	for _, entry := range entries {
+		if entry.fileType == "i" {
+			current = entry
+			config.AofIncrFileCount = entry.seq + 1
+		}
+	}
+	if current.filename == "" {
+		current.filename, err = createEmptyIncFile(aofDir)
+		if err != nil {
+			return err
+		}
+	}
+
+	aofCurrentSize = aofFilesSize(aofDir, aofManifest)
+	aofBaseSize = aofCurrentSize
+	return openIncrFile(aofDir, current.filename)
+}
+
+func aofFilesSize(aofDir string, entries []manifestEntry) int64 {
+	var size int64
+	for _, entry := range entries {
+		if info, err := os.Stat(filepath.Join(aofDir, entry.filename)); err == nil {
+			size += info.Size()
+		}
+	}
+	return size
+}
+
+func openIncrFile(aofDir string, filename string) error {
+	file, err := os.OpenFile(filepath.Join(aofDir, filename), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	aofFile = file
+	aofLastFsync = time.Now()
+	return nil
+}
+
+// loadAppendOnlyFiles replays the base file and then each incremental file in order
+func loadAppendOnlyFiles(aofDir string, entries []manifestEntry) error {
+	loadingAof = true
+	defer func() { loadingAof = false }()
+
+	for i, entry := range entries {
+		if entry.fileType == "h" {
+			continue
+		}
+		path := filepath.Join(aofDir, entry.filename)
+		fmt.Printf("Loading AOF file %s\n", entry.filename)
+
+		if err := replayAofFile(path, i == len(entries)-1); err != nil {
+			return fmt.Errorf("loading AOF file %s: %w", entry.filename, err)
+		}
+	}
+	return nil
+}
+
+// countingReader tracks how many bytes have been read so a truncated tail can be cut off
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
+
+// replayAofFile runs every command in the file. When the last file ends in a
+// partially written command or transaction (the server died mid write) the
+// tail is truncated, the same as redis does with aof-load-truncated yes.
+func replayAofFile(path string, isLast bool) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	counter := &countingReader{r: file}
+	reader := bufio.NewReader(counter)
+	loader := newClient(-1, nil)
+	loader.internal = true
+	validOffset := int64(0)
+	count := 0
+
+	// a base file may start with an RDB preamble, followed by the commands
+	// that were written while it was being produced
+	if header, err := reader.Peek(5); err == nil && string(header) == "REDIS" {
+		if err := loadRDB(reader); err != nil {
+			return err
+		}
+		validOffset = counter.n - int64(reader.Buffered())
+	}
+
+	for {
+		cmd, err := readCommand(reader)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			if counter.n == validOffset {
+				break
+			}
+			if !isLast {
+				return fmt.Errorf("unexpected end of file at offset %d", validOffset)
+			}
+			fmt.Printf("AOF %s is truncated, discarding the last partial command or transaction\n", path)
+			return os.Truncate(path, validOffset)
+		}
+		if err != nil {
+			return err
+		}
+
+		handleCommand(cmd, loader)
+		// a transaction cut short by a crash is dropped whole, like redis does
+		if !loader.inMulti {
+			validOffset = counter.n - int64(reader.Buffered())
+		}
+		count++
+	}
+	fmt.Printf("Replayed %d commands from %s\n", count, path)
+	return nil
+}
+
+// feedAppendOnlyFile appends a write, encoded exactly as it is sent to replicas,
+// to the current incremental file and fsyncs it when appendfsync is always
+func feedAppendOnlyFile(cmd []string) {
+	if aofFile == nil || loadingAof {
+		return
+	}
+	n, err := aofFile.WriteString(encodeStringArray(cmd))
+	if err != nil {
+		fmt.Printf("Error writing to AOF: %v\n", err)
+		return
+	}
+	if config.AppendFSync == "always" {
+		aofFile.Sync()
+		aofLastFsync = time.Now()
+	}
+
+	aofCurrentSize += int64(n)
+	// a rewrite moves on to a new file, which mustn't split a transaction
+	switch cmd[0] {
+	case "MULTI":
+		aofInTransaction = true
+	case "EXEC":
+		aofInTransaction = false
+	}
+	if !aofInTransaction && shouldAutoRewriteAof() {
+		fmt.Printf("Starting automatic rewriting of AOF on %d%% growth\n", config.AutoAofRewritePercentage)
+		if err := startAofRewrite(); err != nil {
+			fmt.Printf("Automatic AOF rewrite failed to start: %v\n", err)
+		}
+	}
+}
+
+func shouldAutoRewriteAof() bool {
+	if aofRewriteInProgress || config.AutoAofRewritePercentage <= 0 || aofCurrentSize < int64(config.AutoAofRewriteMinSize) {
+		return false
+	}
+	base := aofBaseSize
+	if base == 0 {
+		base = 1
+	}
+	growth := (aofCurrentSize - base) * 100 / base
+	return growth >= int64(config.AutoAofRewritePercentage)
+}
+
+// startAofRewrite switches new writes to a fresh incremental file and then, in
+// the background, writes a base file for the keyspace as it is at this moment.
+// Once the base is on disk the manifest is swapped to base + the new
+// incremental files and everything older is deleted.
+func startAofRewrite() error {
+	if aofFile == nil {
+		return fmt.Errorf("append only file is not enabled")
+	}
+	if aofRewriteInProgress {
+		return fmt.Errorf("Background append only file rewriting already in progress")
+	}
+
+	filename, err := createEmptyIncFile(aofDirPath)
+	if err != nil {
+		return err
+	}
+	aofFile.Sync()
+	aofFile.Close()
+	if err := openIncrFile(aofDirPath, filename); err != nil {
+		return err
+	}
+
+	aofRewriteInProgress = true
+	firstIncrSeq := config.AofIncrFileCount - 1
+	baseSeq := 1
+	for _, entry := range aofManifest {
+		if entry.fileType == "b" && entry.seq >= baseSeq {
+			baseSeq = entry.seq + 1
+		}
+	}
+	snapshot := newKeyspaceSnapshot()
+	aofRewriteSnap = snapshot
+
+	go func() {
+		tmpPath := filepath.Join(aofDirPath, fmt.Sprintf("temp-rewriteaof-bg-%d.aof", os.Getpid()))
+		err := writeAofBase(tmpPath, snapshot)
+		runOnExecutor(func() {
+			finishAofRewrite(tmpPath, baseSeq, firstIncrSeq, err)
+		})
+	}()
+	return nil
+}
+
+// aofRewriteSnap is the snapshot of the rewrite in progress, nil otherwise
+var aofRewriteSnap *keyspaceSnapshot
+
+func finishAofRewrite(tmpPath string, baseSeq int, firstIncrSeq int, err error) {
+	aofRewriteInProgress = false
+	if aofRewriteSnap != nil {
+		aofRewriteSnap.release()
+		aofRewriteSnap = nil
+	}
+	if err == errSnapshotCancelled {
+		os.Remove(tmpPath)
+		fmt.Println("Background AOF rewrite cancelled, starting again from the new keyspace")
+		if err := startAofRewrite(); err != nil {
+			fmt.Printf("Background AOF rewrite failed to start: %v\n", err)
+			aofLastRewriteStatus = "err"
+		}
+		return
+	}
+	if err != nil {
+		fmt.Printf("Background AOF rewrite failed: %v\n", err)
+		aofLastRewriteStatus = "err"
+		os.Remove(tmpPath)
+		return
+	}
+
+	baseName := fmt.Sprintf("%s.%d.base.aof", config.AppendFilename, baseSeq)
+	if err := os.Rename(tmpPath, filepath.Join(aofDirPath, baseName)); err != nil {
+		fmt.Printf("Background AOF rewrite failed: %v\n", err)
+		aofLastRewriteStatus = "err"
+		os.Remove(tmpPath)
+		return
+	}
+
+	entries := []manifestEntry{{baseName, baseSeq, "b"}}
+	history := []manifestEntry{}
+	for _, entry := range aofManifest {
+		if entry.fileType == "i" && entry.seq >= firstIncrSeq {
+			entries = append(entries, entry)
+		} else {
+			history = append(history, entry)
+		}
+	}
+	if err := writeManifest(aofDirPath, entries); err != nil {
+		fmt.Printf("Background AOF rewrite failed to update the manifest: %v\n", err)
+		aofLastRewriteStatus = "err"
+		return
+	}
+	aofManifest = entries
+
+	for _, entry := range history {
+		os.Remove(filepath.Join(aofDirPath, entry.filename))
+	}
+	aofCurrentSize = aofFilesSize(aofDirPath, aofManifest)
+	aofBaseSize = aofCurrentSize
+	aofLastRewriteStatus = "ok"
+	fmt.Printf("Background AOF rewrite finished successfully, base file %s\n", baseName)
+}
+
+// restartAofAfterSync rewrites the AOF once a full resync replaced the
+// keyspace, like redis' restartAOFAfterSYNC. Until then a restart would replay
+// history from before the sync.
+func restartAofAfterSync() {
+	if aofFile == nil {
+		return
+	}
+	if aofRewriteInProgress {
+		// finishAofRewrite starts again once the goroutine notices
+		if aofRewriteSnap != nil {
+			aofRewriteSnap.cancel()
+			aofRewriteSnap = nil
+		}
+		return
+	}
+	if err := startAofRewrite(); err != nil {
+		fmt.Printf("Failed to rewrite the AOF after the sync with the master: %v\n", err)
+	}
+}
+
+// writeAofBase writes the commands that rebuild the snapshot, fsynced before returning
+func writeAofBase(path string, snapshot *keyspaceSnapshot) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(file)
+	for {
+		batch, done, err := snapshot.next()
+		if err != nil {
+			file.Close()
+			return err
+		}
+		for _, entry := range batch {
+			for _, cmd := range rewriteCommandsForKey(entry.key, entry.value, entry.expireAt) {
+				if _, err := writer.WriteString(encodeStringArray(cmd)); err != nil {
+					file.Close()
+					return err
+				}
+			}
+		}
+		if done {
+			break
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// the most elements put in one RPUSH/SADD/HSET/ZADD of a rewritten AOF
+const aofRewriteItemsPerCmd = 64
+
+// rewriteCommandsForKey returns the shortest commands that recreate one key
+func rewriteCommandsForKey(key string, value RedisValue, expireAt time.Time) [][]string {
+	cmds := [][]string{}
+	switch v := value.value.(type) {
+	case string:
+		cmds = append(cmds, []string{"SET", key, v})
+	case int:
+		cmds = append(cmds, []string{"SET", key, strconv.Itoa(v)})
+	case []string:
+		for start := 0; start < len(v); start += aofRewriteItemsPerCmd {
+			end := min(start+aofRewriteItemsPerCmd, len(v))
+			cmds = append(cmds, append([]string{"RPUSH", key}, v[start:end]...))
+		}
+	case map[string]struct{}:
+		cmd := []string{"SADD", key}
+		for member := range v {
+			cmd = append(cmd, member)
+			if len(cmd)-2 == aofRewriteItemsPerCmd {
+				cmds = append(cmds, cmd)
+				cmd = []string{"SADD", key}
+			}
+		}
+		if len(cmd) > 2 {
+			cmds = append(cmds, cmd)
+		}
+	case map[string]string:
+		cmd := []string{"HSET", key}
+		for field, fieldValue := range v {
+			cmd = append(cmd, field, fieldValue)
+			if (len(cmd)-2)/2 == aofRewriteItemsPerCmd {
+				cmds = append(cmds, cmd)
+				cmd = []string{"HSET", key}
+			}
+		}
+		if len(cmd) > 2 {
+			cmds = append(cmds, cmd)
+		}
+	case SortedSet:
+		cmd := []string{"ZADD", key}
+		for _, entry := range v.Sorted {
+			cmd = append(cmd, strconv.FormatFloat(entry.Score, 'f', -1, 64), entry.Member)
+			if (len(cmd)-2)/2 == aofRewriteItemsPerCmd {
+				cmds = append(cmds, cmd)
+				cmd = []string{"ZADD", key}
+			}
+		}
+		if len(cmd) > 2 {
+			cmds = append(cmds, cmd)
+		}
+	case RedisStream:
+		for _, entry := range v.Entries {
+			cmd := []string{"XADD", key, entry.ID}
+			for field, fieldValue := range entry.Fields {
+				cmd = append(cmd, field, fieldValue)
+			}
+			cmds = append(cmds, cmd)
+		}
+	}
+
+	// the deadline is absolute so reloading the AOF later doesn't extend it
+	if !expireAt.IsZero() && len(cmds) > 0 {
+		if !expireAt.After(time.Now()) {
+			return nil
+		}
+		cmds = append(cmds, []string{"PEXPIREAT", key, strconv.FormatInt(expireAt.UnixMilli(), 10)})
+	}
+	return cmds
+}
+
+func bgrewriteaofResponse() string {
+	if err := startAofRewrite(); err != nil {
+		return encodeSimpleErrorResponse(err.Error())
+	}
+	return encodeSimpleString("Background append only file rewriting started")
+}
+
+// startAofFsync flushes the AOF to disk once a second when appendfsync is everysec
+func startAofFsync() {
+	if config.AppendFSync != "everysec" {
+		return
+	}
+	go func() {
+		for range time.Tick(time.Second) {
+			var file *os.File
+			runOnExecutor(func() {
+				file = aofFile
+				aofLastFsync = time.Now()
+			})
+			if file != nil {
+				file.Sync()
+			}
+		}
+	}()
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// replBacklog is a circular buffer holding the tail of the replication stream
+// so a replica that briefly lost its link can continue from its own offset
+// instead of needing a full resync. The last byte in the buffer always has the
+// offset config.MasterReplOffset.
+type replBacklog struct {
+	buf     []byte
+	idx     int // where the next byte is written
+	histlen int // how much of buf holds valid data
+}
+
+// the backlog only exists once a replica has attached, it's freed again after
+// repl-backlog-ttl seconds without any replicas
+var backlog *replBacklog
+var noReplicasSince = time.Now()
+
+func createReplBacklog() {
+	if backlog != nil {
+		return
+	}
+	backlog = &replBacklog{buf: make([]byte, config.ReplBacklogSize)}
+	fmt.Printf("Created a replication backlog of %d bytes\n", config.ReplBacklogSize)
+}
+
+func (b *replBacklog) feed(data []byte) {
+	for len(data) > 0 {
+		n := copy(b.buf[b.idx:], data)
+		b.idx = (b.idx + n) % len(b.buf)
+		b.histlen = min(b.histlen+n, len(b.buf))
+		data = data[n:]
+	}
+}
+
+// firstOffset is the replication offset of the oldest byte still in the backlog
+func (b *replBacklog) firstOffset() int {
+	return config.MasterReplOffset - b.histlen + 1
+}
+
+// readFrom returns everything from offset to the end of the stream, false when
+// offset has already been overwritten or is ahead of the stream
+func (b *replBacklog) readFrom(offset int) ([]byte, bool) {
+	start := b.firstOffset()
+	if offset < start || offset > start+b.histlen {
+		return nil, false
+	}
+	n := b.histlen - (offset - start)
+	out := make([]byte, 0, n)
+	pos := ((b.idx-n)%len(b.buf) + len(b.buf)) % len(b.buf)
+	if pos+n <= len(b.buf) {
+		return append(out, b.buf[pos:pos+n]...), true
+	}
+	out = append(out, b.buf[pos:]...)
+	return append(out, b.buf[:n-(len(b.buf)-pos)]...), true
+}
+
+// resize keeps as much of the most recent history as fits in the new size
+func (b *replBacklog) resize(size int) {
+	keep := min(b.histlen, size)
+	data, _ := b.readFrom(config.MasterReplOffset - keep + 1)
+	b.buf = make([]byte, size)
+	b.idx = 0
+	b.histlen = 0
+	b.feed(data)
+}
+
+// shiftReplicationId is used when a replica becomes a master. The old replid
+// stays valid up to the current offset so the other replicas of the old master
+// can still partially resync from us.
+func shiftReplicationId() {
+	config.Replid2 = config.Replid
+	config.SecondReplOffset = config.MasterReplOffset + 1
+	config.Replid = randReplid()
+	fmt.Printf("Setting secondary replication ID to %s, valid up to offset: %d. New replication ID is %s\n",
+		config.Replid2, config.SecondReplOffset, config.Replid)
+}
+
+// tryPartialResync answers PSYNC with +CONTINUE and the missing part of the
+// stream when the replica's history is one of ours and still in the backlog
+func tryPartialResync(c *client, replid string, offset int) bool {
+	if backlog == nil {
+		return false
+	}
+	if replid != config.Replid && (replid != config.Replid2 || offset > config.SecondReplOffset) {
+		fmt.Printf("[#%d] Partial resynchronization not accepted: replication ID mismatch (asked for %s)\n", c.id, replid)
+		return false
+	}
+	data, ok := backlog.readFrom(offset)
+	if !ok {
+		fmt.Printf("[#%d] Unable to partial resync: offset %d is outside the backlog\n", c.id, offset)
+		return false
+	}
+
+	c.queueReply(encodeSimpleString("CONTINUE " + config.Replid))
+	c.queueReply(string(data))
+	c.replState = replStateOnline
+	addReplica(c)
+	fmt.Printf("[#%d] Partial resynchronization accepted. Sending %d bytes of backlog starting from offset %d\n", c.id, len(data), offset)
+	return true
+}
+
+// startReplicationCron runs the periodic replication housekeeping once a second
+func startReplicationCron() {
+	go func() {
+		for range time.Tick(time.Second) {
+			runOnExecutor(replicationCron)
+		}
+	}()
+}
+
+// replCronLoops counts the replicationCron runs, for the PING period
+var replCronLoops int
+
+func replicationCron() {
+	replCronLoops++
+	replicaCron()
+	masterCron()
+	checkFailover()
+
+	if len(config.Replicas) > 0 {
+		noReplicasSince = time.Now()
+		return
+	}
+	// like redis only a master frees its backlog
+	if backlog != nil && config.Role == "master" && config.ReplBacklogTTL > 0 &&
+		time.Since(noReplicasSince) > time.Duration(config.ReplBacklogTTL)*time.Second {
+		fmt.Printf("Replication backlog freed after %d seconds without connected replicas\n", config.ReplBacklogTTL)
+		backlog = nil
+		// writes from now on aren't counted, so no replica's history can continue from here
+		config.Replid = randReplid()
+		config.Replid2 = ""
+		config.SecondReplOffset = -1
+	}
+}
+
+// masterCron looks after the links to our own replicas: a master pings them
+// every repl-ping-replica-period so they can tell a quiet master from a dead
+// one, and replicas that stopped acknowledging are disconnected
+func masterCron() {
+	if len(config.Replicas) == 0 {
+		return
+	}
+	// a replica's replicas get the PINGs of the top master through its stream
+	if config.Role == "master" && replCronLoops%config.ReplPingReplicaPeriod == 0 {
+		propagate([]string{"PING"})
+	}
+	// removing a replica changes config.Replicas, so go over a copy
+	for _, replica := range append([]*client(nil), config.Replicas...) {
+		if replica.replState != replStateOnline || time.Since(replica.replAckTime) <= time.Duration(config.ReplTimeout)*time.Second {
+			continue
+		}
+		fmt.Printf("[#%d] Disconnecting timedout replica (streaming sync): %s\n", replica.id, replica.conn.RemoteAddr())
+		removeReplica(replica)
+		replica.conn.Close()
+	}
+}
@@ -1,12 +1,13 @@
 package main
 
-import (
-    "net"
-)
-
 type blockingClient struct {
-    conn   net.Conn       // address of the client that is being blocked
-    notify chan struct{}  // channel to notify when the client is no longer blocked (string to send the value that was pushed)
+    client *client      // the client that is being blocked
+    notify chan string  // channel to notify when the client is no longer blocked (string to send the value that was pushed)
+}
+
+// buffered so the executor never waits on a client that is about to time out
+func newBlockingClient(c *client) blockingClient {
+    return blockingClient{c, make(chan string, 1)}
 }
 
 // key: key for the value awaiting a response, value: queue of clients
@@ -27,10 +28,10 @@ func popBlockingClient(listKey string, queueMap map[string][]blockingClient) (bl
     return client, true
 }
 
-func removeBlockingClient(listKey string, conn net.Conn, queueMap map[string][]blockingClient) {
+func removeBlockingClient(listKey string, c *client, queueMap map[string][]blockingClient) {
     queue := queueMap[listKey]
-    for i, client := range queue {
-        if client.conn == conn {
+    for i, blocked := range queue {
+        if blocked.client == c {
             queueMap[listKey] = append(queue[:i], queue[i+1:]...)
             break
         }
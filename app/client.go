@@ -0,0 +1,203 @@
+package main
+
+import (
+    "fmt"
+    "net"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/DeanLogan/redis-clone/app/resp"
+)
+
+// client holds everything the server knows about one connection. It is only
+// touched from the executor, apart from the output buffer which has its own lock
+// so the connection's writer goroutine can drain it.
+type client struct {
+    id            int
+    conn          net.Conn
+    name          string
+    user          string        // authenticated ACL user, empty when not logged in
+    db            int
+    protocol      int           // RESP version negotiated by the client
+    inMulti       bool
+    multiQueue    [][]string
+    watchedKeys   map[string]struct{}
+    watchDirty    bool          // a watched key was modified so EXEC has to fail
+    subscriptions map[string]struct{}
+    isReplica     bool
+    isMaster      bool          // the link a replica uses to receive its master's stream
+    internal      bool          // replays commands checked elsewhere (the master's stream, the AOF), so skips the ACL
+    replAckOffset int           // last offset a replica acknowledged with REPLCONF ACK
+    replAckTime   time.Time
+    replPort      int           // the port the replica serves clients on
+    replState     int
+    replPending   []byte        // writes held back until the replica's RDB has been sent
+    createdAt     time.Time
+    lastActivity  time.Time
+    lastCommand   string
+    asking        bool          // ASKING was sent, the next command may use a slot being imported
+
+    outMu       sync.Mutex
+    outBuf      []byte
+    outSignal   chan struct{}
+    outDone     chan struct{}
+    outFinished chan struct{}
+}
+
+// key: client id, value: connected client
+var clients = make(map[int]*client)
+
+func newClient(id int, conn net.Conn) *client {
+    now := time.Now()
+    return &client{
+        id:            id,
+        conn:          conn,
+        protocol:      2,
+        watchedKeys:   make(map[string]struct{}),
+        subscriptions: make(map[string]struct{}),
+        createdAt:     now,
+        lastActivity:  now,
+        outSignal:     make(chan struct{}, 1),
+        outDone:       make(chan struct{}),
+        outFinished:   make(chan struct{}),
+    }
+}
+
+// queueReply appends to the client's output buffer, it never blocks so it is
+// safe to call from the executor for replies to other clients (pub/sub, replicas)
+func (c *client) queueReply(reply string) {
+    if len(reply) == 0 {
+        return
+    }
+    c.outMu.Lock()
+    c.outBuf = append(c.outBuf, reply...)
+    c.outMu.Unlock()
+
+    select {
+    case c.outSignal <- struct{}{}:
+    default:
+    }
+}
+
+// encode serialises a reply using the protocol version the client negotiated
+func (c *client) encode(v resp.RespValue) string {
+    return resp.EncodeProto(v, c.protocol)
+}
+
+// reply queues the response to a command
+func (c *client) reply(response string) {
+    c.queueReply(c.upgradeNull(response))
+}
+
+// upgradeNull swaps the RESP2 null a handler without the client handed back
+// for the RESP3 null when the client asked for it. Nulls nested in a reply are
+// converted by encode.
+func (c *client) upgradeNull(response string) string {
+    if c.protocol >= 3 && (response == NullBulkString || response == "*-1\r\n") {
+        return resp.Encode(resp.Null())
+    }
+    return response
+}
+
+func (c *client) pendingOutput() int {
+    c.outMu.Lock()
+    defer c.outMu.Unlock()
+    return len(c.outBuf)
+}
+
+// writeLoop flushes the output buffer to the socket until closeOutput is called
+func (c *client) writeLoop() {
+    defer close(c.outFinished)
+    for {
+        select {
+        case <-c.outSignal:
+            if err := c.flushOutput(); err != nil {
+                fmt.Printf("[#%d] Error writing response: %v\n", c.id, err.Error())
+                c.conn.Close()
+                <-c.outDone
+                return
+            }
+        case <-c.outDone:
+            c.flushOutput()
+            return
+        }
+    }
+}
+
+func (c *client) flushOutput() error {
+    c.outMu.Lock()
+    buf := c.outBuf
+    c.outBuf = nil
+    c.outMu.Unlock()
+
+    if len(buf) == 0 {
+        return nil
+    }
+    _, err := c.conn.Write(buf)
+    return err
+}
+
+// outputClosed reports whether the writer has stopped, after a write error or
+// once the connection is closing
+func (c *client) outputClosed() bool {
+    select {
+    case <-c.outFinished:
+        return true
+    default:
+        return false
+    }
+}
+
+// closeOutput stops the writer once everything already queued has been sent
+func (c *client) closeOutput() {
+    close(c.outDone)
+    <-c.outFinished
+}
+
+func (c *client) flags() string {
+    flags := ""
+    if c.isMaster {
+        flags += "M"
+    }
+    if c.isReplica {
+        flags += "S"
+    }
+    if len(c.subscriptions) > 0 {
+        flags += "P"
+    }
+    if c.inMulti {
+        flags += "x"
+    }
+    if flags == "" {
+        flags = "N"
+    }
+    return flags
+}
+
+func (c *client) info() string {
+    multi := -1
+    if c.inMulti {
+        multi = len(c.multiQueue)
+    }
+    now := time.Now()
+    return fmt.Sprintf("id=%d addr=%s laddr=%s name=%s age=%d idle=%d flags=%s db=%d sub=%d psub=0 multi=%d watch=%d omem=%d cmd=%s user=%s resp=%d",
+        c.id, c.conn.RemoteAddr().String(), c.conn.LocalAddr().String(), c.name,
+        int(now.Sub(c.createdAt).Seconds()), int(now.Sub(c.lastActivity).Seconds()), c.flags(),
+        c.db, len(c.subscriptions), multi, len(c.watchedKeys), c.pendingOutput(),
+        strings.ToLower(c.lastCommand), c.user, c.protocol)
+}
+
+// cleanup drops every piece of server state that refers to the client
+func (c *client) cleanup() {
+    delete(clients, c.id)
+    c.inMulti = false
+    c.multiQueue = nil
+    clearWatchedState(c)
+    for channel := range c.subscriptions {
+        unsubscribe(channel, c)
+    }
+    if c.isReplica {
+        removeReplica(c)
+    }
+}
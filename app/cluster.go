@@ -0,0 +1,1358 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/DeanLogan/redis-clone/app/resp"
+)
+
+// Cluster mode splits the keyspace into 16384 hash slots, each served by one
+// master. Nodes talk to each other over the cluster bus, a second port at
+// port+10000 carrying RESP arrays: every message starts with a header
+// describing the sender, PING/PONG/MEET add gossip about the other nodes the
+// sender knows and FAIL announces a node the majority agrees is down.
+const clusterSlots = 16384
+const clusterBusPortOffset = 10000
+
+const (
+	clusterCronPeriod     = 100 * time.Millisecond
+	clusterPingPeriod     = time.Second
+	clusterReconnectDelay = 100 * time.Millisecond
+)
+
+const (
+	clusterNodeMyself = 1 << iota
+	clusterNodeMaster
+	clusterNodePfail     // we think it's down
+	clusterNodeFail      // the majority of masters agreed it's down
+	clusterNodeHandshake // we haven't heard its real id yet
+	clusterNodeMeet      // the handshake is a MEET, so the node adds us too
+)
+
+var clusterNodeFlagNames = []struct {
+	flag int
+	name string
+}{
+	{clusterNodeMyself, "myself"},
+	{clusterNodeMaster, "master"},
+	{clusterNodePfail, "fail?"},
+	{clusterNodeFail, "fail"},
+	{clusterNodeHandshake, "handshake"},
+}
+
+type clusterNode struct {
+	id          string
+	ip          string
+	port        int
+	busPort     int
+	flags       int
+	configEpoch int
+	createdAt   time.Time
+
+	pingSent       time.Time // zero once the PING was answered
+	pongRecv       time.Time
+	lastPingQueued time.Time
+	failTime       time.Time
+	failReports    map[string]time.Time // reporting master id -> when it last said so
+
+	link    net.Conn   // outbound bus link, nil while disconnected
+	pending [][]string // messages waiting for the link
+	deleted bool
+}
+
+var clusterMyself *clusterNode
+var clusterNodes = make(map[string]*clusterNode)
+var clusterCurrentEpoch int
+var clusterSlotOwner [clusterSlots]*clusterNode
+var clusterMigratingTo [clusterSlots]*clusterNode
+var clusterImportingFrom [clusterSlots]*clusterNode
+var clusterStateOK bool
+var clusterConfigDirty bool
+var clusterMessagesSent = make(map[string]int)
+var clusterMessagesReceived = make(map[string]int)
+
+func clusterEnabled() bool {
+	return config.ClusterEnabled == "yes"
+}
+
+var crc16Table = func() (table [256]uint16) {
+	for i := range table {
+		crc := uint16(i) << 8
+		for j := 0; j < 8; j++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+		table[i] = crc
+	}
+	return
+}()
+
+// crc16 is the XMODEM variant redis uses for key slots
+func crc16(s string) uint16 {
+	var crc uint16
+	for i := 0; i < len(s); i++ {
+		crc = crc<<8 ^ crc16Table[byte(crc>>8)^s[i]]
+	}
+	return crc
+}
+
+// keyHashSlot only hashes what's between the first { and the next } when
+// that's not empty, so related keys can be forced into the same slot
+func keyHashSlot(key string) int {
+	if start := strings.IndexByte(key, '{'); start >= 0 {
+		if end := strings.IndexByte(key[start+1:], '}'); end > 0 {
+			key = key[start+1 : start+1+end]
+		}
+	}
+	return int(crc16(key)) & (clusterSlots - 1)
+}
+
+func clusterBusPort(port int) int {
+	return port + clusterBusPortOffset
+}
+
+func clusterConfigPath() string {
+	return filepath.Join(config.Dir, config.ClusterConfigFile)
+}
+
+func clusterNodeTimeout() time.Duration {
+	return time.Duration(config.ClusterNodeTimeout) * time.Millisecond
+}
+
+// clusterInit loads nodes.conf, or creates a fresh identity, then starts the
+// bus. It runs on the executor.
+func clusterInit() error {
+	if err := clusterLoadConfig(); err != nil {
+		if !os.IsNotExist(err) {
+			return err
+		}
+		clusterMyself = &clusterNode{
+			id:          randStringWithCharset(40, "0123456789abcdef"),
+			flags:       clusterNodeMyself | clusterNodeMaster,
+			createdAt:   time.Now(),
+			failReports: make(map[string]time.Time),
+		}
+		clusterNodes[clusterMyself.id] = clusterMyself
+		fmt.Printf("No cluster configuration found, I'm %s\n", clusterMyself.id)
+		clusterConfigDirty = true
+	} else {
+		fmt.Printf("Node configuration loaded, I'm %s\n", clusterMyself.id)
+	}
+	clusterMyself.port = config.Port
+	clusterMyself.busPort = clusterBusPort(config.Port)
+
+	listener, err := net.Listen("tcp", fmt.Sprintf("0.0.0.0:%d", clusterMyself.busPort))
+	if err != nil {
+		return err
+	}
+	go clusterAcceptLoop(listener)
+	for _, n := range clusterNodes {
+		if n != clusterMyself {
+			go n.run()
+		}
+	}
+	clusterUpdateState()
+	clusterSaveConfigIfDirty()
+
+	go func() {
+		for range time.Tick(clusterCronPeriod) {
+			runOnExecutor(clusterCron)
+		}
+	}()
+	return nil
+}
+
+func newClusterNode(id, ip string, port, busPort, flags int) *clusterNode {
+	n := &clusterNode{
+		id:          id,
+		ip:          ip,
+		port:        port,
+		busPort:     busPort,
+		flags:       flags,
+		createdAt:   time.Now(),
+		failReports: make(map[string]time.Time),
+	}
+	clusterNodes[id] = n
+	clusterConfigDirty = true
+	go n.run()
+	return n
+}
+
+// clusterStartHandshake adds a node we only know the address of, it gets its
+// real id from the first PONG
+func clusterStartHandshake(ip string, port, busPort int) bool {
+	for _, n := range clusterNodes {
+		if n.flags&clusterNodeHandshake != 0 && n.ip == ip && n.port == port && n.busPort == busPort {
+			return false
+		}
+	}
+	newClusterNode(randStringWithCharset(40, "0123456789abcdef"), ip, port, busPort, clusterNodeHandshake|clusterNodeMeet|clusterNodeMaster)
+	return true
+}
+
+func clusterDelNode(n *clusterNode) {
+	n.deleted = true
+	if n.link != nil {
+		n.link.Close()
+	}
+	delete(clusterNodes, n.id)
+	for slot := 0; slot < clusterSlots; slot++ {
+		if clusterMigratingTo[slot] == n {
+			clusterMigratingTo[slot] = nil
+		}
+		if clusterImportingFrom[slot] == n {
+			clusterImportingFrom[slot] = nil
+		}
+	}
+	for _, other := range clusterNodes {
+		delete(other.failReports, n.id)
+	}
+	clusterConfigDirty = true
+}
+
+func (n *clusterNode) busAddr() string {
+	return net.JoinHostPort(n.ip, strconv.Itoa(n.busPort))
+}
+
+func (n *clusterNode) slotCount() int {
+	count := 0
+	for _, owner := range clusterSlotOwner {
+		if owner == n {
+			count++
+		}
+	}
+	return count
+}
+
+// run keeps the outbound link to n connected until the node is deleted
+func (n *clusterNode) run() {
+	for {
+		var addr string
+		deleted := false
+		runOnExecutor(func() {
+			deleted = n.deleted
+			addr = n.busAddr()
+		})
+		if deleted {
+			return
+		}
+		if conn, err := net.DialTimeout("tcp", addr, min(clusterNodeTimeout(), time.Second)); err == nil {
+			n.serve(conn)
+		}
+		time.Sleep(clusterReconnectDelay)
+	}
+}
+
+// serve sends what nextMessages hands out, every message is answered with a PONG
+func (n *clusterNode) serve(conn net.Conn) {
+	defer conn.Close()
+	connected := false
+	runOnExecutor(func() {
+		if n.deleted {
+			return
+		}
+		n.link = conn
+		connected = true
+	})
+	if !connected {
+		return
+	}
+	defer runOnExecutor(func() { n.link = nil })
+
+	remoteIP, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	localIP, _, _ := net.SplitHostPort(conn.LocalAddr().String())
+	reader := bufio.NewReader(conn)
+	for {
+		var msgs [][]string
+		deleted := false
+		runOnExecutor(func() {
+			deleted = n.deleted
+			if !deleted {
+				msgs = n.nextMessages(time.Now())
+			}
+		})
+		if deleted {
+			return
+		}
+		for _, msg := range msgs {
+			conn.SetDeadline(time.Now().Add(clusterNodeTimeout()))
+			if _, err := conn.Write([]byte(encodeStringArray(msg))); err != nil {
+				return
+			}
+			reply, err := readCommand(reader)
+			if err != nil {
+				return
+			}
+			runOnExecutor(func() { clusterProcessMessage(reply, remoteIP, localIP, n) })
+		}
+		time.Sleep(clusterCronPeriod)
+	}
+}
+
+func (n *clusterNode) nextMessages(now time.Time) [][]string {
+	msgs := n.pending
+	n.pending = nil
+	if now.Sub(n.lastPingQueued) >= clusterPingPeriod {
+		msgType := "PING"
+		if n.flags&clusterNodeMeet != 0 {
+			msgType = "MEET"
+		}
+		msgs = append(msgs, clusterBuildMessage(msgType, n))
+		n.lastPingQueued = now
+		if n.pingSent.IsZero() {
+			n.pingSent = now
+		}
+	}
+	return msgs
+}
+
+func clusterAcceptLoop(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			fmt.Println("Error accepting cluster bus connection: ", err.Error())
+			return
+		}
+		go clusterServeInbound(conn)
+	}
+}
+
+// clusterServeInbound answers every message from another node's outbound link
+func clusterServeInbound(conn net.Conn) {
+	defer conn.Close()
+	remoteIP, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	localIP, _, _ := net.SplitHostPort(conn.LocalAddr().String())
+	reader := bufio.NewReader(conn)
+	for {
+		msg, err := readCommand(reader)
+		if err != nil {
+			return
+		}
+		var reply []string
+		runOnExecutor(func() { reply = clusterProcessMessage(msg, remoteIP, localIP, nil) })
+		if reply == nil {
+			return
+		}
+		if _, err := conn.Write([]byte(encodeStringArray(reply))); err != nil {
+			return
+		}
+	}
+}
+
+// clusterBuildMessage is the header every message starts with, followed by
+// gossip entries of id, ip, port, bus port and flags for PING, PONG and MEET
+func clusterBuildMessage(msgType string, to *clusterNode) []string {
+	msg := []string{
+		msgType,
+		clusterMyself.id,
+		strconv.Itoa(clusterCurrentEpoch),
+		strconv.Itoa(clusterMyself.configEpoch),
+		strconv.Itoa(clusterMyself.port),
+		strconv.Itoa(clusterMyself.busPort),
+		clusterNodeFlags(clusterMyself),
+		clusterSlotRanges(clusterMyself, ","),
+	}
+	clusterMessagesSent[strings.ToLower(msgType)]++
+	if msgType == "FAIL" {
+		return msg
+	}
+	for _, n := range clusterNodes {
+		if n == clusterMyself || n == to || n.flags&clusterNodeHandshake != 0 {
+			continue
+		}
+		msg = append(msg, n.id, n.ip, strconv.Itoa(n.port), strconv.Itoa(n.busPort), clusterNodeFlags(n))
+	}
+	return msg
+}
+
+// clusterBroadcast queues msgType for every node we have a link with
+func clusterBroadcast(build func(to *clusterNode) []string) {
+	for _, n := range clusterNodes {
+		if n == clusterMyself || n.flags&clusterNodeHandshake != 0 || n.link == nil {
+			continue
+		}
+		n.pending = append(n.pending, build(n))
+	}
+}
+
+// clusterProcessMessage handles a message from another node, linkNode is set
+// when it's the reply on our own outbound link. The reply to send back is
+// nil when the connection should be dropped.
+func clusterProcessMessage(msg []string, remoteIP, localIP string, linkNode *clusterNode) []string {
+	if len(msg) < 8 {
+		return nil
+	}
+	msgType := strings.ToUpper(msg[0])
+	senderID := msg[1]
+	currentEpoch, err1 := strconv.Atoi(msg[2])
+	configEpoch, err2 := strconv.Atoi(msg[3])
+	port, err3 := strconv.Atoi(msg[4])
+	busPort, err4 := strconv.Atoi(msg[5])
+	if err1 != nil || err2 != nil || err3 != nil || err4 != nil {
+		return nil
+	}
+	clusterMessagesReceived[strings.ToLower(msgType)]++
+	now := time.Now()
+
+	// we learn our own address from how others reach us
+	if linkNode == nil && (msgType == "MEET" || clusterMyself.ip == "") && clusterMyself.ip != localIP {
+		clusterMyself.ip = localIP
+		clusterConfigDirty = true
+	}
+
+	sender := clusterNodes[senderID]
+	if sender != nil && sender.flags&clusterNodeHandshake != 0 {
+		sender = nil
+	}
+	if linkNode != nil && linkNode.flags&clusterNodeHandshake != 0 {
+		// the first PONG tells us who we've been talking to
+		if sender != nil {
+			clusterDelNode(linkNode)
+			return nil
+		}
+		delete(clusterNodes, linkNode.id)
+		linkNode.id = senderID
+		linkNode.flags &^= clusterNodeHandshake | clusterNodeMeet
+		clusterNodes[senderID] = linkNode
+		clusterConfigDirty = true
+		fmt.Printf("Handshake with node %s completed\n", senderID)
+		sender = linkNode
+	}
+	if sender == nil && msgType == "MEET" {
+		sender = newClusterNode(senderID, remoteIP, port, busPort, clusterNodeMaster)
+	}
+
+	if sender != nil {
+		if currentEpoch > clusterCurrentEpoch {
+			clusterCurrentEpoch = currentEpoch
+			clusterConfigDirty = true
+		}
+		if configEpoch > sender.configEpoch {
+			sender.configEpoch = configEpoch
+			clusterConfigDirty = true
+		}
+		if linkNode == nil && (sender.ip != remoteIP || sender.port != port || sender.busPort != busPort) {
+			// it moved, the outbound link reconnects to the new address
+			sender.ip, sender.port, sender.busPort = remoteIP, port, busPort
+			if sender.link != nil {
+				sender.link.Close()
+			}
+			clusterConfigDirty = true
+		}
+		if msgType == "PONG" && linkNode == sender {
+			sender.pongRecv = now
+			sender.pingSent = time.Time{}
+			clusterNodeAlive(sender, now)
+		}
+		clusterUpdateSlotsConfigWith(sender, msg[7])
+		clusterHandleConfigEpochCollision(sender)
+	}
+
+	switch msgType {
+	case "PING", "PONG", "MEET":
+		if sender != nil {
+			clusterProcessGossip(sender, msg[8:], now)
+		}
+	case "FAIL":
+		if sender != nil && len(msg) > 8 {
+			if failing := clusterNodes[msg[8]]; failing != nil && failing != clusterMyself && failing.flags&clusterNodeFail == 0 {
+				fmt.Printf("FAIL message received from %s about %s\n", senderID, failing.id)
+				failing.flags = failing.flags&^clusterNodePfail | clusterNodeFail
+				failing.failTime = now
+				clusterConfigDirty = true
+			}
+		}
+	}
+
+	if linkNode != nil {
+		return []string{}
+	}
+	return clusterBuildMessage("PONG", sender)
+}
+
+// clusterNodeAlive clears PFAIL, and FAIL when nothing depends on it: masters
+// with slots have no replica to take over, so they come back after a while
+func clusterNodeAlive(n *clusterNode, now time.Time) {
+	if n.flags&clusterNodePfail != 0 {
+		n.flags &^= clusterNodePfail
+		clusterConfigDirty = true
+	}
+	if n.flags&clusterNodeFail != 0 && (n.slotCount() == 0 || now.Sub(n.failTime) > 2*clusterNodeTimeout()) {
+		fmt.Printf("Clear FAIL state for node %s: it's reachable again\n", n.id)
+		n.flags &^= clusterNodeFail
+		clusterConfigDirty = true
+	}
+}
+
+func clusterProcessGossip(sender *clusterNode, entries []string, now time.Time) {
+	for i := 0; i+5 <= len(entries); i += 5 {
+		id, ip, flags := entries[i], entries[i+1], entries[i+4]
+		port, err1 := strconv.Atoi(entries[i+2])
+		busPort, err2 := strconv.Atoi(entries[i+3])
+		if err1 != nil || err2 != nil {
+			continue
+		}
+		n := clusterNodes[id]
+		if n == nil {
+			if ip != "" && !strings.Contains(flags, "handshake") && !strings.Contains(flags, "noaddr") {
+				clusterStartHandshake(ip, port, busPort)
+			}
+			continue
+		}
+		if n == clusterMyself || n.flags&clusterNodeHandshake != 0 {
+			continue
+		}
+		// only masters' opinions count towards FAIL
+		if sender.flags&clusterNodeMaster == 0 {
+			continue
+		}
+		if strings.Contains(flags, "fail") {
+			n.failReports[sender.id] = now
+			clusterMarkNodeAsFailingIfNeeded(n, now)
+		} else {
+			delete(n.failReports, sender.id)
+		}
+	}
+}
+
+// clusterUpdateSlotsConfigWith takes the slots a node claims, a claim wins
+// over the current owner when it comes with a higher config epoch
+func clusterUpdateSlotsConfigWith(sender *clusterNode, ranges string) {
+	claimed, ok := parseSlotRanges(ranges, ",")
+	if !ok {
+		return
+	}
+	lost := make(map[int]bool)
+	for _, slot := range claimed {
+		owner := clusterSlotOwner[slot]
+		if owner == sender || clusterImportingFrom[slot] != nil {
+			continue
+		}
+		if owner == nil || owner.configEpoch < sender.configEpoch {
+			if owner == clusterMyself {
+				lost[slot] = true
+				clusterMigratingTo[slot] = nil
+			}
+			clusterSlotOwner[slot] = sender
+			clusterConfigDirty = true
+		}
+	}
+	if len(lost) == 0 {
+		return
+	}
+	// keys we still hold for slots we lost are stale now
+	fmt.Printf("%d slots were taken over by %s\n", len(lost), sender.id)
+	for key := range store {
+		if lost[keyHashSlot(key)] {
+			preserveForSnapshots([]string{key})
+			delete(store, key)
+			delete(ttl, key)
+			touchWatchedKey(key)
+			propagateWrite([]string{"DEL", key})
+		}
+	}
+}
+
+// clusterHandleConfigEpochCollision makes sure no two masters end up with the
+// same config epoch, the node with the lower id moves on to a new one
+func clusterHandleConfigEpochCollision(sender *clusterNode) {
+	if sender.configEpoch != clusterMyself.configEpoch || sender.flags&clusterNodeMaster == 0 || sender.id <= clusterMyself.id {
+		return
+	}
+	clusterCurrentEpoch++
+	clusterMyself.configEpoch = clusterCurrentEpoch
+	clusterConfigDirty = true
+	fmt.Printf("configEpoch collision with node %s, configEpoch set to %d\n", sender.id, clusterCurrentEpoch)
+}
+
+// clusterBumpConfigEpochWithoutConsensus gives us a new epoch unless ours is already the highest
+func clusterBumpConfigEpochWithoutConsensus() {
+	maxEpoch := 0
+	for _, n := range clusterNodes {
+		maxEpoch = max(maxEpoch, n.configEpoch)
+	}
+	if clusterMyself.configEpoch == 0 || clusterMyself.configEpoch != maxEpoch {
+		clusterCurrentEpoch++
+		clusterMyself.configEpoch = clusterCurrentEpoch
+		clusterConfigDirty = true
+	}
+}
+
+// clusterSize is the number of masters serving at least one slot
+func clusterSize() int {
+	masters := make(map[*clusterNode]bool)
+	for _, owner := range clusterSlotOwner {
+		if owner != nil {
+			masters[owner] = true
+		}
+	}
+	return len(masters)
+}
+
+func clusterMarkNodeAsFailingIfNeeded(n *clusterNode, now time.Time) {
+	if n.flags&clusterNodePfail == 0 || n.flags&clusterNodeFail != 0 {
+		return
+	}
+	failures := 0
+	for id, reported := range n.failReports {
+		if now.Sub(reported) > 2*clusterNodeTimeout() {
+			delete(n.failReports, id)
+			continue
+		}
+		failures++
+	}
+	if clusterMyself.flags&clusterNodeMaster != 0 {
+		failures++
+	}
+	if failures < clusterSize()/2+1 {
+		return
+	}
+	fmt.Printf("Marking node %s as failing (quorum reached)\n", n.id)
+	n.flags = n.flags&^clusterNodePfail | clusterNodeFail
+	n.failTime = now
+	clusterConfigDirty = true
+	clusterBroadcast(func(to *clusterNode) []string {
+		return append(clusterBuildMessage("FAIL", to), n.id)
+	})
+}
+
+func clusterCron() {
+	now := time.Now()
+	timeout := clusterNodeTimeout()
+	for _, n := range clusterNodes {
+		if n == clusterMyself {
+			continue
+		}
+		if n.flags&clusterNodeHandshake != 0 {
+			if now.Sub(n.createdAt) > max(timeout, time.Second) {
+				fmt.Printf("Handshake with %s:%d timed out\n", n.ip, n.port)
+				clusterDelNode(n)
+			}
+			continue
+		}
+		// a node we can't even connect to counts as not answering
+		if n.link == nil && n.pingSent.IsZero() {
+			n.pingSent = now
+		}
+		if !n.pingSent.IsZero() && now.Sub(n.pingSent) > timeout && n.flags&(clusterNodePfail|clusterNodeFail) == 0 {
+			fmt.Printf("Node %s is not reachable, marking it as possibly failing\n", n.id)
+			n.flags |= clusterNodePfail
+			clusterConfigDirty = true
+		}
+		clusterMarkNodeAsFailingIfNeeded(n, now)
+	}
+	clusterUpdateState()
+	clusterSaveConfigIfDirty()
+}
+
+// clusterUpdateState decides whether we serve queries: every slot has to be
+// covered by a working master and we have to be on the majority side
+func clusterUpdateState() {
+	ok := true
+	for _, owner := range clusterSlotOwner {
+		if owner == nil || owner.flags&clusterNodeFail != 0 {
+			ok = false
+			break
+		}
+	}
+	if ok {
+		reachable := 0
+		masters := make(map[*clusterNode]bool)
+		for _, owner := range clusterSlotOwner {
+			if !masters[owner] {
+				masters[owner] = true
+				if owner.flags&(clusterNodePfail|clusterNodeFail) == 0 {
+					reachable++
+				}
+			}
+		}
+		ok = reachable >= len(masters)/2+1
+	}
+	if ok != clusterStateOK {
+		state := "fail"
+		if ok {
+			state = "ok"
+		}
+		fmt.Printf("Cluster state changed: %s\n", state)
+		clusterStateOK = ok
+	}
+}
+
+func clusterNodeFlags(n *clusterNode) string {
+	var names []string
+	for _, f := range clusterNodeFlagNames {
+		if n.flags&f.flag != 0 {
+			names = append(names, f.name)
+		}
+	}
+	if n.ip == "" && n != clusterMyself {
+		names = append(names, "noaddr")
+	}
+	if len(names) == 0 {
+		return "noflags"
+	}
+	return strings.Join(names, ",")
+}
+
+// clusterSlotRanges lists n's slots as start-end ranges, single slots on their own
+func clusterSlotRanges(n *clusterNode, sep string) string {
+	var ranges []string
+	for _, r := range clusterSlotRangePairs(n) {
+		if r[0] == r[1] {
+			ranges = append(ranges, strconv.Itoa(r[0]))
+		} else {
+			ranges = append(ranges, fmt.Sprintf("%d-%d", r[0], r[1]))
+		}
+	}
+	return strings.Join(ranges, sep)
+}
+
+func clusterSlotRangePairs(n *clusterNode) [][2]int {
+	var ranges [][2]int
+	start := -1
+	for slot := 0; slot <= clusterSlots; slot++ {
+		owned := slot < clusterSlots && clusterSlotOwner[slot] == n
+		if owned && start < 0 {
+			start = slot
+		} else if !owned && start >= 0 {
+			ranges = append(ranges, [2]int{start, slot - 1})
+			start = -1
+		}
+	}
+	return ranges
+}
+
+func parseSlotRanges(s, sep string) ([]int, bool) {
+	var slots []int
+	if s == "" {
+		return slots, true
+	}
+	for _, r := range strings.Split(s, sep) {
+		startArg, endArg, isRange := strings.Cut(r, "-")
+		start, err1 := strconv.Atoi(startArg)
+		end, err2 := start, error(nil)
+		if isRange {
+			end, err2 = strconv.Atoi(endArg)
+		}
+		if err1 != nil || err2 != nil || start < 0 || end >= clusterSlots || start > end {
+			return nil, false
+		}
+		for slot := start; slot <= end; slot++ {
+			slots = append(slots, slot)
+		}
+	}
+	return slots, true
+}
+
+// clusterNodeLine is a line of CLUSTER NODES and of nodes.conf
+func clusterNodeLine(n *clusterNode) string {
+	linkState := "disconnected"
+	if n == clusterMyself || n.link != nil {
+		linkState = "connected"
+	}
+	line := fmt.Sprintf("%s %s:%d@%d %s - %d %d %d %s",
+		n.id, n.ip, n.port, n.busPort, clusterNodeFlags(n),
+		unixMillis(n.pingSent), unixMillis(n.pongRecv), n.configEpoch, linkState)
+	if ranges := clusterSlotRanges(n, " "); ranges != "" {
+		line += " " + ranges
+	}
+	if n == clusterMyself {
+		for slot := 0; slot < clusterSlots; slot++ {
+			if target := clusterMigratingTo[slot]; target != nil {
+				line += fmt.Sprintf(" [%d->-%s]", slot, target.id)
+			}
+			if source := clusterImportingFrom[slot]; source != nil {
+				line += fmt.Sprintf(" [%d-<-%s]", slot, source.id)
+			}
+		}
+	}
+	return line
+}
+
+func unixMillis(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixMilli()
+}
+
+func clusterSortedNodes() []*clusterNode {
+	nodes := make([]*clusterNode, 0, len(clusterNodes))
+	for _, n := range clusterNodes {
+		nodes = append(nodes, n)
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].id < nodes[j].id })
+	return nodes
+}
+
+func clusterNodesDescription() string {
+	var sb strings.Builder
+	for _, n := range clusterSortedNodes() {
+		sb.WriteString(clusterNodeLine(n))
+		sb.WriteString("\n")
+	}
+	return sb.String()
+}
+
+func clusterSaveConfigIfDirty() {
+	if !clusterConfigDirty {
+		return
+	}
+	if err := clusterSaveConfig(); err != nil {
+		fmt.Printf("Failed to save the cluster configuration: %v\n", err)
+		return
+	}
+	clusterConfigDirty = false
+}
+
+func clusterSaveConfig() error {
+	var sb strings.Builder
+	for _, n := range clusterSortedNodes() {
+		if n.flags&clusterNodeHandshake != 0 {
+			continue
+		}
+		sb.WriteString(clusterNodeLine(n))
+		sb.WriteString("\n")
+	}
+	fmt.Fprintf(&sb, "vars currentEpoch %d lastVoteEpoch 0\n", clusterCurrentEpoch)
+
+	path := clusterConfigPath()
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(sb.String()), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// clusterLoadConfig restores the nodes, slots and epochs from nodes.conf
+func clusterLoadConfig() error {
+	data, err := os.ReadFile(clusterConfigPath())
+	if err != nil {
+		return err
+	}
+	corrupt := fmt.Errorf("unrecoverable error: corrupted cluster config file %q", clusterConfigPath())
+
+	type slotState struct {
+		slot      int
+		importing bool
+		nodeID    string
+	}
+	var migrations []slotState
+	slotOwners := make(map[int]string)
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if fields[0] == "vars" {
+			for i := 1; i+1 < len(fields); i += 2 {
+				if fields[i] == "currentEpoch" {
+					clusterCurrentEpoch, _ = strconv.Atoi(fields[i+1])
+				}
+			}
+			continue
+		}
+		if len(fields) < 8 {
+			return corrupt
+		}
+		hostPort, busPortArg, _ := strings.Cut(fields[1], "@")
+		ip, portArg, err1 := net.SplitHostPort(hostPort)
+		port, err2 := strconv.Atoi(portArg)
+		busPort, err3 := strconv.Atoi(busPortArg)
+		configEpoch, err4 := strconv.Atoi(fields[6])
+		if err1 != nil || err2 != nil || err3 != nil || err4 != nil {
+			return corrupt
+		}
+		n := &clusterNode{
+			id:          fields[0],
+			ip:          ip,
+			port:        port,
+			busPort:     busPort,
+			configEpoch: configEpoch,
+			createdAt:   time.Now(),
+			failReports: make(map[string]time.Time),
+		}
+		// whether it failed is for the running cluster to tell us again
+		for _, name := range strings.Split(fields[2], ",") {
+			switch name {
+			case "myself":
+				n.flags |= clusterNodeMyself
+				clusterMyself = n
+			case "master":
+				n.flags |= clusterNodeMaster
+			}
+		}
+		clusterNodes[n.id] = n
+
+		for _, field := range fields[8:] {
+			if strings.HasPrefix(field, "[") {
+				entry := strings.Trim(field, "[]")
+				importing := strings.Contains(entry, "-<-")
+				slotArg, nodeID, ok := strings.Cut(entry, "->-")
+				if importing {
+					slotArg, nodeID, ok = strings.Cut(entry, "-<-")
+				}
+				slot, err := strconv.Atoi(slotArg)
+				if !ok || err != nil || slot < 0 || slot >= clusterSlots {
+					return corrupt
+				}
+				migrations = append(migrations, slotState{slot, importing, nodeID})
+				continue
+			}
+			slots, ok := parseSlotRanges(field, ",")
+			if !ok {
+				return corrupt
+			}
+			for _, slot := range slots {
+				slotOwners[slot] = n.id
+			}
+		}
+	}
+	if clusterMyself == nil {
+		return corrupt
+	}
+	for slot, id := range slotOwners {
+		clusterSlotOwner[slot] = clusterNodes[id]
+	}
+	for _, m := range migrations {
+		if m.importing {
+			clusterImportingFrom[m.slot] = clusterNodes[m.nodeID]
+		} else {
+			clusterMigratingTo[m.slot] = clusterNodes[m.nodeID]
+		}
+	}
+	return nil
+}
+
+// commandKeys returns the keys a call touches, from the command table's key
+// positions or from the arguments for the commands where those can't say
+func commandKeys(command string, entry *redisCommand, cmd []string) []string {
+	switch command {
+	case "XREAD":
+		for i := 1; i < len(cmd); i++ {
+			if strings.ToUpper(cmd[i]) == "STREAMS" {
+				streams := cmd[i+1:]
+				return streams[:len(streams)/2]
+			}
+		}
+		return nil
+	case "MIGRATE":
+		if len(cmd) > 3 && cmd[3] != "" {
+			return cmd[3:4]
+		}
+		for i := 6; i < len(cmd); i++ {
+			if strings.ToUpper(cmd[i]) == "KEYS" {
+				return cmd[i+1:]
+			}
+		}
+		return nil
+	}
+	if entry.firstKey == 0 || entry.firstKey >= len(cmd) {
+		return nil
+	}
+	last := entry.lastKey
+	if last < 0 {
+		last += len(cmd)
+	}
+	var keys []string
+	for i := entry.firstKey; i <= last && i < len(cmd); i += entry.keyStep {
+		keys = append(keys, cmd[i])
+	}
+	return keys
+}
+
+// clusterRejection returns the redirection or error for a call whose keys
+// we don't serve, or "" when it can run here
+func clusterRejection(command string, entry *redisCommand, cmd []string, c *client) string {
+	asking := c.asking || entry.flags&cmdAsking != 0
+	c.asking = false
+
+	var keys []string
+	if command == "EXEC" {
+		for _, queued := range c.multiQueue {
+			queuedCommand := strings.ToUpper(queued[0])
+			if queuedEntry, ok := commandTable[queuedCommand]; ok {
+				keys = append(keys, commandKeys(queuedCommand, queuedEntry, queued)...)
+			}
+		}
+	} else {
+		keys = commandKeys(command, entry, cmd)
+	}
+	if len(keys) == 0 {
+		return ""
+	}
+
+	slot := keyHashSlot(keys[0])
+	for _, key := range keys[1:] {
+		if keyHashSlot(key) != slot {
+			return encodeErrorResponseWithMsg("CROSSSLOT", "Keys in request don't hash to the same slot")
+		}
+	}
+	if !clusterStateOK {
+		return encodeErrorResponseWithMsg("CLUSTERDOWN", "The cluster is down")
+	}
+	owner := clusterSlotOwner[slot]
+	if owner == nil {
+		return encodeErrorResponseWithMsg("CLUSTERDOWN", "Hash slot not served")
+	}
+
+	migrating := owner == clusterMyself && clusterMigratingTo[slot] != nil
+	importing := clusterImportingFrom[slot] != nil
+	// MIGRATE has to reach the keys that are still here
+	if command == "MIGRATE" && (migrating || importing) {
+		return ""
+	}
+	missing := 0
+	for _, key := range keys {
+		if _, ok := store[key]; !ok {
+			missing++
+		}
+	}
+
+	if migrating && missing > 0 {
+		if missing < len(keys) {
+			return encodeErrorResponseWithMsg("TRYAGAIN", "Multiple keys request during rehashing of slot")
+		}
+		target := clusterMigratingTo[slot]
+		return encodeErrorResponseWithMsg("ASK", fmt.Sprintf("%d %s:%d", slot, target.ip, target.port))
+	}
+	if importing && asking {
+		if len(keys) > 1 && missing > 0 {
+			return encodeErrorResponseWithMsg("TRYAGAIN", "Multiple keys request during rehashing of slot")
+		}
+		return ""
+	}
+	if owner != clusterMyself {
+		return encodeErrorResponseWithMsg("MOVED", fmt.Sprintf("%d %s:%d", slot, owner.ip, owner.port))
+	}
+	return ""
+}
+
+func askingResponse(c *client) string {
+	if !clusterEnabled() {
+		return encodeSimpleErrorResponse("This instance has cluster support disabled")
+	}
+	c.asking = true
+	return encodeSimpleString("OK")
+}
+
+func parseSlot(arg string) (int, bool) {
+	slot, err := strconv.Atoi(arg)
+	return slot, err == nil && slot >= 0 && slot < clusterSlots
+}
+
+func countKeysInSlot(slot int) int {
+	count := 0
+	for key := range store {
+		if keyHashSlot(key) == slot && !isExpired(key) {
+			count++
+		}
+	}
+	return count
+}
+
+func clusterResponse(cmd []string, c *client) string {
+	if !clusterEnabled() {
+		return encodeSimpleErrorResponse("This instance has cluster support disabled")
+	}
+	defer clusterSaveConfigIfDirty()
+	subcommand := strings.ToUpper(cmd[1])
+	args := cmd[2:]
+	wrongArgs := encodeSimpleErrorResponse(fmt.Sprintf("wrong number of arguments for 'cluster|%s' command", strings.ToLower(subcommand)))
+
+	switch subcommand {
+	case "MYID":
+		return encodeBulkString(clusterMyself.id)
+	case "MEET":
+		if len(args) != 2 && len(args) != 3 {
+			return wrongArgs
+		}
+		port, err := strconv.Atoi(args[1])
+		busPort := clusterBusPort(port)
+		if err == nil && len(args) == 3 {
+			busPort, err = strconv.Atoi(args[2])
+		}
+		if err != nil || net.ParseIP(args[0]) == nil || port <= 0 || port > 65535 {
+			return encodeSimpleErrorResponse(fmt.Sprintf("Invalid node address specified: %s:%s", args[0], args[1]))
+		}
+		clusterStartHandshake(args[0], port, busPort)
+		return encodeSimpleString("OK")
+	case "ADDSLOTS", "DELSLOTS", "ADDSLOTSRANGE", "DELSLOTSRANGE":
+		return clusterSlotsChangeResponse(subcommand, args, wrongArgs)
+	case "SETSLOT":
+		return clusterSetSlotResponse(args, wrongArgs)
+	case "NODES":
+		return c.encode(resp.VerbatimString("txt", clusterNodesDescription()))
+	case "SLOTS":
+		return c.encode(clusterSlotsReply())
+	case "SHARDS":
+		return c.encode(clusterShardsReply())
+	case "INFO":
+		return c.encode(resp.VerbatimString("txt", clusterInfo()))
+	case "KEYSLOT":
+		if len(args) != 1 {
+			return wrongArgs
+		}
+		return encodeInt(keyHashSlot(args[0]))
+	case "COUNTKEYSINSLOT":
+		if len(args) != 1 {
+			return wrongArgs
+		}
+		slot, ok := parseSlot(args[0])
+		if !ok {
+			return encodeSimpleErrorResponse("Invalid slot")
+		}
+		return encodeInt(countKeysInSlot(slot))
+	case "GETKEYSINSLOT":
+		if len(args) != 2 {
+			return wrongArgs
+		}
+		slot, ok := parseSlot(args[0])
+		count, err := strconv.Atoi(args[1])
+		if !ok {
+			return encodeSimpleErrorResponse("Invalid slot")
+		}
+		if err != nil || count < 0 {
+			return encodeSimpleErrorResponse("Invalid number of keys")
+		}
+		var keysInSlot []string
+		for key := range store {
+			if len(keysInSlot) == count {
+				break
+			}
+			if keyHashSlot(key) == slot && !isExpired(key) {
+				keysInSlot = append(keysInSlot, key)
+			}
+		}
+		return c.encode(resp.StringArray(keysInSlot))
+	}
+	return encodeSimpleErrorResponse(fmt.Sprintf("unknown subcommand '%s'. Try CLUSTER HELP.", cmd[1]))
+}
+
+func clusterSlotsChangeResponse(subcommand string, args []string, wrongArgs string) string {
+	isRange := strings.HasSuffix(subcommand, "RANGE")
+	if len(args) == 0 || (isRange && len(args)%2 != 0) {
+		return wrongArgs
+	}
+	var slots []int
+	for i := 0; i < len(args); i++ {
+		start, ok := parseSlot(args[i])
+		end := start
+		if isRange {
+			i++
+			var endOK bool
+			end, endOK = parseSlot(args[i])
+			ok = ok && endOK
+		}
+		if !ok {
+			return encodeSimpleErrorResponse("Invalid or out of range slot")
+		}
+		if start > end {
+			return encodeSimpleErrorResponse(fmt.Sprintf("start slot number %d is greater than end slot number %d", start, end))
+		}
+		for slot := start; slot <= end; slot++ {
+			slots = append(slots, slot)
+		}
+	}
+
+	adding := strings.HasPrefix(subcommand, "ADD")
+	seen := make(map[int]bool)
+	for _, slot := range slots {
+		if seen[slot] {
+			return encodeSimpleErrorResponse(fmt.Sprintf("Slot %d specified multiple times", slot))
+		}
+		seen[slot] = true
+		if adding && clusterSlotOwner[slot] != nil {
+			return encodeSimpleErrorResponse(fmt.Sprintf("Slot %d is already busy", slot))
+		}
+		if !adding && clusterSlotOwner[slot] == nil {
+			return encodeSimpleErrorResponse(fmt.Sprintf("Slot %d is already unassigned", slot))
+		}
+	}
+	for _, slot := range slots {
+		if adding {
+			clusterSlotOwner[slot] = clusterMyself
+			// adding a slot we were importing means the import is done
+			clusterImportingFrom[slot] = nil
+		} else {
+			clusterSlotOwner[slot] = nil
+			clusterMigratingTo[slot] = nil
+		}
+	}
+	clusterConfigDirty = true
+	clusterUpdateState()
+	return encodeSimpleString("OK")
+}
+
+// CLUSTER SETSLOT slot IMPORTING node-id | MIGRATING node-id | NODE node-id | STABLE
+func clusterSetSlotResponse(args []string, wrongArgs string) string {
+	if len(args) < 2 {
+		return wrongArgs
+	}
+	slot, ok := parseSlot(args[0])
+	if !ok {
+		return encodeSimpleErrorResponse("Invalid or out of range slot")
+	}
+	action := strings.ToUpper(args[1])
+	if action == "STABLE" {
+		clusterMigratingTo[slot] = nil
+		clusterImportingFrom[slot] = nil
+		clusterConfigDirty = true
+		return encodeSimpleString("OK")
+	}
+	if len(args) != 3 {
+		return wrongArgs
+	}
+	n := clusterNodes[args[2]]
+	if n == nil || n.flags&clusterNodeHandshake != 0 {
+		return encodeSimpleErrorResponse(fmt.Sprintf("I don't know about node %s", args[2]))
+	}
+
+	switch action {
+	case "MIGRATING":
+		if clusterSlotOwner[slot] != clusterMyself {
+			return encodeSimpleErrorResponse(fmt.Sprintf("I'm not the owner of hash slot %d", slot))
+		}
+		if n == clusterMyself {
+			return encodeSimpleErrorResponse("Can't MIGRATE a slot to myself")
+		}
+		clusterMigratingTo[slot] = n
+	case "IMPORTING":
+		if clusterSlotOwner[slot] == clusterMyself {
+			return encodeSimpleErrorResponse(fmt.Sprintf("I'm already the owner of hash slot %d", slot))
+		}
+		if n == clusterMyself {
+			return encodeSimpleErrorResponse("Can't IMPORT a slot from myself")
+		}
+		clusterImportingFrom[slot] = n
+	case "NODE":
+		if clusterSlotOwner[slot] == clusterMyself && n != clusterMyself && countKeysInSlot(slot) > 0 {
+			return encodeSimpleErrorResponse(fmt.Sprintf("Can't assign hashslot %d to a different node while I still hold keys for this hash slot.", slot))
+		}
+		if n != clusterMyself {
+			clusterMigratingTo[slot] = nil
+		}
+		// the import is over, a new epoch makes the rest of the cluster take our word for it
+		if n == clusterMyself && clusterImportingFrom[slot] != nil {
+			clusterImportingFrom[slot] = nil
+			clusterBumpConfigEpochWithoutConsensus()
+		}
+		clusterSlotOwner[slot] = n
+		clusterUpdateState()
+	default:
+		return encodeSimpleErrorResponse("Invalid CLUSTER SETSLOT action or number of arguments. Try CLUSTER HELP")
+	}
+	clusterConfigDirty = true
+	return encodeSimpleString("OK")
+}
+
+func clusterSlotsReply() resp.RespValue {
+	var entries []resp.RespValue
+	for _, n := range clusterSortedNodes() {
+		for _, r := range clusterSlotRangePairs(n) {
+			entries = append(entries, resp.Array(
+				resp.Integer(r[0]),
+				resp.Integer(r[1]),
+				resp.Array(resp.BulkString(n.ip), resp.Integer(n.port), resp.BulkString(n.id), resp.Array()),
+			))
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Elems[0].Int < entries[j].Elems[0].Int })
+	return resp.Array(entries...)
+}
+
+func clusterShardsReply() resp.RespValue {
+	var shards []resp.RespValue
+	for _, n := range clusterSortedNodes() {
+		if n.flags&clusterNodeHandshake != 0 {
+			continue
+		}
+		var slots []resp.RespValue
+		for _, r := range clusterSlotRangePairs(n) {
+			slots = append(slots, resp.Integer(r[0]), resp.Integer(r[1]))
+		}
+		health := "online"
+		if n.flags&(clusterNodePfail|clusterNodeFail) != 0 {
+			health = "fail"
+		}
+		offset := 0
+		if n == clusterMyself {
+			offset = config.MasterReplOffset
+		}
+		node := resp.Map(
+			resp.KV("id", resp.BulkString(n.id)),
+			resp.KV("port", resp.Integer(n.port)),
+			resp.KV("ip", resp.BulkString(n.ip)),
+			resp.KV("endpoint", resp.BulkString(n.ip)),
+			resp.KV("role", resp.BulkString("master")),
+			resp.KV("replication-offset", resp.Integer(offset)),
+			resp.KV("health", resp.BulkString(health)),
+		)
+		shards = append(shards, resp.Map(
+			resp.KV("slots", resp.Array(slots...)),
+			resp.KV("nodes", resp.Array(node)),
+		))
+	}
+	return resp.Array(shards...)
+}
+
+func clusterInfo() string {
+	assigned, pfail, fail := 0, 0, 0
+	for _, owner := range clusterSlotOwner {
+		if owner == nil {
+			continue
+		}
+		assigned++
+		if owner.flags&clusterNodeFail != 0 {
+			fail++
+		} else if owner.flags&clusterNodePfail != 0 {
+			pfail++
+		}
+	}
+	state := "fail"
+	if clusterStateOK {
+		state = "ok"
+	}
+	sent, received := 0, 0
+	for _, count := range clusterMessagesSent {
+		sent += count
+	}
+	for _, count := range clusterMessagesReceived {
+		received += count
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "cluster_state:%s\r\n", state)
+	fmt.Fprintf(&sb, "cluster_slots_assigned:%d\r\n", assigned)
+	fmt.Fprintf(&sb, "cluster_slots_ok:%d\r\n", assigned-pfail-fail)
+	fmt.Fprintf(&sb, "cluster_slots_pfail:%d\r\n", pfail)
+	fmt.Fprintf(&sb, "cluster_slots_fail:%d\r\n", fail)
+	fmt.Fprintf(&sb, "cluster_known_nodes:%d\r\n", len(clusterNodes))
+	fmt.Fprintf(&sb, "cluster_size:%d\r\n", clusterSize())
+	fmt.Fprintf(&sb, "cluster_current_epoch:%d\r\n", clusterCurrentEpoch)
+	fmt.Fprintf(&sb, "cluster_my_epoch:%d\r\n", clusterMyself.configEpoch)
+	for _, msgType := range []string{"ping", "pong", "meet", "fail"} {
+		if count := clusterMessagesSent[msgType]; count > 0 {
+			fmt.Fprintf(&sb, "cluster_stats_messages_%s_sent:%d\r\n", msgType, count)
+		}
+	}
+	fmt.Fprintf(&sb, "cluster_stats_messages_sent:%d\r\n", sent)
+	for _, msgType := range []string{"ping", "pong", "meet", "fail"} {
+		if count := clusterMessagesReceived[msgType]; count > 0 {
+			fmt.Fprintf(&sb, "cluster_stats_messages_%s_received:%d\r\n", msgType, count)
+		}
+	}
+	fmt.Fprintf(&sb, "cluster_stats_messages_received:%d", received)
+	return sb.String()
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCRC16(t *testing.T) {
+	// the check value of CRC-16/XMODEM, also in the redis cluster spec
+	if got := crc16("123456789"); got != 12739 {
+		t.Fatalf("crc16(\"123456789\") = %d, want 12739", got)
+	}
+	if got := crc16(""); got != 0 {
+		t.Fatalf("crc16(\"\") = %d, want 0", got)
+	}
+}
+
+func TestKeyHashSlot(t *testing.T) {
+	if got := keyHashSlot("123456789"); got != 12739 {
+		t.Errorf("keyHashSlot(\"123456789\") = %d, want 12739", got)
+	}
+	if got := keyHashSlot("foo"); got != 12182 {
+		t.Errorf("keyHashSlot(\"foo\") = %d, want 12182", got)
+	}
+
+	tests := []struct {
+		a, b string
+	}{
+		{"{user}a", "{user}b"},
+		{"{user}a", "user"},
+		{"x{user}y{z}", "user"},
+		// only the first {...} counts, even when the second isn't empty
+		{"{user}{other}", "user"},
+		// an empty tag hashes the whole key
+		{"{}user", "{}user"},
+		{"{user", "{user"},
+	}
+	for _, tt := range tests {
+		if keyHashSlot(tt.a) != keyHashSlot(tt.b) {
+			t.Errorf("keyHashSlot(%q) = %d, keyHashSlot(%q) = %d, want the same slot", tt.a, keyHashSlot(tt.a), tt.b, keyHashSlot(tt.b))
+		}
+	}
+	if keyHashSlot("{}a") == keyHashSlot("{}b") {
+		t.Errorf("keys with an empty tag should hash the whole key")
+	}
+	for _, key := range []string{"", "a", "{user}a", strings.Repeat("x", 1000)} {
+		if slot := keyHashSlot(key); slot < 0 || slot >= clusterSlots {
+			t.Errorf("keyHashSlot(%q) = %d, out of range", key, slot)
+		}
+	}
+}
+
+// withClusterState runs fn on the executor with myself and one other master
+// set up, putting the cluster globals back afterwards
+func withClusterState(fn func(myself, other *clusterNode)) {
+	runOnExecutor(func() {
+		savedMyself, savedNodes, savedState := clusterMyself, clusterNodes, clusterStateOK
+		savedOwner, savedMigrating, savedImporting := clusterSlotOwner, clusterMigratingTo, clusterImportingFrom
+		defer func() {
+			clusterMyself, clusterNodes, clusterStateOK = savedMyself, savedNodes, savedState
+			clusterSlotOwner, clusterMigratingTo, clusterImportingFrom = savedOwner, savedMigrating, savedImporting
+		}()
+
+		myself := &clusterNode{id: "myself", ip: "127.0.0.1", port: 7000, flags: clusterNodeMyself | clusterNodeMaster, failReports: make(map[string]time.Time)}
+		other := &clusterNode{id: "other", ip: "127.0.0.1", port: 7001, flags: clusterNodeMaster, failReports: make(map[string]time.Time)}
+		clusterMyself = myself
+		clusterNodes = map[string]*clusterNode{myself.id: myself, other.id: other}
+		clusterStateOK = true
+		clusterSlotOwner = [clusterSlots]*clusterNode{}
+		clusterMigratingTo = [clusterSlots]*clusterNode{}
+		clusterImportingFrom = [clusterSlots]*clusterNode{}
+		fn(myself, other)
+	})
+}
+
+func TestClusterRejection(t *testing.T) {
+	withClusterState(func(myself, other *clusterNode) {
+		c := newClient(0, nil)
+		reject := func(args ...string) string {
+			command := strings.ToUpper(args[0])
+			return clusterRejection(command, commandTable[command], args, c)
+		}
+
+		mine, theirs := keyHashSlot("{mine}"), keyHashSlot("{theirs}")
+		clusterSlotOwner[mine] = myself
+		clusterSlotOwner[theirs] = other
+
+		if got := reject("GET", "{mine}a"); got != "" {
+			t.Errorf("GET of a key we serve = %q, want no rejection", got)
+		}
+		want := fmt.Sprintf("-MOVED %d 127.0.0.1:7001\r\n", theirs)
+		if got := reject("GET", "{theirs}a"); got != want {
+			t.Errorf("GET of a key another node serves = %q, want %q", got, want)
+		}
+		if got := reject("DEL", "{mine}a", "{mine}b"); got != "" {
+			t.Errorf("DEL of keys sharing a slot = %q, want no rejection", got)
+		}
+		if got := reject("DEL", "{mine}a", "{theirs}b"); !strings.HasPrefix(got, "-CROSSSLOT ") {
+			t.Errorf("DEL across slots = %q, want CROSSSLOT", got)
+		}
+		if got := reject("PING"); got != "" {
+			t.Errorf("PING = %q, want no rejection", got)
+		}
+
+		// our slot is moving to other: keys that already left get an ASK
+		clusterMigratingTo[mine] = other
+		store["{mine}here"] = RedisValue{value: "v"}
+		defer delete(store, "{mine}here")
+		if got := reject("GET", "{mine}here"); got != "" {
+			t.Errorf("GET of a key still here while migrating = %q, want no rejection", got)
+		}
+		want = fmt.Sprintf("-ASK %d 127.0.0.1:7001\r\n", mine)
+		if got := reject("GET", "{mine}gone"); got != want {
+			t.Errorf("GET of a key that left while migrating = %q, want %q", got, want)
+		}
+		if got := reject("DEL", "{mine}here", "{mine}gone"); !strings.HasPrefix(got, "-TRYAGAIN ") {
+			t.Errorf("DEL of keys split by a migration = %q, want TRYAGAIN", got)
+		}
+		if got := reject("MIGRATE", "127.0.0.1", "7001", "{mine}gone", "0", "1000"); got != "" {
+			t.Errorf("MIGRATE out of a migrating slot = %q, want no rejection", got)
+		}
+
+		// their slot is moving to us: only a client that sent ASKING gets in
+		clusterImportingFrom[theirs] = other
+		if got := reject("GET", "{theirs}a"); !strings.HasPrefix(got, "-MOVED ") {
+			t.Errorf("GET of an importing slot without ASKING = %q, want MOVED", got)
+		}
+		c.asking = true
+		if got := reject("GET", "{theirs}a"); got != "" {
+			t.Errorf("GET of an importing slot after ASKING = %q, want no rejection", got)
+		}
+		if c.asking {
+			t.Errorf("ASKING should only apply to the next command")
+		}
+		if got := reject("RESTORE-ASKING", "{theirs}a", "0", "payload"); got != "" {
+			t.Errorf("RESTORE-ASKING into an importing slot = %q, want no rejection", got)
+		}
+
+		clusterSlotOwner[mine] = nil
+		if got := reject("GET", "{mine}a"); !strings.HasPrefix(got, "-CLUSTERDOWN ") {
+			t.Errorf("GET of an unserved slot = %q, want CLUSTERDOWN", got)
+		}
+		clusterStateOK = false
+		if got := reject("GET", "{theirs}a"); got != "-CLUSTERDOWN The cluster is down\r\n" {
+			t.Errorf("GET while the cluster is down = %q, want CLUSTERDOWN", got)
+		}
+	})
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+    "strings"
+    "time"
+)
+
+// All commands, and anything else that reads or writes the keyspace or the
+// per-connection maps, run one at a time on the executor goroutine. This keeps
+// every command atomic and MULTI/EXEC isolated without locks in the handlers.
+var executorQueue = make(chan func(), 1024)
+
+// blocking commands are started from the client's own goroutine so that waiting
+// for data never stalls the executor, they use runOnExecutor for any state access
+var blockingCommandHandlers map[string]func([]string, *client) string
+
+func init() {
+    blockingCommandHandlers = map[string]func([]string, *client) string{
+        "BLPOP": bLPopResponse,
+        "XREAD": blockingXreadResponse,
+        "WAIT":  waitResponse,
+    }
+}
+
+func startExecutor() {
+    go func() {
+        for task := range executorQueue {
+            task()
+        }
+    }()
+}
+
+// runOnExecutor queues fn on the executor and waits for it to finish, it must
+// never be called from code that is already running on the executor
+func runOnExecutor(fn func()) {
+    done := make(chan struct{})
+    executorQueue <- func() {
+        defer close(done)
+        fn()
+    }
+    <-done
+}
+
+// executeCommand is the entry point for commands read from a connection
+func executeCommand(cmd []string, c *client) (response string) {
+    command := strings.ToUpper(strings.TrimSpace(cmd[0]))
+    blocking := false
+
+    for {
+        // during FAILOVER writes wait here, off the executor, until the switch is done or aborted
+        var paused chan struct{}
+        runOnExecutor(func() {
+            c.lastActivity = time.Now()
+            c.lastCommand = command
+            if writeIsPaused(command, c) {
+                paused = writesPaused
+                return
+            }
+            _, ok := blockingCommandHandlers[command]
+            // a bad call goes through handleCommand so it gets the usual arity error
+            if ok && !c.inMulti && !isSubscriber(c) && commandTable[command].arityMatches(len(cmd)) {
+                // the checks handleCommand would have made
+                response = aclRejection(command, c)
+                if response == "" && clusterEnabled() && !c.internal {
+                    response = clusterRejection(command, commandTable[command], cmd, c)
+                }
+                if response == "" && commandTable[command].flags&cmdWrite != 0 {
+                    response = writeRejection(c)
+                }
+                if response == "" {
+                    // the handler only gets to the keys later, a master can expire them now
+                    currentClient = c
+                    restoreHiddenKeys(expireCommandKeys(command, commandTable[command], cmd))
+                    currentClient = nil
+                    // BLPOP changes its list later, from this client's goroutine
+                    preserveForSnapshots(commandKeys(command, commandTable[command], cmd))
+                }
+                blocking = response == ""
+                return
+            }
+            response = handleCommand(cmd, c)
+        })
+        if paused == nil {
+            break
+        }
+        <-paused
+    }
+
+    if blocking {
+        response = blockingCommandHandlers[command](cmd, c)
+    }
+    return
+}
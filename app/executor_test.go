@@ -0,0 +1,230 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/DeanLogan/redis-clone/app/resp"
+)
+
+// These tests drive a real server from many connections at once, run them with
+// -race to check that nothing but the executor touches the keyspace.
+
+var testServerAddr string
+
+func TestMain(m *testing.M) {
+	config.Role = "master"
+	config.ReplicaReadOnly = "yes"
+	config.AppendOnly = "no"
+	config.ClusterEnabled = "no"
+	config.ProtoMaxBulkLen = 512 * 1024 * 1024
+	config.ReplBacklogSize = 1024 * 1024
+	config.MinReplicasMaxLag = 10
+	config.Replid = randReplid()
+	newAclUser("default")
+	startExecutor()
+	startLazyfree()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		fmt.Println("Failed to listen:", err)
+		os.Exit(1)
+	}
+	testServerAddr = listener.Addr().String()
+	go func() {
+		for id := 1; ; id++ {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go manageClientConnection(id, conn)
+		}
+	}()
+
+	code := m.Run()
+	listener.Close()
+	os.Exit(code)
+}
+
+type testConn struct {
+	t      *testing.T
+	conn   net.Conn
+	reader *resp.Reader
+}
+
+func dialTestServer(t *testing.T) *testConn {
+	conn, err := net.Dial("tcp", testServerAddr)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &testConn{t: t, conn: conn, reader: resp.NewReader(conn)}
+}
+
+func (tc *testConn) do(args ...string) resp.RespValue {
+	if _, err := tc.conn.Write([]byte(encodeStringArray(args))); err != nil {
+		tc.t.Errorf("%v: write: %v", args, err)
+		return resp.RespValue{}
+	}
+	reply, err := tc.reader.ReadValue()
+	if err != nil {
+		tc.t.Errorf("%v: read: %v", args, err)
+	}
+	return reply
+}
+
+func (tc *testConn) doInt(args ...string) int {
+	reply := tc.do(args...)
+	if reply.Type != resp.INTEGER {
+		tc.t.Errorf("%v: expected an integer, got %+v", args, reply)
+	}
+	return int(reply.Int)
+}
+
+// runConcurrently runs fn on n goroutines, each with its own connection
+func runConcurrently(t *testing.T, n int, fn func(worker int, tc *testConn)) {
+	conns := make([]*testConn, n)
+	for i := range conns {
+		conns[i] = dialTestServer(t)
+	}
+	var wg sync.WaitGroup
+	for i, tc := range conns {
+		wg.Add(1)
+		go func(i int, tc *testConn) {
+			defer wg.Done()
+			fn(i, tc)
+		}(i, tc)
+	}
+	wg.Wait()
+}
+
+func TestConcurrentIncr(t *testing.T) {
+	const workers, incrs = 20, 200
+	dialTestServer(t).do("DEL", "test:incr")
+
+	var mu sync.Mutex
+	seen := make(map[int]bool)
+	runConcurrently(t, workers, func(_ int, tc *testConn) {
+		for i := 0; i < incrs; i++ {
+			n := tc.doInt("INCR", "test:incr")
+			mu.Lock()
+			if seen[n] {
+				t.Errorf("INCR returned %d twice", n)
+			}
+			seen[n] = true
+			mu.Unlock()
+		}
+	})
+
+	got := dialTestServer(t).do("GET", "test:incr")
+	if got.Str != strconv.Itoa(workers*incrs) {
+		t.Fatalf("GET test:incr = %q, want %d", got.Str, workers*incrs)
+	}
+}
+
+func TestMultiExecIsolation(t *testing.T) {
+	const writers, readers, rounds = 10, 10, 100
+	dialTestServer(t).do("DEL", "test:multi:a", "test:multi:b")
+
+	runConcurrently(t, writers+readers, func(worker int, tc *testConn) {
+		for i := 0; i < rounds; i++ {
+			tc.do("MULTI")
+			if worker < writers {
+				tc.do("INCR", "test:multi:a")
+				tc.do("INCR", "test:multi:b")
+			} else {
+				tc.do("GET", "test:multi:a")
+				tc.do("GET", "test:multi:b")
+			}
+			reply := tc.do("EXEC")
+			if reply.Type != resp.ARRAY || len(reply.Elems) != 2 {
+				t.Errorf("EXEC = %+v", reply)
+				return
+			}
+			// a transaction never sees half of another one
+			a, b := reply.Elems[0], reply.Elems[1]
+			if a.Str != b.Str || a.Int != b.Int {
+				t.Errorf("EXEC saw a=%+v b=%+v", a, b)
+			}
+		}
+	})
+
+	tc := dialTestServer(t)
+	for _, key := range []string{"test:multi:a", "test:multi:b"} {
+		if got := tc.do("GET", key); got.Str != strconv.Itoa(writers*rounds) {
+			t.Fatalf("GET %s = %q, want %d", key, got.Str, writers*rounds)
+		}
+	}
+}
+
+func TestWatchOptimisticLocking(t *testing.T) {
+	const workers, incrs = 10, 50
+	dialTestServer(t).do("DEL", "test:watch")
+
+	runConcurrently(t, workers, func(_ int, tc *testConn) {
+		for done := 0; done < incrs; {
+			tc.do("WATCH", "test:watch")
+			n, _ := strconv.Atoi(tc.do("GET", "test:watch").Str)
+			tc.do("MULTI")
+			tc.do("SET", "test:watch", strconv.Itoa(n+1))
+			// a null reply means another client got there first
+			if reply := tc.do("EXEC"); !reply.IsNull {
+				done++
+			}
+		}
+	})
+
+	got := dialTestServer(t).do("GET", "test:watch")
+	if got.Str != strconv.Itoa(workers*incrs) {
+		t.Fatalf("GET test:watch = %q, want %d", got.Str, workers*incrs)
+	}
+}
+
+func TestBlockingPops(t *testing.T) {
+	const poppers, pushers, perPusher = 10, 5, 100
+	const total = pushers * perPusher
+	dialTestServer(t).do("DEL", "test:queue")
+
+	var mu sync.Mutex
+	popped := make(map[string]int)
+	runConcurrently(t, poppers+pushers, func(worker int, tc *testConn) {
+		if worker < pushers {
+			for i := 0; i < perPusher; i++ {
+				tc.doInt("RPUSH", "test:queue", fmt.Sprintf("%d-%d", worker, i))
+			}
+			return
+		}
+		for {
+			mu.Lock()
+			finished := len(popped) >= total
+			mu.Unlock()
+			if finished {
+				return
+			}
+			reply := tc.do("BLPOP", "test:queue", "0.2")
+			if reply.IsNull {
+				continue
+			}
+			if reply.Type != resp.ARRAY || len(reply.Elems) != 2 {
+				t.Errorf("BLPOP = %+v", reply)
+				return
+			}
+			mu.Lock()
+			popped[reply.Elems[1].Str]++
+			mu.Unlock()
+		}
+	})
+
+	if len(popped) != total {
+		t.Fatalf("popped %d distinct values, want %d", len(popped), total)
+	}
+	for value, count := range popped {
+		if count != 1 {
+			t.Errorf("%s was popped %d times", value, count)
+		}
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Keys expire lazily: handleCommand checks the keys of every command before
+// its handler runs, so no handler ever sees a key whose time is up. Only a
+// master deletes them, the DEL it propagates is what removes the key from its
+// replicas and the AOF. Expiry times are always propagated as an absolute
+// PEXPIREAT so a replica or a reloaded AOF ends up with the same deadline.
+
+// currentClient is the client whose command is running, nil outside commands
+var currentClient *client
+
+// keyIsExpired reports whether key's time is up, without acting on it
+func keyIsExpired(key string) bool {
+	expireAt, ok := ttl[key]
+	return ok && expireAt.Before(time.Now())
+}
+
+// isExpired deletes key once its time is up and reports whether the key has
+// to be treated as missing
+func isExpired(key string) bool {
+	if !keyIsExpired(key) {
+		return false
+	}
+	// the AOF and the master's stream replay writes made while the key was alive
+	if currentClient != nil && currentClient.internal {
+		return false
+	}
+	// a replica waits for its master's DEL
+	if config.Role == "slave" {
+		return true
+	}
+	delete(store, key)
+	delete(ttl, key)
+	touchWatchedKey(key)
+	propagateWrite([]string{"DEL", key})
+	return true
+}
+
+type hiddenKey struct {
+	value    RedisValue
+	expireAt time.Time
+}
+
+// expireCommandKeys expires the keys cmd is about to use. On a replica they
+// can't be deleted, so they're hidden while the command runs and put back by
+// restoreHiddenKeys.
+func expireCommandKeys(command string, entry *redisCommand, cmd []string) map[string]hiddenKey {
+	var hidden map[string]hiddenKey
+	for _, key := range commandKeys(command, entry, cmd) {
+		if !isExpired(key) {
+			continue
+		}
+		if rv, ok := store[key]; ok {
+			if hidden == nil {
+				hidden = make(map[string]hiddenKey)
+			}
+			hidden[key] = hiddenKey{rv, ttl[key]}
+			delete(store, key)
+			delete(ttl, key)
+		}
+	}
+	return hidden
+}
+
+func restoreHiddenKeys(hidden map[string]hiddenKey) {
+	for key, h := range hidden {
+		// a writable replica may have created the key again
+		if _, ok := store[key]; !ok {
+			store[key] = h.value
+			ttl[key] = h.expireAt
+		}
+	}
+}
+
+// setExpire gives key an absolute expiry, propagated as PEXPIREAT, or deletes
+// it when that's already in the past
+func setExpire(key string, expireAt time.Time) {
+	if !expireAt.After(time.Now()) && (currentClient == nil || !currentClient.internal) {
+		delete(store, key)
+		delete(ttl, key)
+		rewritePropagation([]string{"DEL", key})
+		return
+	}
+	ttl[key] = expireAt
+	rewritePropagation([]string{"PEXPIREAT", key, strconv.FormatInt(expireAt.UnixMilli(), 10)})
+}
+
+// EXPIRE key seconds, PEXPIRE key milliseconds, EXPIREAT key unix-time-seconds
+// and PEXPIREAT key unix-time-milliseconds, all taking [NX | XX | GT | LT]
+func expireResponse(cmd []string) string {
+	command := strings.ToUpper(cmd[0])
+	key := cmd[1]
+	n, err := strconv.ParseInt(cmd[2], 10, 64)
+	if err != nil {
+		return encodeSimpleErrorResponse("value is not an integer or out of range")
+	}
+
+	var nx, xx, gt, lt bool
+	for _, option := range cmd[3:] {
+		switch strings.ToUpper(option) {
+		case "NX":
+			nx = true
+		case "XX":
+			xx = true
+		case "GT":
+			gt = true
+		case "LT":
+			lt = true
+		default:
+			return encodeSimpleErrorResponse(fmt.Sprintf("Unsupported option %s", option))
+		}
+	}
+	if nx && (xx || gt || lt) {
+		return encodeSimpleErrorResponse("NX and XX, GT or LT options at the same time are not compatible")
+	}
+	if gt && lt {
+		return encodeSimpleErrorResponse("GT and LT options at the same time are not compatible")
+	}
+
+	// everything is worked out in unix milliseconds, checking for overflow on the way
+	invalid := encodeSimpleErrorResponse(fmt.Sprintf("invalid expire time in '%s' command", strings.ToLower(command)))
+	ms := n
+	if command == "EXPIRE" || command == "EXPIREAT" {
+		if n > math.MaxInt64/1000 || n < math.MinInt64/1000 {
+			return invalid
+		}
+		ms = n * 1000
+	}
+	if command == "EXPIRE" || command == "PEXPIRE" {
+		now := time.Now().UnixMilli()
+		if ms > math.MaxInt64-now {
+			return invalid
+		}
+		ms += now
+	}
+
+	if !keyExists(key) {
+		rewritePropagation()
+		return encodeInt(0)
+	}
+	current, hasTTL := ttl[key]
+	// a key without a TTL counts as never expiring for GT and LT
+	switch {
+	case nx && hasTTL,
+		xx && !hasTTL,
+		gt && (!hasTTL || ms <= current.UnixMilli()),
+		lt && hasTTL && ms >= current.UnixMilli():
+		rewritePropagation()
+		return encodeInt(0)
+	}
+	setExpire(key, time.UnixMilli(ms))
+	return encodeInt(1)
+}
+
+// TTL key and PTTL key
+func ttlResponse(cmd []string) string {
+	key := cmd[1]
+	if !keyExists(key) {
+		return encodeInt(-2)
+	}
+	expireAt, ok := ttl[key]
+	if !ok {
+		return encodeInt(-1)
+	}
+	remaining := max(time.Until(expireAt).Milliseconds(), 0)
+	if strings.ToUpper(cmd[0]) == "TTL" {
+		remaining = (remaining + 500) / 1000
+	}
+	return encodeInt(int(remaining))
+}
+
+// EXPIRETIME key and PEXPIRETIME key
+func expiretimeResponse(cmd []string) string {
+	key := cmd[1]
+	if !keyExists(key) {
+		return encodeInt(-2)
+	}
+	expireAt, ok := ttl[key]
+	if !ok {
+		return encodeInt(-1)
+	}
+	if strings.ToUpper(cmd[0]) == "EXPIRETIME" {
+		return encodeInt(int(expireAt.Unix()))
+	}
+	return encodeInt(int(expireAt.UnixMilli()))
+}
+
+func persistResponse(cmd []string) string {
+	key := cmd[1]
+	if !keyExists(key) {
+		rewritePropagation()
+		return encodeInt(0)
+	}
+	if _, ok := ttl[key]; !ok {
+		rewritePropagation()
+		return encodeInt(0)
+	}
+	delete(ttl, key)
+	return encodeInt(1)
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FAILOVER hands the master role to a replica without losing writes: client
+// writes are paused, the target is given time to acknowledge everything, then
+// we become its replica with PSYNC ... FAILOVER, which makes it promote itself.
+const (
+	failoverNone        = iota
+	failoverWaitForSync // writes are paused until the target has acknowledged our offset
+	failoverInProgress  // we're connecting to the target as its replica
+)
+
+var failoverState = failoverNone
+var failoverTargetHost string // empty when any replica that catches up will do
+var failoverTargetPort int
+var failoverForce bool
+var failoverDeadline time.Time // zero without a TIMEOUT
+
+// writesPaused is closed once client writes may go ahead again, nil when nothing is paused
+var writesPaused chan struct{}
+
+// FAILOVER [TO host port [FORCE]] [ABORT] [TIMEOUT milliseconds]
+func failoverResponse(cmd []string) string {
+	var host string
+	var port, timeout int
+	var force, abort bool
+	for i := 1; i < len(cmd); i++ {
+		switch strings.ToUpper(cmd[i]) {
+		case "TO":
+			if i+2 >= len(cmd) {
+				return encodeSimpleErrorResponse("syntax error")
+			}
+			p, err := strconv.Atoi(cmd[i+2])
+			if err != nil || p <= 0 || p > 65535 {
+				return encodeSimpleErrorResponse("Invalid port")
+			}
+			host, port = cmd[i+1], p
+			i += 2
+		case "TIMEOUT":
+			if i+1 >= len(cmd) {
+				return encodeSimpleErrorResponse("syntax error")
+			}
+			t, err := strconv.Atoi(cmd[i+1])
+			if err != nil || t <= 0 {
+				return encodeSimpleErrorResponse("FAILOVER timeout must be greater than 0")
+			}
+			timeout = t
+			i++
+		case "FORCE":
+			force = true
+		case "ABORT":
+			abort = true
+		default:
+			return encodeSimpleErrorResponse("syntax error")
+		}
+	}
+
+	if abort {
+		if host != "" || timeout > 0 || force {
+			return encodeSimpleErrorResponse("FAILOVER ABORT can't be combined with other arguments")
+		}
+		if failoverState == failoverNone {
+			return encodeSimpleErrorResponse("No failover in progress.")
+		}
+		abortFailover("failover aborted by the user")
+		return encodeSimpleString("OK")
+	}
+
+	if config.Role == "slave" {
+		return encodeSimpleErrorResponse("FAILOVER is not valid when server is a replica.")
+	}
+	if len(config.Replicas) == 0 {
+		return encodeSimpleErrorResponse("FAILOVER requires connected replicas.")
+	}
+	if failoverState != failoverNone {
+		return encodeSimpleErrorResponse("FAILOVER already in progress.")
+	}
+	if force && (host == "" || timeout == 0) {
+		return encodeSimpleErrorResponse("FAILOVER with force option requires both a timeout and target HOST and IP.")
+	}
+	if host != "" && failoverReplica(host, port) == nil {
+		return encodeSimpleErrorResponse("FAILOVER target HOST and PORT is not a replica.")
+	}
+
+	failoverState = failoverWaitForSync
+	failoverTargetHost, failoverTargetPort = host, port
+	failoverForce = force
+	failoverDeadline = time.Time{}
+	if timeout > 0 {
+		failoverDeadline = time.Now().Add(time.Duration(timeout) * time.Millisecond)
+	}
+	writesPaused = make(chan struct{})
+	fmt.Println("FAILOVER requested, pausing writes until a replica has caught up")
+	checkFailover()
+	return encodeSimpleString("OK")
+}
+
+// failoverReplica finds the replica listening on host:port
+func failoverReplica(host string, port int) *client {
+	for _, replica := range config.Replicas {
+		ip, _, _ := net.SplitHostPort(replica.conn.RemoteAddr().String())
+		if ip == host && replica.replPort == port && replica.replState == replStateOnline {
+			return replica
+		}
+	}
+	return nil
+}
+
+// checkFailover runs after every ACK and from the replication cron, the
+// switch happens once the target acknowledged exactly our offset
+func checkFailover() {
+	if failoverState != failoverWaitForSync {
+		return
+	}
+
+	var target *client
+	if failoverTargetHost != "" {
+		target = failoverReplica(failoverTargetHost, failoverTargetPort)
+		if target == nil {
+			abortFailover("the target replica disconnected")
+			return
+		}
+		if target.replAckOffset != config.MasterReplOffset {
+			target = nil
+		}
+	} else {
+		for _, replica := range config.Replicas {
+			if replica.replState == replStateOnline && replica.replAckOffset == config.MasterReplOffset {
+				target = replica
+				break
+			}
+		}
+	}
+
+	if target == nil {
+		if failoverDeadline.IsZero() || time.Now().Before(failoverDeadline) {
+			return
+		}
+		if !failoverForce {
+			abortFailover("replica never caught up before the timeout")
+			return
+		}
+		fmt.Println("FAILOVER timeout reached, forcing the failover")
+	} else {
+		ip, _, _ := net.SplitHostPort(target.conn.RemoteAddr().String())
+		failoverTargetHost, failoverTargetPort = ip, target.replPort
+	}
+
+	fmt.Printf("Switching roles with failover target %s:%d\n", failoverTargetHost, failoverTargetPort)
+	failoverState = failoverInProgress
+	replicationSetMaster(failoverTargetHost, failoverTargetPort)
+	replLink.failover = true
+}
+
+// finishFailover runs once the link to the new master is up
+func finishFailover() {
+	fmt.Printf("Failover to %s:%d completed\n", failoverTargetHost, failoverTargetPort)
+	resetFailover()
+}
+
+func abortFailover(reason string) {
+	fmt.Printf("FAILOVER aborted: %s\n", reason)
+	// we may already have stepped down, take the master role back
+	if failoverState == failoverInProgress {
+		replicationUnsetMaster()
+	}
+	resetFailover()
+}
+
+func resetFailover() {
+	failoverState = failoverNone
+	failoverTargetHost, failoverTargetPort = "", 0
+	failoverForce = false
+	failoverDeadline = time.Time{}
+	if writesPaused != nil {
+		close(writesPaused)
+		writesPaused = nil
+	}
+}
+
+// writeIsPaused reports whether the client has to wait for the failover
+// before running cmd, queueing inside MULTI is fine but EXEC waits
+func writeIsPaused(command string, c *client) bool {
+	if writesPaused == nil || c.internal || c.isReplica {
+		return false
+	}
+	if command == "EXEC" && c.inMulti {
+		for _, queued := range c.multiQueue {
+			if entry, ok := commandTable[strings.ToUpper(queued[0])]; ok && entry.flags&cmdWrite != 0 {
+				return true
+			}
+		}
+		return false
+	}
+	entry, ok := commandTable[command]
+	return ok && !c.inMulti && entry.flags&cmdWrite != 0
+}
+
+func failoverInfo() string {
+	state := "no-failover"
+	switch failoverState {
+	case failoverWaitForSync:
+		state = "waiting-for-sync"
+	case failoverInProgress:
+		state = "failover-in-progress"
+	}
+	return fmt.Sprintf("master_failover_state:%s\r\n", state)
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// lazyfreeThreshold is the number of elements above which UNLINK and the ASYNC
+// flushes leave tearing a value down to the lazyfree goroutine
+const lazyfreeThreshold = 64
+
+var lazyfreeQueue = make(chan any, 1024)
+
+func startLazyfree() {
+	go func() {
+		for v := range lazyfreeQueue {
+			switch v := v.(type) {
+			case map[string]RedisValue:
+				clear(v)
+			case map[string]time.Time:
+				clear(v)
+			case map[string]struct{}:
+				clear(v)
+			case map[string]string:
+				clear(v)
+			case SortedSet:
+				clear(v.Entries)
+			}
+		}
+	}()
+}
+
+// freeLazily hands v to the lazyfree goroutine, when that's busy the garbage
+// collector gets it like any other value
+func freeLazily(v any) {
+	select {
+	case lazyfreeQueue <- v:
+	default:
+	}
+}
+
+func valueLength(rv RedisValue) int {
+	switch v := rv.value.(type) {
+	case []string:
+		return len(v)
+	case map[string]struct{}:
+		return len(v)
+	case map[string]string:
+		return len(v)
+	case SortedSet:
+		return len(v.Entries)
+	case RedisStream:
+		return len(v.Entries)
+	}
+	return 1
+}
+
+// keyExists is true for keys that are present and not expired
+func keyExists(key string) bool {
+	_, ok := store[key]
+	return ok && !isExpired(key)
+}
+
+// deleteKey removes key and its expiry, reporting whether it existed
+func deleteKey(key string, lazy bool) bool {
+	if !keyExists(key) {
+		return false
+	}
+	rv := store[key]
+	delete(store, key)
+	delete(ttl, key)
+	if lazy && valueLength(rv) > lazyfreeThreshold {
+		freeLazily(rv.value)
+	}
+	return true
+}
+
+// DEL key [key ...] and UNLINK key [key ...]
+func delResponse(cmd []string, lazy bool) string {
+	deleted := 0
+	for _, key := range cmd[1:] {
+		if deleteKey(key, lazy) {
+			deleted++
+		}
+	}
+	if deleted == 0 {
+		rewritePropagation()
+	}
+	return encodeInt(deleted)
+}
+
+// EXISTS key [key ...] counts a key as many times as it's given, TOUCH doesn't
+// have anything to update without eviction so it's the same count
+func existsResponse(cmd []string) string {
+	count := 0
+	for _, key := range cmd[1:] {
+		if keyExists(key) {
+			count++
+		}
+	}
+	return encodeInt(count)
+}
+
+// RENAME key newkey and RENAMENX key newkey, the expiry moves with the value
+func renameResponse(cmd []string, nx bool) string {
+	src, dst := cmd[1], cmd[2]
+	if !keyExists(src) {
+		return encodeSimpleErrorResponse("no such key")
+	}
+	if src == dst {
+		if nx {
+			return encodeInt(0)
+		}
+		return encodeSimpleString("OK")
+	}
+	if nx && keyExists(dst) {
+		return encodeInt(0)
+	}
+
+	rv := store[src]
+	expireAt, hasTTL := ttl[src]
+	delete(store, src)
+	delete(ttl, src)
+	store[dst] = rv
+	delete(ttl, dst)
+	if hasTTL {
+		ttl[dst] = expireAt
+	}
+	if list, ok := rv.value.([]string); ok {
+		serveBlockedPoppers(dst, list)
+	}
+
+	if nx {
+		return encodeInt(1)
+	}
+	return encodeSimpleString("OK")
+}
+
+// COPY source destination [DB destination-db] [REPLACE]
+func copyResponse(cmd []string) string {
+	src, dst := cmd[1], cmd[2]
+	replace := false
+	for i := 3; i < len(cmd); i++ {
+		switch strings.ToUpper(cmd[i]) {
+		case "REPLACE":
+			replace = true
+		case "DB":
+			if i+1 >= len(cmd) {
+				return encodeSimpleErrorResponse("syntax error")
+			}
+			db, err := strconv.Atoi(cmd[i+1])
+			if err != nil {
+				return encodeSimpleErrorResponse("value is not an integer or out of range")
+			}
+			// there's only the one database
+			if db != 0 {
+				return encodeSimpleErrorResponse("DB index is out of range")
+			}
+			i++
+		default:
+			return encodeSimpleErrorResponse("syntax error")
+		}
+	}
+
+	if src == dst {
+		return encodeSimpleErrorResponse("source and destination objects are the same")
+	}
+	if !keyExists(src) || (keyExists(dst) && !replace) {
+		return encodeInt(0)
+	}
+
+	rv := copyRedisValue(store[src])
+	store[dst] = rv
+	delete(ttl, dst)
+	if expireAt, ok := ttl[src]; ok {
+		ttl[dst] = expireAt
+	}
+	if list, ok := rv.value.([]string); ok {
+		serveBlockedPoppers(dst, list)
+	}
+	return encodeInt(1)
+}
+
+func randomkeyResponse() string {
+	// map iteration starts at a random key, expired ones found on the way are dropped
+	for key := range store {
+		if !isExpired(key) {
+			return encodeBulkString(key)
+		}
+	}
+	return NullBulkString
+}
+
+// DBSIZE leaves out keys whose time is up like KEYS does, without deleting them
+func dbsizeResponse() string {
+	size := len(store)
+	for key := range ttl {
+		if _, ok := store[key]; ok && keyIsExpired(key) {
+			size--
+		}
+	}
+	return encodeInt(size)
+}
+
+// FLUSHALL [ASYNC|SYNC] and FLUSHDB [ASYNC|SYNC]
+func flushallResponse(cmd []string) string {
+	lazy := false
+	if len(cmd) > 2 {
+		return encodeSimpleErrorResponse("syntax error")
+	}
+	if len(cmd) == 2 {
+		switch strings.ToUpper(cmd[1]) {
+		case "ASYNC":
+			lazy = true
+		case "SYNC":
+		default:
+			return encodeSimpleErrorResponse("syntax error")
+		}
+	}
+
+	oldStore, oldTTL := store, ttl
+	emptyKeyspace()
+	// a snapshot still being written keeps reading the old maps
+	if lazy && len(keyspaceSnapshots) == 0 {
+		freeLazily(oldStore)
+		freeLazily(oldTTL)
+	}
+	fmt.Printf("Keyspace flushed with %s\n", strings.ToUpper(cmd[0]))
+	return encodeSimpleString("OK")
+}
@@ -1,53 +1,326 @@
 package main
 
 import (
-	"encoding/base64"
+	"bufio"
+	"bytes"
+	"errors"
 	"fmt"
 	"net"
-	"strconv"
+	"time"
 )
 
+// replica states while a full resync is in progress
+const (
+	replStateWaitBgsaveStart = iota + 1 // waiting for a diskless sync to start, the snapshot will include every write
+	replStateWaitBgsave                 // the RDB is being produced, writes are held back
+	replStateOnline
+)
+
+// writes caused by a command besides the command itself, such as the pop that
+// serves a blocked BLPOP client, sent on once the command has been propagated
+var pendingPropagation [][]string
+
+func alsoPropagate(cmd []string) {
+	pendingPropagation = append(pendingPropagation, cmd)
+}
+
+// a handler can replace what its command propagates, like EXPIRE becoming an
+// absolute PEXPIREAT, an empty replacement propagates nothing
+var propagationRewritten bool
+var propagationRewrite [][]string
+
+func rewritePropagation(cmds ...[]string) {
+	propagationRewritten = true
+	propagationRewrite = cmds
+}
+
+// while EXEC runs, the writes of the transaction collect here so they reach the
+// replicas and the AOF together
+var execPropagating bool
+var execPropagation [][]string
+
+func beginExecPropagation() {
+	execPropagating = true
+}
+
+// endExecPropagation sends on what the transaction wrote, wrapped in MULTI/EXEC
+// when there is more than one write. A read only transaction propagates nothing.
+func endExecPropagation() {
+	cmds := execPropagation
+	execPropagating, execPropagation = false, nil
+	if len(cmds) > 1 {
+		cmds = append(append([][]string{{"MULTI"}}, cmds...), []string{"EXEC"})
+	}
+	for _, cmd := range cmds {
+		propagateWrite(cmd)
+	}
+}
+
+func flushPropagation() {
+	pending := pendingPropagation
+	pendingPropagation = nil
+	for _, cmd := range pending {
+		propagateWrite(cmd)
+	}
+}
+
+// replicaWaiter is a WAIT call blocked until numReplicas replicas have
+// acknowledged offset, notify receives how many did
+type replicaWaiter struct {
+	offset      int
+	numReplicas int
+	notify      chan int
+}
+
+var replicaWaiters []*replicaWaiter
+
+func addReplicaWaiter(w *replicaWaiter) {
+	replicaWaiters = append(replicaWaiters, w)
+}
+
+func removeReplicaWaiter(w *replicaWaiter) {
+	for i, waiter := range replicaWaiters {
+		if waiter == w {
+			replicaWaiters = append(replicaWaiters[:i], replicaWaiters[i+1:]...)
+			return
+		}
+	}
+}
+
+func countAckedReplicas(offset int) int {
+	acked := 0
+	for _, replica := range config.Replicas {
+		if replica.replAckOffset >= offset {
+			acked++
+		}
+	}
+	return acked
+}
+
+// wakeReplicaWaiters runs after every REPLCONF ACK and releases the WAIT calls
+// that now have enough replicas
+func wakeReplicaWaiters() {
+	remaining := replicaWaiters[:0]
+	for _, w := range replicaWaiters {
+		if acked := countAckedReplicas(w.offset); acked >= w.numReplicas {
+			w.notify <- acked
+			continue
+		}
+		remaining = append(remaining, w)
+	}
+	replicaWaiters = remaining
+}
+
+// replicaLag is the number of seconds since the replica last acknowledged
+func replicaLag(c *client) int {
+	return int(time.Since(c.replAckTime).Seconds())
+}
+
+// goodReplicasCount is how many replicas are online and acknowledged within
+// min-replicas-max-lag, the ones that count towards min-replicas-to-write
+func goodReplicasCount() int {
+	good := 0
+	for _, replica := range config.Replicas {
+		if replica.replState == replStateOnline && replicaLag(replica) <= config.MinReplicasMaxLag {
+			good++
+		}
+	}
+	return good
+}
+
+// replicasInfo is the master part of INFO replication, a line per replica
+func replicasInfo() string {
+	info := fmt.Sprintf("connected_slaves:%d\r\n", len(config.Replicas))
+	if config.MinReplicasToWrite > 0 {
+		info += fmt.Sprintf("min_slaves_good_slaves:%d\r\n", goodReplicasCount())
+	}
+	for i, replica := range config.Replicas {
+		ip, _, _ := net.SplitHostPort(replica.conn.RemoteAddr().String())
+		state := "online"
+		if replica.replState != replStateOnline {
+			state = "wait_bgsave"
+		}
+		info += fmt.Sprintf("slave%d:ip=%s,port=%d,state=%s,offset=%d,lag=%d\r\n",
+			i, ip, replica.replPort, state, replica.replAckOffset, replicaLag(replica))
+	}
+	return info
+}
+
+// propagateWrite sends a write to the replicas and appends it to the AOF. A
+// replica never sends on writes of its own, its replicas get its master's stream
+func propagateWrite(cmd []string) {
+	if execPropagating {
+		execPropagation = append(execPropagation, cmd)
+		return
+	}
+	config.WriteOffset++
+	rdbDirty++
+	if config.Role == "master" {
+		propagate(cmd)
+	}
+	feedAppendOnlyFile(cmd)
+}
+
 func propagate(cmd []string) {
-	if len(config.Replicas) == 0 {
+	// nobody can consume the stream until a replica has attached and created the backlog
+	if backlog == nil {
 		return
 	}
-	for i := 0; i < len(config.Replicas); i++ {
-		fmt.Printf("Replicating to: %s\n", config.Replicas[i].RemoteAddr().String())
-		_, err := config.Replicas[i].Write([]byte(encodeStringArray(cmd)))
-		// remove stale replicas
-		if err != nil {
-			fmt.Printf("Disconnected: %s\n", config.Replicas[i].RemoteAddr().String())
-			if len(config.Replicas) > 1 {
-				last := len(config.Replicas) - 1
-				config.Replicas[i] = config.Replicas[last]
-				config.Replicas = config.Replicas[:last]
-				i--
+	feedReplicationStream([]byte(encodeStringArray(cmd)))
+}
+
+// feedReplicationStream adds data to our replication stream. On a master that's
+// the commands it propagates, on a replica the exact bytes its master sent, so
+// the offsets and backlog of every node in a chain stay identical.
+func feedReplicationStream(data []byte) {
+	config.MasterReplOffset += len(data)
+	if backlog != nil {
+		backlog.feed(data)
+	}
+	for _, replica := range config.Replicas {
+		switch replica.replState {
+		case replStateWaitBgsaveStart:
+		case replStateWaitBgsave:
+			replica.replPending = append(replica.replPending, data...)
+		default:
+			replica.queueReply(string(data))
+		}
+	}
+}
+
+// startFullResync answers PSYNC with +FULLRESYNC and the offset the snapshot
+// is taken at, then writes the RDB in the background. The replica is
+// registered straight away so writes made during the transfer are buffered
+// and sent right after the RDB. With repl-diskless-sync the replica waits for
+// the delay to pass first, so replicas arriving together share one transfer.
+func startFullResync(c *client) {
+	createReplBacklog()
+	addReplica(c)
+	if config.ReplDisklessSync == "yes" {
+		c.replState = replStateWaitBgsaveStart
+		if !disklessSyncScheduled {
+			disklessSyncScheduled = true
+			fmt.Printf("Delay next diskless sync for %d seconds to wait for more replicas\n", config.ReplDisklessSyncDelay)
+			time.AfterFunc(time.Duration(config.ReplDisklessSyncDelay)*time.Second, func() {
+				runOnExecutor(startDisklessSync)
+			})
+		}
+		return
+	}
+
+	c.queueReply(encodeSimpleString(fmt.Sprintf("FULLRESYNC %s %d", config.Replid, config.MasterReplOffset)))
+	c.replState = replStateWaitBgsave
+	snapshot := newKeyspaceSnapshot()
+	info := currentReplInfo()
+
+	go func() {
+		var rdb bytes.Buffer
+		err := writeRDB(&rdb, snapshotSource(snapshot), info)
+		runOnExecutor(func() {
+			snapshot.release()
+			if !c.isReplica {
+				return // disconnected during the transfer
+			}
+			if err != nil {
+				fmt.Printf("[#%d] Failed to produce the RDB for full resync: %v\n", c.id, err)
+				c.conn.Close()
+				return
 			}
+			c.queueReply(fmt.Sprintf("$%d\r\n", rdb.Len()) + rdb.String())
+			finishFullResync(c)
+			fmt.Printf("[#%d] full resynch sent: %d bytes\n", c.id, rdb.Len())
+		})
+	}()
+}
+
+// finishFullResync sends the writes held back during the transfer
+func finishFullResync(c *client) {
+	c.queueReply(string(c.replPending))
+	c.replPending = nil
+	c.replState = replStateOnline
+}
+
+// the size of a diskless transfer isn't known up front, so it starts with
+// "$EOF:<mark>" and ends with the same 40 byte mark
+const disklessSyncMarkLen = 40
+
+// how much of the RDB may sit in a replica's output buffer before the
+// transfer waits for the socket to catch up
+const disklessSyncBufferLimit = 1 << 20
+
+var disklessSyncScheduled bool
+
+// startDisklessSync streams one snapshot to every replica waiting for it
+func startDisklessSync() {
+	disklessSyncScheduled = false
+	var targets []*client
+	for _, replica := range config.Replicas {
+		if replica.replState == replStateWaitBgsaveStart {
+			targets = append(targets, replica)
 		}
 	}
+	if len(targets) == 0 {
+		return
+	}
+
+	mark := randStringWithCharset(disklessSyncMarkLen, charset)
+	snapshot := newKeyspaceSnapshot()
+	info := currentReplInfo()
+	for _, replica := range targets {
+		replica.queueReply(encodeSimpleString(fmt.Sprintf("FULLRESYNC %s %d", config.Replid, config.MasterReplOffset)))
+		replica.queueReply("$EOF:" + mark + "\r\n")
+		replica.replState = replStateWaitBgsave
+	}
+	fmt.Printf("Starting diskless sync to %d replicas\n", len(targets))
+
+	go func() {
+		stream := &replicaStream{replicas: targets}
+		writer := bufio.NewWriterSize(stream, 64*1024)
+		err := writeRDB(writer, snapshotSource(snapshot), info)
+		if err == nil {
+			err = writer.Flush()
+		}
+		runOnExecutor(func() {
+			snapshot.release()
+			for _, replica := range targets {
+				if !replica.isReplica {
+					continue // disconnected during the transfer
+				}
+				if err != nil {
+					fmt.Printf("[#%d] Diskless sync failed: %v\n", replica.id, err)
+					replica.conn.Close()
+					continue
+				}
+				replica.queueReply(mark)
+				finishFullResync(replica)
+				fmt.Printf("[#%d] Diskless sync finished: %d bytes sent\n", replica.id, stream.written)
+			}
+		})
+	}()
 }
 
-func sendEmptyRDB(id int, conn net.Conn) {
-    base64String := "UkVESVMwMDEx+glyZWRpcy12ZXIFNy4yLjD6CnJlZGlzLWJpdHPAQPoFY3RpbWXCbQi8ZfoIdXNlZC1tZW3CsMQQAPoIYW9mLWJhc2XAAP/wbjv+wP9aog=="
-    data, err := base64ToBinary(base64String)
-    if err != nil {
-        fmt.Println("Error decoding base64 string:", err)
-        return
-    }
-	dataLen := strconv.Itoa(len(data))
-    _, err = conn.Write([]byte(fmt.Sprintf("$%s\r\n%v", dataLen, data)))
-    if err != nil {
-        fmt.Println("Error sending message: ", err.Error())
-        return
-    }
-	fmt.Printf("[#%d] full resynch sent: %s\n", id, dataLen)
-	config.Replicas = append(config.Replicas, conn)
+// replicaStream fans the RDB out to the output buffers of the replicas being
+// synced, only waiting when a replica's socket falls behind
+type replicaStream struct {
+	replicas []*client
+	written  int
 }
 
-func base64ToBinary(base64String string) (string, error) {
-    data, err := base64.StdEncoding.DecodeString(base64String)
-    if err != nil {
-        return "", err
-    }
-    return string(data), nil
+func (s *replicaStream) Write(p []byte) (int, error) {
+	alive := 0
+	for _, replica := range s.replicas {
+		for replica.pendingOutput() > disklessSyncBufferLimit && !replica.outputClosed() {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if replica.outputClosed() {
+			continue
+		}
+		replica.queueReply(string(p))
+		alive++
+	}
+	if alive == 0 {
+		return 0, errors.New("every replica disconnected")
+	}
+	s.written += len(p)
+	return len(p), nil
 }
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/DeanLogan/redis-clone/app/resp"
+)
+
+// DUMP payloads use the RDB encoding of a single value followed by the RDB
+// version and a CRC64 of everything before it, both little endian, like redis.
+
+func dumpPayload(rv RedisValue) (string, bool) {
+	valueType, ok := rdbValueType(rv)
+	if !ok {
+		return "", false
+	}
+	var buf bytes.Buffer
+	rw := &rdbWriter{w: &buf}
+	rw.writeByte(valueType)
+	rw.writeValue(rv)
+	rw.write([]byte{byte(rdbVersion), byte(rdbVersion >> 8)})
+	footer := make([]byte, 8)
+	binary.LittleEndian.PutUint64(footer, rw.crc)
+	buf.Write(footer)
+	return buf.String(), true
+}
+
+func restorePayload(payload string) (RedisValue, error) {
+	errBadPayload := fmt.Errorf("DUMP payload version or checksum are wrong")
+	if len(payload) < 11 {
+		return RedisValue{}, errBadPayload
+	}
+	body, footer := payload[:len(payload)-8], payload[len(payload)-8:]
+	version := binary.LittleEndian.Uint16([]byte(body[len(body)-2:]))
+	if version > rdbVersion || crc64Jones(0, []byte(body)) != binary.LittleEndian.Uint64([]byte(footer)) {
+		return RedisValue{}, errBadPayload
+	}
+	rr := &rdbReader{r: bufio.NewReader(strings.NewReader(body[:len(body)-2]))}
+	valueType, err := rr.readByte()
+	if err != nil {
+		return RedisValue{}, fmt.Errorf("Bad data format")
+	}
+	rv, err := rr.readObject(valueType)
+	if err != nil {
+		return RedisValue{}, fmt.Errorf("Bad data format")
+	}
+	return rv, nil
+}
+
+func dumpResponse(cmd []string) string {
+	key := cmd[1]
+	rv, ok := store[key]
+	if !ok || isExpired(key) {
+		return NullBulkString
+	}
+	payload, ok := dumpPayload(rv)
+	if !ok {
+		return NullBulkString
+	}
+	return encodeBulkString(payload)
+}
+
+// RESTORE key ttl serialized-value [REPLACE] [ABSTTL] [IDLETIME seconds] [FREQ frequency]
+func restoreResponse(cmd []string) string {
+	key := cmd[1]
+	ttlMs, err := strconv.ParseInt(cmd[2], 10, 64)
+	if err != nil {
+		return encodeSimpleErrorResponse("value is not an integer or out of range")
+	}
+	if ttlMs < 0 {
+		return encodeSimpleErrorResponse("Invalid TTL value, must be >= 0")
+	}
+	replace, absTTL := false, false
+	for i := 4; i < len(cmd); i++ {
+		switch strings.ToUpper(cmd[i]) {
+		case "REPLACE":
+			replace = true
+		case "ABSTTL":
+			absTTL = true
+		case "IDLETIME", "FREQ":
+			// there's no eviction to feed these to
+			if i+1 >= len(cmd) {
+				return encodeSimpleErrorResponse("syntax error")
+			}
+			i++
+		default:
+			return encodeSimpleErrorResponse("syntax error")
+		}
+	}
+
+	if _, exists := store[key]; exists && !isExpired(key) && !replace {
+		return encodeErrorResponseWithMsg("BUSYKEY", "Target key name already exists.")
+	}
+	rv, err := restorePayload(cmd[3])
+	if err != nil {
+		return errorResponse(fmt.Errorf("ERR %v", err))
+	}
+
+	delete(ttl, key)
+	if ttlMs > 0 {
+		expireAt := time.Now().Add(time.Duration(ttlMs) * time.Millisecond)
+		if absTTL {
+			expireAt = time.UnixMilli(ttlMs)
+		}
+		// restoring something that has already expired leaves the key deleted
+		if !expireAt.After(time.Now()) {
+			delete(store, key)
+			rewritePropagation([]string{"DEL", key})
+			return encodeSimpleString("OK")
+		}
+		ttl[key] = expireAt
+		// replicas and the AOF get the deadline, not the time left
+		if !absTTL {
+			propagated := append([]string{}, cmd...)
+			propagated[2] = strconv.FormatInt(expireAt.UnixMilli(), 10)
+			rewritePropagation(append(propagated, "ABSTTL"))
+		}
+	}
+	store[key] = rv
+	return encodeSimpleString("OK")
+}
+
+// MIGRATE host port key|"" destination-db timeout [COPY] [REPLACE] [AUTH password] [AUTH2 username password] [KEYS key [key ...]]
+//
+// Like redis the transfer happens on the executor, the timeout bounds how long
+// every other client waits for it.
+func migrateResponse(cmd []string) string {
+	// replicas and the AOF only get a DEL for each key that moved, even when a
+	// later key fails
+	rewritePropagation()
+	_, err1 := strconv.Atoi(cmd[2])
+	db, err2 := strconv.Atoi(cmd[4])
+	timeout, err3 := strconv.Atoi(cmd[5])
+	if err1 != nil || err2 != nil || err3 != nil {
+		return encodeSimpleErrorResponse("value is not an integer or out of range")
+	}
+	if db != 0 {
+		return encodeSimpleErrorResponse("DB index is out of range")
+	}
+	if timeout <= 0 {
+		timeout = 1000
+	}
+
+	copyKeys, replace := false, false
+	var auth []string
+	keys := []string{cmd[3]}
+	for i := 6; i < len(cmd); i++ {
+		switch strings.ToUpper(cmd[i]) {
+		case "COPY":
+			copyKeys = true
+		case "REPLACE":
+			replace = true
+		case "AUTH":
+			if i+1 >= len(cmd) {
+				return encodeSimpleErrorResponse("syntax error")
+			}
+			auth = []string{"AUTH", cmd[i+1]}
+			i++
+		case "AUTH2":
+			if i+2 >= len(cmd) {
+				return encodeSimpleErrorResponse("syntax error")
+			}
+			auth = []string{"AUTH", cmd[i+1], cmd[i+2]}
+			i += 2
+		case "KEYS":
+			if cmd[3] != "" {
+				return encodeSimpleErrorResponse("When using MIGRATE KEYS option, the key argument must be set to the empty string")
+			}
+			keys = cmd[i+1:]
+			i = len(cmd)
+		default:
+			return encodeSimpleErrorResponse("syntax error")
+		}
+	}
+
+	// only keys that still exist are sent
+	var requests [][]string
+	var sent []string
+	restore := "RESTORE"
+	if clusterEnabled() {
+		restore = "RESTORE-ASKING"
+	}
+	for _, key := range keys {
+		rv, ok := store[key]
+		if !ok || isExpired(key) {
+			continue
+		}
+		payload, ok := dumpPayload(rv)
+		if !ok {
+			continue
+		}
+		ttlMs := int64(0)
+		if expireAt, ok := ttl[key]; ok {
+			ttlMs = max(time.Until(expireAt).Milliseconds(), 1)
+		}
+		request := []string{restore, key, strconv.FormatInt(ttlMs, 10), payload}
+		if replace {
+			request = append(request, "REPLACE")
+		}
+		requests = append(requests, request)
+		sent = append(sent, key)
+	}
+	if len(sent) == 0 {
+		return encodeSimpleString("NOKEY")
+	}
+
+	deadline := time.Now().Add(time.Duration(timeout) * time.Millisecond)
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(cmd[1], cmd[2]), time.Until(deadline))
+	if err != nil {
+		return encodeErrorResponseWithMsg("IOERR", "error or timeout connecting to the client")
+	}
+	defer conn.Close()
+	conn.SetDeadline(deadline)
+
+	var pipeline strings.Builder
+	if auth != nil {
+		pipeline.WriteString(encodeStringArray(auth))
+	}
+	for _, request := range requests {
+		pipeline.WriteString(encodeStringArray(request))
+	}
+	if _, err := conn.Write([]byte(pipeline.String())); err != nil {
+		return encodeErrorResponseWithMsg("IOERR", "error or timeout writing to target instance")
+	}
+
+	reader := resp.NewReader(conn)
+	if auth != nil {
+		reply, err := reader.ReadValue()
+		if err != nil {
+			return encodeErrorResponseWithMsg("IOERR", "error or timeout reading to target instance")
+		}
+		if reply.Type == resp.ERROR {
+			return encodeSimpleErrorResponse("Target instance replied with error: " + reply.Str)
+		}
+	}
+	var targetErr string
+	for _, key := range sent {
+		reply, err := reader.ReadValue()
+		if err != nil {
+			return encodeErrorResponseWithMsg("IOERR", "error or timeout reading to target instance")
+		}
+		if reply.Type == resp.ERROR {
+			if targetErr == "" {
+				targetErr = reply.Str
+			}
+			continue
+		}
+		// the key lives on the target now
+		if !copyKeys {
+			delete(store, key)
+			delete(ttl, key)
+			touchWatchedKey(key)
+			alsoPropagate([]string{"DEL", key})
+		}
+	}
+	if targetErr != "" {
+		return encodeSimpleErrorResponse("Target instance replied with error: " + targetErr)
+	}
+	return encodeSimpleString("OK")
+}
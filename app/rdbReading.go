@@ -2,72 +2,980 @@ package main
 
 import (
 	"bufio"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
+	"math"
 	"os"
-	"slices"
 	"strconv"
 	"time"
 )
 
-func readEncodedInt(reader *bufio.Reader) (int, error) {
-	mask := byte(0b11000000)
-	b0, err := reader.ReadByte()
+// every RDB value type the loader understands, older encodings included
+const (
+	rdbTypeZset             = 3
+	rdbTypeHash             = 4
+	rdbTypeModulePreGA      = 6
+	rdbTypeModule2          = 7
+	rdbTypeHashZipmap       = 9
+	rdbTypeListZiplist      = 10
+	rdbTypeSetIntset        = 11
+	rdbTypeZsetZiplist      = 12
+	rdbTypeHashZiplist      = 13
+	rdbTypeListQuicklist    = 14
+	rdbTypeStreamListpacks  = 15
+	rdbTypeHashListpack     = 16
+	rdbTypeZsetListpack     = 17
+	rdbTypeListQuicklist2   = 18
+	rdbTypeStreamListpacks2 = 19
+	rdbTypeSetListpack      = 20
+)
+
+const (
+	rdbOpcodeSlotInfo      = 0xF4
+	rdbOpcodeFunction2     = 0xF5
+	rdbOpcodeFunctionPreGA = 0xF6
+	rdbOpcodeModuleAux     = 0xF7
+	rdbOpcodeIdle          = 0xF8
+	rdbOpcodeFreq          = 0xF9
+)
+
+// special string encodings, flagged by the top two bits of the length byte being 11
+const (
+	rdbEncInt8  = 0
+	rdbEncInt16 = 1
+	rdbEncInt32 = 2
+	rdbEncLZF   = 3
+)
+
+// module values are stored as a sequence of typed opcodes ending with EOF
+const (
+	rdbModuleOpcodeEOF    = 0
+	rdbModuleOpcodeSint   = 1
+	rdbModuleOpcodeUint   = 2
+	rdbModuleOpcodeFloat  = 3
+	rdbModuleOpcodeDouble = 4
+	rdbModuleOpcodeString = 5
+)
+
+// quicklist2 node containers
+const (
+	quicklistNodePlain  = 1
+	quicklistNodePacked = 2
+)
+
+// stream entry flags stored in the listpack
+const (
+	streamItemFlagDeleted    = 1
+	streamItemFlagSameFields = 2
+)
+
+var errRDBCorrupt = errors.New("RDB file is corrupted")
+
+// replication position from the aux fields of the last RDB loaded, see rdbReplInfo
+var rdbLoadedReplInfo rdbReplInfo
+
+// rdbReader reads RDB primitives and keeps a running checksum of the bytes consumed
+type rdbReader struct {
+	r   *bufio.Reader
+	crc uint64
+}
+
+func (rr *rdbReader) read(n int) ([]byte, error) {
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(rr.r, buf); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	rr.crc = crc64Jones(rr.crc, buf)
+	return buf, nil
+}
+
+func (rr *rdbReader) readByte() (byte, error) {
+	b, err := rr.read(1)
 	if err != nil {
 		return 0, err
 	}
-	if b0&mask == 0b00000000 {
-		return int(b0), nil
-	} else if b0&mask == 0b01000000 {
-		b1, err := reader.ReadByte()
+	return b[0], nil
+}
+
+// readLength returns a length, or with encoded set, which special string encoding follows
+func (rr *rdbReader) readLength() (length uint64, encoded bool, err error) {
+	b0, err := rr.readByte()
+	if err != nil {
+		return 0, false, err
+	}
+	switch b0 >> 6 {
+	case 0:
+		return uint64(b0 & 0x3F), false, nil
+	case 1:
+		b1, err := rr.readByte()
 		if err != nil {
-			return 0, err
+			return 0, false, err
+		}
+		return uint64(b0&0x3F)<<8 | uint64(b1), false, nil
+	case 2:
+		switch b0 {
+		case 0x80:
+			buf, err := rr.read(4)
+			if err != nil {
+				return 0, false, err
+			}
+			return uint64(binary.BigEndian.Uint32(buf)), false, nil
+		case 0x81:
+			buf, err := rr.read(8)
+			if err != nil {
+				return 0, false, err
+			}
+			return binary.BigEndian.Uint64(buf), false, nil
 		}
-		return int(b1)<<6 | int(b0&mask), nil
-	} else if b0&mask == 0b10000000 {
-		b1, _ := reader.ReadByte()
-		b2, _ := reader.ReadByte()
-		b3, _ := reader.ReadByte()
-		b4, err := reader.ReadByte()
+		return 0, false, fmt.Errorf("%w: unknown length encoding 0x%02x", errRDBCorrupt, b0)
+	default:
+		return uint64(b0 & 0x3F), true, nil
+	}
+}
+
+func (rr *rdbReader) readLen() (int, error) {
+	length, encoded, err := rr.readLength()
+	if err != nil {
+		return 0, err
+	}
+	if encoded || length > math.MaxInt32 {
+		return 0, fmt.Errorf("%w: invalid length", errRDBCorrupt)
+	}
+	return int(length), nil
+}
+
+func (rr *rdbReader) readString() (string, error) {
+	length, encoded, err := rr.readLength()
+	if err != nil {
+		return "", err
+	}
+	if !encoded {
+		if length > math.MaxInt32 {
+			return "", fmt.Errorf("%w: string too long", errRDBCorrupt)
+		}
+		buf, err := rr.read(int(length))
+		return string(buf), err
+	}
+
+	switch length {
+	case rdbEncInt8:
+		b, err := rr.readByte()
+		return strconv.Itoa(int(int8(b))), err
+	case rdbEncInt16:
+		buf, err := rr.read(2)
 		if err != nil {
-			return 0, err
+			return "", err
 		}
-		
-		return int(b1)<<24 | int(b2)<<16 | int(b3)<<8 | int(b4), nil
-	} else if b0 >= 0b11000000 && b0 <= 0b11000010 { // Special format: Integers as String
-		var b1, b2, b3, b4 byte
-		b1, err = reader.ReadByte()
-		if b0 >= 0b11000001 {
-			b2, err = reader.ReadByte()
+		return strconv.Itoa(int(int16(binary.LittleEndian.Uint16(buf)))), nil
+	case rdbEncInt32:
+		buf, err := rr.read(4)
+		if err != nil {
+			return "", err
 		}
-		if b0 == 0b11000010 {
-			b3, _ = reader.ReadByte()
-			b4, err = reader.ReadByte()
+		return strconv.Itoa(int(int32(binary.LittleEndian.Uint32(buf)))), nil
+	case rdbEncLZF:
+		compressedLen, err := rr.readLen()
+		if err != nil {
+			return "", err
 		}
+		uncompressedLen, err := rr.readLen()
 		if err != nil {
-			return 0, err
+			return "", err
 		}
-		return int(b1) | int(b2)<<8 | int(b3)<<16 | int(b4)<<24, nil
-	} else {
-		return 0, errors.New("not implemented")
+		compressed, err := rr.read(compressedLen)
+		if err != nil {
+			return "", err
+		}
+		data, err := lzfDecompress(compressed, uncompressedLen)
+		return string(data), err
 	}
+	return "", fmt.Errorf("%w: unknown string encoding %d", errRDBCorrupt, length)
 }
 
-func readEncodedString(reader *bufio.Reader) (string, error) {
-	size, err := readEncodedInt(reader)
+func (rr *rdbReader) readMillis() (time.Time, error) {
+	buf, err := rr.read(8)
 	if err != nil {
-		return "", err
+		return time.Time{}, err
 	}
-	data := make([]byte, size)
-	actual, err := reader.Read(data)
+	return time.UnixMilli(int64(binary.LittleEndian.Uint64(buf))), nil
+}
+
+func (rr *rdbReader) readBinaryDouble() (float64, error) {
+	buf, err := rr.read(8)
 	if err != nil {
-		return "", err
+		return 0, err
+	}
+	return math.Float64frombits(binary.LittleEndian.Uint64(buf)), nil
+}
+
+// readStringDouble reads the old text score format, a length byte where 253,
+// 254 and 255 stand for nan, inf and -inf
+func (rr *rdbReader) readStringDouble() (float64, error) {
+	length, err := rr.readByte()
+	if err != nil {
+		return 0, err
+	}
+	switch length {
+	case 253:
+		return math.NaN(), nil
+	case 254:
+		return math.Inf(1), nil
+	case 255:
+		return math.Inf(-1), nil
+	}
+	buf, err := rr.read(int(length))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseFloat(string(buf), 64)
+}
+
+// lzfDecompress expands the LZF format used for compressed RDB strings
+func lzfDecompress(in []byte, outLen int) ([]byte, error) {
+	out := make([]byte, 0, outLen)
+	for i := 0; i < len(in); {
+		ctrl := int(in[i])
+		i++
+		if ctrl < 32 {
+			// literal run of ctrl+1 bytes
+			run := ctrl + 1
+			if i+run > len(in) {
+				return nil, fmt.Errorf("%w: invalid LZF data", errRDBCorrupt)
+			}
+			out = append(out, in[i:i+run]...)
+			i += run
+			continue
+		}
+
+		// back reference
+		length := ctrl >> 5
+		if length == 7 {
+			if i >= len(in) {
+				return nil, fmt.Errorf("%w: invalid LZF data", errRDBCorrupt)
+			}
+			length += int(in[i])
+			i++
+		}
+		if i >= len(in) {
+			return nil, fmt.Errorf("%w: invalid LZF data", errRDBCorrupt)
+		}
+		ref := len(out) - ((ctrl & 0x1F) << 8) - int(in[i]) - 1
+		i++
+		if ref < 0 {
+			return nil, fmt.Errorf("%w: invalid LZF data", errRDBCorrupt)
+		}
+		// the reference may overlap the bytes being written so copy one at a time
+		for j := 0; j < length+2; j++ {
+			out = append(out, out[ref+j])
+		}
+	}
+	if len(out) != outLen {
+		return nil, fmt.Errorf("%w: LZF length mismatch", errRDBCorrupt)
+	}
+	return out, nil
+}
+
+// parseZiplist returns every entry of a ziplist as a string, integers included
+func parseZiplist(data []byte) ([]string, error) {
+	if len(data) < 11 {
+		return nil, fmt.Errorf("%w: ziplist too short", errRDBCorrupt)
+	}
+	entries := []string{}
+	pos := 10
+	for {
+		if pos >= len(data) {
+			return nil, fmt.Errorf("%w: ziplist missing terminator", errRDBCorrupt)
+		}
+		if data[pos] == 0xFF {
+			return entries, nil
+		}
+		// previous entry length, one byte or 0xFE followed by four
+		if data[pos] == 0xFE {
+			pos += 5
+		} else {
+			pos++
+		}
+		if pos >= len(data) {
+			return nil, fmt.Errorf("%w: ziplist entry out of range", errRDBCorrupt)
+		}
+
+		enc := data[pos]
+		var strLen, headerLen int
+		switch enc >> 6 {
+		case 0:
+			strLen, headerLen = int(enc&0x3F), 1
+		case 1:
+			if pos+1 >= len(data) {
+				return nil, fmt.Errorf("%w: ziplist entry out of range", errRDBCorrupt)
+			}
+			strLen, headerLen = int(enc&0x3F)<<8|int(data[pos+1]), 2
+		case 2:
+			if pos+4 >= len(data) {
+				return nil, fmt.Errorf("%w: ziplist entry out of range", errRDBCorrupt)
+			}
+			strLen, headerLen = int(binary.BigEndian.Uint32(data[pos+1:])), 5
+		default:
+			value, size, err := ziplistInt(data[pos:])
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, strconv.FormatInt(value, 10))
+			pos += size
+			continue
+		}
+
+		start := pos + headerLen
+		if strLen < 0 || start+strLen > len(data) {
+			return nil, fmt.Errorf("%w: ziplist entry out of range", errRDBCorrupt)
+		}
+		entries = append(entries, string(data[start:start+strLen]))
+		pos = start + strLen
+	}
+}
+
+// ziplistInt decodes an integer entry and returns it with its encoded size
+func ziplistInt(data []byte) (int64, int, error) {
+	need := map[byte]int{0xC0: 3, 0xD0: 5, 0xE0: 9, 0xF0: 4, 0xFE: 2}
+	enc := data[0]
+	if size, ok := need[enc]; ok && size > len(data) {
+		return 0, 0, fmt.Errorf("%w: ziplist entry out of range", errRDBCorrupt)
+	}
+	switch {
+	case enc == 0xC0:
+		return int64(int16(binary.LittleEndian.Uint16(data[1:]))), 3, nil
+	case enc == 0xD0:
+		return int64(int32(binary.LittleEndian.Uint32(data[1:]))), 5, nil
+	case enc == 0xE0:
+		return int64(binary.LittleEndian.Uint64(data[1:])), 9, nil
+	case enc == 0xF0:
+		v := int32(uint32(data[1])<<8|uint32(data[2])<<16|uint32(data[3])<<24) >> 8
+		return int64(v), 4, nil
+	case enc == 0xFE:
+		return int64(int8(data[1])), 2, nil
+	case enc >= 0xF1 && enc <= 0xFD:
+		return int64(enc&0x0F) - 1, 1, nil
+	}
+	return 0, 0, fmt.Errorf("%w: unknown ziplist encoding 0x%02x", errRDBCorrupt, enc)
+}
+
+// parseListpack returns every element of a listpack as a string, integers included
+func parseListpack(data []byte) ([]string, error) {
+	if len(data) < 7 {
+		return nil, fmt.Errorf("%w: listpack too short", errRDBCorrupt)
 	}
-	if int(size) != actual {
-		return "", errors.New("unexpected string length")
+	entries := []string{}
+	pos := 6
+	for {
+		if pos >= len(data) {
+			return nil, fmt.Errorf("%w: listpack missing terminator", errRDBCorrupt)
+		}
+		enc := data[pos]
+		if enc == 0xFF {
+			return entries, nil
+		}
+
+		var value string
+		var size int
+		fits := func(n int) bool { return pos+n <= len(data) }
+		switch {
+		case enc&0x80 == 0:
+			value, size = strconv.Itoa(int(enc)), 1
+		case enc&0xC0 == 0x80:
+			size = 1 + int(enc&0x3F)
+			if !fits(size) {
+				return nil, fmt.Errorf("%w: listpack entry out of range", errRDBCorrupt)
+			}
+			value = string(data[pos+1 : pos+size])
+		case enc&0xE0 == 0xC0:
+			if !fits(2) {
+				return nil, fmt.Errorf("%w: listpack entry out of range", errRDBCorrupt)
+			}
+			v := int(enc&0x1F)<<8 | int(data[pos+1])
+			if v >= 1<<12 {
+				v -= 1 << 13
+			}
+			value, size = strconv.Itoa(v), 2
+		case enc&0xF0 == 0xE0:
+			if !fits(2) {
+				return nil, fmt.Errorf("%w: listpack entry out of range", errRDBCorrupt)
+			}
+			size = 2 + (int(enc&0x0F)<<8 | int(data[pos+1]))
+			if !fits(size) {
+				return nil, fmt.Errorf("%w: listpack entry out of range", errRDBCorrupt)
+			}
+			value = string(data[pos+2 : pos+size])
+		case enc == 0xF0:
+			if !fits(5) {
+				return nil, fmt.Errorf("%w: listpack entry out of range", errRDBCorrupt)
+			}
+			size = 5 + int(binary.LittleEndian.Uint32(data[pos+1:]))
+			if size < 5 || !fits(size) {
+				return nil, fmt.Errorf("%w: listpack entry out of range", errRDBCorrupt)
+			}
+			value = string(data[pos+5 : pos+size])
+		case enc >= 0xF1 && enc <= 0xF4:
+			size = map[byte]int{0xF1: 3, 0xF2: 4, 0xF3: 5, 0xF4: 9}[enc]
+			if !fits(size) {
+				return nil, fmt.Errorf("%w: listpack entry out of range", errRDBCorrupt)
+			}
+			var v int64
+			switch enc {
+			case 0xF1:
+				v = int64(int16(binary.LittleEndian.Uint16(data[pos+1:])))
+			case 0xF2:
+				v = int64(int32(uint32(data[pos+1])<<8|uint32(data[pos+2])<<16|uint32(data[pos+3])<<24) >> 8)
+			case 0xF3:
+				v = int64(int32(binary.LittleEndian.Uint32(data[pos+1:])))
+			case 0xF4:
+				v = int64(binary.LittleEndian.Uint64(data[pos+1:]))
+			}
+			value = strconv.FormatInt(v, 10)
+		default:
+			return nil, fmt.Errorf("%w: unknown listpack encoding 0x%02x", errRDBCorrupt, enc)
+		}
+
+		entries = append(entries, value)
+		pos += size + len(listpackBacklen(size))
+	}
+}
+
+// parseIntset returns the members of an intset, little endian integers of 2, 4 or 8 bytes
+func parseIntset(data []byte) ([]string, error) {
+	if len(data) < 8 {
+		return nil, fmt.Errorf("%w: intset too short", errRDBCorrupt)
+	}
+	width := int(binary.LittleEndian.Uint32(data))
+	count := int(binary.LittleEndian.Uint32(data[4:]))
+	if (width != 2 && width != 4 && width != 8) || 8+width*count != len(data) {
+		return nil, fmt.Errorf("%w: invalid intset", errRDBCorrupt)
+	}
+	members := make([]string, 0, count)
+	for i := 0; i < count; i++ {
+		item := data[8+i*width:]
+		var v int64
+		switch width {
+		case 2:
+			v = int64(int16(binary.LittleEndian.Uint16(item)))
+		case 4:
+			v = int64(int32(binary.LittleEndian.Uint32(item)))
+		case 8:
+			v = int64(binary.LittleEndian.Uint64(item))
+		}
+		members = append(members, strconv.FormatInt(v, 10))
+	}
+	return members, nil
+}
+
+// parseZipmap returns the alternating fields and values of the pre 2.6 hash encoding
+func parseZipmap(data []byte) ([]string, error) {
+	entries := []string{}
+	pos := 1 // skip the entry count, it is only a hint
+	readLen := func() (int, error) {
+		if pos >= len(data) {
+			return 0, fmt.Errorf("%w: zipmap entry out of range", errRDBCorrupt)
+		}
+		b := data[pos]
+		if b < 254 {
+			pos++
+			return int(b), nil
+		}
+		if b == 254 && pos+5 <= len(data) {
+			n := int(binary.LittleEndian.Uint32(data[pos+1:]))
+			pos += 5
+			return n, nil
+		}
+		return 0, fmt.Errorf("%w: invalid zipmap length", errRDBCorrupt)
+	}
+
+	for {
+		if pos >= len(data) {
+			return nil, fmt.Errorf("%w: zipmap missing terminator", errRDBCorrupt)
+		}
+		if data[pos] == 0xFF {
+			return entries, nil
+		}
+		keyLen, err := readLen()
+		if err != nil {
+			return nil, err
+		}
+		if pos+keyLen > len(data) {
+			return nil, fmt.Errorf("%w: zipmap entry out of range", errRDBCorrupt)
+		}
+		key := string(data[pos : pos+keyLen])
+		pos += keyLen
+
+		valueLen, err := readLen()
+		if err != nil {
+			return nil, err
+		}
+		if pos >= len(data) {
+			return nil, fmt.Errorf("%w: zipmap entry out of range", errRDBCorrupt)
+		}
+		free := int(data[pos])
+		pos++
+		if pos+valueLen+free > len(data) {
+			return nil, fmt.Errorf("%w: zipmap entry out of range", errRDBCorrupt)
+		}
+		entries = append(entries, key, string(data[pos:pos+valueLen]))
+		pos += valueLen + free
+	}
+}
+
+// readPackedBlob reads a string holding a ziplist, listpack or intset
+func (rr *rdbReader) readPackedBlob(parse func([]byte) ([]string, error)) ([]string, error) {
+	blob, err := rr.readString()
+	if err != nil {
+		return nil, err
+	}
+	return parse([]byte(blob))
+}
+
+func (rr *rdbReader) readStrings(n int) ([]string, error) {
+	items := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		item, err := rr.readString()
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+func newSetValue(members []string) RedisValue {
+	set := make(map[string]struct{}, len(members))
+	for _, member := range members {
+		set[member] = struct{}{}
+	}
+	return RedisValue{value: set}
+}
+
+func newHashValue(pairs []string) (RedisValue, error) {
+	if len(pairs)%2 != 0 {
+		return RedisValue{}, fmt.Errorf("%w: odd number of hash elements", errRDBCorrupt)
+	}
+	hash := make(map[string]string, len(pairs)/2)
+	for i := 0; i < len(pairs); i += 2 {
+		hash[pairs[i]] = pairs[i+1]
+	}
+	return RedisValue{value: hash}, nil
+}
+
+func newSortedSetValue(entries []SortedSetEntry) RedisValue {
+	sortedSet := SortedSet{Entries: make(map[string]float64, len(entries))}
+	for _, entry := range entries {
+		sortedSet.Entries[entry.Member] = entry.Score
+	}
+	for member, score := range sortedSet.Entries {
+		sortedSet.Sorted = append(sortedSet.Sorted, SortedSetEntry{Member: member, Score: score})
+	}
+	sortSortedSet(&sortedSet)
+	return RedisValue{value: sortedSet}
+}
+
+// sortedSetFromPairs converts alternating member/score strings from a ziplist or listpack
+func sortedSetFromPairs(pairs []string) (RedisValue, error) {
+	if len(pairs)%2 != 0 {
+		return RedisValue{}, fmt.Errorf("%w: odd number of sorted set elements", errRDBCorrupt)
+	}
+	entries := make([]SortedSetEntry, 0, len(pairs)/2)
+	for i := 0; i < len(pairs); i += 2 {
+		score, err := strconv.ParseFloat(pairs[i+1], 64)
+		if err != nil {
+			return RedisValue{}, fmt.Errorf("%w: invalid sorted set score", errRDBCorrupt)
+		}
+		entries = append(entries, SortedSetEntry{Member: pairs[i], Score: score})
+	}
+	return newSortedSetValue(entries), nil
+}
+
+// readObject reads the value that follows a key for the given RDB type
+func (rr *rdbReader) readObject(valueType byte) (RedisValue, error) {
+	switch valueType {
+	case rdbTypeString:
+		s, err := rr.readString()
+		return RedisValue{value: s}, err
+
+	case rdbTypeList, rdbTypeSet:
+		n, err := rr.readLen()
+		if err != nil {
+			return RedisValue{}, err
+		}
+		items, err := rr.readStrings(n)
+		if err != nil {
+			return RedisValue{}, err
+		}
+		if valueType == rdbTypeSet {
+			return newSetValue(items), nil
+		}
+		return RedisValue{value: items}, nil
+
+	case rdbTypeZset, rdbTypeZset2:
+		n, err := rr.readLen()
+		if err != nil {
+			return RedisValue{}, err
+		}
+		entries := make([]SortedSetEntry, 0, n)
+		for i := 0; i < n; i++ {
+			member, err := rr.readString()
+			if err != nil {
+				return RedisValue{}, err
+			}
+			var score float64
+			if valueType == rdbTypeZset2 {
+				score, err = rr.readBinaryDouble()
+			} else {
+				score, err = rr.readStringDouble()
+			}
+			if err != nil {
+				return RedisValue{}, err
+			}
+			entries = append(entries, SortedSetEntry{Member: member, Score: score})
+		}
+		return newSortedSetValue(entries), nil
+
+	case rdbTypeHash:
+		n, err := rr.readLen()
+		if err != nil {
+			return RedisValue{}, err
+		}
+		pairs, err := rr.readStrings(n * 2)
+		if err != nil {
+			return RedisValue{}, err
+		}
+		return newHashValue(pairs)
+
+	case rdbTypeHashZipmap, rdbTypeHashZiplist, rdbTypeHashListpack:
+		parse := map[byte]func([]byte) ([]string, error){
+			rdbTypeHashZipmap:   parseZipmap,
+			rdbTypeHashZiplist:  parseZiplist,
+			rdbTypeHashListpack: parseListpack,
+		}[valueType]
+		pairs, err := rr.readPackedBlob(parse)
+		if err != nil {
+			return RedisValue{}, err
+		}
+		return newHashValue(pairs)
+
+	case rdbTypeListZiplist:
+		items, err := rr.readPackedBlob(parseZiplist)
+		return RedisValue{value: items}, err
+
+	case rdbTypeSetIntset, rdbTypeSetListpack:
+		parse := parseIntset
+		if valueType == rdbTypeSetListpack {
+			parse = parseListpack
+		}
+		members, err := rr.readPackedBlob(parse)
+		if err != nil {
+			return RedisValue{}, err
+		}
+		return newSetValue(members), nil
+
+	case rdbTypeZsetZiplist, rdbTypeZsetListpack:
+		parse := parseZiplist
+		if valueType == rdbTypeZsetListpack {
+			parse = parseListpack
+		}
+		pairs, err := rr.readPackedBlob(parse)
+		if err != nil {
+			return RedisValue{}, err
+		}
+		return sortedSetFromPairs(pairs)
+
+	case rdbTypeListQuicklist, rdbTypeListQuicklist2:
+		return rr.readQuicklist(valueType)
+
+	case rdbTypeStreamListpacks, rdbTypeStreamListpacks2, rdbTypeStreamListpacks3:
+		return rr.readStream(valueType)
+
+	case rdbTypeModulePreGA, rdbTypeModule2:
+		return RedisValue{}, fmt.Errorf("module data types are not supported")
+	}
+	return RedisValue{}, fmt.Errorf("%w: unknown value type %d", errRDBCorrupt, valueType)
+}
+
+// readQuicklist reads a list stored as a series of ziplist (v1) or listpack/plain (v2) nodes
+func (rr *rdbReader) readQuicklist(valueType byte) (RedisValue, error) {
+	nodes, err := rr.readLen()
+	if err != nil {
+		return RedisValue{}, err
+	}
+	items := []string{}
+	for i := 0; i < nodes; i++ {
+		container := quicklistNodePacked
+		if valueType == rdbTypeListQuicklist2 {
+			if container, err = rr.readLen(); err != nil {
+				return RedisValue{}, err
+			}
+		}
+		if container == quicklistNodePlain {
+			item, err := rr.readString()
+			if err != nil {
+				return RedisValue{}, err
+			}
+			items = append(items, item)
+			continue
+		}
+
+		parse := parseListpack
+		if valueType == rdbTypeListQuicklist {
+			parse = parseZiplist
+		}
+		nodeItems, err := rr.readPackedBlob(parse)
+		if err != nil {
+			return RedisValue{}, err
+		}
+		items = append(items, nodeItems...)
+	}
+	return RedisValue{value: items}, nil
+}
+
+// readStream reads the listpack nodes of a stream followed by its metadata
+// and consumer groups, which are parsed but dropped as groups aren't supported
+func (rr *rdbReader) readStream(valueType byte) (RedisValue, error) {
+	nodes, err := rr.readLen()
+	if err != nil {
+		return RedisValue{}, err
+	}
+
+	stream := RedisStream{}
+	for i := 0; i < nodes; i++ {
+		nodeKey, err := rr.readString()
+		if err != nil {
+			return RedisValue{}, err
+		}
+		if len(nodeKey) != 16 {
+			return RedisValue{}, fmt.Errorf("%w: invalid stream node key", errRDBCorrupt)
+		}
+		masterMs := binary.BigEndian.Uint64([]byte(nodeKey[:8]))
+		masterSeq := binary.BigEndian.Uint64([]byte(nodeKey[8:]))
+
+		items, err := rr.readPackedBlob(parseListpack)
+		if err != nil {
+			return RedisValue{}, err
+		}
+		entries, err := parseStreamListpack(items, masterMs, masterSeq)
+		if err != nil {
+			return RedisValue{}, err
+		}
+		stream.Entries = append(stream.Entries, entries...)
+	}
+
+	// length and last id, then first id, max deleted id and entries added from v2
+	metadata := 3
+	if valueType >= rdbTypeStreamListpacks2 {
+		metadata += 5
+	}
+	for i := 0; i < metadata; i++ {
+		if _, _, err := rr.readLength(); err != nil {
+			return RedisValue{}, err
+		}
+	}
+
+	groups, err := rr.readLen()
+	if err != nil {
+		return RedisValue{}, err
+	}
+	if groups > 0 {
+		fmt.Printf("Skipping %d stream consumer groups, consumer groups are not supported\n", groups)
+	}
+	for i := 0; i < groups; i++ {
+		if err := rr.skipConsumerGroup(valueType); err != nil {
+			return RedisValue{}, err
+		}
+	}
+	return RedisValue{value: stream}, nil
+}
+
+func (rr *rdbReader) skipConsumerGroup(valueType byte) error {
+	if _, err := rr.readString(); err != nil { // group name
+		return err
+	}
+	fields := 2 // last delivered id
+	if valueType >= rdbTypeStreamListpacks2 {
+		fields++ // entries read
+	}
+	for i := 0; i < fields; i++ {
+		if _, _, err := rr.readLength(); err != nil {
+			return err
+		}
+	}
+
+	pending, err := rr.readLen()
+	if err != nil {
+		return err
+	}
+	for i := 0; i < pending; i++ {
+		// raw id, delivery time and delivery count
+		if _, err := rr.read(16 + 8); err != nil {
+			return err
+		}
+		if _, _, err := rr.readLength(); err != nil {
+			return err
+		}
+	}
+
+	consumers, err := rr.readLen()
+	if err != nil {
+		return err
+	}
+	for i := 0; i < consumers; i++ {
+		if _, err := rr.readString(); err != nil {
+			return err
+		}
+		times := 8 // seen time
+		if valueType >= rdbTypeStreamListpacks3 {
+			times += 8 // active time
+		}
+		if _, err := rr.read(times); err != nil {
+			return err
+		}
+		owned, err := rr.readLen()
+		if err != nil {
+			return err
+		}
+		if _, err := rr.read(16 * owned); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseStreamListpack decodes one stream node. The node starts with a master
+// entry (count, deleted, master fields, 0) and each entry after it is flags,
+// the ID as a delta from the node key, its fields and values (just the values
+// when it has the master's fields) and a trailing element count.
+func parseStreamListpack(items []string, masterMs, masterSeq uint64) ([]StreamEntry, error) {
+	pos := 0
+	next := func() (string, error) {
+		if pos >= len(items) {
+			return "", fmt.Errorf("%w: truncated stream node", errRDBCorrupt)
+		}
+		pos++
+		return items[pos-1], nil
+	}
+	nextInt := func() (int64, error) {
+		s, err := next()
+		if err != nil {
+			return 0, err
+		}
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("%w: invalid stream node", errRDBCorrupt)
+		}
+		return n, nil
+	}
+
+	count, err := nextInt()
+	if err != nil {
+		return nil, err
+	}
+	deleted, err := nextInt()
+	if err != nil {
+		return nil, err
+	}
+	masterFieldCount, err := nextInt()
+	if err != nil {
+		return nil, err
+	}
+	masterFields := []string{}
+	for i := int64(0); i < masterFieldCount; i++ {
+		field, err := next()
+		if err != nil {
+			return nil, err
+		}
+		masterFields = append(masterFields, field)
+	}
+	if _, err := next(); err != nil { // master entry terminator
+		return nil, err
+	}
+
+	entries := []StreamEntry{}
+	for i := int64(0); i < count+deleted; i++ {
+		flags, err := nextInt()
+		if err != nil {
+			return nil, err
+		}
+		msDelta, err := nextInt()
+		if err != nil {
+			return nil, err
+		}
+		seqDelta, err := nextInt()
+		if err != nil {
+			return nil, err
+		}
+
+		entry := StreamEntry{
+			ID:     fmt.Sprintf("%d-%d", masterMs+uint64(msDelta), masterSeq+uint64(seqDelta)),
+			Fields: make(map[string]string),
+		}
+		if flags&streamItemFlagSameFields != 0 {
+			for _, field := range masterFields {
+				value, err := next()
+				if err != nil {
+					return nil, err
+				}
+				entry.Fields[field] = value
+			}
+		} else {
+			fieldCount, err := nextInt()
+			if err != nil {
+				return nil, err
+			}
+			for j := int64(0); j < fieldCount; j++ {
+				field, err := next()
+				if err != nil {
+					return nil, err
+				}
+				value, err := next()
+				if err != nil {
+					return nil, err
+				}
+				entry.Fields[field] = value
+			}
+		}
+
+		if _, err := next(); err != nil { // lp-count
+			return nil, err
+		}
+		if flags&streamItemFlagDeleted == 0 {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
+
+// skipModuleValue walks the opcodes of a module value without interpreting them
+func (rr *rdbReader) skipModuleValue() error {
+	for {
+		opcode, _, err := rr.readLength()
+		if err != nil {
+			return err
+		}
+		switch opcode {
+		case rdbModuleOpcodeEOF:
+			return nil
+		case rdbModuleOpcodeSint, rdbModuleOpcodeUint:
+			_, _, err = rr.readLength()
+		case rdbModuleOpcodeFloat:
+			_, err = rr.read(4)
+		case rdbModuleOpcodeDouble:
+			_, err = rr.read(8)
+		case rdbModuleOpcodeString:
+			_, err = rr.readString()
+		default:
+			return fmt.Errorf("%w: unknown module opcode %d", errRDBCorrupt, opcode)
+		}
+		if err != nil {
+			return err
+		}
 	}
-	return string(data), nil
 }
 
 func readRDB(rdbPath string) error {
@@ -76,118 +984,186 @@ func readRDB(rdbPath string) error {
 		return err
 	}
 	defer file.Close()
+	return loadRDB(bufio.NewReader(file))
+}
 
-	reader := bufio.NewReader(file)
+// loadRDB reads an RDB into the keyspace, stopping after the checksum so an
+// AOF with an RDB preamble can carry on reading commands from the same reader.
+// Only database 0 is loaded as the server has a single keyspace.
+func loadRDB(reader *bufio.Reader) error {
+	dataset := &rdbDataset{store: store, ttl: ttl}
+	err := dataset.load(reader)
+	rdbLoadedReplInfo = dataset.replInfo
+	return err
+}
+
+// rdbDataset is what an RDB is loaded into, the keyspace itself or maps of
+// its own that a replica swaps in once a whole transfer loaded
+type rdbDataset struct {
+	store    map[string]RedisValue
+	ttl      map[string]time.Time
+	replInfo rdbReplInfo
+}
+
+func newRdbDataset() *rdbDataset {
+	return &rdbDataset{store: make(map[string]RedisValue), ttl: make(map[string]time.Time)}
+}
+
+func (d *rdbDataset) load(reader *bufio.Reader) error {
+	rr := &rdbReader{r: reader}
 
-	header := make([]byte, 9)
-	reader.Read(header)
-	if slices.Compare(header[:5], []byte("REDIS")) != 0 {
+	header, err := rr.read(9)
+	if err != nil || string(header[:5]) != "REDIS" {
 		return errors.New("not a RDB file")
 	}
-
-	version, _ := strconv.Atoi(string(header[5:]))
+	version, err := strconv.Atoi(string(header[5:]))
+	if err != nil || version < 1 || version > 12 {
+		return fmt.Errorf("can't handle RDB format version %s", header[5:])
+	}
 	fmt.Printf("File version: %d\n", version)
 
-	for eof := false; !eof; {
-
-		startDataRead := false
-		opCode, err := reader.ReadByte()
+	db := 0
+	loaded, expired, skipped := 0, 0, 0
+	d.replInfo = rdbReplInfo{}
+	var expireAt time.Time
+	now := time.Now()
 
+	for {
+		opCode, err := rr.readByte()
 		if err != nil {
-			if err == io.EOF {
-				break
-			}
 			return err
 		}
 
-		// TODO: handle errors properly
 		switch opCode {
-		case 0xFA: // Auxiliary fields
-			key, _ := readEncodedString(reader)
+		case rdbOpcodeAux:
+			key, err := rr.readString()
+			if err != nil {
+				return err
+			}
+			value, err := rr.readString()
+			if err != nil {
+				return err
+			}
+			fmt.Printf("Aux: %s = %v\n", key, value)
 			switch key {
-			case "redis-ver":
-				value, _ := readEncodedString(reader)
-				fmt.Printf("Aux: %s = %v\n", key, value)
-			case "redis-bits":
-				bits, _ := readEncodedInt(reader)
-				fmt.Printf("Aux: %s = %v\n", key, bits)
-			case "ctime":
-				ctime, _ := readEncodedInt(reader)
-				fmt.Printf("Aux: %s = %v\n", key, ctime)
-			case "used-mem":
-				usedmem, _ := readEncodedInt(reader)
-				fmt.Printf("Aux: %s = %v\n", key, usedmem)
-			case "aof-preamble":
-				size, _ := readEncodedInt(reader)
-				// preamble := make([]byte, size)
-				// reader.Read(preamble)
-				fmt.Printf("Aux: %s = %d\n", key, size)
-			default:
-				fmt.Printf("Unknown auxiliary field: %q\n", key)
+			case "repl-id":
+				d.replInfo.replid = value
+			case "repl-offset":
+				d.replInfo.offset, _ = strconv.Atoi(value)
 			}
 
-		case 0xFB: // Hash table sizes for the main keyspace and expires
-			keyspace, _ := readEncodedInt(reader)
-			expires, _ := readEncodedInt(reader)
+		case rdbOpcodeResizeDB:
+			keyspace, _, err := rr.readLength()
+			if err != nil {
+				return err
+			}
+			expires, _, err := rr.readLength()
+			if err != nil {
+				return err
+			}
 			fmt.Printf("Hash table sizes: keyspace = %d, expires = %d\n", keyspace, expires)
-			startDataRead = true
 
-		case 0xFE: // Database Selector
-			db, _ := readEncodedInt(reader)
+		case rdbOpcodeSelectDB:
+			if db, err = rr.readLen(); err != nil {
+				return err
+			}
 			fmt.Printf("Database Selector = %d\n", db)
 
-		case 0xFF: // End of the RDB file
-			eof = true
-		default:
-			fmt.Printf("Unknown op code: %d\n", opCode)
-		}
+		case rdbOpcodeExpireTime:
+			buf, err := rr.read(4)
+			if err != nil {
+				return err
+			}
+			expireAt = time.Unix(int64(binary.LittleEndian.Uint32(buf)), 0)
 
-		if startDataRead {
-			for {
-				valueType, err := reader.ReadByte()
-				if err != nil {
-					return err
-				}
+		case rdbOpcodeExpireTimeMs:
+			if expireAt, err = rr.readMillis(); err != nil {
+				return err
+			}
 
-				var expiration time.Time
-				if valueType == 0xFD {
-					bytes := make([]byte, 4)
-					reader.Read(bytes)
-					expiration = time.Unix(int64(bytes[0])|int64(bytes[1])<<8|int64(bytes[2])<<16|int64(bytes[3])<<24, 0)
-					valueType, err = reader.ReadByte()
-				} else if valueType == 0xFC {
-					bytes := make([]byte, 8)
-					reader.Read(bytes)
-					expiration = time.UnixMilli(int64(bytes[0]) | int64(bytes[1])<<8 | int64(bytes[2])<<16 | int64(bytes[3])<<24 |
-						int64(bytes[4])<<32 | int64(bytes[5])<<40 | int64(bytes[6])<<48 | int64(bytes[7])<<56)
-					valueType, err = reader.ReadByte()
-				}
+		case rdbOpcodeIdle:
+			if _, _, err := rr.readLength(); err != nil {
+				return err
+			}
 
-				if err != nil {
+		case rdbOpcodeFreq:
+			if _, err := rr.readByte(); err != nil {
+				return err
+			}
+
+		case rdbOpcodeSlotInfo:
+			// slot id, slot size and expires slot size, only used by cluster resizing
+			for i := 0; i < 3; i++ {
+				if _, _, err := rr.readLength(); err != nil {
 					return err
 				}
+			}
 
-				if valueType > 14 {
-					startDataRead = false
-					reader.UnreadByte()
-					break
+		case rdbOpcodeModuleAux:
+			// module id, when opcode and when, then the module's own data
+			for i := 0; i < 3; i++ {
+				if _, _, err := rr.readLength(); err != nil {
+					return err
 				}
+			}
+			if err := rr.skipModuleValue(); err != nil {
+				return err
+			}
+			fmt.Println("Skipped module aux data, modules are not supported")
 
-				key, _ := readEncodedString(reader)
-				value, _ := readEncodedString(reader)
-				fmt.Printf("Reading key/value: %q => %q Expiration: (%v)\n", key, value, expiration)
+		case rdbOpcodeFunction2:
+			if _, err := rr.readString(); err != nil {
+				return err
+			}
+			fmt.Println("Skipped function library, functions are not supported")
 
-				now := time.Now()
+		case rdbOpcodeFunctionPreGA:
+			return errors.New("pre-release function format is not supported")
 
-				if expiration.IsZero() || expiration.After(now) {
-					if expiration.After(now) {
-						ttl[key] = expiration
-					}
-					setGenericValue(key, value)
+		case rdbOpcodeEOF:
+			if version >= 5 {
+				expected := rr.crc
+				footer := make([]byte, 8)
+				if _, err := io.ReadFull(reader, footer); err != nil {
+					return fmt.Errorf("%w: missing checksum", errRDBCorrupt)
+				}
+				checksum := binary.LittleEndian.Uint64(footer)
+				// a zero checksum means the file was written with rdbchecksum no
+				if checksum != 0 && checksum != expected {
+					return fmt.Errorf("%w: wrong RDB checksum expected %016x got %016x", errRDBCorrupt, expected, checksum)
 				}
 			}
+			if skipped > 0 {
+				fmt.Printf("Skipped %d keys from databases other than 0\n", skipped)
+			}
+			fmt.Printf("Loaded %d keys from the RDB, %d expired keys discarded\n", loaded, expired)
+			return nil
+
+		default:
+			key, err := rr.readString()
+			if err != nil {
+				return err
+			}
+			value, err := rr.readObject(opCode)
+			if err != nil {
+				return fmt.Errorf("loading key %q: %w", key, err)
+			}
+
+			keyExpireAt := expireAt
+			expireAt = time.Time{}
+			switch {
+			case db != 0:
+				skipped++
+			case !keyExpireAt.IsZero() && !keyExpireAt.After(now):
+				expired++
+			default:
+				d.store[key] = value
+				delete(d.ttl, key)
+				if !keyExpireAt.IsZero() {
+					d.ttl[key] = keyExpireAt
+				}
+				loaded++
+			}
 		}
 	}
-
-	return nil
-}
\ No newline at end of file
+}
@@ -0,0 +1,590 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash/crc64"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const rdbVersion = 11
+
+// RDB value types written by the encoder
+const (
+	rdbTypeString           = 0
+	rdbTypeList             = 1
+	rdbTypeSet              = 2
+	rdbTypeZset2            = 5
+	rdbTypeStreamListpacks3 = 21
+)
+
+// RDB opcodes
+const (
+	rdbOpcodeAux          = 0xFA
+	rdbOpcodeResizeDB     = 0xFB
+	rdbOpcodeExpireTimeMs = 0xFC
+	rdbOpcodeExpireTime   = 0xFD
+	rdbOpcodeSelectDB     = 0xFE
+	rdbOpcodeEOF          = 0xFF
+)
+
+// the most stream entries put in a single listpack node, same as stream-node-max-entries
+const rdbStreamNodeMaxEntries = 100
+
+// redis uses the Jones polynomial without the initial/final inversion that
+// hash/crc64 applies, so only the table is borrowed from the standard library
+var crc64JonesTable = crc64.MakeTable(0x95ac9329ac4bc9b5)
+
+func crc64Jones(crc uint64, p []byte) uint64 {
+	for _, b := range p {
+		crc = crc64JonesTable[byte(crc)^b] ^ (crc >> 8)
+	}
+	return crc
+}
+
+// rdbWriter keeps the running checksum of everything written so far
+type rdbWriter struct {
+	w   io.Writer
+	crc uint64
+	err error
+}
+
+func (rw *rdbWriter) write(p []byte) {
+	if rw.err != nil {
+		return
+	}
+	rw.crc = crc64Jones(rw.crc, p)
+	_, rw.err = rw.w.Write(p)
+}
+
+func (rw *rdbWriter) writeByte(b byte) {
+	rw.write([]byte{b})
+}
+
+// writeLength uses the 6, 14, 32 or 64 bit length encoding
+func (rw *rdbWriter) writeLength(n uint64) {
+	switch {
+	case n < 1<<6:
+		rw.writeByte(byte(n))
+	case n < 1<<14:
+		rw.write([]byte{byte(n>>8) | 0x40, byte(n)})
+	case n <= math.MaxUint32:
+		buf := []byte{0x80, 0, 0, 0, 0}
+		binary.BigEndian.PutUint32(buf[1:], uint32(n))
+		rw.write(buf)
+	default:
+		buf := []byte{0x81, 0, 0, 0, 0, 0, 0, 0, 0}
+		binary.BigEndian.PutUint64(buf[1:], n)
+		rw.write(buf)
+	}
+}
+
+// writeString stores strings that are canonical 32 bit integers in the
+// compact integer encoding and everything else length prefixed
+func (rw *rdbWriter) writeString(s string) {
+	if n, err := strconv.ParseInt(s, 10, 32); err == nil && strconv.FormatInt(n, 10) == s {
+		switch {
+		case n >= math.MinInt8 && n <= math.MaxInt8:
+			rw.write([]byte{0xC0, byte(n)})
+		case n >= math.MinInt16 && n <= math.MaxInt16:
+			buf := []byte{0xC1, 0, 0}
+			binary.LittleEndian.PutUint16(buf[1:], uint16(n))
+			rw.write(buf)
+		default:
+			buf := []byte{0xC2, 0, 0, 0, 0}
+			binary.LittleEndian.PutUint32(buf[1:], uint32(n))
+			rw.write(buf)
+		}
+		return
+	}
+	rw.writeLength(uint64(len(s)))
+	rw.write([]byte(s))
+}
+
+func (rw *rdbWriter) writeAux(key, value string) {
+	rw.writeByte(rdbOpcodeAux)
+	rw.writeString(key)
+	rw.writeString(value)
+}
+
+// rdbReplInfo is the replication position saved in the RDB aux fields, a
+// replica restarted from the file uses it to ask its master for a partial resync
+type rdbReplInfo struct {
+	replid string
+	offset int
+}
+
+// currentReplInfo must be captured together with the keyspace snapshot
+func currentReplInfo() rdbReplInfo {
+	if config.Role == "slave" {
+		return rdbReplInfo{config.Replid, config.ReplOffset}
+	}
+	return rdbReplInfo{config.Replid, config.MasterReplOffset}
+}
+
+// rdbSource is the keyspace writeRDB serialises, handed out a batch at a time
+// until done. The counts are only the RESIZEDB hint.
+type rdbSource struct {
+	count      int
+	withExpiry int
+	next       func() (batch []snapshotEntry, done bool, err error)
+}
+
+// mapSource hands out maps nothing else changes while they're written, in one batch
+func mapSource(data map[string]RedisValue, expires map[string]time.Time) rdbSource {
+	batch := make([]snapshotEntry, 0, len(data))
+	for key, rv := range data {
+		batch = append(batch, snapshotEntry{key, rv, expires[key]})
+	}
+	return rdbSource{len(data), len(expires), func() ([]snapshotEntry, bool, error) {
+		return batch, true, nil
+	}}
+}
+
+func snapshotSource(s *keyspaceSnapshot) rdbSource {
+	return rdbSource{s.count, s.withExpiry, s.next}
+}
+
+// writeRDB serialises the given keyspace, keys whose expiry has already passed are left out
+func writeRDB(w io.Writer, src rdbSource, info rdbReplInfo) error {
+	rw := &rdbWriter{w: w}
+	rw.write([]byte(fmt.Sprintf("REDIS%04d", rdbVersion)))
+	rw.writeAux("redis-ver", serverVersion)
+	rw.writeAux("redis-bits", strconv.Itoa(strconv.IntSize))
+	rw.writeAux("ctime", strconv.FormatInt(time.Now().Unix(), 10))
+	rw.writeAux("used-mem", "0")
+	rw.writeAux("aof-base", "0")
+	if info.replid != "" {
+		rw.writeAux("repl-stream-db", "0")
+		rw.writeAux("repl-id", info.replid)
+		rw.writeAux("repl-offset", strconv.Itoa(info.offset))
+	}
+
+	rw.writeByte(rdbOpcodeSelectDB)
+	rw.writeLength(0)
+	rw.writeByte(rdbOpcodeResizeDB)
+	rw.writeLength(uint64(src.count))
+	rw.writeLength(uint64(src.withExpiry))
+
+	now := time.Now()
+	for done := false; !done && rw.err == nil; {
+		var batch []snapshotEntry
+		var err error
+		if batch, done, err = src.next(); err != nil {
+			return err
+		}
+		for _, entry := range batch {
+			if !entry.expireAt.IsZero() {
+				if !entry.expireAt.After(now) {
+					continue
+				}
+				buf := make([]byte, 8)
+				binary.LittleEndian.PutUint64(buf, uint64(entry.expireAt.UnixMilli()))
+				rw.writeByte(rdbOpcodeExpireTimeMs)
+				rw.write(buf)
+			}
+			rw.writeKeyValue(entry.key, entry.value)
+		}
+	}
+
+	rw.writeByte(rdbOpcodeEOF)
+	if rw.err != nil {
+		return rw.err
+	}
+	// the checksum itself is not part of the checksum
+	footer := make([]byte, 8)
+	binary.LittleEndian.PutUint64(footer, rw.crc)
+	_, err := w.Write(footer)
+	return err
+}
+
+func (rw *rdbWriter) writeKeyValue(key string, rv RedisValue) {
+	valueType, ok := rdbValueType(rv)
+	if !ok {
+		return
+	}
+	rw.writeByte(valueType)
+	rw.writeString(key)
+	rw.writeValue(rv)
+}
+
+func rdbValueType(rv RedisValue) (byte, bool) {
+	switch rv.value.(type) {
+	case string, int:
+		return rdbTypeString, true
+	case []string:
+		return rdbTypeList, true
+	case map[string]struct{}:
+		return rdbTypeSet, true
+	case map[string]string:
+		return rdbTypeHash, true
+	case SortedSet:
+		return rdbTypeZset2, true
+	case RedisStream:
+		return rdbTypeStreamListpacks3, true
+	}
+	return 0, false
+}
+
+// writeValue writes the value part of a key, the encoding depends on rdbValueType
+func (rw *rdbWriter) writeValue(rv RedisValue) {
+	switch v := rv.value.(type) {
+	case string:
+		rw.writeString(v)
+	case int:
+		rw.writeString(strconv.Itoa(v))
+	case []string:
+		rw.writeLength(uint64(len(v)))
+		for _, item := range v {
+			rw.writeString(item)
+		}
+	case map[string]struct{}:
+		rw.writeLength(uint64(len(v)))
+		for member := range v {
+			rw.writeString(member)
+		}
+	case map[string]string:
+		rw.writeLength(uint64(len(v)))
+		for field, value := range v {
+			rw.writeString(field)
+			rw.writeString(value)
+		}
+	case SortedSet:
+		rw.writeLength(uint64(len(v.Sorted)))
+		// written highest score first, the same order redis saves them in
+		for i := len(v.Sorted) - 1; i >= 0; i-- {
+			buf := make([]byte, 8)
+			binary.LittleEndian.PutUint64(buf, math.Float64bits(v.Sorted[i].Score))
+			rw.writeString(v.Sorted[i].Member)
+			rw.write(buf)
+		}
+	case RedisStream:
+		rw.writeStream(v)
+	}
+}
+
+// writeStream stores the entries as listpack nodes keyed by the ID of their
+// first entry, followed by the stream metadata. Consumer groups are not
+// supported so the group count is always zero.
+func (rw *rdbWriter) writeStream(stream RedisStream) {
+	nodes := (len(stream.Entries) + rdbStreamNodeMaxEntries - 1) / rdbStreamNodeMaxEntries
+	rw.writeLength(uint64(nodes))
+
+	for start := 0; start < len(stream.Entries); start += rdbStreamNodeMaxEntries {
+		entries := stream.Entries[start:min(start+rdbStreamNodeMaxEntries, len(stream.Entries))]
+		masterMs, masterSeq := splitStreamId(entries[0].ID)
+
+		nodeKey := make([]byte, 16)
+		binary.BigEndian.PutUint64(nodeKey, masterMs)
+		binary.BigEndian.PutUint64(nodeKey[8:], masterSeq)
+		rw.writeLength(16)
+		rw.write(nodeKey)
+
+		lp := &listpack{}
+		// master entry: count, deleted, no master fields, terminator
+		lp.appendInt(int64(len(entries)))
+		lp.appendInt(0)
+		lp.appendInt(0)
+		lp.appendInt(0)
+		for _, entry := range entries {
+			ms, seq := splitStreamId(entry.ID)
+			fields := make([]string, 0, len(entry.Fields))
+			for field := range entry.Fields {
+				fields = append(fields, field)
+			}
+			sort.Strings(fields)
+
+			lp.appendInt(0) // flags
+			lp.appendInt(int64(ms - masterMs))
+			lp.appendInt(int64(seq - masterSeq))
+			lp.appendInt(int64(len(fields)))
+			for _, field := range fields {
+				lp.appendString(field)
+				lp.appendString(entry.Fields[field])
+			}
+			lp.appendInt(int64(len(fields)*2 + 4))
+		}
+		blob := lp.bytes()
+		rw.writeLength(uint64(len(blob)))
+		rw.write(blob)
+	}
+
+	var firstMs, firstSeq, lastMs, lastSeq uint64
+	if len(stream.Entries) > 0 {
+		firstMs, firstSeq = splitStreamId(stream.Entries[0].ID)
+		lastMs, lastSeq = splitStreamId(stream.Entries[len(stream.Entries)-1].ID)
+	}
+	rw.writeLength(uint64(len(stream.Entries)))
+	rw.writeLength(lastMs)
+	rw.writeLength(lastSeq)
+	rw.writeLength(firstMs)
+	rw.writeLength(firstSeq)
+	rw.writeLength(0) // max deleted entry id
+	rw.writeLength(0)
+	rw.writeLength(uint64(len(stream.Entries))) // entries added
+	rw.writeLength(0)                           // consumer groups
+}
+
+func splitStreamId(id string) (uint64, uint64) {
+	msPart, seqPart, _ := strings.Cut(id, "-")
+	ms, _ := strconv.ParseUint(msPart, 10, 64)
+	seq, _ := strconv.ParseUint(seqPart, 10, 64)
+	return ms, seq
+}
+
+// listpack builds the serialised form redis uses for small collections: a
+// header with the total size and element count, the elements each followed by
+// their own length so they can be walked backwards, and a 0xFF terminator
+type listpack struct {
+	body  []byte
+	count int
+}
+
+func (lp *listpack) appendInt(n int64) {
+	var entry []byte
+	switch {
+	case n >= 0 && n <= 127:
+		entry = []byte{byte(n)}
+	case n >= -4096 && n <= 4095:
+		entry = []byte{0xC0 | byte((uint64(n)>>8)&0x1F), byte(n)}
+	case n >= math.MinInt16 && n <= math.MaxInt16:
+		entry = []byte{0xF1, 0, 0}
+		binary.LittleEndian.PutUint16(entry[1:], uint16(n))
+	case n >= math.MinInt32 && n <= math.MaxInt32:
+		entry = []byte{0xF3, 0, 0, 0, 0}
+		binary.LittleEndian.PutUint32(entry[1:], uint32(n))
+	default:
+		entry = []byte{0xF4, 0, 0, 0, 0, 0, 0, 0, 0}
+		binary.LittleEndian.PutUint64(entry[1:], uint64(n))
+	}
+	lp.appendEntry(entry)
+}
+
+func (lp *listpack) appendString(s string) {
+	var entry []byte
+	switch {
+	case len(s) < 64:
+		entry = append([]byte{0x80 | byte(len(s))}, s...)
+	case len(s) < 4096:
+		entry = append([]byte{0xE0 | byte(len(s)>>8), byte(len(s))}, s...)
+	default:
+		entry = []byte{0xF0, 0, 0, 0, 0}
+		binary.LittleEndian.PutUint32(entry[1:], uint32(len(s)))
+		entry = append(entry, s...)
+	}
+	lp.appendEntry(entry)
+}
+
+func (lp *listpack) appendEntry(entry []byte) {
+	lp.body = append(lp.body, entry...)
+	lp.body = append(lp.body, listpackBacklen(len(entry))...)
+	lp.count++
+}
+
+// listpackBacklen encodes an entry length 7 bits per byte, read from the end
+func listpackBacklen(l int) []byte {
+	switch {
+	case l <= 127:
+		return []byte{byte(l)}
+	case l < 16383:
+		return []byte{byte(l >> 7), byte(l&127) | 128}
+	case l < 2097151:
+		return []byte{byte(l >> 14), byte((l>>7)&127) | 128, byte(l&127) | 128}
+	case l < 268435455:
+		return []byte{byte(l >> 21), byte((l>>14)&127) | 128, byte((l>>7)&127) | 128, byte(l&127) | 128}
+	default:
+		return []byte{byte(l >> 28), byte((l>>21)&127) | 128, byte((l>>14)&127) | 128, byte((l>>7)&127) | 128, byte(l&127) | 128}
+	}
+}
+
+func (lp *listpack) bytes() []byte {
+	total := 6 + len(lp.body) + 1
+	buf := make([]byte, 6, total)
+	binary.LittleEndian.PutUint32(buf, uint32(total))
+	// element counts that don't fit in 16 bits are stored as unknown
+	count := lp.count
+	if count > math.MaxUint16-1 {
+		count = math.MaxUint16
+	}
+	binary.LittleEndian.PutUint16(buf[4:], uint16(count))
+	buf = append(buf, lp.body...)
+	return append(buf, 0xFF)
+}
+
+// saveRDBFile writes to a temp file in the same directory and renames it over
+// the destination so a crash mid-save never leaves a truncated RDB behind
+func saveRDBFile(path string, src rdbSource, info rdbReplInfo) error {
+	tmpPath := filepath.Join(filepath.Dir(path), fmt.Sprintf("temp-%d.rdb", os.Getpid()))
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+
+	writer := bufio.NewWriter(file)
+	if err := writeRDB(writer, src, info); err != nil {
+		file.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := writer.Flush(); err != nil {
+		file.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+type savePoint struct {
+	seconds int
+	changes int
+}
+
+// writes since the last successful save, checked against the save points
+var rdbDirty int
+var rdbLastSave = time.Now()
+var rdbLastBgsaveTry time.Time
+var rdbBgsaveInProgress bool
+var rdbLastBgsaveStatus = "ok"
+
+// a failed BGSAVE is only retried by the save points after this delay
+const rdbBgsaveRetryDelay = 5 * time.Second
+
+func rdbPath() string {
+	return filepath.Join(config.Dir, config.Dbfilename)
+}
+
+// parseSavePoints parses "<seconds> <changes> [<seconds> <changes> ...]", an
+// empty string disables automatic saving
+func parseSavePoints(value string) ([]savePoint, error) {
+	fields := strings.Fields(value)
+	if len(fields)%2 != 0 {
+		return nil, fmt.Errorf("invalid save parameters")
+	}
+	points := []savePoint{}
+	for i := 0; i < len(fields); i += 2 {
+		seconds, err := strconv.Atoi(fields[i])
+		if err != nil || seconds < 0 {
+			return nil, fmt.Errorf("invalid save parameters")
+		}
+		changes, err := strconv.Atoi(fields[i+1])
+		if err != nil || changes < 0 {
+			return nil, fmt.Errorf("invalid save parameters")
+		}
+		points = append(points, savePoint{seconds, changes})
+	}
+	return points, nil
+}
+
+func formatSavePoints(points []savePoint) string {
+	parts := make([]string, 0, len(points)*2)
+	for _, point := range points {
+		parts = append(parts, strconv.Itoa(point.seconds), strconv.Itoa(point.changes))
+	}
+	return strings.Join(parts, " ")
+}
+
+// startBgsave takes a snapshot of the keyspace and writes it from a background
+// goroutine, the snapshot plays the part of redis' forked child
+func startBgsave() error {
+	if rdbBgsaveInProgress {
+		return fmt.Errorf("Background save already in progress")
+	}
+	rdbBgsaveInProgress = true
+	rdbLastBgsaveTry = time.Now()
+	dirtyAtStart := rdbDirty
+	snapshot := newKeyspaceSnapshot()
+	info := currentReplInfo()
+	path := rdbPath()
+
+	go func() {
+		err := saveRDBFile(path, snapshotSource(snapshot), info)
+		runOnExecutor(func() {
+			snapshot.release()
+			finishBgsave(dirtyAtStart, err)
+		})
+	}()
+	return nil
+}
+
+func finishBgsave(dirtyAtStart int, err error) {
+	rdbBgsaveInProgress = false
+	if err != nil {
+		fmt.Printf("Background saving error: %v\n", err)
+		rdbLastBgsaveStatus = "err"
+		return
+	}
+	rdbDirty -= dirtyAtStart
+	rdbLastSave = time.Now()
+	rdbLastBgsaveStatus = "ok"
+	fmt.Println("Background saving terminated with success")
+}
+
+// startSaveScheduler checks the save points once a second
+func startSaveScheduler() {
+	go func() {
+		for range time.Tick(time.Second) {
+			runOnExecutor(checkSavePoints)
+		}
+	}()
+}
+
+func checkSavePoints() {
+	if rdbBgsaveInProgress {
+		return
+	}
+	for _, point := range config.SavePoints {
+		if rdbDirty < point.changes || time.Since(rdbLastSave) < time.Duration(point.seconds)*time.Second {
+			continue
+		}
+		if rdbLastBgsaveStatus != "ok" && time.Since(rdbLastBgsaveTry) < rdbBgsaveRetryDelay {
+			return
+		}
+		fmt.Printf("%d changes in %d seconds. Saving...\n", point.changes, point.seconds)
+		if err := startBgsave(); err != nil {
+			fmt.Printf("Background saving failed to start: %v\n", err)
+		}
+		return
+	}
+}
+
+func saveResponse() string {
+	if rdbBgsaveInProgress {
+		return encodeSimpleErrorResponse("Background save already in progress")
+	}
+	// SAVE runs on the executor so the live keyspace can be written without a copy
+	if err := saveRDBFile(rdbPath(), mapSource(store, ttl), currentReplInfo()); err != nil {
+		fmt.Printf("Error saving DB on disk: %v\n", err)
+		return encodeSimpleErrorResponse(err.Error())
+	}
+	rdbDirty = 0
+	rdbLastSave = time.Now()
+	return encodeSimpleString("OK")
+}
+
+func bgsaveResponse() string {
+	if err := startBgsave(); err != nil {
+		return encodeSimpleErrorResponse(err.Error())
+	}
+	return encodeSimpleString("Background saving started")
+}
+
+func lastsaveResponse() string {
+	return encodeInt(int(rdbLastSave.Unix()))
+}
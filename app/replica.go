@@ -3,10 +3,14 @@ package main
 import (
 	"bufio"
 	"fmt"
+	"io"
 	"net"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
 )
 
 func handleReplicaConfig() {
@@ -19,106 +23,598 @@ func handleReplicaConfig() {
     }
 }
 
-func connectToMaster() (net.Conn, *bufio.Reader) {
-	masterConn, err := net.Dial("tcp", net.JoinHostPort(config.ReplicaofHost, strconv.Itoa(config.ReplicaofPort)))
-    if err != nil {
-        fmt.Printf("Failed to connect to master %v\n", err)
-        os.Exit(1)
-    }
+// replication link states of a replica, following redis' repl_state
+const (
+	replLinkConnect    = iota // waiting to (re)connect
+	replLinkConnecting        // dialling the master
+	replLinkHandshake         // PING, REPLCONF and PSYNC
+	replLinkTransfer          // receiving the RDB of a full resync
+	replLinkConnected         // applying the master's stream
+)
 
-    reader := bufio.NewReader(masterConn)
-    handshake(masterConn, reader)
+const (
+	replReconnectMinDelay = time.Second
+	replReconnectMaxDelay = 10 * time.Second
+	replConnectTimeout    = 10 * time.Second
+)
 
-    return masterConn, reader
+// masterLink is a replica's connection to its master. It is only touched from
+// the executor, the goroutine running the link goes through runOnExecutor.
+// lastRead is the exception, it's set on every read off the connection.
+type masterLink struct {
+	host      string
+	port      int
+	state     int
+	conn      net.Conn
+	master    *client      // set once the link is connected, used to send ACKs
+	lastIO    time.Time    // last time anything was received from the master
+	lastRead  atomic.Int64 // unix nanoseconds of the last read that returned bytes
+	downSince time.Time
+	stopped   bool
+	lastError string // why the last attempt failed, for INFO
+	failover  bool   // set by FAILOVER, PSYNC asks the new master to promote itself
 }
 
-func handleMasterConnection(masterConn net.Conn, reader *bufio.Reader) {
-    // receiving RDB (ignoring it for now)
-    response, _ := reader.ReadString('\n')
-    if response[0] != '$' {
-        fmt.Printf("Invalid response\n")
-        os.Exit(1)
-    }
+// replLink is nil on a master
+var replLink *masterLink
 
-    rdbSize, _ := strconv.Atoi(response[1 : len(response)-2])
-    buffer := make([]byte, rdbSize)
-    receivedSize, err := reader.Read(buffer)
-    if err != nil {
-        fmt.Printf("Invalid RDB received %v\n", err)
-        os.Exit(1)
-    }
-    if rdbSize != receivedSize {
-        fmt.Printf("Size mismatch - got: %d, want: %d\n", receivedSize, rdbSize)
-    }
+// startMasterLink connects to a new master in the background, retrying until
+// the link is stopped by REPLICAOF
+func startMasterLink(host string, port int) {
+	replLink = &masterLink{host: host, port: port, state: replLinkConnect, downSince: time.Now()}
+	go replLink.run()
+}
+
+// stop closes the connection so the link's goroutine notices and exits, no
+// command read from the old master is applied after this
+func (l *masterLink) stop() {
+	l.stopped = true
+	if l.conn != nil {
+		l.conn.Close()
+	}
+}
 
-	config.ReplOffset = 0 // set offset to 0 after handshake and empty RDB file has been received
+func (l *masterLink) addr() string {
+	return net.JoinHostPort(l.host, strconv.Itoa(l.port))
+}
+
+// lastReceived is when the master last sent us anything, a transfer only moves
+// lastRead as it doesn't go through the executor until it's complete
+func (l *masterLink) lastReceived() time.Time {
+	if read := time.Unix(0, l.lastRead.Load()); read.After(l.lastIO) {
+		return read
+	}
+	return l.lastIO
+}
+
+func (l *masterLink) setState(state int) {
+	runOnExecutor(func() {
+		l.state = state
+		l.lastIO = time.Now()
+		if state == replLinkConnected && l.failover && failoverState == failoverInProgress {
+			finishFailover()
+		}
+	})
+}
+
+func (l *masterLink) run() {
+	delay := replReconnectMinDelay
+	for {
+		synced, err := l.connectAndSync()
 
-    go syncWithMaster(reader, masterConn)
+		stopped := false
+		runOnExecutor(func() {
+			stopped = l.stopped
+			if err != nil {
+				l.lastError = err.Error()
+			}
+			l.state = replLinkConnect
+			l.conn = nil
+			l.master = nil
+			l.downSince = time.Now()
+			// the new master wouldn't take over, FAILOVER gives the role back to us
+			if !l.stopped && l.failover && failoverState == failoverInProgress {
+				abortFailover(fmt.Sprintf("failed to connect to %s", l.addr()))
+				stopped = true
+			}
+		})
+		if stopped {
+			fmt.Printf("Stopped replicating from %s\n", l.addr())
+			return
+		}
+		// a link that got as far as syncing starts the backoff from scratch
+		if synced {
+			delay = replReconnectMinDelay
+		}
+		fmt.Printf("Lost the link with master %s: %v, reconnecting in %v\n", l.addr(), err, delay)
+		time.Sleep(delay)
+		delay = min(delay*2, replReconnectMaxDelay)
+	}
 }
 
-func handshake(masterConn net.Conn, reader *bufio.Reader) {
-	response, err := sendAndCheckResponse(masterConn, reader, []string{"PING"}, "PONG")
-	if !response {
-		fmt.Println("Failed to handshake with master")
-		return 
+// connectAndSync walks the link through every state and only returns once the
+// connection is gone, synced reports whether it reached the connected state
+func (l *masterLink) connectAndSync() (synced bool, err error) {
+	l.setState(replLinkConnecting)
+	fmt.Printf("Connecting to MASTER %s\n", l.addr())
+	conn, err := net.DialTimeout("tcp", l.addr(), replConnectTimeout)
+	if err != nil {
+		return false, err
 	}
+	defer conn.Close()
+
+	var timeout time.Duration
+	runOnExecutor(func() {
+		// REPLICAOF may have moved on while we were dialling
+		if l.stopped {
+			conn.Close()
+			return
+		}
+		l.conn = conn
+		timeout = time.Duration(config.ReplTimeout) * time.Second
+	})
+
+	reader := bufio.NewReader(&linkReader{link: l, conn: conn, timeout: timeout})
+	l.setState(replLinkHandshake)
+	resync, err := l.handshake(conn, reader)
 	if err != nil {
-		fmt.Printf("Error: %v\n", err)
-		return
+		return false, err
 	}
 
-	response, err = sendAndCheckResponse(masterConn, reader, []string{"REPLCONF", "listening-port", strconv.Itoa(config.Port)}, "OK")
-	if !response {
-		fmt.Println("Failed to handshake with master")
-		return
+	if resync != nil {
+		l.setState(replLinkTransfer)
+		if err := l.receiveRDB(reader, resync); err != nil {
+			return false, fmt.Errorf("failed to load the RDB sent by the master: %w", err)
+		}
 	}
+	l.setState(replLinkConnected)
+	fmt.Println("MASTER <-> REPLICA sync: Finished with success")
+	return true, l.syncWithMaster(reader, conn)
+}
+
+// receiveRDB replaces the keyspace with the RDB the master sends after
+// +FULLRESYNC. It comes like a bulk string without the trailing \r\n, or after
+// a diskless sync as "$EOF:<mark>", the RDB and then the mark again.
+func (l *masterLink) receiveRDB(reader *bufio.Reader, resync *rdbReplInfo) error {
+	line, err := reader.ReadString('\n')
 	if err != nil {
-		fmt.Printf("Error: %v\n", err)
-		return
+		return err
+	}
+	if line[0] != '$' {
+		return fmt.Errorf("expected the RDB payload, got %q", line)
+	}
+	header := strings.TrimSpace(line[1:])
+	size, mark := 0, ""
+	if strings.HasPrefix(header, "EOF:") {
+		mark = header[4:]
+		if len(mark) != disklessSyncMarkLen {
+			return fmt.Errorf("invalid EOF mark %q", mark)
+		}
+	} else if size, err = strconv.Atoi(header); err != nil || size < 0 {
+		return fmt.Errorf("invalid RDB length %q", line)
 	}
 
-	response, err = sendAndCheckResponse(masterConn, reader, []string{"REPLCONF", "capa", "psync2"}, "OK")
-	if !response {
-		fmt.Println("Failed to handshake with master")
-		return
+	var mode, dir, dbfilename string
+	var empty bool
+	runOnExecutor(func() {
+		mode, dir, dbfilename = config.ReplDisklessLoad, config.Dir, config.Dbfilename
+		empty = len(store) == 0
+	})
+	if mode == "swapdb" || (mode == "on-empty-db" && empty) {
+		return l.loadRDBFromSocket(reader, size, mark, resync)
+	}
+	return l.loadRDBFromDisk(reader, size, mark, dir, dbfilename, resync)
+}
+
+// loadRDBFromSocket parses the RDB while it arrives, into maps of its own so
+// the executor keeps serving the old keyspace until the whole transfer loaded.
+// A broken transfer leaves the keyspace untouched.
+func (l *masterLink) loadRDBFromSocket(reader *bufio.Reader, size int, mark string, resync *rdbReplInfo) error {
+	src := reader
+	var payload io.Reader
+	if mark == "" {
+		payload = io.LimitReader(reader, int64(size))
+		src = bufio.NewReader(payload)
+	}
+
+	dataset := newRdbDataset()
+	if err := dataset.load(src); err != nil {
+		return err
 	}
+	if mark != "" {
+		end := make([]byte, len(mark))
+		if _, err := io.ReadFull(reader, end); err != nil {
+			return err
+		}
+		if string(end) != mark {
+			return fmt.Errorf("the RDB doesn't end with the EOF mark")
+		}
+	}
+	if payload != nil {
+		// skip anything the loader didn't need so the command stream starts in the right place
+		if _, err := io.Copy(io.Discard, payload); err != nil {
+			return err
+		}
+	}
+	if err := l.swapInDataset(dataset, resync); err != nil {
+		return err
+	}
+	fmt.Println("MASTER <-> REPLICA sync: Loaded the RDB straight from the socket")
+	return nil
+}
+
+// swapInDataset replaces the keyspace with a dataset loaded off the executor,
+// only then do we take on the master's history
+func (l *masterLink) swapInDataset(dataset *rdbDataset, resync *rdbReplInfo) error {
+	var err error
+	runOnExecutor(func() {
+		if l.stopped {
+			err = fmt.Errorf("replication link stopped")
+			return
+		}
+		for key := range store {
+			touchWatchedKey(key)
+		}
+		for key := range dataset.store {
+			touchWatchedKey(key)
+		}
+		detachSnapshots()
+		store, ttl = dataset.store, dataset.ttl
+		config.Replid = resync.replid
+		config.ReplOffset = resync.offset
+		config.MasterReplOffset = resync.offset
+		config.Replid2 = ""
+		config.SecondReplOffset = -1
+		// a new history: our backlog is useless and our replicas need the new dataset
+		backlog = nil
+		createReplBacklog()
+		disconnectReplicas()
+		restartAofAfterSync()
+	})
+	return err
+}
+
+// loadRDBFromDisk saves the transfer to a temp file and only then flushes the
+// keyspace and loads it, the file becomes our dbfilename like after a SAVE
+func (l *masterLink) loadRDBFromDisk(reader *bufio.Reader, size int, mark string, dir string, dbfilename string, resync *rdbReplInfo) error {
+	tmpPath := filepath.Join(dir, fmt.Sprintf("temp-%d.%d.rdb", time.Now().Unix(), os.Getpid()))
+	file, err := os.Create(tmpPath)
 	if err != nil {
-		fmt.Printf("Error: %v\n", err)
-		return
+		return err
+	}
+	if mark == "" {
+		_, err = io.CopyN(file, reader, int64(size))
+	} else {
+		err = copyUntilMark(file, reader, mark)
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	file.Close()
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
 	}
 
-	response, err = sendAndCheckResponse(masterConn, reader, []string{"PSYNC", "?", "-1"}, "FULLRESYNC")
-	if !response {
-		fmt.Println("Failed to handshake with master")
-		return
+	// like the socket transfer it loads off the executor and is swapped in whole
+	dataset := newRdbDataset()
+	if file, err = os.Open(tmpPath); err == nil {
+		err = dataset.load(bufio.NewReader(file))
+		file.Close()
+	}
+	if err == nil {
+		err = l.swapInDataset(dataset, resync)
 	}
 	if err != nil {
-		fmt.Printf("Error: %v\n", err)
-		return
+		os.Remove(tmpPath)
+		return err
+	}
+	rdbPath := filepath.Join(dir, dbfilename)
+	if err := os.Rename(tmpPath, rdbPath); err != nil {
+		// the keyspace is already the master's, only the file on disk is behind
+		fmt.Printf("Failed to move the RDB sent by the master to %s: %v\n", rdbPath, err)
+		os.Remove(tmpPath)
 	}
+	fmt.Printf("MASTER <-> REPLICA sync: Loaded the RDB from %s\n", rdbPath)
+	return nil
 }
 
-func syncWithMaster(reader *bufio.Reader, masterConn net.Conn) {
-	scanner := bufio.NewScanner(reader)
+// copyUntilMark copies an EOF framed transfer, holding back the newest bytes
+// until it's clear they aren't the mark. Reading byte by byte leaves the
+// command stream that follows the mark in the reader.
+func copyUntilMark(dst io.Writer, reader *bufio.Reader, mark string) error {
+	w := bufio.NewWriter(dst)
+	tail := make([]byte, 0, 2*len(mark))
 	for {
-		cmd, err := readCommand(scanner)
+		b, err := reader.ReadByte()
 		if err != nil {
-			fmt.Println(err)
-			return
+			return err
+		}
+		tail = append(tail, b)
+		if len(tail) >= len(mark) && b == mark[len(mark)-1] && string(tail[len(tail)-len(mark):]) == mark {
+			if _, err := w.Write(tail[:len(tail)-len(mark)]); err != nil {
+				return err
+			}
+			return w.Flush()
+		}
+		if len(tail) == cap(tail) {
+			// only the newest len(mark)-1 bytes can still turn out to be the mark
+			n := len(tail) - (len(mark) - 1)
+			if _, err := w.Write(tail[:n]); err != nil {
+				return err
+			}
+			tail = append(tail[:0], tail[n:]...)
+		}
+	}
+}
+
+func isDisklessLoadMode(mode string) bool {
+	switch mode {
+	case "disabled", "on-empty-db", "swapdb":
+		return true
+	}
+	return false
+}
+
+// handshakeStep sends one command of the handshake, a failure carries the master's reply
+func handshakeStep(masterConn net.Conn, reader *bufio.Reader, command []string, expectedResponse string) error {
+	if _, err := masterConn.Write([]byte(encodeStringArray(command))); err != nil {
+		return err
+	}
+	reply, err := reader.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	reply = strings.TrimSpace(reply)
+	if reply != "+"+expectedResponse {
+		return fmt.Errorf("%s rejected by the master: %s", command[0], strings.TrimPrefix(reply, "-"))
+	}
+	return nil
+}
+
+// handshake returns the master's replid and offset when it answered PSYNC with
+// an RDB to load, nil when it continued the stream where we left off
+func (l *masterLink) handshake(masterConn net.Conn, reader *bufio.Reader) (resync *rdbReplInfo, err error) {
+	// with a known history ask to continue right after the last byte we processed
+	psync := []string{"PSYNC", "?", "-1"}
+	var port string
+	var auth []string
+	runOnExecutor(func() {
+		port = strconv.Itoa(config.Port)
+		if config.Replid != "" {
+			psync = []string{"PSYNC", config.Replid, strconv.Itoa(config.ReplOffset + 1)}
+		}
+		if l.failover {
+			psync = append(psync, "FAILOVER")
+		}
+		if config.Masterauth != "" {
+			auth = []string{"AUTH", config.Masterauth}
+			if config.Masteruser != "" {
+				auth = []string{"AUTH", config.Masteruser, config.Masterauth}
+			}
+		}
+	})
+
+	// a master with passwords refuses everything else until we authenticate
+	if auth != nil {
+		if err := handshakeStep(masterConn, reader, auth, "OK"); err != nil {
+			return nil, err
+		}
+	}
+	if err := handshakeStep(masterConn, reader, []string{"PING"}, "PONG"); err != nil {
+		return nil, err
+	}
+	if err := handshakeStep(masterConn, reader, []string{"REPLCONF", "listening-port", port}, "OK"); err != nil {
+		return nil, err
+	}
+	if err := handshakeStep(masterConn, reader, []string{"REPLCONF", "capa", "psync2"}, "OK"); err != nil {
+		return nil, err
+	}
+
+	masterConn.Write([]byte(encodeStringArray(psync)))
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+
+	fields := strings.Fields(line)
+	switch {
+	case len(fields) >= 1 && fields[0] == "+CONTINUE":
+		runOnExecutor(func() {
+			if l.stopped {
+				return
+			}
+			// +CONTINUE [<replid>], the master may have a new replid after a failover
+			if len(fields) == 2 && fields[1] != config.Replid {
+				config.Replid2 = config.Replid
+				config.SecondReplOffset = config.ReplOffset + 1
+				config.Replid = fields[1]
+				// our replicas have to learn the new replid, they can continue with it
+				disconnectReplicas()
+			}
+			// the stream carries on from our offset, so does our backlog
+			createReplBacklog()
+			fmt.Printf("Partial resynchronization from offset %d accepted\n", config.ReplOffset+1)
+		})
+		return nil, nil
+	case len(fields) == 3 && fields[0] == "+FULLRESYNC":
+		// +FULLRESYNC <replid> <offset>, the offset the master's snapshot was taken at
+		offset, err := strconv.Atoi(fields[2])
+		if err != nil {
+			return nil, fmt.Errorf("invalid FULLRESYNC offset %q", fields[2])
 		}
-		if len(cmd) == 0 {
-			break
+		runOnExecutor(func() {
+			if l.stopped {
+				return
+			}
+			// the master's replid is only ours once its RDB loaded, until then a
+			// fresh one makes sure a retry after a failed transfer is a full resync
+			config.Replid = randReplid()
+			disconnectReplicas()
+		})
+		return &rdbReplInfo{replid: fields[1], offset: offset}, nil
+	}
+	return nil, fmt.Errorf("expected FULLRESYNC or CONTINUE but got %q", strings.TrimSpace(line))
+}
+
+func (l *masterLink) syncWithMaster(reader *bufio.Reader, masterConn net.Conn) error {
+	master := newClient(0, masterConn)
+	master.isMaster = true
+	master.internal = true
+	// ACKs are sent from the replication cron too, so everything goes through the output buffer
+	go master.writeLoop()
+	defer master.closeOutput()
+	runOnExecutor(func() {
+		l.master = master
+	})
+
+	recorder := &streamRecorder{r: reader}
+	stream := bufio.NewReader(recorder)
+	for {
+		cmd, err := readCommand(stream)
+		if err != nil {
+			return err
 		}
+		raw := recorder.take(stream.Buffered())
 		fmt.Printf("[from master] Command = %q\n", cmd)
-		response, _ := handleCommand(cmd, nil)
-		fmt.Printf("response = %q\n", response)
-		if strings.ToUpper(cmd[0]) == "REPLCONF" {
-			fmt.Printf("ack = %q\n", cmd)
-			_, err := masterConn.Write([]byte(response))
-			if err != nil {
-				fmt.Printf("Error responding to master: %v\n", err.Error())
-				break
+		runOnExecutor(func() {
+			if l.stopped {
+				return
+			}
+			l.lastIO = time.Now()
+			response := handleCommand(cmd, master)
+			// the offset only moves once the command is applied, so GETACK reports what came before it
+			config.ReplOffset += len(raw)
+			feedReplicationStream(raw)
+			if strings.ToUpper(cmd[0]) == "REPLCONF" {
+				fmt.Printf("ack = %q\n", response)
+				master.queueReply(response)
 			}
+		})
+	}
+}
+
+// linkReader is the connection as the link reads it, every read has to arrive
+// within repl-timeout so a master that stalls mid transfer can't block the
+// link's goroutine for good. Each read counts as I/O for the replication cron.
+type linkReader struct {
+	link    *masterLink
+	conn    net.Conn
+	timeout time.Duration
+}
+
+func (r *linkReader) Read(p []byte) (int, error) {
+	if r.timeout > 0 {
+		r.conn.SetReadDeadline(time.Now().Add(r.timeout))
+	}
+	n, err := r.conn.Read(p)
+	if n > 0 {
+		r.link.lastRead.Store(time.Now().UnixNano())
+	}
+	return n, err
+}
+
+// streamRecorder keeps the bytes read from the master until the command they
+// belong to has been parsed, so they can be passed on to our replicas unchanged
+type streamRecorder struct {
+	r   io.Reader
+	buf []byte
+}
+
+func (s *streamRecorder) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	s.buf = append(s.buf, p[:n]...)
+	return n, err
+}
+
+// take returns the bytes of the command just parsed, buffered is how much the
+// reader parsing the commands has read ahead
+func (s *streamRecorder) take(buffered int) []byte {
+	n := len(s.buf) - buffered
+	raw := append([]byte(nil), s.buf[:n]...)
+	s.buf = append(s.buf[:0], s.buf[n:]...)
+	return raw
+}
+
+// replicaCron is the replica half of replicationCron, it acknowledges the
+// stream every second and drops a link the master has gone quiet on
+func replicaCron() {
+	if replLink == nil || replLink.state == replLinkConnect {
+		return
+	}
+	if time.Since(replLink.lastReceived()) > time.Duration(config.ReplTimeout)*time.Second {
+		fmt.Printf("Timeout on the link with master %s, no data for %d seconds\n", replLink.addr(), config.ReplTimeout)
+		if replLink.conn != nil {
+			replLink.conn.Close()
 		}
+		// the link's goroutine takes it from here and reconnects
+		replLink.state = replLinkConnect
+		return
+	}
+	if replLink.master != nil {
+		replLink.master.queueReply(encodeStringArray([]string{"REPLCONF", "ACK", strconv.Itoa(config.ReplOffset)}))
 	}
-}
\ No newline at end of file
+}
+
+// replicationSetMaster turns this node into a replica of host:port, a former
+// master keeps its history so the new master can continue it with PSYNC
+func replicationSetMaster(host string, port int) {
+	if replLink != nil {
+		replLink.stop()
+	}
+	if config.Role == "master" {
+		config.ReplOffset = config.MasterReplOffset
+	}
+	config.Role = "slave"
+	config.ReplicaofHost = host
+	config.ReplicaofPort = port
+	// our replicas have to follow the new history, they can usually continue with PSYNC
+	disconnectReplicas()
+	startMasterLink(host, port)
+	fmt.Printf("Connecting to MASTER %s:%d, switched to replica mode\n", host, port)
+}
+
+// replicationUnsetMaster promotes a replica, its old replid stays valid for
+// partial resyncs of the master's other replicas
+func replicationUnsetMaster() {
+	if replLink != nil {
+		replLink.stop()
+		replLink = nil
+	}
+	shiftReplicationId()
+	config.Role = "master"
+	config.ReplicaofHost = ""
+	config.ReplicaofPort = 0
+	disconnectReplicas()
+	fmt.Println("MASTER MODE enabled")
+}
+
+func disconnectReplicas() {
+	for _, replica := range config.Replicas {
+		replica.conn.Close()
+	}
+}
+
+// replicationLinkInfo is the replica part of INFO replication
+func replicationLinkInfo() string {
+	if replLink == nil {
+		return ""
+	}
+	status, lastIO, syncing := "down", -1, 0
+	if replLink.state == replLinkConnected {
+		status = "up"
+		lastIO = int(time.Since(replLink.lastReceived()).Seconds())
+	}
+	if replLink.state == replLinkTransfer {
+		syncing = 1
+	}
+	info := fmt.Sprintf("master_host:%s\r\nmaster_port:%d\r\nmaster_link_status:%s\r\nmaster_last_io_seconds_ago:%d\r\nmaster_sync_in_progress:%d\r\nslave_repl_offset:%d\r\n",
+		replLink.host, replLink.port, status, lastIO, syncing, config.ReplOffset)
+	if status == "down" {
+		info += fmt.Sprintf("master_link_down_since_seconds:%d\r\n", int(time.Since(replLink.downSince).Seconds()))
+		if replLink.lastError != "" {
+			info += fmt.Sprintf("master_link_last_error:%s\r\n", replLink.lastError)
+		}
+	}
+	return info
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+    "bufio"
+    "bytes"
+    "fmt"
+    "io"
+    "strconv"
+    "strings"
+)
+
+const (
+    maxInlineSize     = 64 * 1024     // longest inline command or multibulk header line
+    maxMultibulkCount = 1024 * 1024   // most arguments a single command may have
+)
+
+// protocolError is returned when a client sends bytes that are not a valid
+// request, the connection gets an -ERR Protocol error reply and is then closed
+type protocolError struct {
+    msg string
+}
+
+func (e protocolError) Error() string {
+    return "Protocol error: " + e.msg
+}
+
+// readCommand reads one request from the reader, either a multibulk array of
+// bulk strings or an inline command. Bulk strings are read by their declared
+// length so they may contain any bytes, and anything left in the reader
+// (pipelined commands) is kept for the next call.
+func readCommand(reader *bufio.Reader) ([]string, error) {
+    for {
+        first, err := reader.Peek(1)
+        if err != nil {
+            return nil, err
+        }
+
+        var cmd []string
+        if first[0] == '*' {
+            cmd, err = readMultibulk(reader)
+        } else {
+            cmd, err = readInline(reader)
+        }
+        if err != nil {
+            return nil, err
+        }
+        // empty lines and zero length arrays are skipped like real redis does
+        if len(cmd) > 0 {
+            return cmd, nil
+        }
+    }
+}
+
+func readMultibulk(reader *bufio.Reader) ([]string, error) {
+    line, err := readRequestLine(reader, "too big mbulk count string")
+    if err != nil {
+        return nil, err
+    }
+
+    count, err := strconv.Atoi(line[1:])
+    if err != nil || count > maxMultibulkCount {
+        return nil, protocolError{"invalid multibulk length"}
+    }
+    if count <= 0 {
+        return nil, nil
+    }
+
+    cmd := make([]string, 0, count)
+    for i := 0; i < count; i++ {
+        line, err := readRequestLine(reader, "too big bulk count string")
+        if err != nil {
+            return nil, err
+        }
+        if len(line) == 0 || line[0] != '$' {
+            got := byte(' ')
+            if len(line) > 0 {
+                got = line[0]
+            }
+            return nil, protocolError{fmt.Sprintf("expected '$', got '%c'", got)}
+        }
+
+        size, err := strconv.Atoi(line[1:])
+        if err != nil || size < 0 || size > config.ProtoMaxBulkLen {
+            return nil, protocolError{"invalid bulk length"}
+        }
+
+        // the payload is followed by \r\n which is read and checked here too. The
+        // buffer grows as the payload arrives, so declaring a huge bulk and never
+        // sending it doesn't make us allocate it.
+        var buf bytes.Buffer
+        if _, err := io.CopyN(&buf, reader, int64(size)+2); err != nil {
+            if err == io.EOF {
+                err = io.ErrUnexpectedEOF
+            }
+            return nil, err
+        }
+        data := buf.Bytes()
+        if data[size] != '\r' || data[size+1] != '\n' {
+            return nil, protocolError{"invalid bulk length"}
+        }
+        cmd = append(cmd, string(data[:size]))
+    }
+    return cmd, nil
+}
+
+func readInline(reader *bufio.Reader) ([]string, error) {
+    line, err := readRequestLine(reader, "too big inline request")
+    if err != nil {
+        return nil, err
+    }
+    return splitInlineArgs(line)
+}
+
+// readRequestLine returns the next line without its line ending, lines longer
+// than maxInlineSize are rejected instead of being buffered indefinitely
+func readRequestLine(reader *bufio.Reader, tooBigMsg string) (string, error) {
+    var line []byte
+    for {
+        chunk, err := reader.ReadSlice('\n')
+        line = append(line, chunk...)
+        if len(line) > maxInlineSize {
+            return "", protocolError{tooBigMsg}
+        }
+        if err == bufio.ErrBufferFull {
+            continue
+        }
+        if err != nil {
+            return "", err
+        }
+        break
+    }
+
+    line = line[:len(line)-1]
+    if len(line) > 0 && line[len(line)-1] == '\r' {
+        line = line[:len(line)-1]
+    }
+    if len(line) == 0 {
+        return "", nil
+    }
+    return string(line), nil
+}
+
+// splitInlineArgs splits an inline command on whitespace, honouring double
+// quotes (with escapes such as \n and \x41) and single quotes
+func splitInlineArgs(line string) ([]string, error) {
+    args := []string{}
+    i := 0
+    for {
+        for i < len(line) && (line[i] == ' ' || line[i] == '\t') {
+            i++
+        }
+        if i >= len(line) {
+            return args, nil
+        }
+
+        var arg strings.Builder
+        inDouble, inSingle, done := false, false, false
+        for !done {
+            if i >= len(line) {
+                if inDouble || inSingle {
+                    return nil, protocolError{"unbalanced quotes in request"}
+                }
+                break
+            }
+            ch := line[i]
+            switch {
+            case inDouble:
+                if ch == '\\' && i+3 < len(line) && line[i+1] == 'x' && isHexDigit(line[i+2]) && isHexDigit(line[i+3]) {
+                    b, _ := strconv.ParseUint(line[i+2:i+4], 16, 8)
+                    arg.WriteByte(byte(b))
+                    i += 3
+                } else if ch == '\\' && i+1 < len(line) {
+                    i++
+                    switch line[i] {
+                    case 'n':
+                        arg.WriteByte('\n')
+                    case 'r':
+                        arg.WriteByte('\r')
+                    case 't':
+                        arg.WriteByte('\t')
+                    case 'b':
+                        arg.WriteByte('\b')
+                    case 'a':
+                        arg.WriteByte('\a')
+                    default:
+                        arg.WriteByte(line[i])
+                    }
+                } else if ch == '"' {
+                    // a closing quote must be followed by a space or the end of the line
+                    if i+1 < len(line) && line[i+1] != ' ' && line[i+1] != '\t' {
+                        return nil, protocolError{"unbalanced quotes in request"}
+                    }
+                    done = true
+                } else {
+                    arg.WriteByte(ch)
+                }
+            case inSingle:
+                if ch == '\\' && i+1 < len(line) && line[i+1] == '\'' {
+                    i++
+                    arg.WriteByte('\'')
+                } else if ch == '\'' {
+                    if i+1 < len(line) && line[i+1] != ' ' && line[i+1] != '\t' {
+                        return nil, protocolError{"unbalanced quotes in request"}
+                    }
+                    done = true
+                } else {
+                    arg.WriteByte(ch)
+                }
+            default:
+                switch ch {
+                case ' ', '\t':
+                    done = true
+                case '"':
+                    inDouble = true
+                case '\'':
+                    inSingle = true
+                default:
+                    arg.WriteByte(ch)
+                }
+            }
+            i++
+        }
+        args = append(args, arg.String())
+    }
+}
+
+func isHexDigit(ch byte) bool {
+    return (ch >= '0' && ch <= '9') || (ch >= 'a' && ch <= 'f') || (ch >= 'A' && ch <= 'F')
+}
+
+// parseMemorySize understands the units accepted in redis.conf (1k, 5mb, 2gb...)
+func parseMemorySize(value string) (int, error) {
+    units := []struct {
+        suffix string
+        mul    int
+    }{
+        {"kb", 1024}, {"mb", 1024 * 1024}, {"gb", 1024 * 1024 * 1024},
+        {"k", 1000}, {"m", 1000 * 1000}, {"g", 1000 * 1000 * 1000},
+    }
+    lower := strings.ToLower(value)
+    for _, unit := range units {
+        if strings.HasSuffix(lower, unit.suffix) {
+            n, err := strconv.Atoi(lower[:len(lower)-len(unit.suffix)])
+            if err != nil {
+                return 0, err
+            }
+            return n * unit.mul, nil
+        }
+    }
+    return strconv.Atoi(lower)
+}
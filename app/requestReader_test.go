@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func readAllCommands(input string) ([][]string, error) {
+	reader := bufio.NewReader(strings.NewReader(input))
+	var cmds [][]string
+	for {
+		cmd, err := readCommand(reader)
+		if err == io.EOF {
+			return cmds, nil
+		}
+		if err != nil {
+			return cmds, err
+		}
+		cmds = append(cmds, cmd)
+	}
+}
+
+func TestReadCommand(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  [][]string
+	}{
+		{"multibulk", "*2\r\n$3\r\nGET\r\n$3\r\nfoo\r\n", [][]string{{"GET", "foo"}}},
+		{"inline", "PING\r\n", [][]string{{"PING"}}},
+		{"inline with a bare LF", "SET a b\n", [][]string{{"SET", "a", "b"}}},
+		{
+			"pipelined in one read",
+			"*1\r\n$4\r\nPING\r\n*3\r\n$3\r\nSET\r\n$1\r\nk\r\n$1\r\nv\r\nGET k\r\n",
+			[][]string{{"PING"}, {"SET", "k", "v"}, {"GET", "k"}},
+		},
+		{"CRLF inside a bulk", "*2\r\n$4\r\nECHO\r\n$4\r\na\r\nb\r\n", [][]string{{"ECHO", "a\r\nb"}}},
+		{"binary bulk", "*2\r\n$4\r\nECHO\r\n$4\r\n\x00\xff*$\r\n", [][]string{{"ECHO", "\x00\xff*$"}}},
+		{"empty bulk", "*2\r\n$4\r\nECHO\r\n$0\r\n\r\n", [][]string{{"ECHO", ""}}},
+		{"empty lines are skipped", "\r\n\r\nPING\r\n", [][]string{{"PING"}}},
+		{"empty arrays are skipped", "*0\r\n*-1\r\nPING\r\n", [][]string{{"PING"}}},
+		// like redis a negative count is an empty request, not an error
+		{"negative multibulk count", "*-5\r\n*1\r\n$4\r\nPING\r\n", [][]string{{"PING"}}},
+	}
+	for _, tt := range tests {
+		got, err := readAllCommands(tt.input)
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestReadCommandErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string // "" for a truncated request rather than a protocol error
+	}{
+		{"oversized multibulk count", "*" + strconv.Itoa(maxMultibulkCount+1) + "\r\n", "invalid multibulk length"},
+		{"non numeric multibulk count", "*abc\r\n", "invalid multibulk length"},
+		{"missing $", "*1\r\n:3\r\n", "expected '$', got ':'"},
+		{"negative bulk length", "*1\r\n$-1\r\n", "invalid bulk length"},
+		// over the 512mb proto-max-bulk-len, rejected before anything is buffered
+		{"bulk over proto-max-bulk-len", "*1\r\n$" + strconv.Itoa(config.ProtoMaxBulkLen+1) + "\r\n", "invalid bulk length"},
+		{"bulk without its CRLF", "*1\r\n$3\r\nfooXY", "invalid bulk length"},
+		{"long multibulk header", "*" + strings.Repeat("1", maxInlineSize+1) + "\r\n", "too big mbulk count string"},
+		{"long inline request", strings.Repeat("a", maxInlineSize+1) + "\r\n", "too big inline request"},
+		{"unbalanced double quote", "SET \"foo\r\n", "unbalanced quotes in request"},
+		{"truncated bulk", "*1\r\n$10\r\nabc", ""},
+	}
+	for _, tt := range tests {
+		_, err := readAllCommands(tt.input)
+		if tt.want == "" {
+			if err != io.ErrUnexpectedEOF {
+				t.Errorf("%s: got %v, want %v", tt.name, err, io.ErrUnexpectedEOF)
+			}
+			continue
+		}
+		var perr protocolError
+		if !errors.As(err, &perr) || perr.msg != tt.want {
+			t.Errorf("%s: got %v, want protocol error %q", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestSplitInlineArgs(t *testing.T) {
+	tests := []struct {
+		line string
+		want []string
+	}{
+		{"", []string{}},
+		{"   ", []string{}},
+		{"SET a b", []string{"SET", "a", "b"}},
+		{"  SET\t a   b  ", []string{"SET", "a", "b"}},
+		{`SET "hello world"`, []string{"SET", "hello world"}},
+		{`SET 'hello world'`, []string{"SET", "hello world"}},
+		{`SET ""`, []string{"SET", ""}},
+		{`SET "a\nb\r\tc"`, []string{"SET", "a\nb\r\tc"}},
+		{`SET "\x41\x6a"`, []string{"SET", "Aj"}},
+		// \x with no hex digits after it is just an escaped x
+		{`SET "\xzz"`, []string{"SET", "xzz"}},
+		{`SET "say \"hi\""`, []string{"SET", `say "hi"`}},
+		{`SET 'it\'s'`, []string{"SET", "it's"}},
+		// single quotes don't understand the other escapes
+		{`SET 'a\nb'`, []string{"SET", `a\nb`}},
+		{`SET a"b c"`, []string{"SET", "ab c"}},
+	}
+	for _, tt := range tests {
+		got, err := splitInlineArgs(tt.line)
+		if err != nil {
+			t.Errorf("splitInlineArgs(%q): unexpected error %v", tt.line, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("splitInlineArgs(%q) = %q, want %q", tt.line, got, tt.want)
+		}
+	}
+
+	for _, line := range []string{`SET "foo`, `SET 'foo`, `SET "foo"bar`, `SET 'foo'bar`, `SET "foo\"`, `SET a"b"c`} {
+		if _, err := splitInlineArgs(line); err == nil {
+			t.Errorf("splitInlineArgs(%q) should fail with unbalanced quotes", line)
+		}
+	}
+}
+
+func TestParseMemorySize(t *testing.T) {
+	tests := []struct {
+		value string
+		want  int
+	}{
+		{"0", 0},
+		{"1024", 1024},
+		{"1k", 1000},
+		{"1kb", 1024},
+		{"5mb", 5 * 1024 * 1024},
+		{"5M", 5 * 1000 * 1000},
+		{"2GB", 2 * 1024 * 1024 * 1024},
+		{"1g", 1000 * 1000 * 1000},
+	}
+	for _, tt := range tests {
+		got, err := parseMemorySize(tt.value)
+		if err != nil || got != tt.want {
+			t.Errorf("parseMemorySize(%q) = %d, %v, want %d", tt.value, got, err, tt.want)
+		}
+	}
+	for _, value := range []string{"", "mb", "abc", "1tb", "1.5mb"} {
+		if _, err := parseMemorySize(value); err == nil {
+			t.Errorf("parseMemorySize(%q) should fail", value)
+		}
+	}
+}
@@ -0,0 +1,241 @@
+package resp
+
+import (
+    "bufio"
+    "bytes"
+    "errors"
+    "fmt"
+    "io"
+    "math/big"
+    "strconv"
+    "strings"
+)
+
+var ErrInvalidFormat = errors.New("invalid resp format")
+
+// Reader decodes values from a stream, any bytes after a value are left
+// buffered for the next call so pipelined replies can be read one by one
+type Reader struct {
+    rd         *bufio.Reader
+    MaxBulkLen int
+}
+
+func NewReader(r io.Reader) *Reader {
+    if br, ok := r.(*bufio.Reader); ok {
+        return &Reader{rd: br, MaxBulkLen: 512 * 1024 * 1024}
+    }
+    return &Reader{rd: bufio.NewReader(r), MaxBulkLen: 512 * 1024 * 1024}
+}
+
+// Parse decodes the first value in msg and returns it with the number of bytes it used
+func Parse(msg string) (RespValue, int, error) {
+    sr := strings.NewReader(msg)
+    reader := NewReader(sr)
+    v, err := reader.ReadValue()
+    if err != nil {
+        return RespValue{}, 0, err
+    }
+    return v, len(msg) - sr.Len() - reader.rd.Buffered(), nil
+}
+
+func (r *Reader) ReadValue() (RespValue, error) {
+    t, err := r.rd.ReadByte()
+    if err != nil {
+        return RespValue{}, err
+    }
+
+    if t == ATTRIBUTE {
+        attrs, err := r.readPairs()
+        if err != nil {
+            return RespValue{}, err
+        }
+        v, err := r.ReadValue()
+        if err != nil {
+            return RespValue{}, err
+        }
+        if len(attrs) > 0 {
+            v.Attrs = attrs
+        }
+        return v, nil
+    }
+
+    v := RespValue{Type: t}
+    switch t {
+    case STRING, ERROR:
+        v.Str, err = r.readLine()
+    case INTEGER:
+        v.Int, err = r.readInt()
+    case NULL:
+        var line string
+        line, err = r.readLine()
+        if err == nil && line != "" {
+            err = fmt.Errorf("invalid null value %q", line)
+        }
+    case BOOLEANS:
+        v.Bool, err = r.readBoolean()
+    case DOUBLE:
+        v.Double, err = r.readDouble()
+    case BIG_NUMBER:
+        v.Big, err = r.readBigNumber()
+    case BULK, BULK_ERROR:
+        v.Str, v.IsNull, err = r.readBulk()
+        if v.IsNull && t != BULK {
+            err = ErrInvalidFormat
+        }
+    case VERBATIM_STRING:
+        var data string
+        data, _, err = r.readBulk()
+        if err == nil {
+            if len(data) < 4 || data[3] != ':' {
+                return v, fmt.Errorf("invalid verbatim string %q", data)
+            }
+            v.Format, v.Str = data[:3], data[4:]
+        }
+    case ARRAY, SETS, PUSH:
+        v.Elems, v.IsNull, err = r.readElems()
+        if v.IsNull && t != ARRAY {
+            err = ErrInvalidFormat
+        }
+    case MAPS:
+        v.Pairs, err = r.readPairs()
+    default:
+        err = fmt.Errorf("unknown type: %q", t)
+    }
+    return v, err
+}
+
+func (r *Reader) readLine() (string, error) {
+    line, err := r.rd.ReadString('\n')
+    if err != nil {
+        return "", err
+    }
+    if len(line) < 2 || line[len(line)-2] != '\r' {
+        return "", ErrInvalidFormat
+    }
+    return line[:len(line)-2], nil
+}
+
+func (r *Reader) readInt() (int64, error) {
+    line, err := r.readLine()
+    if err != nil {
+        return 0, err
+    }
+    return strconv.ParseInt(line, 10, 64)
+}
+
+func (r *Reader) readBoolean() (bool, error) {
+    line, err := r.readLine()
+    if err != nil {
+        return false, err
+    }
+    switch line {
+    case "t":
+        return true, nil
+    case "f":
+        return false, nil
+    default:
+        return false, errors.New("invalid boolean value")
+    }
+}
+
+func (r *Reader) readDouble() (float64, error) {
+    line, err := r.readLine()
+    if err != nil {
+        return 0, err
+    }
+    return strconv.ParseFloat(line, 64)
+}
+
+func (r *Reader) readBigNumber() (*big.Int, error) {
+    line, err := r.readLine()
+    if err != nil {
+        return nil, err
+    }
+    n, ok := new(big.Int).SetString(line, 10)
+    if !ok {
+        return nil, fmt.Errorf("invalid big number %q", line)
+    }
+    return n, nil
+}
+
+// readBulk reads a length prefixed payload, a length of -1 is the RESP2 null
+func (r *Reader) readBulk() (string, bool, error) {
+    size, err := r.readInt()
+    if err != nil {
+        return "", false, err
+    }
+    if size == -1 {
+        return "", true, nil
+    }
+    if size < 0 || size > int64(r.MaxBulkLen) {
+        return "", false, fmt.Errorf("invalid bulk length %d", size)
+    }
+
+    // grow the buffer as the payload arrives rather than trusting the declared size up front
+    var buf bytes.Buffer
+    if _, err := io.CopyN(&buf, r.rd, size+2); err != nil {
+        if err == io.EOF {
+            err = io.ErrUnexpectedEOF
+        }
+        return "", false, err
+    }
+    data := buf.Bytes()
+    if data[size] != '\r' || data[size+1] != '\n' {
+        return "", false, ErrInvalidFormat
+    }
+    return string(data[:size]), false, nil
+}
+
+func (r *Reader) readLength() (int, bool, error) {
+    n, err := r.readInt()
+    if err != nil {
+        return 0, false, err
+    }
+    if n == -1 {
+        return 0, true, nil
+    }
+    if n < 0 || n > int64(r.MaxBulkLen) {
+        return 0, false, fmt.Errorf("invalid aggregate length %d", n)
+    }
+    return int(n), false, nil
+}
+
+func (r *Reader) readElems() ([]RespValue, bool, error) {
+    n, isNull, err := r.readLength()
+    if err != nil || isNull {
+        return nil, isNull, err
+    }
+    // the length comes off the wire, so only trust it as far as a small allocation
+    elems := make([]RespValue, 0, min(n, 1024))
+    for i := 0; i < n; i++ {
+        elem, err := r.ReadValue()
+        if err != nil {
+            return nil, false, err
+        }
+        elems = append(elems, elem)
+    }
+    return elems, false, nil
+}
+
+func (r *Reader) readPairs() ([]Pair, error) {
+    n, isNull, err := r.readLength()
+    if err != nil {
+        return nil, err
+    }
+    if isNull {
+        return nil, ErrInvalidFormat
+    }
+    pairs := make([]Pair, 0, min(n, 1024))
+    for i := 0; i < n; i++ {
+        key, err := r.ReadValue()
+        if err != nil {
+            return nil, err
+        }
+        value, err := r.ReadValue()
+        if err != nil {
+            return nil, err
+        }
+        pairs = append(pairs, Pair{Key: key, Value: value})
+    }
+    return pairs, nil
+}
@@ -0,0 +1,189 @@
+package resp
+
+import (
+    "math"
+    "strconv"
+    "strings"
+)
+
+// Encode serialises v, and everything nested in it, in its native wire form
+func Encode(v RespValue) string {
+    var sb strings.Builder
+    writeValue(&sb, v)
+    return sb.String()
+}
+
+func writeValue(sb *strings.Builder, v RespValue) {
+    if len(v.Attrs) > 0 {
+        writeHeader(sb, ATTRIBUTE, len(v.Attrs))
+        writePairs(sb, v.Attrs)
+    }
+
+    switch v.Type {
+    case STRING, ERROR:
+        sb.WriteByte(v.Type)
+        sb.WriteString(v.Str)
+        sb.WriteString("\r\n")
+    case INTEGER:
+        sb.WriteByte(INTEGER)
+        sb.WriteString(strconv.FormatInt(v.Int, 10))
+        sb.WriteString("\r\n")
+    case BULK, BULK_ERROR:
+        if v.IsNull {
+            sb.WriteString("$-1\r\n")
+            return
+        }
+        writeHeader(sb, v.Type, len(v.Str))
+        sb.WriteString(v.Str)
+        sb.WriteString("\r\n")
+    case VERBATIM_STRING:
+        format := v.Format
+        if len(format) != 3 {
+            format = "txt"
+        }
+        writeHeader(sb, VERBATIM_STRING, len(v.Str)+4)
+        sb.WriteString(format)
+        sb.WriteByte(':')
+        sb.WriteString(v.Str)
+        sb.WriteString("\r\n")
+    case ARRAY, SETS, PUSH:
+        if v.IsNull {
+            sb.WriteString("*-1\r\n")
+            return
+        }
+        writeHeader(sb, v.Type, len(v.Elems))
+        for _, elem := range v.Elems {
+            writeValue(sb, elem)
+        }
+    case MAPS:
+        writeHeader(sb, MAPS, len(v.Pairs))
+        writePairs(sb, v.Pairs)
+    case NULL:
+        sb.WriteString("_\r\n")
+    case BOOLEANS:
+        if v.Bool {
+            sb.WriteString("#t\r\n")
+        } else {
+            sb.WriteString("#f\r\n")
+        }
+    case DOUBLE:
+        sb.WriteByte(DOUBLE)
+        sb.WriteString(FormatDouble(v.Double))
+        sb.WriteString("\r\n")
+    case BIG_NUMBER:
+        sb.WriteByte(BIG_NUMBER)
+        if v.Big == nil {
+            sb.WriteString("0")
+        } else {
+            sb.WriteString(v.Big.String())
+        }
+        sb.WriteString("\r\n")
+    default:
+        // an unset value is sent as a null so the stream never gets out of step
+        sb.WriteString("_\r\n")
+    }
+}
+
+func writeHeader(sb *strings.Builder, prefix byte, n int) {
+    sb.WriteByte(prefix)
+    sb.WriteString(strconv.Itoa(n))
+    sb.WriteString("\r\n")
+}
+
+func writePairs(sb *strings.Builder, pairs []Pair) {
+    for _, pair := range pairs {
+        writeValue(sb, pair.Key)
+        writeValue(sb, pair.Value)
+    }
+}
+
+// FormatDouble writes a float the way RESP3 expects, including inf, -inf and nan
+func FormatDouble(f float64) string {
+    switch {
+    case math.IsInf(f, 1):
+        return "inf"
+    case math.IsInf(f, -1):
+        return "-inf"
+    case math.IsNaN(f):
+        return "nan"
+    }
+    return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+// EncodeProto serialises v for a client that negotiated the given protocol
+// version, RESP2 clients get every RESP3-only type in its RESP2 equivalent and
+// RESP3 clients get the RESP3 null for the RESP2 null bulk strings and arrays
+func EncodeProto(v RespValue, protocol int) string {
+    if protocol >= 3 {
+        return Encode(upgradeNulls(v))
+    }
+    return Encode(Downgrade(v))
+}
+
+// upgradeNulls rewrites v, recursively, with every null bulk string or array
+// replaced by the RESP3 null
+func upgradeNulls(v RespValue) RespValue {
+    if v.IsNull {
+        return Null()
+    }
+    if len(v.Elems) > 0 {
+        elems := make([]RespValue, len(v.Elems))
+        for i, elem := range v.Elems {
+            elems[i] = upgradeNulls(elem)
+        }
+        v.Elems = elems
+    }
+    if len(v.Pairs) > 0 {
+        pairs := make([]Pair, len(v.Pairs))
+        for i, pair := range v.Pairs {
+            pairs[i] = Pair{Key: upgradeNulls(pair.Key), Value: upgradeNulls(pair.Value)}
+        }
+        v.Pairs = pairs
+    }
+    return v
+}
+
+// Downgrade rewrites v, recursively, using only RESP2 types: maps become flat
+// arrays, sets and pushes become arrays, doubles and big numbers become bulk
+// strings, booleans become 1 or 0 and attributes are dropped
+func Downgrade(v RespValue) RespValue {
+    switch v.Type {
+    case NULL:
+        return NullBulkString()
+    case BOOLEANS:
+        if v.Bool {
+            return Integer(1)
+        }
+        return Integer(0)
+    case DOUBLE:
+        return BulkString(FormatDouble(v.Double))
+    case BIG_NUMBER:
+        if v.Big == nil {
+            return BulkString("0")
+        }
+        return BulkString(v.Big.String())
+    case BULK_ERROR:
+        // a simple error can't hold either line ending character
+        return Error(strings.NewReplacer("\r", " ", "\n", " ").Replace(v.Str))
+    case VERBATIM_STRING:
+        return BulkString(v.Str)
+    case ARRAY, SETS, PUSH:
+        if v.IsNull {
+            return NullArray()
+        }
+        elems := make([]RespValue, len(v.Elems))
+        for i, elem := range v.Elems {
+            elems[i] = Downgrade(elem)
+        }
+        return Array(elems...)
+    case MAPS:
+        elems := make([]RespValue, 0, len(v.Pairs)*2)
+        for _, pair := range v.Pairs {
+            elems = append(elems, Downgrade(pair.Key), Downgrade(pair.Value))
+        }
+        return Array(elems...)
+    default:
+        v.Attrs = nil
+        return v
+    }
+}
@@ -0,0 +1,148 @@
+// Package resp implements the Redis serialization protocol, both the RESP2
+// types and the additional RESP3 ones, as a typed value tree with a matching
+// encoder and decoder.
+package resp
+
+import (
+    "math/big"
+)
+
+const (
+    STRING          = '+'
+    ERROR           = '-'
+    INTEGER         = ':'
+    BULK            = '$'
+    ARRAY           = '*'
+    NULL            = '_'
+    BOOLEANS        = '#'
+    DOUBLE          = ','
+    BIG_NUMBER      = '('
+    BULK_ERROR      = '!'
+    VERBATIM_STRING = '='
+    MAPS            = '%'
+    SETS            = '~'
+    PUSH            = '>'
+    ATTRIBUTE       = '|'
+)
+
+// RespValue is a single protocol value. Only the fields that belong to Type are
+// used, for example Str for strings and errors, Elems for arrays, sets and
+// pushes and Pairs for maps.
+type RespValue struct {
+    Type   byte
+    Str    string      // STRING, ERROR, BULK, BULK_ERROR and the text of a VERBATIM_STRING
+    Format string      // three letter encoding of a VERBATIM_STRING, e.g. "txt"
+    Int    int64       // INTEGER
+    Double float64     // DOUBLE
+    Bool   bool        // BOOLEANS
+    Big    *big.Int    // BIG_NUMBER
+    Elems  []RespValue // ARRAY, SETS, PUSH
+    Pairs  []Pair      // MAPS
+    Attrs  []Pair      // attributes sent ahead of the value, RESP3 only
+    IsNull bool        // RESP2 null bulk string ($-1) or null array (*-1)
+}
+
+// Pair is one key/value entry of a map or attribute
+type Pair struct {
+    Key   RespValue
+    Value RespValue
+}
+
+func SimpleString(s string) RespValue {
+    return RespValue{Type: STRING, Str: s}
+}
+
+func Error(s string) RespValue {
+    return RespValue{Type: ERROR, Str: s}
+}
+
+func Integer(n int) RespValue {
+    return RespValue{Type: INTEGER, Int: int64(n)}
+}
+
+func BulkString(s string) RespValue {
+    return RespValue{Type: BULK, Str: s}
+}
+
+func NullBulkString() RespValue {
+    return RespValue{Type: BULK, IsNull: true}
+}
+
+func Array(elems ...RespValue) RespValue {
+    if elems == nil {
+        elems = []RespValue{}
+    }
+    return RespValue{Type: ARRAY, Elems: elems}
+}
+
+func NullArray() RespValue {
+    return RespValue{Type: ARRAY, IsNull: true}
+}
+
+// StringArray is an array of bulk strings, the shape most replies take
+func StringArray(strs []string) RespValue {
+    elems := make([]RespValue, len(strs))
+    for i, s := range strs {
+        elems[i] = BulkString(s)
+    }
+    return Array(elems...)
+}
+
+func Null() RespValue {
+    return RespValue{Type: NULL}
+}
+
+func Boolean(b bool) RespValue {
+    return RespValue{Type: BOOLEANS, Bool: b}
+}
+
+func Double(f float64) RespValue {
+    return RespValue{Type: DOUBLE, Double: f}
+}
+
+func BigNumber(n *big.Int) RespValue {
+    return RespValue{Type: BIG_NUMBER, Big: n}
+}
+
+func BulkError(s string) RespValue {
+    return RespValue{Type: BULK_ERROR, Str: s}
+}
+
+func VerbatimString(format, s string) RespValue {
+    return RespValue{Type: VERBATIM_STRING, Format: format, Str: s}
+}
+
+func Map(pairs ...Pair) RespValue {
+    if pairs == nil {
+        pairs = []Pair{}
+    }
+    return RespValue{Type: MAPS, Pairs: pairs}
+}
+
+func Set(elems ...RespValue) RespValue {
+    if elems == nil {
+        elems = []RespValue{}
+    }
+    return RespValue{Type: SETS, Elems: elems}
+}
+
+func Push(elems ...RespValue) RespValue {
+    if elems == nil {
+        elems = []RespValue{}
+    }
+    return RespValue{Type: PUSH, Elems: elems}
+}
+
+// KV builds a map pair with a bulk string key, the common case for replies
+func KV(key string, value RespValue) Pair {
+    return Pair{Key: BulkString(key), Value: value}
+}
+
+func IsRespType(val byte) bool {
+    switch val {
+    case STRING, ERROR, INTEGER, BULK, ARRAY, NULL, BOOLEANS, DOUBLE, BIG_NUMBER, BULK_ERROR, VERBATIM_STRING, MAPS, SETS, PUSH, ATTRIBUTE:
+        return true
+    default:
+        return false
+    }
+}
@@ -0,0 +1,204 @@
+package resp
+
+import (
+    "math"
+    "math/big"
+    "reflect"
+    "strings"
+    "testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+    huge, _ := new(big.Int).SetString("3492890328409238509324850943850943825024385", 10)
+
+    tests := []struct {
+        name  string
+        value RespValue
+        wire  string
+    }{
+        {"simple string", SimpleString("OK"), "+OK\r\n"},
+        {"empty simple string", SimpleString(""), "+\r\n"},
+        {"error", Error("ERR unknown"), "-ERR unknown\r\n"},
+        {"integer", Integer(-42), ":-42\r\n"},
+        {"bulk string", BulkString("hello"), "$5\r\nhello\r\n"},
+        {"binary bulk string", BulkString("a\r\nb\x00"), "$5\r\na\r\nb\x00\r\n"},
+        {"null bulk string", NullBulkString(), "$-1\r\n"},
+        {"array", StringArray([]string{"a", "bc"}), "*2\r\n$1\r\na\r\n$2\r\nbc\r\n"},
+        {"empty array", Array(), "*0\r\n"},
+        {"null array", NullArray(), "*-1\r\n"},
+        {"null", Null(), "_\r\n"},
+        {"true", Boolean(true), "#t\r\n"},
+        {"false", Boolean(false), "#f\r\n"},
+        {"double", Double(1.5), ",1.5\r\n"},
+        {"double inf", Double(math.Inf(1)), ",inf\r\n"},
+        {"double negative inf", Double(math.Inf(-1)), ",-inf\r\n"},
+        {"big number", BigNumber(huge), "(3492890328409238509324850943850943825024385\r\n"},
+        {"bulk error", BulkError("SYNTAX invalid"), "!14\r\nSYNTAX invalid\r\n"},
+        {"verbatim string", VerbatimString("txt", "Some string"), "=15\r\ntxt:Some string\r\n"},
+        {"map", Map(KV("first", Integer(1)), KV("second", Integer(2))), "%2\r\n$5\r\nfirst\r\n:1\r\n$6\r\nsecond\r\n:2\r\n"},
+        {"set", Set(Integer(1), SimpleString("two")), "~2\r\n:1\r\n+two\r\n"},
+        {"push", Push(BulkString("message"), BulkString("ch")), ">2\r\n$7\r\nmessage\r\n$2\r\nch\r\n"},
+        {"nested", Array(Map(KV("k", Array(Null(), Double(-0.25)))), Set()), "*2\r\n%1\r\n$1\r\nk\r\n*2\r\n_\r\n,-0.25\r\n~0\r\n"},
+        {
+            "attribute",
+            RespValue{Type: ARRAY, Elems: []RespValue{Integer(2)}, Attrs: []Pair{KV("ttl", Integer(100))}},
+            "|1\r\n$3\r\nttl\r\n:100\r\n*1\r\n:2\r\n",
+        },
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            encoded := Encode(tt.value)
+            if encoded != tt.wire {
+                t.Fatalf("Encode() = %q, want %q", encoded, tt.wire)
+            }
+
+            decoded, n, err := Parse(encoded)
+            if err != nil {
+                t.Fatalf("Parse(%q) error: %v", encoded, err)
+            }
+            if n != len(encoded) {
+                t.Errorf("Parse(%q) consumed %d bytes, want %d", encoded, n, len(encoded))
+            }
+            if !reflect.DeepEqual(decoded, tt.value) {
+                t.Errorf("Parse(%q) = %#v, want %#v", encoded, decoded, tt.value)
+            }
+        })
+    }
+}
+
+func TestEncodeProtoDowngradesForResp2(t *testing.T) {
+    value := Array(
+        Map(KV("proto", Integer(2))),
+        Set(BulkString("a")),
+        Push(BulkString("message")),
+        Null(),
+        Boolean(true),
+        Double(2.5),
+        BigNumber(big.NewInt(12)),
+        BulkError("ERR bad"),
+        VerbatimString("txt", "info"),
+    )
+    want := "*9\r\n*2\r\n$5\r\nproto\r\n:2\r\n*1\r\n$1\r\na\r\n*1\r\n$7\r\nmessage\r\n$-1\r\n:1\r\n$3\r\n2.5\r\n$2\r\n12\r\n-ERR bad\r\n$4\r\ninfo\r\n"
+    if got := EncodeProto(value, 2); got != want {
+        t.Errorf("EncodeProto(v, 2) = %q, want %q", got, want)
+    }
+    if got := EncodeProto(value, 3); got != Encode(value) {
+        t.Errorf("EncodeProto(v, 3) = %q, want the native encoding %q", got, Encode(value))
+    }
+}
+
+func TestEncodeProtoUpgradesNullsForResp3(t *testing.T) {
+    value := Array(
+        NullBulkString(),
+        Array(BulkString("a"), NullArray()),
+        Map(KV("missing", NullBulkString())),
+    )
+    want := "*3\r\n_\r\n*2\r\n$1\r\na\r\n_\r\n%1\r\n$7\r\nmissing\r\n_\r\n"
+    if got := EncodeProto(value, 3); got != want {
+        t.Errorf("EncodeProto(v, 3) = %q, want %q", got, want)
+    }
+    if got := EncodeProto(NullArray(), 3); got != "_\r\n" {
+        t.Errorf("EncodeProto(NullArray(), 3) = %q, want %q", got, "_\r\n")
+    }
+    want2 := "*3\r\n$-1\r\n*2\r\n$1\r\na\r\n*-1\r\n*2\r\n$7\r\nmissing\r\n$-1\r\n"
+    if got := EncodeProto(value, 2); got != want2 {
+        t.Errorf("EncodeProto(v, 2) = %q, want %q", got, want2)
+    }
+}
+
+func TestBulkErrorDowngradeStripsLineEndings(t *testing.T) {
+    tests := []struct {
+        msg  string
+        want string
+    }{
+        {"ERR a\r\nb", "-ERR a  b\r\n"},
+        {"ERR a\rb", "-ERR a b\r\n"},
+        {"ERR a\nb", "-ERR a b\r\n"},
+    }
+    for _, tt := range tests {
+        if got := EncodeProto(BulkError(tt.msg), 2); got != tt.want {
+            t.Errorf("EncodeProto(BulkError(%q), 2) = %q, want %q", tt.msg, got, tt.want)
+        }
+    }
+}
+
+func TestDoubleNaN(t *testing.T) {
+    decoded, _, err := Parse(Encode(Double(math.NaN())))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if decoded.Type != DOUBLE || !math.IsNaN(decoded.Double) {
+        t.Errorf("got %#v, want a NaN double", decoded)
+    }
+}
+
+func TestReaderPipelined(t *testing.T) {
+    reader := NewReader(strings.NewReader("+PONG\r\n:1\r\n$3\r\nfoo\r\n"))
+    want := []RespValue{SimpleString("PONG"), Integer(1), BulkString("foo")}
+    for _, w := range want {
+        got, err := reader.ReadValue()
+        if err != nil {
+            t.Fatal(err)
+        }
+        if !reflect.DeepEqual(got, w) {
+            t.Errorf("ReadValue() = %#v, want %#v", got, w)
+        }
+    }
+}
+
+func TestParseErrors(t *testing.T) {
+    inputs := []string{
+        "",
+        "?\r\n",
+        "+missing line ending",
+        ":abc\r\n",
+        "$5\r\nabc\r\n",
+        "$3\r\nabcde",
+        "#x\r\n",
+        ",notanumber\r\n",
+        "(12a\r\n",
+        "=3\r\ntxt\r\n",
+        "*2\r\n:1\r\n",
+        "%1\r\n+key\r\n",
+        "~-1\r\n",
+        "!-1\r\n",
+        "_x\r\n",
+    }
+    for _, input := range inputs {
+        if v, _, err := Parse(input); err == nil {
+            t.Errorf("Parse(%q) = %#v, want an error", input, v)
+        }
+    }
+}
+
+func FuzzDecode(f *testing.F) {
+    seeds := []string{
+        "+OK\r\n", "-ERR x\r\n", ":1\r\n", "$3\r\nfoo\r\n", "$-1\r\n", "*-1\r\n",
+        "*2\r\n$1\r\na\r\n:2\r\n", "_\r\n", "#t\r\n", ",3.14\r\n", ",nan\r\n", "(123\r\n",
+        "!3\r\nerr\r\n", "=7\r\ntxt:abc\r\n", "%1\r\n+a\r\n:1\r\n", "~1\r\n+a\r\n", ">1\r\n+a\r\n",
+        "|1\r\n+a\r\n+b\r\n:1\r\n",
+    }
+    for _, seed := range seeds {
+        f.Add(seed)
+    }
+
+    f.Fuzz(func(t *testing.T, input string) {
+        v, _, err := Parse(input)
+        if err != nil {
+            return
+        }
+        // whatever decodes must survive another encode/decode unchanged
+        encoded := Encode(v)
+        again, n, err := Parse(encoded)
+        if err != nil {
+            t.Fatalf("re-parsing %q (from %q) failed: %v", encoded, input, err)
+        }
+        if n != len(encoded) {
+            t.Fatalf("re-parsing %q consumed %d of %d bytes", encoded, n, len(encoded))
+        }
+        if Encode(again) != encoded {
+            t.Fatalf("round trip changed %q into %q", encoded, Encode(again))
+        }
+    })
+}
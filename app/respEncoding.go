@@ -2,26 +2,22 @@ package main
 
 import (
 	"fmt"
+    "strconv"
     "strings"
+
+    "github.com/DeanLogan/redis-clone/app/resp"
 )
 
 func encodeBulkString(s string) string {
-	return fmt.Sprintf("$%d\r\n%s\r\n", len(s), s)
+	return resp.Encode(resp.BulkString(s))
 }
 
 func encodeSimpleString(s string) string {
-	if len(s) == 0 {
-		return "+\r\n"
-	}
-	return fmt.Sprintf("+%s\r\n", s)
+	return resp.Encode(resp.SimpleString(s))
 }
 
 func encodeStringArray(arr []string) string {
-	result := fmt.Sprintf("*%d\r\n", len(arr))
-	for _, s := range arr {
-		result += encodeBulkString(s)
-	}
-	return result
+	return resp.Encode(resp.StringArray(arr))
 }
 
 func wrapRespFragmentsAsArray(arr []string) string {
@@ -33,35 +29,28 @@ func wrapRespFragmentsAsArray(arr []string) string {
 }
 
 func encodeInt(n int) string {
-	return fmt.Sprintf(":%d\r\n", n)
+	return resp.Encode(resp.Integer(n))
 }
 
 func encodeStream(stream RedisStream) string {
-    result := fmt.Sprintf("*%d\r\n", len(stream.Entries))
-    for _, entry := range stream.Entries {
-        result += fmt.Sprintf("*2\r\n$%d\r\n%s\r\n", len(entry.ID), entry.ID)
-        result += encodeStringMap(entry.Fields)
-    }
-    return result
+    return resp.Encode(streamEntriesValue(stream.Entries))
 }
 
 func encodeStreamWithKey(streamKey string, entries []StreamEntry) string {
-    result := fmt.Sprintf("*2\r\n$%d\r\n%s\r\n", len(streamKey), streamKey)
-    result += fmt.Sprintf("*%d\r\n", len(entries))
-    for _, entry := range entries {
-        result += fmt.Sprintf("*2\r\n$%d\r\n%s\r\n", len(entry.ID), entry.ID)
-        result += encodeStringMap(entry.Fields)
-    }
-    return result
+    return resp.Encode(resp.Array(resp.BulkString(streamKey), streamEntriesValue(entries)))
 }
 
-func encodeStringMap(m map[string]string) string {
-    result := fmt.Sprintf("*%d\r\n", len(m)*2)
-    for k, v := range m {
-        result += encodeBulkString(k)
-        result += encodeBulkString(v)
+// each entry is a two element array of the ID and a flat field/value array
+func streamEntriesValue(entries []StreamEntry) resp.RespValue {
+    values := make([]resp.RespValue, len(entries))
+    for i, entry := range entries {
+        fields := make([]string, 0, len(entry.Fields)*2)
+        for k, v := range entry.Fields {
+            fields = append(fields, k, v)
+        }
+        values[i] = resp.Array(resp.BulkString(entry.ID), resp.StringArray(fields))
     }
-    return result
+    return resp.Array(values...)
 }
 
 func encodeSimpleErrorResponse(s string) string{
@@ -70,9 +59,18 @@ func encodeSimpleErrorResponse(s string) string{
 
 func encodeErrorResponseWithMsg(key string, msg string) string{
 	if len(msg) == 0 {
-		return "-\r\n"
+		return resp.Encode(resp.Error(""))
 	}
-	return fmt.Sprintf("-%s %s\r\n", key, msg)
+	return resp.Encode(resp.Error(key + " " + msg))
+}
+
+// flattens a hash into field, value, field, value...
+func hashToSlice(hash map[string]string) []string {
+    pairs := make([]string, 0, len(hash)*2)
+    for field, value := range hash {
+        pairs = append(pairs, field, value)
+    }
+    return pairs
 }
 
 func encodeStreamArray(entries []string) string {
@@ -83,48 +81,34 @@ func encodeStreamArray(entries []string) string {
 }
 
 func encodeRedisValue(rv RedisValue) string {
+    return resp.Encode(redisValueToResp(rv))
+}
+
+func redisValueToResp(rv RedisValue) resp.RespValue {
     switch v := rv.value.(type) {
     case string:
-        return encodeBulkString(v)
+        return resp.BulkString(v)
     case int:
-        return encodeInt(v)
+        return resp.Integer(v)
     case []string:
-        return encodeStringArray(v)
+        return resp.StringArray(v)
     case map[string]struct{}:
         set := make([]string, 0, len(v))
         for k := range v {
             set = append(set, k)
         }
-        return encodeStringArray(set)
+        return resp.StringArray(set)
+    case map[string]string:
+        return resp.StringArray(hashToSlice(v))
+    case SortedSet:
+        members := make([]string, 0, len(v.Sorted)*2)
+        for _, entry := range v.Sorted {
+            members = append(members, entry.Member, strconv.FormatFloat(entry.Score, 'f', -1, 64))
+        }
+        return resp.StringArray(members)
     case RedisStream:
-        return encodeStream(v)
-    default:
-        return encodeBulkString("")
-    }
-}
-
-func encodeRespValue(val RespValue) string {
-    switch val.Type {
-    case '+':
-        return encodeSimpleString(val.Value.(string))
-    case '-':
-        return encodeSimpleErrorResponse(val.Value.(string))
-    case ':':
-        return encodeInt(val.Value.(int))
-    case '$':
-        return encodeBulkString(val.Value.(string))
-    case '*':
-        return encodeRespValueArray(val.Value.([]RespValue))
+        return streamEntriesValue(v.Entries)
     default:
-        return encodeBulkString("")
+        return resp.NullBulkString()
     }
 }
-
-func encodeRespValueArray(arr []RespValue) string {
-    var sb strings.Builder
-    sb.WriteString(fmt.Sprintf("*%d\r\n", len(arr)))
-    for _, v := range arr {
-        sb.WriteString(encodeRespValue(v))
-    }
-    return sb.String()
-}
\ No newline at end of file
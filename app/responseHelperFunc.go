@@ -6,17 +6,29 @@ import (
 	"strings"
 	"time"
 	"unicode"
-    "net"
     "math"
+
+    "github.com/DeanLogan/redis-clone/app/resp"
 )
 
-func checkIfConnIsReplica(conn net.Conn) bool {
-    for _, r := range config.Replicas {
-        if r == conn {
-            return true
+func addReplica(c *client) {
+    if c.isReplica {
+        return
+    }
+    c.isReplica = true
+    // the lag counts from when the replica attached until its first ACK
+    c.replAckTime = time.Now()
+    config.Replicas = append(config.Replicas, c)
+}
+
+func removeReplica(c *client) {
+    for i, replica := range config.Replicas {
+        if replica == c {
+            config.Replicas = append(config.Replicas[:i], config.Replicas[i+1:]...)
+            break
         }
     }
-    return false
+    c.isReplica = false
 }
 
 func toSnakeCase(str string) string {
@@ -34,25 +46,12 @@ func toSnakeCase(str string) string {
     return string(result)
 }
 
-func isExpired(key string) bool {
-    expiration, exists := ttl[key]
-    if !exists {
-        return false
-    }
-    if expiration.Before(time.Now()) {
-        delete(ttl, key)
-        delete(store, key)
-        return true
-    }
-    return false
-}
-
 func generateMilisecondTime(entryId *string) {
     millis := time.Now().UnixNano() / int64(time.Millisecond)
     *entryId = strconv.FormatInt(millis, 10) + "-*"
 }
 
-func generateSequenceNumber(entryId *string) error {
+func generateSequenceNumber(streamKey string, entryId *string) error {
     if len(*entryId) > 0 {
         *entryId = (*entryId)[:len(*entryId)-1]
     }
@@ -62,8 +61,8 @@ func generateSequenceNumber(entryId *string) error {
         return fmt.Errorf("invalid stream ID given for 'xadd' command, additional info: %s", err.Error())
     }
 
-    currentSequenceNumber, exists := entryIds[milisecondTime]
-    if !exists {
+    topMilisecondTime, topSequenceNumber, exists := streamTopId(streamKey)
+    if !exists || topMilisecondTime != milisecondTime {
         if milisecondTime == 0 {
             *entryId += "1"
         } else {
@@ -72,11 +71,11 @@ func generateSequenceNumber(entryId *string) error {
         return nil
     }
 
-    *entryId += strconv.Itoa(currentSequenceNumber + 1)
+    *entryId += strconv.Itoa(topSequenceNumber + 1)
     return nil
 }
 
-func verifyStreamId(entryId string) string {
+func verifyStreamId(streamKey string, entryId string) string {
     milisecondTime, sequenceNumber, err := seperateStreamId(entryId)
     if err != nil {
         return encodeSimpleErrorResponse("invalid stream ID given for 'xadd' command, additional info: "+err.Error())
@@ -86,22 +85,27 @@ func verifyStreamId(entryId string) string {
         return encodeSimpleErrorResponse("The ID specified in XADD must be greater than 0-0")
     }
 
-    if milisecondTime < streamTopMilisecondsTimeForStream {
-        return encodeSimpleErrorResponse("The ID specified in XADD is equal or smaller than the target stream top item")
-    }
-
-    currentSequenceNumber, exists := entryIds[milisecondTime]
-    if exists && sequenceNumber <= currentSequenceNumber && milisecondTime == streamTopMilisecondsTimeForStream {
+    // IDs only have to increase within a stream, each stream has its own top item
+    topMilisecondTime, topSequenceNumber, exists := streamTopId(streamKey)
+    if exists && (milisecondTime < topMilisecondTime || (milisecondTime == topMilisecondTime && sequenceNumber <= topSequenceNumber)) {
         return encodeSimpleErrorResponse("The ID specified in XADD is equal or smaller than the target stream top item")
     }
 
-    // update stream top values
-    streamTopMilisecondsTimeForStream = milisecondTime
-    entryIds[milisecondTime] = sequenceNumber
-
     return ""
 }
 
+func streamTopId(streamKey string) (int, int, bool) {
+    stream, ok := getStream(streamKey)
+    if !ok || len(stream.Entries) == 0 {
+        return 0, 0, false
+    }
+    milisecondTime, sequenceNumber, err := seperateStreamId(stream.Entries[len(stream.Entries)-1].ID)
+    if err != nil {
+        return 0, 0, false
+    }
+    return milisecondTime, sequenceNumber, true
+}
+
 // seperate stream ID into milisecondTime and sequenceNumber
 func seperateStreamId(id string) (int, int, error) {
     index := strings.LastIndex(id, string('-'))
@@ -217,17 +221,16 @@ func fetchStreamEntries(streamKeys, startIDs []string, count int) []string {
     return result
 }
 
-func waitForNewStreamEntries(streamKeys []string, blockTime int, startIDs []string, count int, conn net.Conn) []string {
+func waitForNewStreamEntries(streamKeys []string, blockTime int, startIDs []string, count int, blockClient blockingClient) []string {
     key := streamKeys[0]
     var entries []string
-    blockClient := blockingClient{conn, make(chan struct{})}
-    addBlockingClient(key, blockClient, blockingQueueForXread)
 
     if blockTime == 0 {
         // Block forever until notified
         <-blockClient.notify
-        removeBlockingClient(key, conn, blockingQueueForXread)
-        entries = fetchStreamEntries(streamKeys, startIDs, count)
+        runOnExecutor(func() {
+            entries = fetchStreamEntries(streamKeys, startIDs, count)
+        })
     } else if blockTime > 0 {
         // waits depending on the block time which is measured in ms
         experationTime := time.Now().Add(time.Duration(blockTime * int(time.Millisecond)))
@@ -235,10 +238,13 @@ func waitForNewStreamEntries(streamKeys []string, blockTime int, startIDs []stri
 
         select {
         case <-blockClient.notify:
-            removeBlockingClient(key, conn, blockingQueueForXread)
-            entries = fetchStreamEntries(streamKeys, startIDs, count)
+            runOnExecutor(func() {
+                entries = fetchStreamEntries(streamKeys, startIDs, count)
+            })
         case <-timeoutChan:
-            removeBlockingClient(key, conn, blockingQueueForXread)
+            runOnExecutor(func() {
+                removeBlockingClient(key, blockClient.client, blockingQueueForXread)
+            })
             return nil 
         }
     }
@@ -278,44 +284,34 @@ func parseRangeIndices(cmd []string, arrLen int) (int, int, bool) {
     return startIndx, stopIndx, true
 }
 
-func handleBlockingPop(key string, conn net.Conn) []string {
-    arr, _ := getList[string](key)
-    removeBlockingClient(key, conn, blockingQueueForBlop)
+func popFromListHead(key string) (string, bool) {
+    arr, ok := getList[string](key)
+    if !ok || len(arr) == 0 {
+        return "", false
+    }
     _, val := removeFromList(key, arr, 0)
-    return []string{key, val}
-}
-
-func isInMulti(conn net.Conn) bool {
-    _, ok := queuedCommands[conn]
-    return ok
+    alsoPropagate([]string{"LPOP", key})
+    return encodeStringArray([]string{key, val}), true
 }
 
-func subscribe(channel string, conn net.Conn) {
+func subscribe(channel string, c *client) {
     if _, ok := channelSubscribers[channel]; !ok {
-        channelSubscribers[channel] = make(map[net.Conn]struct{})
+        channelSubscribers[channel] = make(map[*client]struct{})
     }
-    channelSubscribers[channel][conn] = struct{}{}
+    channelSubscribers[channel][c] = struct{}{}
+    c.subscriptions[channel] = struct{}{}
 }
 
-func unsubscribe(channel string, conn net.Conn) {
+func unsubscribe(channel string, c *client) {
+    delete(c.subscriptions, channel)
     if subs, ok := channelSubscribers[channel]; ok {
-        delete(subs, conn)
+        delete(subs, c)
         if len(subs) == 0 {
             delete(channelSubscribers, channel)
         }
     }
 }
 
-func subscriberCount(conn net.Conn) int {
-    count := 0
-    for _, subs := range channelSubscribers {
-        if _, ok := subs[conn]; ok {
-            count++
-        }
-    }
-    return count
-}
-
 func parseGeoCoords(longStr, latStr string) (float64, float64, error) {
     long, err := strconv.ParseFloat(longStr, 64)
     if err != nil {
@@ -338,20 +334,17 @@ func geoCoordsToStrings(long, lat float64) (string, string) {
     return longStr, latStr
 }
 
-func encodeGeoPositionResp(sortedSet SortedSet, setOk bool, location string) string {
+func geoPositionValue(sortedSet SortedSet, setOk bool, location string) resp.RespValue {
     if !setOk {
-        return "*-1\r\n"
+        return resp.NullArray()
     }
     encodedHashVal, ok := sortedSet.Entries[location]
     if !ok {
-        return "*-1\r\n"
+        return resp.NullArray()
     }
     lon, lat := decodeGeoHash(encodedHashVal)
     longStr, latStr := geoCoordsToStrings(lon, lat)
-    return wrapRespFragmentsAsArray([]string{
-        encodeBulkString(longStr),
-        encodeBulkString(latStr),
-    })
+    return resp.StringArray([]string{longStr, latStr})
 }
 
 func getLonLatForLocationInSet(sortedSet SortedSet, location string) (float64, float64) {
@@ -2,22 +2,27 @@ package main
 
 import (
 	"fmt"
-	"net"
 	"reflect"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
     "math"
+
+    "github.com/DeanLogan/redis-clone/app/resp"
 )
 
 const NullBulkString = "$-1\r\n"
 
+// version reported by HELLO and INFO
+const serverVersion = "7.2.0"
+
 func commandResponse() string {
     return encodeSimpleString("OK")
 }
 
-func xreadResponse(cmd []string, conn net.Conn) string {
-    parsedCmd, count, blockTime, err := parseXreadArguments(cmd)
+func xreadResponse(cmd []string) string {
+    parsedCmd, count, _, err := parseXreadArguments(cmd)
     if err != nil {
         return encodeSimpleErrorResponse(err.Error())
     }
@@ -30,8 +35,32 @@ func xreadResponse(cmd []string, conn net.Conn) string {
     normaliseStartIDs(streamKeys, startIDs)
 
     entries := fetchStreamEntries(streamKeys, startIDs, count)
+    return encodeStreamArray(entries)
+}
+
+func blockingXreadResponse(cmd []string, c *client) string {
+    parsedCmd, count, blockTime, err := parseXreadArguments(cmd)
+    if err != nil {
+        return encodeSimpleErrorResponse(err.Error())
+    }
+
+    streamKeys, startIDs, err := extractStreamKeysAndIDs(parsedCmd)
+    if err != nil {
+        return encodeSimpleErrorResponse(err.Error())
+    }
+
+    var entries []string
+    blockClient := newBlockingClient(c)
+    runOnExecutor(func() {
+        normaliseStartIDs(streamKeys, startIDs)
+        entries = fetchStreamEntries(streamKeys, startIDs, count)
+        if len(entries) == 0 && blockTime >= 0 {
+            addBlockingClient(streamKeys[0], blockClient, blockingQueueForXread)
+        }
+    })
+
     if len(entries) == 0 && blockTime >= 0 {
-        entries = waitForNewStreamEntries(streamKeys, blockTime, startIDs, count, conn)
+        entries = waitForNewStreamEntries(streamKeys, blockTime, startIDs, count, blockClient)
     }
     
     return encodeStreamArray(entries)
@@ -45,18 +74,18 @@ func xaddResponse(cmd []string) string {
     streamKey := cmd[1]
     entryId := cmd[2]
 
-    if len(entryId) == 1 && entryId[0] == ARRAY {
+    if len(entryId) == 1 && entryId[0] == resp.ARRAY {
         generateMilisecondTime(&entryId)
     } 
 
     if strings.HasSuffix(entryId, "*") {
-        err := generateSequenceNumber(&entryId)
+        err := generateSequenceNumber(streamKey, &entryId)
         if err != nil {
             return encodeSimpleErrorResponse(err.Error())
         }
     }
 
-    msg := verifyStreamId(entryId)
+    msg := verifyStreamId(streamKey, entryId)
     if msg != "" {
         return msg
     }
@@ -104,48 +133,103 @@ func typeResponse(cmd []string) string {
     return encodeSimpleString("none")
 }
 
-func replconfResponse(cmd []string, conn net.Conn) string {
-	switch strings.ToUpper(cmd[1]) {
-	case "GETACK":
-		if config.Role != "slave" && len(cmd) < 2 {
-			return errorResponse(fmt.Errorf("invalid replconf command"))
-		} 
+func replconfResponse(cmd []string, c *client) string {
+    switch strings.ToUpper(cmd[1]) {
+    case "GETACK":
+        if len(cmd) < 3 {
+            return errorResponse(fmt.Errorf("invalid replconf command"))
+        }
         if cmd[2] == "*" {
             bytes := int(math.Max(float64(config.ReplOffset), 0))
             // subtracted 37 as ReplOffset includes the current command which should not be included in the response
-            return encodeStringArray([]string{"REPLCONF", "ACK", strconv.Itoa(bytes)}) 
-        } else {
-            return encodeSimpleString("OK")
+            return encodeStringArray([]string{"REPLCONF", "ACK", strconv.Itoa(bytes)})
         }
+        return encodeSimpleString("OK")
     case "ACK":
+        if len(cmd) < 3 {
+            return errorResponse(fmt.Errorf("invalid replconf command"))
+        }
         ackOffset, _ := strconv.Atoi(cmd[2])
         // Only update if this connection is a known replica
-        if checkIfConnIsReplica(conn) {
-            replicaAckOffsets[conn] = ackOffset
-            ackReceived <- true
+        if c.isReplica {
+            c.replAckOffset = ackOffset
+            c.replAckTime = time.Now()
+            wakeReplicaWaiters()
+            checkFailover()
         }
         return ""
-	case "CAPA":
-		if config.Role != "master" && config.ListeningPort == "" {
-			return errorResponse(fmt.Errorf("invalid replconf command"))
-		}
-		return encodeSimpleString("OK")
-	case "LISTENING-PORT":
-		if config.Role != "master" && len(cmd) < 2 {
-			return errorResponse(fmt.Errorf("invalid replconf command"))
-		}
-		config.ListeningPort = cmd[2]
-		return encodeSimpleString("OK")
-	}
+    case "CAPA":
+        if config.Role != "master" && config.ListeningPort == "" {
+            return errorResponse(fmt.Errorf("invalid replconf command"))
+        }
+        return encodeSimpleString("OK")
+    case "LISTENING-PORT":
+        if len(cmd) < 3 {
+            return errorResponse(fmt.Errorf("invalid replconf command"))
+        }
+        c.replPort, _ = strconv.Atoi(cmd[2])
+        return encodeSimpleString("OK")
+    }
     return errorResponse(fmt.Errorf("invalid replconf command"))
 }
 
-func psyncResponse(cmd []string) (string, bool) {
-    if len(cmd) == 3 {
-        // TODO: Implement synch
-        return encodeSimpleString(fmt.Sprintf("FULLRESYNC %s 0", config.Replid)), true 
+// psyncResponse queues the +FULLRESYNC line itself so nothing can be written to
+// the replica between it and the RDB that follows
+func psyncResponse(cmd []string, c *client) string {
+    if len(cmd) != 3 && len(cmd) != 4 {
+        return encodeSimpleErrorResponse("wrong number of arguments for 'psync' command")
+    }
+    // "PSYNC <replid> <offset> FAILOVER" is our master handing over its role during FAILOVER
+    if len(cmd) == 4 {
+        if strings.ToUpper(cmd[3]) != "FAILOVER" {
+            return encodeSimpleErrorResponse("syntax error")
+        }
+        if cmd[1] != config.Replid {
+            return encodeSimpleErrorResponse("PSYNC FAILOVER replid must match my replid.")
+        }
+        if config.Role == "slave" {
+            fmt.Println("Failover request received, promoting to master")
+            replicationUnsetMaster()
+        }
+    }
+    // a replica only has something to offer once it follows its master's stream
+    if config.Role == "slave" && (replLink == nil || replLink.state != replLinkConnected) {
+        return encodeErrorResponseWithMsg("NOMASTERLINK", "Can't SYNC while not connected with my master")
+    }
+    // "PSYNC ? -1" is a replica without any history asking for a full sync
+    if offset, err := strconv.Atoi(cmd[2]); err == nil && cmd[1] != "?" && tryPartialResync(c, cmd[1], offset) {
+        return ""
+    }
+    startFullResync(c)
+    return ""
+}
+
+func replicaofResponse(cmd []string, c *client) string {
+    if len(cmd) != 3 {
+        return encodeSimpleErrorResponse(fmt.Sprintf("wrong number of arguments for '%s' command", strings.ToLower(cmd[0])))
+    }
+    if c.isMaster {
+        return encodeSimpleErrorResponse("Command is not valid when client is a replica.")
+    }
+    if failoverState != failoverNone {
+        return encodeSimpleErrorResponse("REPLICAOF not allowed while failing over.")
+    }
+    if strings.ToUpper(cmd[1]) == "NO" && strings.ToUpper(cmd[2]) == "ONE" {
+        if config.Role == "slave" {
+            replicationUnsetMaster()
+        }
+        return encodeSimpleString("OK")
     }
-    return "", false
+
+    port, err := strconv.Atoi(cmd[2])
+    if err != nil || port <= 0 || port > 65535 {
+        return encodeSimpleErrorResponse("Invalid master port")
+    }
+    if replLink != nil && replLink.host == cmd[1] && replLink.port == port {
+        return encodeSimpleString("OK Already connected to specified master")
+    }
+    replicationSetMaster(cmd[1], port)
+    return encodeSimpleString("OK")
 }
 
 func pingResponse(subscriber bool) string {
@@ -159,27 +243,22 @@ func echoResponse(cmd []string) string {
     return encodeBulkString(cmd[1])
 }
 
-func infoResponse(cmd []string) string {
+func infoResponse(cmd []string, c *client) string {
     if len(cmd) == 2 && strings.ToUpper(cmd[1]) == "REPLICATION" {
-        response := ""
-        v := reflect.ValueOf(config)
-        t := v.Type()
-
-        for i := 0; i < v.NumField(); i++ {
-            field := v.Field(i)
-            fieldName := toSnakeCase(t.Field(i).Name)
-            if field.Kind() == reflect.Slice {
-                response += fmt.Sprintf("%s:%d", fieldName, field.Len()) + "\r\n"
-            } else {
-                response += fmt.Sprintf("%s:%v", fieldName, field.Interface()) + "\r\n"
-            }
-        }
-        if response == "" {
-            return NullBulkString
+        // only the replication state redis reports, not the config behind it
+        response := "role:" + config.Role + "\r\n"
+        response += replicationLinkInfo()
+        response += replicasInfo()
+        response += failoverInfo()
+        // redis shows a zeroed id when there is no previous history
+        replid2 := config.Replid2
+        if replid2 == "" {
+            replid2 = strings.Repeat("0", 40)
         }
+        response += fmt.Sprintf("master_replid:%s\r\nmaster_replid2:%s\r\nmaster_repl_offset:%d\r\nsecond_repl_offset:%d\r\nrepl_backlog_size:%d\r\n",
+            config.Replid, replid2, config.MasterReplOffset, config.SecondReplOffset, config.ReplBacklogSize)
         response = response[:len(response)-2] // remove the last \r\n
-		fmt.Println(encodeBulkString(response))
-        return encodeBulkString(response)
+        return c.encode(resp.VerbatimString("txt", response))
     }
     return ""
 }
@@ -187,9 +266,12 @@ func infoResponse(cmd []string) string {
 func setResponse(cmd []string) string {
     key, value := cmd[1], cmd[2]
     setGenericValue(key, value)
+    delete(ttl, key)
     if len(cmd) == 5 && strings.ToUpper(cmd[3]) == "PX" {
         expiration, _ := strconv.Atoi(cmd[4])
         ttl[key] = time.Now().Add(time.Millisecond * time.Duration(expiration))
+        // replicas and the AOF get the deadline, not the time left
+        rewritePropagation([]string{"SET", key, value}, []string{"PEXPIREAT", key, strconv.FormatInt(ttl[key].UnixMilli(), 10)})
     }
     return encodeSimpleString("OK")
 }
@@ -269,33 +351,64 @@ func lPopResponse(cmd []string) string {
     return encodeStringArray(valsPopped)
 }
 
-func bLPopResponse(cmd []string, conn net.Conn) string {
+func bLPopResponse(cmd []string, c *client) string {
     key := cmd[1]
     timoutStr := cmd[2]
     timeout, err := strconv.ParseFloat(timoutStr, 64)
     if err != nil {
         return "$-1\r\n"
     }
-    
-    blockClient := blockingClient{conn, make(chan struct{})}
-    addBlockingClient(key, blockClient, blockingQueueForBlop)
+
+    var response string
+    var popped bool
+    blockClient := newBlockingClient(c)
+    runOnExecutor(func() {
+        response, popped = popFromListHead(key)
+        if popped {
+            touchWatchedKey(key)
+        } else {
+            addBlockingClient(key, blockClient, blockingQueueForBlop)
+        }
+        flushPropagation()
+    })
+    if popped {
+        return response
+    }
+
     if timeout == 0 {
-        <-blockClient.notify
-        arr := handleBlockingPop(key, conn)
-        return encodeStringArray(arr)
+        val := <-blockClient.notify
+        return encodeStringArray([]string{key, val})
     }
 
     experationTime := time.Now().Add(time.Duration(timeout * float64(time.Second)))
     timeoutChan := time.After(time.Until(experationTime))
     
     select {
-    case <-blockClient.notify:
-        arr := handleBlockingPop(key, conn)
-        return encodeStringArray(arr)
+    case val := <-blockClient.notify:
+        return encodeStringArray([]string{key, val})
     case <-timeoutChan:
-        removeBlockingClient(key, conn, blockingQueueForBlop)
+        runOnExecutor(func() {
+            removeBlockingClient(key, c, blockingQueueForBlop)
+        })
+        // a push may have served this client just before it was removed
+        select {
+        case val := <-blockClient.notify:
+            return encodeStringArray([]string{key, val})
+        default:
+            return "*-1\r\n"
+        }
+    }
+}
+
+// BLPOP inside MULTI/EXEC behaves like a pop that has already timed out
+func nonBlockingBLPopResponse(cmd []string) string {
+    // replicas and the AOF get the LPOP, or nothing when the list was empty
+    rewritePropagation()
+    response, popped := popFromListHead(cmd[1])
+    if !popped {
         return "*-1\r\n"
     }
+    return response
 }
 
 func getResponse(cmd []string) string {
@@ -308,61 +421,69 @@ func getResponse(cmd []string) string {
     return encodeBulkString(value)
 }
 
-func waitResponse(cmd []string) string {
+func waitResponse(cmd []string, c *client) string {
     count, err := strconv.Atoi(cmd[1])
-    if err != nil {
-        return errorResponse(err)
+    if err != nil || count < 0 {
+        return encodeSimpleErrorResponse("value is out of range, must be positive")
     }
     timeout, err := strconv.Atoi(cmd[2])
-    if err != nil {
-        return errorResponse(err)
-    }
-
-	fmt.Printf("Wait count=%d timeout=%d\n", count, timeout)
-	propagate([]string{"REPLCONF", "GETACK", "*"})
-
-	for i := 0; i < len(config.Replicas); i++ {
-		go func(conn net.Conn) {
-			fmt.Println("waiting response from replica", conn.RemoteAddr().String())
-			buffer := make([]byte, 1024)
-			// TODO: Ignoring result, just "flushing" the response
-			_, err := conn.Read(buffer)
-			if err == nil {
-				fmt.Println("got response from replica", conn.RemoteAddr().String())
-			} else {
-				fmt.Println("error from replica", conn.RemoteAddr().String(), " => ", err.Error())
-			}
-			ackReceived <- true
-		}(config.Replicas[i])
-	}
-
-	timer := time.After(time.Duration(timeout) * time.Millisecond)
-
-	acks := 0
-    outer:
-    for acks < count {
-        select {
-        case <-ackReceived:
-            acks++
-            fmt.Println("acks =", acks)
-        case <-timer:
-            fmt.Println("timeout! acks =", acks)
-            break outer
+    if err != nil || timeout < 0 {
+        return encodeSimpleErrorResponse("timeout is out of range, must be positive")
+    }
+
+    var response string
+    waiter := &replicaWaiter{numReplicas: count, notify: make(chan int, 1)}
+    runOnExecutor(func() {
+        if config.Role == "slave" {
+            response = encodeSimpleErrorResponse("WAIT cannot be used with replica instances.")
+            return
         }
+        // writes made after this call don't have to be acknowledged
+        waiter.offset = config.MasterReplOffset
+        acked := countAckedReplicas(waiter.offset)
+        if acked >= count || len(config.Replicas) == 0 {
+            response = encodeInt(acked)
+            return
+        }
+        addReplicaWaiter(waiter)
+        propagate([]string{"REPLCONF", "GETACK", "*"})
+    })
+    if response != "" {
+        return response
+    }
+
+    var timeoutChan <-chan time.Time
+    if timeout > 0 {
+        timeoutChan = time.After(time.Duration(timeout) * time.Millisecond)
+    }
+    select {
+    case acked := <-waiter.notify:
+        return encodeInt(acked)
+    case <-timeoutChan:
+        var acked int
+        runOnExecutor(func() {
+            removeReplicaWaiter(waiter)
+            acked = countAckedReplicas(waiter.offset)
+        })
+        return encodeInt(acked)
     }
-    // return num of connected replicas if ACK was never sent before WAIT
-    if(acks == 0) {
-        acks = len(config.Replicas)
+}
+
+// waitInMultiResponse is WAIT inside MULTI, it can't block so it reports how
+// many replicas already acknowledged everything written so far
+func waitInMultiResponse() string {
+    if config.Role == "slave" {
+        return encodeSimpleErrorResponse("WAIT cannot be used with replica instances.")
     }
-	return encodeInt(acks)
+    return encodeInt(countAckedReplicas(config.MasterReplOffset))
 }
 
-func configResponse(cmd []string) string {
+func configResponse(cmd []string, c *client) string {
     fmt.Println("configResponse", len(cmd))
     if len(cmd) >= 3 {
         switch strings.ToUpper(cmd[1]) {
         case "GET":
-            return configGetResponse(cmd)
+            return configGetResponse(cmd, c)
         case "SET":
             return configSetResponse(cmd)
         }
@@ -370,22 +491,64 @@ func configResponse(cmd []string) string {
     return errorResponse(fmt.Errorf("invalid config set command, invalid number of arguments"))
 }
 
-func configGetResponse(cmd []string) string {
-    switch strings.ToLower(cmd[2]) {
+func configGetResponse(cmd []string, c *client) string {
+    name := strings.ToLower(cmd[2])
+    var value string
+    switch name {
     case "dir":
-        return encodeStringArray([]string{"dir", config.Dir})
+        value = config.Dir
     case "dbfilename":
-        return encodeStringArray([]string{"dbfilename", config.Dbfilename})
+        value = config.Dbfilename
     case "appendonly":
-        return encodeStringArray([]string{"appendonly", config.AppendOnly})
+        value = config.AppendOnly
     case "appenddirname":
-        return encodeStringArray([]string{"appenddirname", config.AppendDirName})
+        value = config.AppendDirName
     case "appendfilename":
-        return encodeStringArray([]string{"appendfilename", config.AppendFilename})
+        value = config.AppendFilename
     case "appendfsync":
-        return encodeStringArray([]string{"appendfsync", config.AppendFSync})
-    }
-    return encodeSimpleErrorResponse("selected val does not exists")
+        value = config.AppendFSync
+    case "proto-max-bulk-len":
+        value = strconv.Itoa(config.ProtoMaxBulkLen)
+    case "auto-aof-rewrite-percentage":
+        value = strconv.Itoa(config.AutoAofRewritePercentage)
+    case "auto-aof-rewrite-min-size":
+        value = strconv.Itoa(config.AutoAofRewriteMinSize)
+    case "save":
+        value = formatSavePoints(config.SavePoints)
+    case "repl-backlog-size":
+        value = strconv.Itoa(config.ReplBacklogSize)
+    case "repl-backlog-ttl":
+        value = strconv.Itoa(config.ReplBacklogTTL)
+    case "replica-read-only":
+        value = config.ReplicaReadOnly
+    case "min-replicas-to-write":
+        value = strconv.Itoa(config.MinReplicasToWrite)
+    case "min-replicas-max-lag":
+        value = strconv.Itoa(config.MinReplicasMaxLag)
+    case "repl-ping-replica-period":
+        value = strconv.Itoa(config.ReplPingReplicaPeriod)
+    case "repl-timeout":
+        value = strconv.Itoa(config.ReplTimeout)
+    case "repl-diskless-sync":
+        value = config.ReplDisklessSync
+    case "repl-diskless-sync-delay":
+        value = strconv.Itoa(config.ReplDisklessSyncDelay)
+    case "repl-diskless-load":
+        value = config.ReplDisklessLoad
+    case "masteruser":
+        value = config.Masteruser
+    case "masterauth":
+        value = config.Masterauth
+    case "cluster-enabled":
+        value = config.ClusterEnabled
+    case "cluster-config-file":
+        value = config.ClusterConfigFile
+    case "cluster-node-timeout":
+        value = strconv.Itoa(config.ClusterNodeTimeout)
+    default:
+        return encodeSimpleErrorResponse("selected val does not exists")
+    }
+    return c.encode(resp.Map(resp.KV(name, resp.BulkString(value))))
 }
 
 func configSetResponse(cmd []string) string {
@@ -394,6 +557,9 @@ func configSetResponse(cmd []string) string {
         if len(cmd) < 4 {
             return errorResponse(fmt.Errorf("invalid config set command, REPL-ROLE requires a value"))
         }
+        if config.Role == "slave" && cmd[3] == "master" {
+            shiftReplicationId()
+        }
         config.Role = cmd[3]
         return encodeSimpleString("OK") 
     case "REPL-ID":
@@ -408,16 +574,168 @@ func configSetResponse(cmd []string) string {
         }
         config.ReplOffset, _ = strconv.Atoi(cmd[3])
         return encodeSimpleString("OK")
+    case "PROTO-MAX-BULK-LEN":
+        if len(cmd) < 4 {
+            return errorResponse(fmt.Errorf("invalid config set command, PROTO-MAX-BULK-LEN requires a value"))
+        }
+        size, err := parseMemorySize(cmd[3])
+        if err != nil || size < 1024*1024 {
+            return encodeSimpleErrorResponse("argument must be a memory value of at least 1mb")
+        }
+        config.ProtoMaxBulkLen = size
+        return encodeSimpleString("OK")
+    case "AUTO-AOF-REWRITE-PERCENTAGE":
+        if len(cmd) < 4 {
+            return errorResponse(fmt.Errorf("invalid config set command, AUTO-AOF-REWRITE-PERCENTAGE requires a value"))
+        }
+        percentage, err := strconv.Atoi(cmd[3])
+        if err != nil || percentage < 0 {
+            return encodeSimpleErrorResponse("argument must be a positive integer")
+        }
+        config.AutoAofRewritePercentage = percentage
+        return encodeSimpleString("OK")
+    case "AUTO-AOF-REWRITE-MIN-SIZE":
+        if len(cmd) < 4 {
+            return errorResponse(fmt.Errorf("invalid config set command, AUTO-AOF-REWRITE-MIN-SIZE requires a value"))
+        }
+        size, err := parseMemorySize(cmd[3])
+        if err != nil || size < 0 {
+            return encodeSimpleErrorResponse("argument must be a memory value")
+        }
+        config.AutoAofRewriteMinSize = size
+        return encodeSimpleString("OK")
+    case "SAVE":
+        if len(cmd) < 4 {
+            return errorResponse(fmt.Errorf("invalid config set command, SAVE requires a value"))
+        }
+        points, err := parseSavePoints(cmd[3])
+        if err != nil {
+            return encodeSimpleErrorResponse(err.Error())
+        }
+        config.SavePoints = points
+        return encodeSimpleString("OK")
+    case "REPL-BACKLOG-SIZE":
+        if len(cmd) < 4 {
+            return errorResponse(fmt.Errorf("invalid config set command, REPL-BACKLOG-SIZE requires a value"))
+        }
+        size, err := parseMemorySize(cmd[3])
+        if err != nil || size < 16*1024 {
+            return encodeSimpleErrorResponse("argument must be a memory value of at least 16kb")
+        }
+        config.ReplBacklogSize = size
+        if backlog != nil {
+            backlog.resize(size)
+        }
+        return encodeSimpleString("OK")
+    case "REPL-BACKLOG-TTL":
+        if len(cmd) < 4 {
+            return errorResponse(fmt.Errorf("invalid config set command, REPL-BACKLOG-TTL requires a value"))
+        }
+        seconds, err := strconv.Atoi(cmd[3])
+        if err != nil || seconds < 0 {
+            return encodeSimpleErrorResponse("argument must be a positive integer")
+        }
+        config.ReplBacklogTTL = seconds
+        return encodeSimpleString("OK")
+    case "REPLICA-READ-ONLY":
+        if len(cmd) < 4 {
+            return errorResponse(fmt.Errorf("invalid config set command, REPLICA-READ-ONLY requires a value"))
+        }
+        value := strings.ToLower(cmd[3])
+        if value != "yes" && value != "no" {
+            return encodeSimpleErrorResponse("argument must be 'yes' or 'no'")
+        }
+        config.ReplicaReadOnly = value
+        return encodeSimpleString("OK")
+    case "MIN-REPLICAS-TO-WRITE", "MIN-REPLICAS-MAX-LAG":
+        if len(cmd) < 4 {
+            return errorResponse(fmt.Errorf("invalid config set command, %s requires a value", strings.ToUpper(cmd[2])))
+        }
+        n, err := strconv.Atoi(cmd[3])
+        if err != nil || n < 0 {
+            return encodeSimpleErrorResponse("argument must be a positive integer")
+        }
+        if strings.ToUpper(cmd[2]) == "MIN-REPLICAS-TO-WRITE" {
+            config.MinReplicasToWrite = n
+        } else {
+            config.MinReplicasMaxLag = n
+        }
+        return encodeSimpleString("OK")
+    case "REPL-PING-REPLICA-PERIOD", "REPL-TIMEOUT":
+        if len(cmd) < 4 {
+            return errorResponse(fmt.Errorf("invalid config set command, %s requires a value", strings.ToUpper(cmd[2])))
+        }
+        seconds, err := strconv.Atoi(cmd[3])
+        if err != nil || seconds <= 0 {
+            return encodeSimpleErrorResponse("argument must be a positive integer")
+        }
+        if strings.ToUpper(cmd[2]) == "REPL-PING-REPLICA-PERIOD" {
+            config.ReplPingReplicaPeriod = seconds
+        } else {
+            config.ReplTimeout = seconds
+        }
+        return encodeSimpleString("OK")
+    case "REPL-DISKLESS-SYNC":
+        if len(cmd) < 4 {
+            return errorResponse(fmt.Errorf("invalid config set command, REPL-DISKLESS-SYNC requires a value"))
+        }
+        value := strings.ToLower(cmd[3])
+        if value != "yes" && value != "no" {
+            return encodeSimpleErrorResponse("argument must be 'yes' or 'no'")
+        }
+        config.ReplDisklessSync = value
+        return encodeSimpleString("OK")
+    case "REPL-DISKLESS-SYNC-DELAY":
+        if len(cmd) < 4 {
+            return errorResponse(fmt.Errorf("invalid config set command, REPL-DISKLESS-SYNC-DELAY requires a value"))
+        }
+        seconds, err := strconv.Atoi(cmd[3])
+        if err != nil || seconds < 0 {
+            return encodeSimpleErrorResponse("argument must be a positive integer")
+        }
+        config.ReplDisklessSyncDelay = seconds
+        return encodeSimpleString("OK")
+    case "REPL-DISKLESS-LOAD":
+        if len(cmd) < 4 {
+            return errorResponse(fmt.Errorf("invalid config set command, REPL-DISKLESS-LOAD requires a value"))
+        }
+        value := strings.ToLower(cmd[3])
+        if !isDisklessLoadMode(value) {
+            return encodeSimpleErrorResponse("argument must be one of disabled, on-empty-db or swapdb")
+        }
+        config.ReplDisklessLoad = value
+        return encodeSimpleString("OK")
+    case "MASTERUSER", "MASTERAUTH":
+        if len(cmd) < 4 {
+            return errorResponse(fmt.Errorf("invalid config set command, %s requires a value", strings.ToUpper(cmd[2])))
+        }
+        // used from the next connection attempt
+        if strings.ToUpper(cmd[2]) == "MASTERUSER" {
+            config.Masteruser = cmd[3]
+        } else {
+            config.Masterauth = cmd[3]
+        }
+        return encodeSimpleString("OK")
+    case "CLUSTER-NODE-TIMEOUT":
+        if len(cmd) < 4 {
+            return errorResponse(fmt.Errorf("invalid config set command, CLUSTER-NODE-TIMEOUT requires a value"))
+        }
+        ms, err := strconv.Atoi(cmd[3])
+        if err != nil || ms <= 0 {
+            return encodeSimpleErrorResponse("argument must be a positive integer")
+        }
+        config.ClusterNodeTimeout = ms
+        return encodeSimpleString("OK")
     }
     return encodeSimpleErrorResponse("selected val does not exists")
 }
 
 func keysResponse(cmd []string) string {
-    if cmd[1] != "*" {
-        return errorResponse(fmt.Errorf("invalid number of arguments"))
-    }
+    keys := []string{}
     for key := range store {
-        keys = append(keys, key)
+        if stringMatch(cmd[1], key, false) && !isExpired(key) {
+            keys = append(keys, key)
+        }
     }
     return encodeStringArray(keys)
 }
@@ -437,55 +755,61 @@ func incrResponse(cmd []string) string {
     return encodeInt(intVal)
 }
 
-func multiResponse(conn net.Conn) string {
-    if !isInMulti(conn) {
-        queuedCommands[conn] = [][]string{}
+func multiResponse(c *client) string {
+    if !c.inMulti {
+        c.inMulti = true
+        c.multiQueue = [][]string{}
     }
     return encodeSimpleString("OK")
 }
 
-func execResponse(conn net.Conn) string {
-    commands, ok := queuedCommands[conn]
-    
-    if !ok {
+func execResponse(c *client) string {
+    if !c.inMulti {
         return encodeSimpleErrorResponse("EXEC without MULTI")
     }
 
-    if dirtyWatchedConns[conn] {
-        delete(queuedCommands, conn)
-        clearWatchedState(conn)
+    commands := c.multiQueue
+    c.inMulti = false
+    c.multiQueue = nil
+
+    if c.watchDirty {
+        clearWatchedState(c)
         return "*-1\r\n"
     }
 
     var results []string
-
-    delete(queuedCommands, conn)
+    beginExecPropagation()
     for _, cmd := range commands {        
-        response, _ := handleCommand(cmd, conn)
-        results = append(results, response)
+        response := handleCommand(cmd, c)
+        results = append(results, c.upgradeNull(response))
     }
-    clearWatchedState(conn)
+    endExecPropagation()
+    clearWatchedState(c)
     return wrapRespFragmentsAsArray(results)
 }
 
-func discardResponse(conn net.Conn) string {
-    if !isInMulti(conn) {
+func discardResponse(c *client) string {
+    if !c.inMulti {
         return encodeSimpleErrorResponse("DISCARD without MULTI")
     }
-    delete(queuedCommands, conn)
-    clearWatchedState(conn)
+    c.inMulti = false
+    c.multiQueue = nil
+    clearWatchedState(c)
     return encodeSimpleString("OK")
 }
 
-func subscribeResponse(cmd []string, conn net.Conn) string {
-    channel := cmd[1]
-    subscribe(channel, conn)
-    response := []RespValue{
-        {Type: BULK, Value: "subscribe"},
-        {Type: BULK, Value: channel},
-        {Type: ':', Value: subscriberCount(conn)},
-    }
-    return encodeRespValueArray(response)
+// SUBSCRIBE channel [channel ...], confirming each with the running count
+func subscribeResponse(cmd []string, c *client) string {
+    var response strings.Builder
+    for _, channel := range cmd[1:] {
+        subscribe(channel, c)
+        response.WriteString(c.encode(resp.Push(
+            resp.BulkString("subscribe"),
+            resp.BulkString(channel),
+            resp.Integer(len(c.subscriptions)),
+        )))
+    }
+    return response.String()
 }
 
 func publishResponse(cmd []string) string {
@@ -493,24 +817,109 @@ func publishResponse(cmd []string) string {
     msg := cmd[2]
     channel := channelSubscribers[channelName]
 
-    arr := []string{"message", channelName, msg}
-    for conn := range channel {
-        conn.Write([]byte(encodeStringArray(arr)))
+    message := resp.Push(resp.BulkString("message"), resp.BulkString(channelName), resp.BulkString(msg))
+    for subscriber := range channel {
+        subscriber.queueReply(subscriber.encode(message))
     }
     
     count := len(channel)
     return encodeInt(count)
 }
 
-func unsubscribeResponse(cmd []string, conn net.Conn) string {
-    channel := cmd[1]
-    unsubscribe(channel, conn)
-        response := []RespValue{
-        {Type: BULK, Value: "unsubscribe"},
-        {Type: BULK, Value: channel},
-        {Type: ':', Value: subscriberCount(conn)},
+// UNSUBSCRIBE [channel [channel ...]], without channels it leaves every one
+func unsubscribeResponse(cmd []string, c *client) string {
+    channels := cmd[1:]
+    if len(channels) == 0 {
+        for channel := range c.subscriptions {
+            channels = append(channels, channel)
+        }
+        sort.Strings(channels)
+    }
+    // with nothing to leave redis still confirms, naming no channel
+    if len(channels) == 0 {
+        return c.encode(resp.Push(resp.BulkString("unsubscribe"), resp.Null(), resp.Integer(0)))
+    }
+
+    var response strings.Builder
+    for _, channel := range channels {
+        unsubscribe(channel, c)
+        response.WriteString(c.encode(resp.Push(
+            resp.BulkString("unsubscribe"),
+            resp.BulkString(channel),
+            resp.Integer(len(c.subscriptions)),
+        )))
+    }
+    return response.String()
+}
+
+func saddResponse(cmd []string) string {
+    key := cmd[1]
+
+    set := make(map[string]struct{})
+    if existing, ok := store[key]; ok {
+        existingSet, ok := existing.value.(map[string]struct{})
+        if !ok {
+            return encodeErrorResponseWithMsg("WRONGTYPE", "Operation against a key holding the wrong kind of value")
+        }
+        set = existingSet
+    }
+
+    added := 0
+    for _, member := range cmd[2:] {
+        if _, exists := set[member]; !exists {
+            set[member] = struct{}{}
+            added++
+        }
+    }
+    store[key] = RedisValue{value: set}
+    return encodeInt(added)
+}
+
+func hsetResponse(cmd []string) string {
+    if len(cmd) < 4 || len(cmd)%2 != 0 {
+        return encodeSimpleErrorResponse("wrong number of arguments for 'hset' command")
+    }
+    key := cmd[1]
+
+    hash := make(map[string]string)
+    if existing, ok := store[key]; ok {
+        existingHash, ok := existing.value.(map[string]string)
+        if !ok {
+            return encodeErrorResponseWithMsg("WRONGTYPE", "Operation against a key holding the wrong kind of value")
+        }
+        hash = existingHash
+    }
+
+    added := 0
+    for i := 2; i < len(cmd); i += 2 {
+        if _, exists := hash[cmd[i]]; !exists {
+            added++
+        }
+        hash[cmd[i]] = cmd[i+1]
+    }
+    store[key] = RedisValue{value: hash}
+    return encodeInt(added)
+}
+
+func hgetResponse(cmd []string) string {
+    hash, ok := getHash(cmd[1])
+    if !ok {
+        return NullBulkString
+    }
+    value, ok := hash[cmd[2]]
+    if !ok {
+        return NullBulkString
     }
-    return encodeRespValueArray(response)
+    return encodeBulkString(value)
+}
+
+func hgetallResponse(cmd []string, c *client) string {
+    hash, _ := getHash(cmd[1])
+    pairs := make([]resp.Pair, 0, len(hash))
+    for field, value := range hash {
+        pairs = append(pairs, resp.KV(field, resp.BulkString(value)))
+    }
+    return c.encode(resp.Map(pairs...))
 }
 
 func zaddResponse(cmd []string) string {
@@ -578,7 +987,7 @@ func zcardResponse(cmd []string) string {
     return encodeInt(len(sortedSet.Entries))
 }
 
-func zscoreResponse(cmd []string) string {
+func zscoreResponse(cmd []string, c *client) string {
     key := cmd[1]
     memberKey := cmd[2]
 
@@ -591,8 +1000,7 @@ func zscoreResponse(cmd []string) string {
         return NullBulkString
     }
 
-    memberScoreStr := strconv.FormatFloat(memberScore, 'f', -1, 64)
-    return encodeBulkString(memberScoreStr)
+    return c.encode(resp.Double(memberScore))
 }
 
 func zremResponse(cmd []string) string {
@@ -640,15 +1048,15 @@ func geoaddResponse(cmd []string) string {
     return encodeInt(len(sortedSet.Entries) - setLenBeforeAdds)
 }
 
-func geoposResponse(cmd []string) string {
+func geoposResponse(cmd []string, c *client) string {
     key := cmd[1]
     sortedSet, ok := getSortedSet(key)
-    var result []string
+    var result []resp.RespValue
 
     for _, location := range cmd[2:] {
-        result = append(result, encodeGeoPositionResp(sortedSet, ok, location))
+        result = append(result, geoPositionValue(sortedSet, ok, location))
     }
-    return wrapRespFragmentsAsArray(result)
+    return c.encode(resp.Array(result...))
 }
 
 func geodistResponse(cmd []string) string {
@@ -705,8 +1113,8 @@ func geosearchResponse(cmd []string) string {
     return encodeStringArray(result)
 }
 
-func aclResponse(cmd []string, conn net.Conn) string {
-    username := loggedInUsers[conn]
+func aclResponse(cmd []string, c *client) string {
+    username := c.user
 
     cmdArg := strings.ToUpper(cmd[1])
     if cmdArg == "WHOAMI" {
@@ -716,41 +1124,133 @@ func aclResponse(cmd []string, conn net.Conn) string {
         return encodeBulkString(username)
     }
 
-    user, ok := config.Users[cmd[2]]
-    if !ok {
-        return encodeSimpleErrorResponse("ACL user config not found")
+    if len(cmd) < 3 {
+        return encodeSimpleErrorResponse(fmt.Sprintf("wrong number of arguments for 'acl|%s' command", strings.ToLower(cmd[1])))
     }
+    user, ok := config.Users[cmd[2]]
 
     switch cmdArg {
     case "GETUSER":
-        return encodeRespValueArray(user.toGetUser())
+        if !ok {
+            return NullBulkString
+        }
+        return c.encode(user.toGetUser())
     case "SETUSER":
-        user.setPassword(cmd[3])
+        // like redis a new user is off, has no password and can't run anything until the rules say so
+        if !ok {
+            user = aclUser{
+                Username: cmd[2],
+                Flags:    map[string]struct{}{"off": {}},
+                Password: make(map[string]struct{}),
+                Commands: make(map[string]bool),
+            }
+        }
+        // the rules go to a copy, a failing one leaves the user as it was
+        user = user.clone()
+        for _, rule := range cmd[3:] {
+            if err := user.applyRule(rule); err != nil {
+                return encodeSimpleErrorResponse(err.Error())
+            }
+        }
+        config.Users[cmd[2]] = user
         return encodeSimpleString("OK")
     }
 
     return encodeSimpleErrorResponse("command not yet supported")
 }
 
-func authResponse(cmd []string, conn net.Conn) string {
-    if len(cmd) != 3 {
+// HELLO [protover [AUTH username password] [SETNAME clientname]]
+func helloResponse(cmd []string, c *client) string {
+    protocol := c.protocol
+    if len(cmd) > 1 {
+        version, err := strconv.Atoi(cmd[1])
+        if err != nil {
+            return encodeSimpleErrorResponse("Protocol version is not an integer or out of range")
+        }
+        if version != 2 && version != 3 {
+            return encodeErrorResponseWithMsg("NOPROTO", "unsupported protocol version")
+        }
+        protocol = version
+    }
+
+    var name string
+    setName := false
+    for i := 2; i < len(cmd); i++ {
+        switch strings.ToUpper(cmd[i]) {
+        case "AUTH":
+            if i+2 >= len(cmd) {
+                return encodeSimpleErrorResponse(fmt.Sprintf("Syntax error in HELLO option '%s'", cmd[i]))
+            }
+            user, ok := config.Users[cmd[i+1]]
+            if !ok || !user.authenticate(c, cmd[i+2]) {
+                return encodeErrorResponseWithMsg("WRONGPASS", "invalid username-password pair or user is disabled.")
+            }
+            i += 2
+        case "SETNAME":
+            if i+1 >= len(cmd) {
+                return encodeSimpleErrorResponse(fmt.Sprintf("Syntax error in HELLO option '%s'", cmd[i]))
+            }
+            if strings.ContainsAny(cmd[i+1], " \n") {
+                return encodeSimpleErrorResponse("Client names cannot contain spaces, newlines or special characters.")
+            }
+            name = cmd[i+1]
+            setName = true
+            i++
+        default:
+            return encodeSimpleErrorResponse(fmt.Sprintf("Syntax error in HELLO option '%s'", cmd[i]))
+        }
+    }
+
+    c.protocol = protocol
+    if setName {
+        c.name = name
+    }
+
+    role := "master"
+    if config.Role == "slave" {
+        role = "replica"
+    }
+    mode := "standalone"
+    if sentinelMode {
+        mode = "sentinel"
+    } else if clusterEnabled() {
+        mode = "cluster"
+    }
+    return c.encode(resp.Map(
+        resp.KV("server", resp.BulkString("redis")),
+        resp.KV("version", resp.BulkString(serverVersion)),
+        resp.KV("proto", resp.Integer(c.protocol)),
+        resp.KV("id", resp.Integer(c.id)),
+        resp.KV("mode", resp.BulkString(mode)),
+        resp.KV("role", resp.BulkString(role)),
+        resp.KV("modules", resp.Array()),
+    ))
+}
+
+// AUTH [username] password, without a username it's the default user
+func authResponse(cmd []string, c *client) string {
+    if len(cmd) != 2 && len(cmd) != 3 {
         return encodeErrorResponseWithMsg("WRONGPASS", "invalid username-password pair or user is disabled.")
     }
+    username, password := "default", cmd[len(cmd)-1]
+    if len(cmd) == 3 {
+        username = cmd[1]
+    }
 
-    user, ok := config.Users[cmd[1]]
+    user, ok := config.Users[username]
     if !ok {
         return encodeErrorResponseWithMsg("WRONGPASS", "ACL user config not found")
     }
 
-    if !user.authenticate(conn, cmd[2]) {
+    if !user.authenticate(c, password) {
         return encodeErrorResponseWithMsg("WRONGPASS", "invalid username-password pair or user is disabled.")
     }
 
     return encodeSimpleString("OK")
 }
 
-func watchResponse(cmd []string, conn net.Conn) string {
-    if isInMulti(conn) {
+func watchResponse(cmd []string, c *client) string {
+    if c.inMulti {
         return encodeSimpleErrorResponse("WATCH inside MULTI is not allowed");
     }
     if len(cmd) <= 1 {
@@ -760,34 +1260,76 @@ func watchResponse(cmd []string, conn net.Conn) string {
     for i := 1; i < len(cmd); i++ {
         watchers, ok := watchedKeys[cmd[i]]
         if !ok {
-            watchers = make(map[net.Conn]struct{})
+            watchers = make(map[*client]struct{})
         }
-        watchers[conn] = struct{}{}
+        watchers[c] = struct{}{}
         watchedKeys[cmd[i]] = watchers
+        c.watchedKeys[cmd[i]] = struct{}{}
     }
 
     return encodeSimpleString("OK")
 }
 
-func unwatchResponse(conn net.Conn) string {
-    clearWatchedState(conn)
+func unwatchResponse(c *client) string {
+    clearWatchedState(c)
     return encodeSimpleString("OK")
 }
 
-func clearWatchedState(conn net.Conn) {
-    delete(dirtyWatchedConns, conn)
-
-    for key, watchers := range watchedKeys {
-        if _, ok := watchers[conn]; !ok {
-            continue
-        }
+func clearWatchedState(c *client) {
+    c.watchDirty = false
 
-        delete(watchers, conn)
+    for key := range c.watchedKeys {
+        watchers := watchedKeys[key]
+        delete(watchers, c)
         if len(watchers) == 0 {
             delete(watchedKeys, key)
-            continue
         }
+    }
+    c.watchedKeys = make(map[string]struct{})
+}
+
+// marks every client watching key so their next EXEC fails
+func touchWatchedKey(key string) {
+    for watcher := range watchedKeys[key] {
+        watcher.watchDirty = true
+    }
+}
 
-        watchedKeys[key] = watchers
+func clientResponse(cmd []string, c *client) string {
+    if len(cmd) < 2 {
+        return encodeSimpleErrorResponse("wrong number of arguments for 'client' command")
     }
-}
\ No newline at end of file
+
+    switch strings.ToUpper(cmd[1]) {
+    case "ID":
+        return encodeInt(c.id)
+    case "GETNAME":
+        if c.name == "" {
+            return NullBulkString
+        }
+        return encodeBulkString(c.name)
+    case "SETNAME":
+        if len(cmd) != 3 {
+            return encodeSimpleErrorResponse("wrong number of arguments for 'client|setname' command")
+        }
+        if strings.ContainsAny(cmd[2], " \n") {
+            return encodeSimpleErrorResponse("Client names cannot contain spaces, newlines or special characters.")
+        }
+        c.name = cmd[2]
+        return encodeSimpleString("OK")
+    case "INFO":
+        return encodeBulkString(c.info() + "\n")
+    case "LIST":
+        ids := make([]int, 0, len(clients))
+        for id := range clients {
+            ids = append(ids, id)
+        }
+        sort.Ints(ids)
+        list := ""
+        for _, id := range ids {
+            list += clients[id].info() + "\n"
+        }
+        return encodeBulkString(list)
+    }
+    return encodeSimpleErrorResponse(fmt.Sprintf("unknown subcommand '%s'", cmd[1]))
+}
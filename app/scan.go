@@ -0,0 +1,301 @@
+package main
+
+import (
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/DeanLogan/redis-clone/app/resp"
+)
+
+// stringMatch is redis' glob matching: * and ? wildcards, [abc], [a-z] and
+// [^x] classes, and \ to match the next character literally
+func stringMatch(pattern, s string, nocase bool) bool {
+	skipLongerMatches := false
+	return stringMatchImpl(pattern, s, nocase, &skipLongerMatches)
+}
+
+// skipLongerMatches is set once a * has tried every suffix of s without a
+// match. A * further out trying a shorter suffix can't do any better, so it
+// gives up too instead of backtracking exponentially (CVE-2022-36021).
+func stringMatchImpl(pattern, s string, nocase bool, skipLongerMatches *bool) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 1 && pattern[1] == '*' {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 1 {
+				return true
+			}
+			for i := 0; i <= len(s); i++ {
+				if stringMatchImpl(pattern[1:], s[i:], nocase, skipLongerMatches) {
+					return true
+				}
+				if *skipLongerMatches {
+					return false
+				}
+			}
+			*skipLongerMatches = true
+			return false
+		case '?':
+			if len(s) == 0 {
+				return false
+			}
+			s = s[1:]
+		case '[':
+			if len(s) == 0 {
+				return false
+			}
+			pattern = pattern[1:]
+			not := len(pattern) > 0 && pattern[0] == '^'
+			if not {
+				pattern = pattern[1:]
+			}
+			match := false
+			for len(pattern) > 0 && pattern[0] != ']' {
+				switch {
+				case pattern[0] == '\\' && len(pattern) >= 2:
+					pattern = pattern[1:]
+					match = match || equalFold(pattern[0], s[0], nocase)
+				case len(pattern) >= 3 && pattern[1] == '-':
+					start, end := pattern[0], pattern[2]
+					if start > end {
+						start, end = end, start
+					}
+					c := s[0]
+					if nocase {
+						start, end, c = lower(start), lower(end), lower(c)
+					}
+					match = match || (c >= start && c <= end)
+					pattern = pattern[2:]
+				default:
+					match = match || equalFold(pattern[0], s[0], nocase)
+				}
+				pattern = pattern[1:]
+			}
+			// like redis an unterminated class matches up to the end of the pattern
+			if len(pattern) == 0 {
+				pattern = "]"
+			}
+			if match == not {
+				return false
+			}
+			s = s[1:]
+		case '\\':
+			if len(pattern) >= 2 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+		default:
+			if len(s) == 0 || !equalFold(pattern[0], s[0], nocase) {
+				return false
+			}
+			s = s[1:]
+		}
+		pattern = pattern[1:]
+	}
+	return len(s) == 0
+}
+
+func lower(c byte) byte {
+	if c >= 'A' && c <= 'Z' {
+		return c + 'a' - 'A'
+	}
+	return c
+}
+
+func equalFold(a, b byte, nocase bool) bool {
+	if nocase {
+		return lower(a) == lower(b)
+	}
+	return a == b
+}
+
+// The SCAN family can't use positions in a Go map as a cursor, so elements are
+// visited in the order of a hash of their name and the cursor is the hash to
+// continue from. The order doesn't depend on how many elements there are, so
+// anything present for the whole iteration is returned however much the
+// collection grows or shrinks in between calls.
+
+func scanHash(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	return h.Sum64()
+}
+
+type scanOptions struct {
+	match    string
+	count    int
+	typeName string // SCAN only
+	noValues bool   // HSCAN only
+}
+
+func parseScanOptions(args []string, command string) (scanOptions, string) {
+	opts := scanOptions{count: 10}
+	for i := 0; i < len(args); i++ {
+		option := strings.ToUpper(args[i])
+		switch {
+		case option == "MATCH" && i+1 < len(args):
+			opts.match = args[i+1]
+			i++
+		case option == "COUNT" && i+1 < len(args):
+			count, err := strconv.Atoi(args[i+1])
+			if err != nil {
+				return opts, encodeSimpleErrorResponse("value is not an integer or out of range")
+			}
+			if count < 1 {
+				return opts, encodeSimpleErrorResponse("syntax error")
+			}
+			opts.count = count
+			i++
+		case option == "TYPE" && i+1 < len(args) && command == "SCAN":
+			opts.typeName = strings.ToLower(args[i+1])
+			i++
+		case option == "NOVALUES" && command == "HSCAN":
+			opts.noValues = true
+		default:
+			return opts, encodeSimpleErrorResponse("syntax error")
+		}
+	}
+	return opts, ""
+}
+
+func parseScanCursor(arg string) (uint64, bool) {
+	cursor, err := strconv.ParseUint(arg, 10, 64)
+	return cursor, err == nil
+}
+
+// scanNames returns up to count names whose hash is at least cursor, in hash
+// order, and the cursor to continue from. Names sharing a hash are never split
+// across calls. The returned cursor is 0 once everything was visited.
+func scanNames(names []string, cursor uint64, count int) ([]string, uint64) {
+	type entry struct {
+		name string
+		hash uint64
+	}
+	var remaining []entry
+	for _, name := range names {
+		if h := scanHash(name); h >= cursor {
+			remaining = append(remaining, entry{name, h})
+		}
+	}
+	sort.Slice(remaining, func(i, j int) bool { return remaining[i].hash < remaining[j].hash })
+
+	var batch []string
+	for i, e := range remaining {
+		if len(batch) >= count && e.hash != remaining[i-1].hash {
+			return batch, e.hash
+		}
+		batch = append(batch, e.name)
+	}
+	return batch, 0
+}
+
+func scanReply(c *client, cursor uint64, items []string) string {
+	return c.encode(resp.Array(resp.BulkString(strconv.FormatUint(cursor, 10)), resp.StringArray(items)))
+}
+
+// SCAN cursor [MATCH pattern] [COUNT count] [TYPE type]
+func scanResponse(cmd []string, c *client) string {
+	cursor, ok := parseScanCursor(cmd[1])
+	if !ok {
+		return encodeSimpleErrorResponse("invalid cursor")
+	}
+	opts, errResp := parseScanOptions(cmd[2:], "SCAN")
+	if errResp != "" {
+		return errResp
+	}
+
+	names := make([]string, 0, len(store))
+	for key := range store {
+		names = append(names, key)
+	}
+	batch, next := scanNames(names, cursor, opts.count)
+
+	// like redis the filters apply after the batch was picked, so a call can come back empty
+	items := []string{}
+	for _, key := range batch {
+		if isExpired(key) {
+			continue
+		}
+		if opts.match != "" && !stringMatch(opts.match, key, false) {
+			continue
+		}
+		if opts.typeName != "" && getRedisValueType(store[key]) != opts.typeName {
+			continue
+		}
+		items = append(items, key)
+	}
+	return scanReply(c, next, items)
+}
+
+// SSCAN, HSCAN and ZSCAN key cursor [MATCH pattern] [COUNT count], HSCAN also takes NOVALUES
+func collectionScanResponse(cmd []string, c *client) string {
+	command := strings.ToUpper(cmd[0])
+	key := cmd[1]
+	cursor, ok := parseScanCursor(cmd[2])
+	if !ok {
+		return encodeSimpleErrorResponse("invalid cursor")
+	}
+	opts, errResp := parseScanOptions(cmd[3:], command)
+	if errResp != "" {
+		return errResp
+	}
+
+	rv, exists := store[key]
+	if !exists || isExpired(key) {
+		return scanReply(c, 0, []string{})
+	}
+
+	var names []string
+	var valueOf func(name string) string
+	wrongType := true
+	switch v := rv.value.(type) {
+	case map[string]struct{}:
+		if command != "SSCAN" {
+			break
+		}
+		wrongType = false
+		for member := range v {
+			names = append(names, member)
+		}
+	case map[string]string:
+		if command != "HSCAN" {
+			break
+		}
+		wrongType = false
+		for field := range v {
+			names = append(names, field)
+		}
+		if !opts.noValues {
+			valueOf = func(field string) string { return v[field] }
+		}
+	case SortedSet:
+		if command != "ZSCAN" {
+			break
+		}
+		wrongType = false
+		for member := range v.Entries {
+			names = append(names, member)
+		}
+		valueOf = func(member string) string { return resp.FormatDouble(v.Entries[member]) }
+	}
+	if wrongType {
+		return encodeErrorResponseWithMsg("WRONGTYPE", "Operation against a key holding the wrong kind of value")
+	}
+
+	batch, next := scanNames(names, cursor, opts.count)
+	items := []string{}
+	for _, name := range batch {
+		if opts.match != "" && !stringMatch(opts.match, name, false) {
+			continue
+		}
+		items = append(items, name)
+		if valueOf != nil {
+			items = append(items, valueOf(name))
+		}
+	}
+	return scanReply(c, next, items)
+}
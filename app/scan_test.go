@@ -0,0 +1,84 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStringMatch(t *testing.T) {
+	tests := []struct {
+		pattern string
+		s       string
+		nocase  bool
+		want    bool
+	}{
+		{"", "", false, true},
+		{"", "a", false, false},
+		{"hello", "hello", false, true},
+		{"hello", "hell", false, false},
+
+		{"*", "", false, true},
+		{"*", "anything", false, true},
+		{"h*o", "hello", false, true},
+		{"h*o", "hellx", false, false},
+		{"h**o", "ho", false, true},
+		{"*llo", "hello", false, true},
+		{"he*", "he", false, true},
+		{"*a*b", "xaxxb", false, true},
+		{"*a*b", "xbxxa", false, false},
+
+		{"h?llo", "hello", false, true},
+		{"h?llo", "hllo", false, false},
+		{"?", "", false, false},
+
+		{"h[ae]llo", "hallo", false, true},
+		{"h[ae]llo", "hillo", false, false},
+		{"h[a-c]llo", "hbllo", false, true},
+		{"h[a-c]llo", "hdllo", false, false},
+		{"h[c-a]llo", "hbllo", false, true},
+		{"h[^e]llo", "hallo", false, true},
+		{"h[^e]llo", "hello", false, false},
+		{"[a-z]", "", false, false},
+		{"[\\]]", "]", false, true},
+		{"[\\-]", "-", false, true},
+
+		{"h\\*llo", "h*llo", false, true},
+		{"h\\*llo", "hello", false, false},
+		{"h\\?", "h?", false, true},
+		{"\\[a]", "[a]", false, true},
+		{"a\\", "a\\", false, true},
+
+		// an unterminated class runs to the end of the pattern
+		{"h[ae", "ha", false, true},
+		{"h[ae", "hi", false, false},
+		{"h[^", "hx", false, true},
+
+		{"HELLO", "hello", true, true},
+		{"h[A-C]llo", "hbllo", true, true},
+		{"h[^E]llo", "hello", true, false},
+		{"HELLO", "hello", false, false},
+	}
+	for _, tt := range tests {
+		if got := stringMatch(tt.pattern, tt.s, tt.nocase); got != tt.want {
+			t.Errorf("stringMatch(%q, %q, %v) = %v, want %v", tt.pattern, tt.s, tt.nocase, got, tt.want)
+		}
+	}
+}
+
+// the pattern from CVE-2022-36021 used to backtrack exponentially
+func TestStringMatchStarBacktracking(t *testing.T) {
+	pattern := strings.Repeat("*a", 30) + "*b"
+	s := strings.Repeat("a", 40)
+
+	start := time.Now()
+	if stringMatch(pattern, s, false) {
+		t.Fatalf("stringMatch(%q, %q) matched", pattern, s)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("stringMatch took %v", elapsed)
+	}
+	if !stringMatch(pattern, strings.Repeat("a", 40)+"b", false) {
+		t.Fatalf("stringMatch(%q) didn't match a string ending in b", pattern)
+	}
+}
@@ -0,0 +1,1106 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/DeanLogan/redis-clone/app/resp"
+)
+
+// Sentinel mode watches groups of a master and its replicas. Every monitored
+// instance gets a link that PINGs it and reads INFO replication, and sentinels
+// find each other through hellos published on the instances. Once enough of
+// them agree the master is down one is elected to promote the best replica and
+// point everything else at it, the others learn the new address from its hellos.
+//
+// Like the rest of the server the state is only touched on the executor, the
+// goroutines running the links go through runOnExecutor.
+
+const (
+	sentinelKindMaster = iota
+	sentinelKindReplica
+	sentinelKindSentinel
+)
+
+const (
+	sentinelFailoverNone      = iota
+	sentinelFailoverWaitStart // collecting votes to become the leader
+	sentinelFailoverSelectReplica
+	sentinelFailoverWaitPromotion // REPLICAOF NO ONE sent, waiting for INFO to report it
+	sentinelFailoverReconfReplicas
+)
+
+const (
+	sentinelPingPeriod      = time.Second
+	sentinelInfoPeriod      = time.Second
+	sentinelHelloPeriod     = 2 * time.Second
+	sentinelAskPeriod       = time.Second
+	sentinelTimerPeriod     = 100 * time.Millisecond
+	sentinelLinkPeriod      = 100 * time.Millisecond
+	sentinelConnectTimeout  = time.Second
+	sentinelReplyTimeout    = 5 * time.Second
+	sentinelReconnectDelay  = time.Second
+	sentinelElectionTimeout = 10 * time.Second
+	sentinelMaxDesync       = time.Second // random delay before starting a failover, so sentinels rarely split the vote
+	sentinelHelloChannel    = "__sentinel__:hello"
+)
+
+var sentinelMode bool
+var sentinelMyID string
+var sentinelCurrentEpoch int
+var sentinelMasters = make(map[string]*sentinelMaster)
+
+// defaults for the masters given on the command line
+var sentinelMonitors sentinelMonitorFlag
+var sentinelDownAfter int
+var sentinelFailoverTimeout int
+
+// sentinelMonitorFlag collects every --sentinel-monitor "<name> <host> <port> <quorum>"
+type sentinelMonitorFlag []string
+
+func (f *sentinelMonitorFlag) String() string {
+	return strings.Join(*f, ", ")
+}
+
+func (f *sentinelMonitorFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+type sentinelMaster struct {
+	name            string
+	quorum          int
+	downAfter       time.Duration
+	failoverTimeout time.Duration
+	instance        *sentinelInstance
+	replicas        map[string]*sentinelInstance // by address
+	sentinels       map[string]*sentinelInstance // by run id
+	odown           bool
+	odownSince      time.Time
+	failoverDelay   time.Duration
+	configEpoch     int
+
+	// our vote in the leader election for leaderEpoch
+	leader      string
+	leaderEpoch int
+
+	failoverState     int
+	failoverEpoch     int
+	failoverStartTime time.Time
+	stateChangedAt    time.Time
+	promoted          *sentinelInstance
+}
+
+type sentinelInstance struct {
+	kind   int
+	host   string
+	port   int
+	master *sentinelMaster // the group the instance belongs to
+
+	conn      net.Conn // command link, nil while disconnected
+	helloConn net.Conn // subscribed to the hello channel, masters and replicas only
+	localIP   string   // our address as the instance sees it, announced in hellos
+	stopped   bool
+	pending   []sentinelCommand
+
+	lastOK        time.Time // last valid reply to PING
+	lastPingSent  time.Time
+	lastInfoSent  time.Time
+	lastHelloSent time.Time
+	sdown         bool
+	sdownSince    time.Time
+
+	// from INFO replication
+	infoRefresh   time.Time
+	role          string
+	roleChangedAt time.Time // last change of role or of the master it follows
+	masterHost    string
+	masterPort    int
+	masterLinkUp  bool
+	replOffset    int
+	reconfSentAt  time.Time
+	reconfDone    bool // acknowledged the REPLICAOF of the running failover
+
+	// sentinels only
+	runID        string
+	lastHello    time.Time
+	lastAskSent  time.Time
+	lastAskReply time.Time
+	masterDown   bool   // its view of the master, from IS-MASTER-DOWN-BY-ADDR
+	leader       string // who it voted for in leaderEpoch
+	leaderEpoch  int
+}
+
+// sentinelCommand is a request for an instance's link, onReply runs on the executor
+type sentinelCommand struct {
+	args    []string
+	onReply func(reply resp.RespValue, err error)
+}
+
+// runSentinel replaces main's server setup when started with --sentinel
+func runSentinel() {
+	if sentinelDownAfter <= 0 || sentinelFailoverTimeout <= 0 {
+		fmt.Println("sentinel-down-after-milliseconds and sentinel-failover-timeout must be positive")
+		os.Exit(1)
+	}
+	commandTable = sentinelCommandTable()
+	newAclUser("default")
+	sentinelMyID = randStringWithCharset(40, "0123456789abcdef")
+	startExecutor()
+
+	for _, monitor := range sentinelMonitors {
+		args := strings.Fields(monitor)
+		var err error
+		if len(args) != 4 {
+			err = fmt.Errorf("expected <name> <host> <port> <quorum>")
+		} else {
+			runOnExecutor(func() { err = sentinelMonitor(args[0], args[1], args[2], args[3]) })
+		}
+		if err != nil {
+			fmt.Printf("Invalid sentinel-monitor %q: %v\n", monitor, err)
+			os.Exit(1)
+		}
+	}
+	fmt.Printf("Sentinel ID is %s\n", sentinelMyID)
+
+	go func() {
+		for range time.Tick(sentinelTimerPeriod) {
+			runOnExecutor(sentinelTimer)
+		}
+	}()
+	listenAndServe()
+}
+
+// sentinelCommandTable is the small set of commands a sentinel answers
+func sentinelCommandTable() map[string]*redisCommand {
+	table := map[string]*redisCommand{
+		"SENTINEL": {func(cmd []string, c *client) string { return sentinelResponse(cmd, c) }, -2, 0, 0, 0, 0},
+		"INFO":     {func(cmd []string, c *client) string { return sentinelInfoResponse(c) }, -1, 0, 0, 0, 0},
+	}
+	for _, name := range []string{"PING", "SUBSCRIBE", "UNSUBSCRIBE", "PUBLISH", "AUTH", "HELLO", "CLIENT", "COMMAND", "ACL"} {
+		table[name] = commandTable[name]
+	}
+	return table
+}
+
+func sentinelMonitor(name, host, portArg, quorumArg string) error {
+	port, err := strconv.Atoi(portArg)
+	if err != nil || port <= 0 || port > 65535 {
+		return fmt.Errorf("Invalid port for the master")
+	}
+	quorum, err := strconv.Atoi(quorumArg)
+	if err != nil || quorum <= 0 {
+		return fmt.Errorf("Quorum must be 1 or greater.")
+	}
+	if _, ok := sentinelMasters[name]; ok {
+		return fmt.Errorf("Duplicated master name.")
+	}
+	m := &sentinelMaster{
+		name:            name,
+		quorum:          quorum,
+		downAfter:       time.Duration(sentinelDownAfter) * time.Millisecond,
+		failoverTimeout: time.Duration(sentinelFailoverTimeout) * time.Millisecond,
+		replicas:        make(map[string]*sentinelInstance),
+		sentinels:       make(map[string]*sentinelInstance),
+	}
+	m.instance = newSentinelInstance(sentinelKindMaster, host, port, m)
+	sentinelMasters[name] = m
+	sentinelEvent("+monitor", m.instance, fmt.Sprintf("quorum %d", quorum))
+	return nil
+}
+
+func newSentinelInstance(kind int, host string, port int, m *sentinelMaster) *sentinelInstance {
+	now := time.Now()
+	ri := &sentinelInstance{kind: kind, host: host, port: port, master: m, lastOK: now, roleChangedAt: now}
+	go ri.run()
+	if kind != sentinelKindSentinel {
+		go ri.runHelloLink()
+	}
+	return ri
+}
+
+func (ri *sentinelInstance) addr() string {
+	return net.JoinHostPort(ri.host, strconv.Itoa(ri.port))
+}
+
+// stop closes the links so their goroutines notice and exit
+func (ri *sentinelInstance) stop() {
+	ri.stopped = true
+	if ri.conn != nil {
+		ri.conn.Close()
+	}
+	if ri.helloConn != nil {
+		ri.helloConn.Close()
+	}
+}
+
+// run keeps the command link connected until the instance is stopped
+func (ri *sentinelInstance) run() {
+	for {
+		var addr string
+		stopped := false
+		runOnExecutor(func() {
+			stopped = ri.stopped
+			addr = ri.addr()
+		})
+		if stopped {
+			return
+		}
+		if conn, err := net.DialTimeout("tcp", addr, sentinelConnectTimeout); err == nil {
+			ri.serve(conn)
+		}
+		time.Sleep(sentinelReconnectDelay)
+	}
+}
+
+// serve sends whatever nextCommands asks for, one request at a time
+func (ri *sentinelInstance) serve(conn net.Conn) {
+	defer conn.Close()
+	connected := false
+	runOnExecutor(func() {
+		if ri.stopped {
+			return
+		}
+		ri.conn = conn
+		ri.localIP, _, _ = net.SplitHostPort(conn.LocalAddr().String())
+		connected = true
+	})
+	if !connected {
+		return
+	}
+	defer runOnExecutor(func() { ri.conn = nil })
+
+	reader := resp.NewReader(conn)
+	for {
+		var cmds []sentinelCommand
+		stopped := false
+		runOnExecutor(func() {
+			stopped = ri.stopped
+			if !stopped {
+				cmds = ri.nextCommands(time.Now())
+			}
+		})
+		if stopped {
+			return
+		}
+		for _, cmd := range cmds {
+			conn.SetDeadline(time.Now().Add(sentinelReplyTimeout))
+			_, err := conn.Write([]byte(encodeStringArray(cmd.args)))
+			var reply resp.RespValue
+			if err == nil {
+				reply, err = reader.ReadValue()
+			}
+			runOnExecutor(func() { cmd.onReply(reply, err) })
+			if err != nil {
+				return
+			}
+		}
+		time.Sleep(sentinelLinkPeriod)
+	}
+}
+
+// runHelloLink subscribes to the hello channel of a master or replica
+func (ri *sentinelInstance) runHelloLink() {
+	for {
+		var addr string
+		stopped := false
+		runOnExecutor(func() {
+			stopped = ri.stopped
+			addr = ri.addr()
+		})
+		if stopped {
+			return
+		}
+		if conn, err := net.DialTimeout("tcp", addr, sentinelConnectTimeout); err == nil {
+			ri.readHellos(conn)
+		}
+		time.Sleep(sentinelReconnectDelay)
+	}
+}
+
+func (ri *sentinelInstance) readHellos(conn net.Conn) {
+	defer conn.Close()
+	connected := false
+	runOnExecutor(func() {
+		if !ri.stopped {
+			ri.helloConn = conn
+			connected = true
+		}
+	})
+	if !connected {
+		return
+	}
+	defer runOnExecutor(func() { ri.helloConn = nil })
+
+	if _, err := conn.Write([]byte(encodeStringArray([]string{"SUBSCRIBE", sentinelHelloChannel}))); err != nil {
+		return
+	}
+	reader := resp.NewReader(conn)
+	for {
+		msg, err := reader.ReadValue()
+		if err != nil {
+			return
+		}
+		if len(msg.Elems) == 3 && msg.Elems[0].Str == "message" {
+			runOnExecutor(func() { processHello(msg.Elems[2].Str) })
+		}
+	}
+}
+
+// nextCommands decides what the link sends next: the periodic PING, INFO and
+// hello, the questions for other sentinels and anything the failover queued
+func (ri *sentinelInstance) nextCommands(now time.Time) []sentinelCommand {
+	m := ri.master
+	var cmds []sentinelCommand
+	// like redis ping more often when down-after is shorter, or the gaps alone would make it look down
+	if now.Sub(ri.lastPingSent) >= min(sentinelPingPeriod, m.downAfter) {
+		ri.lastPingSent = now
+		cmds = append(cmds, sentinelCommand{[]string{"PING"}, func(reply resp.RespValue, err error) {
+			// an instance loading its dataset or without its master is still alive
+			if err == nil && (reply.Type == resp.STRING || strings.HasPrefix(reply.Str, "LOADING") || strings.HasPrefix(reply.Str, "MASTERDOWN")) {
+				ri.lastOK = time.Now()
+			}
+		}})
+	}
+	if ri.kind == sentinelKindSentinel {
+		if m.instance.sdown && now.Sub(ri.lastAskSent) >= sentinelAskPeriod {
+			ri.lastAskSent = now
+			cmds = append(cmds, ri.askMasterState())
+		}
+	} else {
+		if now.Sub(ri.lastInfoSent) >= sentinelInfoPeriod {
+			ri.lastInfoSent = now
+			cmds = append(cmds, sentinelCommand{[]string{"INFO", "replication"}, func(reply resp.RespValue, err error) {
+				if err == nil && reply.Type != resp.ERROR {
+					ri.refreshInfo(reply.Str)
+				}
+			}})
+		}
+		if now.Sub(ri.lastHelloSent) >= sentinelHelloPeriod {
+			ri.lastHelloSent = now
+			cmds = append(cmds, sentinelCommand{[]string{"PUBLISH", sentinelHelloChannel, ri.helloMessage()}, func(resp.RespValue, error) {}})
+		}
+	}
+	cmds = append(cmds, ri.pending...)
+	ri.pending = nil
+	return cmds
+}
+
+// askMasterState asks another sentinel whether it also sees the master down,
+// and for its vote once we're trying to fail over
+func (ri *sentinelInstance) askMasterState() sentinelCommand {
+	m := ri.master
+	runID := "*"
+	if m.failoverState != sentinelFailoverNone {
+		runID = sentinelMyID
+	}
+	args := []string{"SENTINEL", "IS-MASTER-DOWN-BY-ADDR", m.instance.host, strconv.Itoa(m.instance.port), strconv.Itoa(sentinelCurrentEpoch), runID}
+	return sentinelCommand{args, func(reply resp.RespValue, err error) {
+		if err != nil || len(reply.Elems) != 3 {
+			return
+		}
+		ri.lastAskReply = time.Now()
+		ri.masterDown = reply.Elems[0].Int == 1
+		if reply.Elems[1].Str != "*" {
+			ri.leader = reply.Elems[1].Str
+			ri.leaderEpoch = int(reply.Elems[2].Int)
+		}
+	}}
+}
+
+// helloMessage is "<ip>,<port>,<runid>,<current epoch>,<master name>,<master ip>,<master port>,<config epoch>"
+func (ri *sentinelInstance) helloMessage() string {
+	m := ri.master
+	host, port := m.currentAddr()
+	return fmt.Sprintf("%s,%d,%s,%d,%s,%s,%d,%d", ri.localIP, config.Port, sentinelMyID, sentinelCurrentEpoch, m.name, host, port, m.configEpoch)
+}
+
+// processHello learns about other sentinels and about failovers they ran
+func processHello(hello string) {
+	fields := strings.Split(hello, ",")
+	if len(fields) != 8 || fields[2] == sentinelMyID {
+		return
+	}
+	port, err1 := strconv.Atoi(fields[1])
+	epoch, err2 := strconv.Atoi(fields[3])
+	masterPort, err3 := strconv.Atoi(fields[6])
+	configEpoch, err4 := strconv.Atoi(fields[7])
+	m, ok := sentinelMasters[fields[4]]
+	if !ok || err1 != nil || err2 != nil || err3 != nil || err4 != nil {
+		return
+	}
+	host, runID, masterHost := fields[0], fields[2], fields[5]
+
+	if epoch > sentinelCurrentEpoch {
+		sentinelCurrentEpoch = epoch
+		sentinelPublish("+new-epoch", strconv.Itoa(epoch))
+	}
+
+	s, ok := m.sentinels[runID]
+	if !ok || s.host != host || s.port != port {
+		// a sentinel that restarted comes back with a new run id on the same address
+		for id, other := range m.sentinels {
+			if id == runID || (other.host == host && other.port == port) {
+				other.stop()
+				delete(m.sentinels, id)
+			}
+		}
+		s = newSentinelInstance(sentinelKindSentinel, host, port, m)
+		s.runID = runID
+		m.sentinels[runID] = s
+		sentinelEvent("+sentinel", s, "")
+	}
+	s.lastHello = time.Now()
+
+	// a newer configuration means someone else failed the master over
+	if configEpoch > m.configEpoch {
+		m.configEpoch = configEpoch
+		if currentHost, currentPort := m.currentAddr(); masterHost != currentHost || masterPort != currentPort {
+			sentinelEvent("+config-update-from", s, "")
+			m.switchMaster(masterHost, masterPort)
+		}
+	}
+}
+
+// refreshInfo applies an INFO replication reply
+func (ri *sentinelInstance) refreshInfo(info string) {
+	m := ri.master
+	now := time.Now()
+	ri.infoRefresh = now
+
+	fields := make(map[string]string)
+	var replicaAddrs [][2]string
+	for _, line := range strings.Split(info, "\r\n") {
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		fields[key] = value
+		// slave0:ip=127.0.0.1,port=6380,state=online,offset=42,lag=0
+		if strings.HasPrefix(key, "slave") && key != "slave_repl_offset" {
+			var ip, port string
+			for _, kv := range strings.Split(value, ",") {
+				k, v, _ := strings.Cut(kv, "=")
+				switch k {
+				case "ip":
+					ip = v
+				case "port":
+					port = v
+				}
+			}
+			replicaAddrs = append(replicaAddrs, [2]string{ip, port})
+		}
+	}
+
+	role := fields["role"]
+	masterHost := fields["master_host"]
+	masterPort, _ := strconv.Atoi(fields["master_port"])
+	if role != ri.role || masterHost != ri.masterHost || masterPort != ri.masterPort {
+		ri.roleChangedAt = now
+	}
+	ri.role = role
+	ri.masterHost, ri.masterPort = masterHost, masterPort
+	ri.masterLinkUp = fields["master_link_status"] == "up"
+	ri.replOffset, _ = strconv.Atoi(fields["slave_repl_offset"])
+
+	if ri.kind == sentinelKindMaster && role == "master" {
+		for _, addr := range replicaAddrs {
+			port, err := strconv.Atoi(addr[1])
+			if err != nil || addr[0] == "" {
+				continue
+			}
+			key := net.JoinHostPort(addr[0], addr[1])
+			if _, ok := m.replicas[key]; !ok {
+				replica := newSentinelInstance(sentinelKindReplica, addr[0], port, m)
+				m.replicas[key] = replica
+				sentinelEvent("+slave", replica, "")
+			}
+		}
+	}
+	if ri.kind != sentinelKindReplica {
+		return
+	}
+
+	if ri == m.promoted && m.failoverState == sentinelFailoverWaitPromotion && role == "master" {
+		m.promotionDone()
+		return
+	}
+
+	// instances disagreeing with a healthy master are pointed back at it, after
+	// long enough that we aren't simply behind on a failover someone else ran
+	if m.failoverState != sentinelFailoverNone || !m.looksSane() || now.Sub(ri.reconfSentAt) < m.failoverTimeout {
+		return
+	}
+	switch {
+	case role == "master" && now.Sub(ri.roleChangedAt) > 4*sentinelInfoPeriod:
+		sentinelEvent("+convert-to-slave", ri, "")
+		ri.sendReplicaof(m.instance.host, m.instance.port, nil)
+	case role == "slave" && (masterHost != m.instance.host || masterPort != m.instance.port) && now.Sub(ri.roleChangedAt) > m.failoverTimeout:
+		sentinelEvent("+fix-slave-config", ri, "")
+		ri.sendReplicaof(m.instance.host, m.instance.port, nil)
+	}
+}
+
+func (ri *sentinelInstance) sendReplicaof(host string, port int, done func()) {
+	ri.reconfSentAt = time.Now()
+	args := []string{"REPLICAOF", host, strconv.Itoa(port)}
+	if host == "" {
+		args = []string{"REPLICAOF", "NO", "ONE"}
+	}
+	ri.pending = append(ri.pending, sentinelCommand{args, func(reply resp.RespValue, err error) {
+		if err == nil && reply.Type == resp.STRING && done != nil {
+			done()
+		}
+	}})
+}
+
+// looksSane reports whether the master is up and reports itself as a master
+func (m *sentinelMaster) looksSane() bool {
+	return !m.instance.sdown && m.instance.role == "master" && time.Since(m.instance.infoRefresh) < 5*sentinelInfoPeriod
+}
+
+// currentAddr is the address clients should use, the promoted replica as soon
+// as it accepted the role
+func (m *sentinelMaster) currentAddr() (string, int) {
+	if m.failoverState == sentinelFailoverReconfReplicas {
+		return m.promoted.host, m.promoted.port
+	}
+	return m.instance.host, m.instance.port
+}
+
+func sentinelTimer() {
+	now := time.Now()
+	for _, m := range sentinelMasters {
+		m.checkSubjectivelyDown(m.instance, now)
+		for _, replica := range m.replicas {
+			m.checkSubjectivelyDown(replica, now)
+		}
+		for _, s := range m.sentinels {
+			m.checkSubjectivelyDown(s, now)
+		}
+		m.checkObjectivelyDown(now)
+		m.failoverStateMachine(now)
+	}
+}
+
+func (m *sentinelMaster) checkSubjectivelyDown(ri *sentinelInstance, now time.Time) {
+	down := now.Sub(ri.lastOK) > m.downAfter
+	if down == ri.sdown {
+		return
+	}
+	ri.sdown = down
+	if down {
+		ri.sdownSince = now
+		sentinelEvent("+sdown", ri, "")
+	} else {
+		sentinelEvent("-sdown", ri, "")
+	}
+}
+
+// checkObjectivelyDown counts the sentinels that recently told us they see the master down too
+func (m *sentinelMaster) checkObjectivelyDown(now time.Time) {
+	votes := 0
+	if m.instance.sdown {
+		votes = 1
+		for _, s := range m.sentinels {
+			if s.masterDown && now.Sub(s.lastAskReply) < 5*sentinelAskPeriod {
+				votes++
+			}
+		}
+	}
+	odown := votes >= m.quorum
+	if odown == m.odown {
+		return
+	}
+	m.odown = odown
+	if odown {
+		m.odownSince = now
+		m.failoverDelay = time.Duration(rand.Int63n(int64(sentinelMaxDesync)))
+		sentinelEvent("+odown", m.instance, fmt.Sprintf("#quorum %d/%d", votes, m.quorum))
+	} else {
+		sentinelEvent("-odown", m.instance, "")
+	}
+}
+
+func (m *sentinelMaster) failoverStateMachine(now time.Time) {
+	switch m.failoverState {
+	case sentinelFailoverNone:
+		// after voting for someone else, or a failed attempt, give them time to finish
+		if m.odown && now.Sub(m.odownSince) >= m.failoverDelay && now.Sub(m.failoverStartTime) >= 2*m.failoverTimeout {
+			m.startFailover(now)
+		}
+	case sentinelFailoverWaitStart:
+		if m.electedLeader() != sentinelMyID {
+			if now.Sub(m.failoverStartTime) > min(m.failoverTimeout, sentinelElectionTimeout) {
+				sentinelEvent("-failover-abort-not-elected", m.instance, "")
+				m.abortFailover()
+			}
+			return
+		}
+		sentinelEvent("+elected-leader", m.instance, "")
+		m.setFailoverState(sentinelFailoverSelectReplica, now)
+		m.selectAndPromote(now)
+	case sentinelFailoverWaitPromotion:
+		if now.Sub(m.stateChangedAt) > m.failoverTimeout {
+			sentinelEvent("-failover-abort-slave-timeout", m.instance, "")
+			m.abortFailover()
+		}
+	case sentinelFailoverReconfReplicas:
+		done := true
+		for _, replica := range m.replicas {
+			if replica != m.promoted && !replica.reconfDone && !replica.sdown {
+				done = false
+			}
+		}
+		// replicas that never answer get fixed later by whoever monitors them
+		if done || now.Sub(m.stateChangedAt) > m.failoverTimeout {
+			sentinelEvent("+failover-end", m.instance, "")
+			m.switchMaster(m.promoted.host, m.promoted.port)
+		}
+	}
+}
+
+func (m *sentinelMaster) setFailoverState(state int, now time.Time) {
+	m.failoverState = state
+	m.stateChangedAt = now
+	sentinelEvent("+failover-state-"+sentinelFailoverStateName(state), m.instance, "")
+}
+
+// startFailover opens a new epoch and votes for ourselves, the other sentinels
+// are asked for their votes by askMasterState
+func (m *sentinelMaster) startFailover(now time.Time) {
+	sentinelCurrentEpoch++
+	m.failoverEpoch = sentinelCurrentEpoch
+	m.failoverStartTime = now
+	sentinelPublish("+new-epoch", strconv.Itoa(sentinelCurrentEpoch))
+	sentinelEvent("+try-failover", m.instance, "")
+	m.setFailoverState(sentinelFailoverWaitStart, now)
+	m.voteLeader(sentinelCurrentEpoch, sentinelMyID)
+	// ask for the votes on the next link round rather than the next ask period,
+	// the sooner the others hear of us the less likely they start their own
+	for _, s := range m.sentinels {
+		s.lastAskSent = time.Time{}
+	}
+}
+
+func (m *sentinelMaster) abortFailover() {
+	m.failoverState = sentinelFailoverNone
+	m.promoted = nil
+	for _, replica := range m.replicas {
+		replica.reconfDone = false
+	}
+}
+
+// voteLeader gives our vote for epoch to runID unless we already voted in it
+func (m *sentinelMaster) voteLeader(epoch int, runID string) (string, int) {
+	if epoch > sentinelCurrentEpoch {
+		sentinelCurrentEpoch = epoch
+		sentinelPublish("+new-epoch", strconv.Itoa(epoch))
+	}
+	if m.leaderEpoch < epoch && sentinelCurrentEpoch <= epoch {
+		m.leader = runID
+		m.leaderEpoch = sentinelCurrentEpoch
+		sentinelEvent("+vote-for-leader", m.instance, fmt.Sprintf("%s %d", runID, m.leaderEpoch))
+		// we just backed someone else, don't start a competing failover soon
+		if runID != sentinelMyID {
+			m.failoverStartTime = time.Now().Add(time.Duration(rand.Int63n(int64(sentinelMaxDesync))))
+		}
+	}
+	return m.leader, m.leaderEpoch
+}
+
+// electedLeader returns the sentinel with a majority of the votes, and at least
+// quorum of them, in the epoch of our failover, or "" without one
+func (m *sentinelMaster) electedLeader() string {
+	votes := make(map[string]int)
+	for _, s := range m.sentinels {
+		if s.leader != "" && s.leaderEpoch == m.failoverEpoch {
+			votes[s.leader]++
+		}
+	}
+	if m.leaderEpoch == m.failoverEpoch {
+		votes[m.leader]++
+	}
+
+	winner, most := "", 0
+	for runID, count := range votes {
+		if count > most || (count == most && runID < winner) {
+			winner, most = runID, count
+		}
+	}
+	voters := len(m.sentinels) + 1
+	if most < voters/2+1 || most < m.quorum {
+		return ""
+	}
+	return winner
+}
+
+// selectAndPromote picks the replica with the most data and sends it REPLICAOF NO ONE
+func (m *sentinelMaster) selectAndPromote(now time.Time) {
+	var best *sentinelInstance
+	for _, replica := range m.sortedReplicas() {
+		if replica.sdown || replica.conn == nil || replica.role != "slave" ||
+			now.Sub(replica.lastOK) > 5*sentinelPingPeriod || now.Sub(replica.infoRefresh) > 3*sentinelInfoPeriod {
+			continue
+		}
+		if best == nil || replica.replOffset > best.replOffset {
+			best = replica
+		}
+	}
+	if best == nil {
+		sentinelEvent("-failover-abort-no-good-slave", m.instance, "")
+		m.abortFailover()
+		return
+	}
+	sentinelEvent("+selected-slave", best, "")
+	m.promoted = best
+	best.sendReplicaof("", 0, nil)
+	m.setFailoverState(sentinelFailoverWaitPromotion, now)
+}
+
+// promotionDone runs once INFO shows the promoted replica as a master, the new
+// configuration wins over the old one from now on
+func (m *sentinelMaster) promotionDone() {
+	m.configEpoch = m.failoverEpoch
+	sentinelEvent("+promoted-slave", m.promoted, "")
+	m.setFailoverState(sentinelFailoverReconfReplicas, time.Now())
+	for _, replica := range m.replicas {
+		if replica == m.promoted {
+			continue
+		}
+		replica := replica
+		replica.sendReplicaof(m.promoted.host, m.promoted.port, func() {
+			replica.reconfDone = true
+			sentinelEvent("+slave-reconf-done", replica, "")
+		})
+		sentinelEvent("+slave-reconf-sent", replica, "")
+	}
+}
+
+// switchMaster makes host:port the master of the group, everything else we
+// know about, the old master included, is expected to replicate from it
+func (m *sentinelMaster) switchMaster(host string, port int) {
+	old := m.instance
+	newAddr := net.JoinHostPort(host, strconv.Itoa(port))
+	addrs := []string{}
+	if old.addr() != newAddr {
+		addrs = append(addrs, old.addr())
+	}
+	for addr, replica := range m.replicas {
+		if addr != newAddr {
+			addrs = append(addrs, addr)
+		}
+		replica.stop()
+	}
+	old.stop()
+
+	m.instance = newSentinelInstance(sentinelKindMaster, host, port, m)
+	m.replicas = make(map[string]*sentinelInstance)
+	for _, addr := range addrs {
+		h, p, _ := net.SplitHostPort(addr)
+		replicaPort, _ := strconv.Atoi(p)
+		m.replicas[addr] = newSentinelInstance(sentinelKindReplica, h, replicaPort, m)
+	}
+	for _, s := range m.sentinels {
+		s.masterDown = false
+	}
+	m.odown = false
+	m.abortFailover()
+	sentinelPublish("+switch-master", fmt.Sprintf("%s %s %d %s %d", m.name, old.host, old.port, host, port))
+}
+
+func (m *sentinelMaster) sortedReplicas() []*sentinelInstance {
+	replicas := make([]*sentinelInstance, 0, len(m.replicas))
+	for _, replica := range m.replicas {
+		replicas = append(replicas, replica)
+	}
+	sort.Slice(replicas, func(i, j int) bool { return replicas[i].addr() < replicas[j].addr() })
+	return replicas
+}
+
+func (m *sentinelMaster) sortedSentinels() []*sentinelInstance {
+	sentinels := make([]*sentinelInstance, 0, len(m.sentinels))
+	for _, s := range m.sentinels {
+		sentinels = append(sentinels, s)
+	}
+	sort.Slice(sentinels, func(i, j int) bool { return sentinels[i].runID < sentinels[j].runID })
+	return sentinels
+}
+
+// sentinelEvent logs an event about an instance and publishes it on the
+// channel named after the event, e.g. "+sdown master mymaster 127.0.0.1 6379"
+func sentinelEvent(event string, ri *sentinelInstance, extra string) {
+	m := ri.master
+	msg := fmt.Sprintf("master %s %s %d", m.name, ri.host, ri.port)
+	switch ri.kind {
+	case sentinelKindReplica:
+		msg = fmt.Sprintf("slave %s %s %d @ %s %s %d", ri.addr(), ri.host, ri.port, m.name, m.instance.host, m.instance.port)
+	case sentinelKindSentinel:
+		msg = fmt.Sprintf("sentinel %s %s %d @ %s %s %d", ri.runID, ri.host, ri.port, m.name, m.instance.host, m.instance.port)
+	}
+	if extra != "" {
+		msg += " " + extra
+	}
+	sentinelPublish(event, msg)
+}
+
+func sentinelPublish(channel, msg string) {
+	fmt.Printf("%s %s\n", channel, msg)
+	publishResponse([]string{"PUBLISH", channel, msg})
+}
+
+func sentinelFailoverStateName(state int) string {
+	switch state {
+	case sentinelFailoverWaitStart:
+		return "wait-start"
+	case sentinelFailoverSelectReplica:
+		return "select-slave"
+	case sentinelFailoverWaitPromotion:
+		return "wait-promotion"
+	case sentinelFailoverReconfReplicas:
+		return "reconf-slaves"
+	}
+	return "none"
+}
+
+func (ri *sentinelInstance) flags() string {
+	flags := []string{"master"}
+	switch ri.kind {
+	case sentinelKindReplica:
+		flags[0] = "slave"
+	case sentinelKindSentinel:
+		flags[0] = "sentinel"
+	}
+	if ri.sdown {
+		flags = append(flags, "s_down")
+	}
+	if ri.kind == sentinelKindMaster && ri.master.odown {
+		flags = append(flags, "o_down")
+	}
+	if ri.kind == sentinelKindMaster && ri.master.failoverState != sentinelFailoverNone {
+		flags = append(flags, "failover_in_progress")
+	}
+	if ri.conn == nil {
+		flags = append(flags, "disconnected")
+	}
+	return strings.Join(flags, ",")
+}
+
+func (ri *sentinelInstance) toResp() resp.RespValue {
+	str := func(n int) resp.RespValue { return resp.BulkString(strconv.Itoa(n)) }
+	pairs := []resp.Pair{
+		resp.KV("name", resp.BulkString(ri.addr())),
+		resp.KV("ip", resp.BulkString(ri.host)),
+		resp.KV("port", str(ri.port)),
+		resp.KV("flags", resp.BulkString(ri.flags())),
+		resp.KV("last-ok-ping-reply", str(int(time.Since(ri.lastOK).Milliseconds()))),
+	}
+	m := ri.master
+	switch ri.kind {
+	case sentinelKindMaster:
+		pairs[0] = resp.KV("name", resp.BulkString(m.name))
+		pairs = append(pairs,
+			resp.KV("role-reported", resp.BulkString(ri.role)),
+			resp.KV("config-epoch", str(m.configEpoch)),
+			resp.KV("num-slaves", str(len(m.replicas))),
+			resp.KV("num-other-sentinels", str(len(m.sentinels))),
+			resp.KV("quorum", str(m.quorum)),
+			resp.KV("down-after-milliseconds", str(int(m.downAfter.Milliseconds()))),
+			resp.KV("failover-timeout", str(int(m.failoverTimeout.Milliseconds()))),
+			resp.KV("failover-state", resp.BulkString(sentinelFailoverStateName(m.failoverState))),
+		)
+	case sentinelKindReplica:
+		linkStatus := "err"
+		if ri.masterLinkUp {
+			linkStatus = "ok"
+		}
+		pairs = append(pairs,
+			resp.KV("role-reported", resp.BulkString(ri.role)),
+			resp.KV("master-host", resp.BulkString(ri.masterHost)),
+			resp.KV("master-port", str(ri.masterPort)),
+			resp.KV("master-link-status", resp.BulkString(linkStatus)),
+			resp.KV("slave-repl-offset", str(ri.replOffset)),
+		)
+	case sentinelKindSentinel:
+		pairs = append(pairs,
+			resp.KV("runid", resp.BulkString(ri.runID)),
+			resp.KV("last-hello-message", str(int(time.Since(ri.lastHello).Milliseconds()))),
+			resp.KV("voted-leader", resp.BulkString(ri.leader)),
+			resp.KV("voted-leader-epoch", str(ri.leaderEpoch)),
+		)
+	}
+	return resp.Map(pairs...)
+}
+
+func sentinelResponse(cmd []string, c *client) string {
+	sub := strings.ToUpper(cmd[1])
+	switch sub {
+	case "MYID":
+		return encodeBulkString(sentinelMyID)
+	case "MASTERS":
+		names := make([]string, 0, len(sentinelMasters))
+		for name := range sentinelMasters {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		masters := make([]resp.RespValue, 0, len(names))
+		for _, name := range names {
+			masters = append(masters, sentinelMasters[name].instance.toResp())
+		}
+		return c.encode(resp.Array(masters...))
+	case "MONITOR":
+		if len(cmd) != 6 {
+			return encodeSimpleErrorResponse("wrong number of arguments for 'sentinel|monitor' command")
+		}
+		if err := sentinelMonitor(cmd[2], cmd[3], cmd[4], cmd[5]); err != nil {
+			return errorResponse(err)
+		}
+		return encodeSimpleString("OK")
+	case "IS-MASTER-DOWN-BY-ADDR":
+		return isMasterDownByAddrResponse(cmd, c)
+	}
+
+	switch sub {
+	case "MASTER", "REPLICAS", "SLAVES", "SENTINELS", "GET-MASTER-ADDR-BY-NAME", "REMOVE", "FAILOVER", "SET":
+	default:
+		return encodeSimpleErrorResponse(fmt.Sprintf("Unknown sentinel subcommand '%s'", cmd[1]))
+	}
+	if len(cmd) < 3 {
+		return encodeSimpleErrorResponse(fmt.Sprintf("wrong number of arguments for 'sentinel|%s' command", strings.ToLower(sub)))
+	}
+	m, ok := sentinelMasters[cmd[2]]
+	if sub == "GET-MASTER-ADDR-BY-NAME" {
+		if !ok {
+			return "*-1\r\n"
+		}
+		host, port := m.currentAddr()
+		return encodeStringArray([]string{host, strconv.Itoa(port)})
+	}
+	if !ok {
+		return encodeSimpleErrorResponse("No such master with that name")
+	}
+
+	switch sub {
+	case "MASTER":
+		return c.encode(m.instance.toResp())
+	case "REPLICAS", "SLAVES":
+		replicas := []resp.RespValue{}
+		for _, replica := range m.sortedReplicas() {
+			replicas = append(replicas, replica.toResp())
+		}
+		return c.encode(resp.Array(replicas...))
+	case "SENTINELS":
+		sentinels := []resp.RespValue{}
+		for _, s := range m.sortedSentinels() {
+			sentinels = append(sentinels, s.toResp())
+		}
+		return c.encode(resp.Array(sentinels...))
+	case "REMOVE":
+		m.instance.stop()
+		for _, replica := range m.replicas {
+			replica.stop()
+		}
+		for _, s := range m.sentinels {
+			s.stop()
+		}
+		delete(sentinelMasters, m.name)
+		sentinelEvent("-monitor", m.instance, "")
+		return encodeSimpleString("OK")
+	case "FAILOVER":
+		// a forced failover skips the agreement, we simply become the leader
+		if m.failoverState != sentinelFailoverNone {
+			return encodeErrorResponseWithMsg("INPROG", "Failover already in progress")
+		}
+		if len(m.replicas) == 0 {
+			return encodeErrorResponseWithMsg("NOGOODSLAVE", "No suitable replica to promote")
+		}
+		now := time.Now()
+		m.startFailover(now)
+		m.setFailoverState(sentinelFailoverSelectReplica, now)
+		m.selectAndPromote(now)
+		if m.failoverState == sentinelFailoverNone {
+			return encodeErrorResponseWithMsg("NOGOODSLAVE", "No suitable replica to promote")
+		}
+		return encodeSimpleString("OK")
+	}
+
+	// SET <name> <option> <value> [<option> <value> ...]
+	if len(cmd) < 5 || len(cmd)%2 == 0 {
+		return encodeSimpleErrorResponse("wrong number of arguments for 'sentinel|set' command")
+	}
+	for i := 3; i < len(cmd); i += 2 {
+		value, err := strconv.Atoi(cmd[i+1])
+		if err != nil || value <= 0 {
+			return encodeSimpleErrorResponse(fmt.Sprintf("Invalid argument '%s' for SENTINEL SET '%s'", cmd[i+1], cmd[i]))
+		}
+		switch strings.ToLower(cmd[i]) {
+		case "down-after-milliseconds":
+			m.downAfter = time.Duration(value) * time.Millisecond
+		case "failover-timeout":
+			m.failoverTimeout = time.Duration(value) * time.Millisecond
+		case "quorum":
+			m.quorum = value
+		default:
+			return encodeSimpleErrorResponse(fmt.Sprintf("Invalid argument '%s' for SENTINEL SET", cmd[i]))
+		}
+	}
+	return encodeSimpleString("OK")
+}
+
+// SENTINEL IS-MASTER-DOWN-BY-ADDR <ip> <port> <current epoch> <runid|*>, a
+// run id instead of * also asks for our vote
+func isMasterDownByAddrResponse(cmd []string, c *client) string {
+	if len(cmd) != 6 {
+		return encodeSimpleErrorResponse("wrong number of arguments for 'sentinel|is-master-down-by-addr' command")
+	}
+	port, err1 := strconv.Atoi(cmd[3])
+	epoch, err2 := strconv.Atoi(cmd[4])
+	if err1 != nil || err2 != nil {
+		return encodeSimpleErrorResponse("value is not an integer or out of range")
+	}
+
+	down, leader, leaderEpoch := 0, "*", 0
+	for _, m := range sentinelMasters {
+		if m.instance.host != cmd[2] || m.instance.port != port {
+			continue
+		}
+		if m.instance.sdown {
+			down = 1
+		}
+		if cmd[5] != "*" {
+			leader, leaderEpoch = m.voteLeader(epoch, cmd[5])
+		}
+		break
+	}
+	return c.encode(resp.Array(resp.Integer(down), resp.BulkString(leader), resp.Integer(leaderEpoch)))
+}
+
+func sentinelInfoResponse(c *client) string {
+	names := make([]string, 0, len(sentinelMasters))
+	for name := range sentinelMasters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	info := fmt.Sprintf("# Sentinel\r\nsentinel_masters:%d\r\nsentinel_myid:%s\r\nsentinel_current_epoch:%d\r\n", len(names), sentinelMyID, sentinelCurrentEpoch)
+	for i, name := range names {
+		m := sentinelMasters[name]
+		status := "ok"
+		if m.odown {
+			status = "odown"
+		} else if m.instance.sdown {
+			status = "sdown"
+		}
+		host, port := m.currentAddr()
+		info += fmt.Sprintf("master%d:name=%s,status=%s,address=%s,slaves=%d,sentinels=%d\r\n",
+			i, name, status, net.JoinHostPort(host, strconv.Itoa(port)), len(m.replicas), len(m.sentinels)+1)
+	}
+	info = info[:len(info)-2]
+	return c.encode(resp.VerbatimString("txt", info))
+}
@@ -0,0 +1,386 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DeanLogan/redis-clone/app/resp"
+)
+
+// withSentinelState runs fn on the executor as sentinel "me" in epoch 0,
+// putting the globals back afterwards. fn must not call t.Fatal.
+func withSentinelState(fn func()) {
+	runOnExecutor(func() {
+		savedID, savedEpoch := sentinelMyID, sentinelCurrentEpoch
+		defer func() { sentinelMyID, sentinelCurrentEpoch = savedID, savedEpoch }()
+		sentinelMyID = "me"
+		sentinelCurrentEpoch = 0
+		fn()
+	})
+}
+
+// testSentinelMaster builds a group that knows the given other sentinels,
+// without starting any links
+func testSentinelMaster(quorum int, sentinels ...string) *sentinelMaster {
+	m := &sentinelMaster{
+		name:            "mymaster",
+		quorum:          quorum,
+		downAfter:       time.Second,
+		failoverTimeout: time.Second,
+		replicas:        make(map[string]*sentinelInstance),
+		sentinels:       make(map[string]*sentinelInstance),
+	}
+	m.instance = &sentinelInstance{kind: sentinelKindMaster, host: "127.0.0.1", port: 6379, master: m, role: "master"}
+	for i, runID := range sentinels {
+		m.sentinels[runID] = &sentinelInstance{kind: sentinelKindSentinel, host: "127.0.0.1", port: 26380 + i, master: m, runID: runID}
+	}
+	return m
+}
+
+func TestSentinelQuorum(t *testing.T) {
+	withSentinelState(func() {
+		now := time.Now()
+		m := testSentinelMaster(2, "a", "b")
+
+		m.checkObjectivelyDown(now)
+		if m.odown {
+			t.Errorf("odown while nobody sees the master down")
+		}
+		// other sentinels agreeing doesn't count until we see it down ourselves
+		m.sentinels["a"].masterDown, m.sentinels["a"].lastAskReply = true, now
+		m.checkObjectivelyDown(now)
+		if m.odown {
+			t.Errorf("odown while we still see the master up")
+		}
+
+		m.instance.sdown = true
+		m.sentinels["a"].masterDown = false
+		m.checkObjectivelyDown(now)
+		if m.odown {
+			t.Errorf("odown with 1/2 votes")
+		}
+		// a stale answer is as good as none
+		m.sentinels["a"].masterDown, m.sentinels["a"].lastAskReply = true, now.Add(-time.Minute)
+		m.checkObjectivelyDown(now)
+		if m.odown {
+			t.Errorf("odown counting an answer from a minute ago")
+		}
+		m.sentinels["a"].lastAskReply = now
+		m.checkObjectivelyDown(now)
+		if !m.odown {
+			t.Errorf("not odown with 2/2 votes")
+		}
+
+		m.sentinels["a"].masterDown = false
+		m.checkObjectivelyDown(now)
+		if m.odown {
+			t.Errorf("still odown after the other sentinel changed its mind")
+		}
+	})
+}
+
+func TestSentinelVoteOncePerEpoch(t *testing.T) {
+	withSentinelState(func() {
+		m := testSentinelMaster(2, "a", "b")
+		check := func(epoch int, runID, wantLeader string, wantEpoch int) {
+			leader, leaderEpoch := m.voteLeader(epoch, runID)
+			if leader != wantLeader || leaderEpoch != wantEpoch {
+				t.Errorf("voteLeader(%d, %s) = %s %d, want %s %d", epoch, runID, leader, leaderEpoch, wantLeader, wantEpoch)
+			}
+		}
+
+		check(1, "a", "a", 1)
+		if sentinelCurrentEpoch != 1 {
+			t.Errorf("current epoch = %d after a vote in epoch 1", sentinelCurrentEpoch)
+		}
+		// the second request in the same epoch gets the vote already given
+		check(1, "b", "a", 1)
+		check(1, "me", "a", 1)
+		check(2, "b", "b", 2)
+		// an old epoch can't take the vote back
+		check(1, "a", "b", 2)
+		if sentinelCurrentEpoch != 2 {
+			t.Errorf("current epoch = %d, want 2", sentinelCurrentEpoch)
+		}
+	})
+}
+
+func TestSentinelElectedLeader(t *testing.T) {
+	withSentinelState(func() {
+		// five sentinels: a majority is three
+		m := testSentinelMaster(2, "a", "b", "c", "d")
+		m.failoverEpoch = 3
+		m.leader, m.leaderEpoch = "me", 3
+
+		vote := func(runID, leader string, epoch int) {
+			m.sentinels[runID].leader, m.sentinels[runID].leaderEpoch = leader, epoch
+		}
+		vote("a", "me", 3)
+		if got := m.electedLeader(); got != "" {
+			t.Errorf("electedLeader with 2/5 votes = %q", got)
+		}
+		// votes from another epoch don't count
+		vote("b", "me", 2)
+		vote("c", "c", 3)
+		if got := m.electedLeader(); got != "" {
+			t.Errorf("electedLeader with a vote from an old epoch = %q", got)
+		}
+		vote("b", "me", 3)
+		if got := m.electedLeader(); got != "me" {
+			t.Errorf("electedLeader with 3/5 votes = %q, want me", got)
+		}
+
+		// a majority isn't enough when the quorum asks for more
+		m.quorum = 4
+		if got := m.electedLeader(); got != "" {
+			t.Errorf("electedLeader with 3 votes and quorum 4 = %q", got)
+		}
+		vote("d", "me", 3)
+		if got := m.electedLeader(); got != "me" {
+			t.Errorf("electedLeader with 4 votes and quorum 4 = %q, want me", got)
+		}
+
+		// our own vote only counts in the epoch of the failover
+		m.quorum = 2
+		m.leaderEpoch = 2
+		vote("a", "c", 3)
+		vote("b", "c", 3)
+		vote("d", "c", 3)
+		if got := m.electedLeader(); got != "c" {
+			t.Errorf("electedLeader = %q, want c", got)
+		}
+	})
+}
+
+func TestSentinelFailoverStateMachine(t *testing.T) {
+	conn, peer := net.Pipe()
+	defer conn.Close()
+	defer peer.Close()
+
+	withSentinelState(func() {
+		now := time.Now()
+		m := testSentinelMaster(2, "a", "b")
+		for i, offset := range []int{100, 300, 200} {
+			replica := &sentinelInstance{
+				kind: sentinelKindReplica, host: "127.0.0.1", port: 6380 + i, master: m, conn: conn,
+				role: "slave", replOffset: offset, lastOK: now, infoRefresh: now,
+			}
+			m.replicas[replica.addr()] = replica
+		}
+		m.instance.sdown = true
+		m.odown, m.odownSince = true, now.Add(-time.Second)
+
+		m.failoverStateMachine(now)
+		if m.failoverState != sentinelFailoverWaitStart || m.failoverEpoch != 1 {
+			t.Errorf("after odown: state %s epoch %d, want wait_start in epoch 1", sentinelFailoverStateName(m.failoverState), m.failoverEpoch)
+			return
+		}
+		if m.leader != "me" || m.leaderEpoch != 1 {
+			t.Errorf("we voted for %s in %d, want ourselves in 1", m.leader, m.leaderEpoch)
+		}
+
+		// one vote out of three isn't a majority
+		m.failoverStateMachine(now)
+		if m.failoverState != sentinelFailoverWaitStart {
+			t.Errorf("left wait_start without a majority: %s", sentinelFailoverStateName(m.failoverState))
+		}
+		m.sentinels["a"].leader, m.sentinels["a"].leaderEpoch = "me", 1
+		m.failoverStateMachine(now)
+		if m.failoverState != sentinelFailoverWaitPromotion {
+			t.Errorf("elected leader but state is %s", sentinelFailoverStateName(m.failoverState))
+			return
+		}
+		if m.promoted == nil || m.promoted.replOffset != 300 {
+			t.Errorf("promoted %+v, want the replica with the highest offset", m.promoted)
+			return
+		}
+		if len(m.promoted.pending) != 1 || strings.Join(m.promoted.pending[0].args, " ") != "REPLICAOF NO ONE" {
+			t.Errorf("promoted replica was sent %v", m.promoted.pending)
+		}
+
+		m.promotionDone()
+		if m.failoverState != sentinelFailoverReconfReplicas || m.configEpoch != 1 {
+			t.Errorf("after the promotion: state %s config epoch %d", sentinelFailoverStateName(m.failoverState), m.configEpoch)
+		}
+		for _, replica := range m.replicas {
+			if replica == m.promoted {
+				continue
+			}
+			if len(replica.pending) != 1 || strings.Join(replica.pending[0].args, " ") != "REPLICAOF 127.0.0.1 6381" {
+				t.Errorf("%s was sent %v", replica.addr(), replica.pending)
+			}
+		}
+	})
+
+	// a leader that never gets elected gives up after the election timeout
+	withSentinelState(func() {
+		now := time.Now()
+		m := testSentinelMaster(2, "a", "b")
+		m.instance.sdown = true
+		m.odown, m.odownSince = true, now.Add(-time.Second)
+		m.failoverStateMachine(now)
+		m.sentinels["a"].leader, m.sentinels["a"].leaderEpoch = "a", 1
+		m.sentinels["b"].leader, m.sentinels["b"].leaderEpoch = "a", 1
+		m.failoverStateMachine(now.Add(m.failoverTimeout + time.Millisecond))
+		if m.failoverState != sentinelFailoverNone {
+			t.Errorf("state %s after losing the election, want none", sentinelFailoverStateName(m.failoverState))
+		}
+		// and doesn't start a new attempt right away
+		m.failoverStateMachine(now.Add(m.failoverTimeout + 2*time.Millisecond))
+		if m.failoverState != sentinelFailoverNone {
+			t.Errorf("retried a failover straight after aborting one")
+		}
+	})
+}
+
+// TestSentinelFailover runs a master, a replica and three sentinels as separate
+// processes and kills the master
+func TestSentinelFailover(t *testing.T) {
+	if testing.Short() {
+		t.Skip("starts several servers")
+	}
+	dir := t.TempDir()
+	bin := filepath.Join(dir, "redis")
+	if out, err := exec.Command("go", "build", "-o", bin, ".").CombinedOutput(); err != nil {
+		t.Fatalf("build: %v\n%s", err, out)
+	}
+
+	var logs []string
+	start := func(name string, args ...string) *exec.Cmd {
+		instanceDir := filepath.Join(dir, name)
+		if err := os.Mkdir(instanceDir, 0o755); err != nil {
+			t.Fatal(err)
+		}
+		logPath := filepath.Join(dir, name+".log")
+		logFile, err := os.Create(logPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cmd := exec.Command(bin, append([]string{"--dir", instanceDir}, args...)...)
+		cmd.Stdout, cmd.Stderr = logFile, logFile
+		if err := cmd.Start(); err != nil {
+			t.Fatalf("start %s: %v", name, err)
+		}
+		logs = append(logs, logPath)
+		t.Cleanup(func() {
+			cmd.Process.Kill()
+			cmd.Wait()
+			logFile.Close()
+		})
+		return cmd
+	}
+	t.Cleanup(func() {
+		if !t.Failed() {
+			return
+		}
+		// the events tell the story, the per-command logging drowns them
+		for _, path := range logs {
+			data, _ := os.ReadFile(path)
+			var events []string
+			for _, line := range strings.Split(string(data), "\n") {
+				if strings.HasPrefix(line, "+") || strings.HasPrefix(line, "-") {
+					events = append(events, line)
+				}
+			}
+			t.Logf("--- %s\n%s", filepath.Base(path), strings.Join(events, "\n"))
+		}
+	})
+
+	ports := freePorts(t, 5)
+	masterAddr := "127.0.0.1:" + strconv.Itoa(ports[0])
+	replicaAddr := "127.0.0.1:" + strconv.Itoa(ports[1])
+	master := start("master", "--port", strconv.Itoa(ports[0]))
+	start("replica", "--port", strconv.Itoa(ports[1]), "--replicaof", "127.0.0.1 "+strconv.Itoa(ports[0]))
+	var sentinelAddrs []string
+	for i, port := range ports[2:] {
+		start(fmt.Sprintf("sentinel%d", i), "--sentinel", "--port", strconv.Itoa(port),
+			"--sentinel-monitor", "mymaster 127.0.0.1 "+strconv.Itoa(ports[0])+" 2",
+			"--sentinel-down-after-milliseconds", "2000", "--sentinel-failover-timeout", "5000")
+		sentinelAddrs = append(sentinelAddrs, "127.0.0.1:"+strconv.Itoa(port))
+	}
+
+	waitFor(t, 10*time.Second, "the replica to sync", func() bool {
+		return strings.Contains(queryAddr(t, replicaAddr, "INFO", "replication").Str, "master_link_status:up")
+	})
+	if reply := queryAddr(t, masterAddr, "SET", "failover:key", "before"); reply.Str != "OK" {
+		t.Fatalf("SET on the master = %+v", reply)
+	}
+	// the sentinels find the replica through the master's INFO and each other
+	// through the hello channel
+	waitFor(t, 15*time.Second, "the sentinels to discover everything", func() bool {
+		for _, addr := range sentinelAddrs {
+			if len(queryAddr(t, addr, "SENTINEL", "SENTINELS", "mymaster").Elems) != 2 ||
+				len(queryAddr(t, addr, "SENTINEL", "REPLICAS", "mymaster").Elems) != 1 {
+				return false
+			}
+		}
+		return queryAddr(t, replicaAddr, "GET", "failover:key").Str == "before"
+	})
+
+	master.Process.Kill()
+	master.Wait()
+
+	waitFor(t, 30*time.Second, "the sentinels to promote the replica", func() bool {
+		for _, addr := range sentinelAddrs {
+			reply := queryAddr(t, addr, "SENTINEL", "GET-MASTER-ADDR-BY-NAME", "mymaster")
+			if len(reply.Elems) != 2 || reply.Elems[1].Str != strconv.Itoa(ports[1]) {
+				return false
+			}
+		}
+		return true
+	})
+	if info := queryAddr(t, replicaAddr, "INFO", "replication").Str; !strings.Contains(info, "role:master") {
+		t.Fatalf("the promoted replica reports\n%s", info)
+	}
+	if reply := queryAddr(t, replicaAddr, "GET", "failover:key"); reply.Str != "before" {
+		t.Fatalf("GET on the new master = %+v", reply)
+	}
+	if reply := queryAddr(t, replicaAddr, "SET", "failover:key", "after"); reply.Str != "OK" {
+		t.Fatalf("SET on the new master = %+v", reply)
+	}
+}
+
+// queryAddr sends one command on a new connection, a failed dial is a zero reply
+func queryAddr(t *testing.T, addr string, args ...string) resp.RespValue {
+	conn, err := net.DialTimeout("tcp", addr, time.Second)
+	if err != nil {
+		return resp.RespValue{}
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Write([]byte(encodeStringArray(args))); err != nil {
+		return resp.RespValue{}
+	}
+	reply, _ := resp.NewReader(conn).ReadValue()
+	return reply
+}
+
+func waitFor(t *testing.T, timeout time.Duration, what string, cond func() bool) {
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func freePorts(t *testing.T, n int) []int {
+	ports := make([]int, n)
+	for i := range ports {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer listener.Close()
+		ports[i] = listener.Addr().(*net.TCPAddr).Port
+	}
+	return ports
+}
@@ -8,7 +8,6 @@ import (
 	"net"
 	"os"
 	"path/filepath"
-	"reflect"
 	"strconv"
 	"strings"
 	"time"
@@ -21,10 +20,9 @@ type serverConfig struct {
 	ReplOffset    	 int
 	ReplicaofHost 	 string
 	ReplicaofPort 	 int
-	Replicas 	  	 []net.Conn
+	Replicas 	  	 []*client
 	ListeningPort 	 string
 	MasterReplOffset int
-    MasterReplid     string
     Dir              string
     AppendOnly       string
     AppendDirName    string
@@ -36,81 +34,162 @@ type serverConfig struct {
     WriteOffset      int
     LastAckedOffset  int
     Users            map[string]aclUser
+    ProtoMaxBulkLen  int
+    AutoAofRewritePercentage int
+    AutoAofRewriteMinSize    int
+    SavePoints               []savePoint
+    Replid2                  string   // the replid we had as a replica, valid up to SecondReplOffset
+    SecondReplOffset         int
+    ReplBacklogSize          int
+    ReplBacklogTTL           int
+    ReplicaReadOnly          string
+    MinReplicasToWrite       int
+    MinReplicasMaxLag        int
+    ReplPingReplicaPeriod    int
+    ReplTimeout              int
+    ReplDisklessSync         string
+    ReplDisklessSyncDelay    int
+    ReplDisklessLoad         string
+    Masteruser               string
+    Masterauth               string
+    ClusterEnabled           string
+    ClusterConfigFile        string
+    ClusterNodeTimeout       int // milliseconds
 }
 
-var watchedKeys = make(map[string]map[net.Conn]struct{})
-var dirtyWatchedConns = make(map[net.Conn]bool)
+var watchedKeys = make(map[string]map[*client]struct{})
 
 const charset = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
 
 var config serverConfig
 
 var ttl = make(map[string]time.Time)
-var keys = []string{}
-var streamTopMilisecondsTimeForStream int
-var entryIds = make(map[int]int) // key is milisecondsTime and value is sequenceNumber
-var replicaAckOffsets = make(map[net.Conn]int) // key: replica address, value: last acked offset
-var queuedCommands = make(map[net.Conn][][]string)
-var channelSubscribers = make(map[string]map[net.Conn]struct{})
+var channelSubscribers = make(map[string]map[*client]struct{})
+
+// redisCommand is an entry of the command table. Like redis a negative arity
+// means at least that many arguments, counting the command name.
+type redisCommand struct {
+    handler  func([]string, *client) string
+    arity    int
+    flags    int
+    firstKey int // position of the first key, 0 for commands without keys
+    lastKey  int // position of the last key, negative counts back from the end
+    keyStep  int
+}
+
+const (
+    cmdWrite  = 1 << iota // modifies the keyspace, so it's propagated and refused by read only replicas
+    cmdAsking             // implies ASKING, so a slot being imported can be used
+)
+
+var commandTable map[string]*redisCommand
+
+func (rc *redisCommand) arityMatches(argc int) bool {
+    if rc.arity > 0 {
+        return argc == rc.arity
+    }
+    return argc >= -rc.arity
+}
 
-var ackReceived chan bool
-var commandHandlers map[string]func([]string, net.Conn) (string, bool)
-var subscriberCommandHandlers map[string]func([]string, net.Conn) (string, bool)
+var subscriberCommandHandlers map[string]func([]string, *client) string
 
 func init() {
-    commandHandlers = map[string]func([]string, net.Conn) (string, bool){
-        "COMMAND":      func(cmd []string, conn net.Conn) (string, bool) { return commandResponse(), false },
-        "REPLCONF":     func(cmd []string, conn net.Conn) (string, bool) { return replconfResponse(cmd, conn), false },
-        "PSYNC":        func(cmd []string, conn net.Conn) (string, bool) { return psyncResponse(cmd) },
-        "PING":         func(cmd []string, conn net.Conn) (string, bool) { return pingResponse(false), false },
-        "ECHO":         func(cmd []string, conn net.Conn) (string, bool) { return echoResponse(cmd), false },
-        "INFO":         func(cmd []string, conn net.Conn) (string, bool) { return infoResponse(cmd), false },
-        "SET":          func(cmd []string, conn net.Conn) (string, bool) { return setResponse(cmd), false },
-        "GET":          func(cmd []string, conn net.Conn) (string, bool) { return getResponse(cmd), false },
-        "WAIT":         func(cmd []string, conn net.Conn) (string, bool) { return waitResponse(cmd), false },
-        "CONFIG":       func(cmd []string, conn net.Conn) (string, bool) { return configResponse(cmd), false },
-        "KEYS":         func(cmd []string, conn net.Conn) (string, bool) { return keysResponse(cmd), false },
-        "TYPE":         func(cmd []string, conn net.Conn) (string, bool) { return typeResponse(cmd), false },
-        "XADD":         func(cmd []string, conn net.Conn) (string, bool) { return xaddResponse(cmd), false },
-        "XRANGE":       func(cmd []string, conn net.Conn) (string, bool) { return xrangeResponse(cmd), false },
-        "XREAD":        func(cmd []string, conn net.Conn) (string, bool) { return xreadResponse(cmd, conn), false },
-        "RPUSH":        func(cmd []string, conn net.Conn) (string, bool) { return rPushResponse(cmd), false },
-        "LRANGE":       func(cmd []string, conn net.Conn) (string, bool) { return lRangeResponse(cmd), false },
-        "LPUSH":        func(cmd []string, conn net.Conn) (string, bool) { return lPushResponse(cmd), false },
-        "LLEN":         func(cmd []string, conn net.Conn) (string, bool) { return lLenResponse(cmd), false },
-        "LPOP":         func(cmd []string, conn net.Conn) (string, bool) { return lPopResponse(cmd), false },
-        "BLPOP":        func(cmd []string, conn net.Conn) (string, bool) { return bLPopResponse(cmd, conn), false },
-        "INCR":         func(cmd []string, conn net.Conn) (string, bool) { return incrResponse(cmd), false },
-        "MULTI":        func(cmd []string, conn net.Conn) (string, bool) { return multiResponse(conn), false },
-        "EXEC":         func(cmd []string, conn net.Conn) (string, bool) { return execResponse(conn), false },
-        "DISCARD":      func(cmd []string, conn net.Conn) (string, bool) { return discardResponse(conn), false },
-        "SUBSCRIBE":    func(cmd []string, conn net.Conn) (string, bool) { return subscribeResponse(cmd, conn), false },
-        "PUBLISH":      func(cmd []string, conn net.Conn) (string, bool) { return publishResponse(cmd), false },
-        "UNSUBSCRIBE":  func(cmd []string, conn net.Conn) (string, bool) { return unsubscribeResponse(cmd, conn), false },
-        "ZADD":         func(cmd []string, conn net.Conn) (string, bool) { return zaddResponse(cmd), false },
-        "ZRANK":        func(cmd []string, conn net.Conn) (string, bool) { return zrankResponse(cmd), false },
-        "ZRANGE":       func(cmd []string, conn net.Conn) (string, bool) { return zrangeResponse(cmd), false },
-        "ZCARD":        func(cmd []string, conn net.Conn) (string, bool) { return zcardResponse(cmd), false },
-        "ZSCORE":       func(cmd []string, conn net.Conn) (string, bool) { return zscoreResponse(cmd), false },
-        "ZREM":         func(cmd []string, conn net.Conn) (string, bool) { return zremResponse(cmd), false },
-        "GEOADD":       func(cmd []string, conn net.Conn) (string, bool) { return geoaddResponse(cmd), false },
-        "GEOPOS":       func(cmd []string, conn net.Conn) (string, bool) { return geoposResponse(cmd), false },
-        "GEODIST":      func(cmd []string, conn net.Conn) (string, bool) { return geodistResponse(cmd), false },
-        "GEOSEARCH":    func(cmd []string, conn net.Conn) (string, bool) { return geosearchResponse(cmd), false },
-        "ACL":          func(cmd []string, conn net.Conn) (string, bool) { return aclResponse(cmd, conn), false },
-        "AUTH":         func(cmd []string, conn net.Conn) (string, bool) { return authResponse(cmd, conn), false },
-        "WATCH":        func(cmd []string, conn net.Conn) (string, bool) { return watchResponse(cmd, conn), false },
-        "UNWATCH":      func(cmd []string, conn net.Conn) (string, bool) { return unwatchResponse(conn), false },
-    }
-
-    subscriberCommandHandlers = map[string]func([]string, net.Conn) (string, bool){
-        "SUBSCRIBE":    func(cmd []string, conn net.Conn) (string, bool) { return subscribeResponse(cmd, conn), false },
-        "UNSUBSCRIBE":  func(cmd []string, conn net.Conn) (string, bool) { return unsubscribeResponse(cmd, conn), false },
+    commandTable = map[string]*redisCommand{
+        "COMMAND":        {func(cmd []string, c *client) string { return commandResponse() }, -1, 0, 0, 0, 0},
+        "REPLCONF":       {func(cmd []string, c *client) string { return replconfResponse(cmd, c) }, -3, 0, 0, 0, 0},
+        "PSYNC":          {func(cmd []string, c *client) string { return psyncResponse(cmd, c) }, -3, 0, 0, 0, 0},
+        "REPLICAOF":      {func(cmd []string, c *client) string { return replicaofResponse(cmd, c) }, 3, 0, 0, 0, 0},
+        "FAILOVER":       {func(cmd []string, c *client) string { return failoverResponse(cmd) }, -1, 0, 0, 0, 0},
+        "SLAVEOF":        {func(cmd []string, c *client) string { return replicaofResponse(cmd, c) }, 3, 0, 0, 0, 0},
+        "PING":           {func(cmd []string, c *client) string { return pingResponse(false) }, -1, 0, 0, 0, 0},
+        "ECHO":           {func(cmd []string, c *client) string { return echoResponse(cmd) }, 2, 0, 0, 0, 0},
+        "INFO":           {func(cmd []string, c *client) string { return infoResponse(cmd, c) }, -1, 0, 0, 0, 0},
+        "SET":            {func(cmd []string, c *client) string { return setResponse(cmd) }, -3, cmdWrite, 1, 1, 1},
+        "GET":            {func(cmd []string, c *client) string { return getResponse(cmd) }, 2, 0, 1, 1, 1},
+        "WAIT":           {func(cmd []string, c *client) string { return waitInMultiResponse() }, 3, 0, 0, 0, 0},
+        "CONFIG":         {func(cmd []string, c *client) string { return configResponse(cmd, c) }, -2, 0, 0, 0, 0},
+        "KEYS":           {func(cmd []string, c *client) string { return keysResponse(cmd) }, 2, 0, 0, 0, 0},
+        "TYPE":           {func(cmd []string, c *client) string { return typeResponse(cmd) }, 2, 0, 1, 1, 1},
+        "XADD":           {func(cmd []string, c *client) string { return xaddResponse(cmd) }, -5, cmdWrite, 1, 1, 1},
+        "XRANGE":         {func(cmd []string, c *client) string { return xrangeResponse(cmd) }, -4, 0, 1, 1, 1},
+        "XREAD":          {func(cmd []string, c *client) string { return xreadResponse(cmd) }, -4, 0, 0, 0, 0},
+        "RPUSH":          {func(cmd []string, c *client) string { return rPushResponse(cmd) }, -3, cmdWrite, 1, 1, 1},
+        "LRANGE":         {func(cmd []string, c *client) string { return lRangeResponse(cmd) }, 4, 0, 1, 1, 1},
+        "LPUSH":          {func(cmd []string, c *client) string { return lPushResponse(cmd) }, -3, cmdWrite, 1, 1, 1},
+        "LLEN":           {func(cmd []string, c *client) string { return lLenResponse(cmd) }, 2, 0, 1, 1, 1},
+        "LPOP":           {func(cmd []string, c *client) string { return lPopResponse(cmd) }, -2, cmdWrite, 1, 1, 1},
+        "BLPOP":          {func(cmd []string, c *client) string { return nonBlockingBLPopResponse(cmd) }, -3, cmdWrite, 1, -2, 1},
+        "INCR":           {func(cmd []string, c *client) string { return incrResponse(cmd) }, 2, cmdWrite, 1, 1, 1},
+        "MULTI":          {func(cmd []string, c *client) string { return multiResponse(c) }, 1, 0, 0, 0, 0},
+        "EXEC":           {func(cmd []string, c *client) string { return execResponse(c) }, 1, 0, 0, 0, 0},
+        "DISCARD":        {func(cmd []string, c *client) string { return discardResponse(c) }, 1, 0, 0, 0, 0},
+        "SUBSCRIBE":      {func(cmd []string, c *client) string { return subscribeResponse(cmd, c) }, -2, 0, 0, 0, 0},
+        "PUBLISH":        {func(cmd []string, c *client) string { return publishResponse(cmd) }, 3, 0, 0, 0, 0},
+        "UNSUBSCRIBE":    {func(cmd []string, c *client) string { return unsubscribeResponse(cmd, c) }, -1, 0, 0, 0, 0},
+        "ZADD":           {func(cmd []string, c *client) string { return zaddResponse(cmd) }, -4, cmdWrite, 1, 1, 1},
+        "ZRANK":          {func(cmd []string, c *client) string { return zrankResponse(cmd) }, -3, 0, 1, 1, 1},
+        "ZRANGE":         {func(cmd []string, c *client) string { return zrangeResponse(cmd) }, -4, 0, 1, 1, 1},
+        "ZCARD":          {func(cmd []string, c *client) string { return zcardResponse(cmd) }, 2, 0, 1, 1, 1},
+        "ZSCORE":         {func(cmd []string, c *client) string { return zscoreResponse(cmd, c) }, 3, 0, 1, 1, 1},
+        "ZREM":           {func(cmd []string, c *client) string { return zremResponse(cmd) }, -3, cmdWrite, 1, 1, 1},
+        "GEOADD":         {func(cmd []string, c *client) string { return geoaddResponse(cmd) }, -5, cmdWrite, 1, 1, 1},
+        "GEOPOS":         {func(cmd []string, c *client) string { return geoposResponse(cmd, c) }, -2, 0, 1, 1, 1},
+        "GEODIST":        {func(cmd []string, c *client) string { return geodistResponse(cmd) }, -4, 0, 1, 1, 1},
+        "GEOSEARCH":      {func(cmd []string, c *client) string { return geosearchResponse(cmd) }, -7, 0, 1, 1, 1},
+        "ACL":            {func(cmd []string, c *client) string { return aclResponse(cmd, c) }, -2, 0, 0, 0, 0},
+        "AUTH":           {func(cmd []string, c *client) string { return authResponse(cmd, c) }, -2, 0, 0, 0, 0},
+        "WATCH":          {func(cmd []string, c *client) string { return watchResponse(cmd, c) }, -2, 0, 1, -1, 1},
+        "UNWATCH":        {func(cmd []string, c *client) string { return unwatchResponse(c) }, 1, 0, 0, 0, 0},
+        "CLIENT":         {func(cmd []string, c *client) string { return clientResponse(cmd, c) }, -2, 0, 0, 0, 0},
+        "HELLO":          {func(cmd []string, c *client) string { return helloResponse(cmd, c) }, -1, 0, 0, 0, 0},
+        "SADD":           {func(cmd []string, c *client) string { return saddResponse(cmd) }, -3, cmdWrite, 1, 1, 1},
+        "HSET":           {func(cmd []string, c *client) string { return hsetResponse(cmd) }, -4, cmdWrite, 1, 1, 1},
+        "HGET":           {func(cmd []string, c *client) string { return hgetResponse(cmd) }, 3, 0, 1, 1, 1},
+        "HGETALL":        {func(cmd []string, c *client) string { return hgetallResponse(cmd, c) }, 2, 0, 1, 1, 1},
+        "BGREWRITEAOF":   {func(cmd []string, c *client) string { return bgrewriteaofResponse() }, 1, 0, 0, 0, 0},
+        "SAVE":           {func(cmd []string, c *client) string { return saveResponse() }, 1, 0, 0, 0, 0},
+        "BGSAVE":         {func(cmd []string, c *client) string { return bgsaveResponse() }, -1, 0, 0, 0, 0},
+        "LASTSAVE":       {func(cmd []string, c *client) string { return lastsaveResponse() }, 1, 0, 0, 0, 0},
+        "EXPIRE":         {func(cmd []string, c *client) string { return expireResponse(cmd) }, -3, cmdWrite, 1, 1, 1},
+        "PEXPIRE":        {func(cmd []string, c *client) string { return expireResponse(cmd) }, -3, cmdWrite, 1, 1, 1},
+        "EXPIREAT":       {func(cmd []string, c *client) string { return expireResponse(cmd) }, -3, cmdWrite, 1, 1, 1},
+        "PEXPIREAT":      {func(cmd []string, c *client) string { return expireResponse(cmd) }, -3, cmdWrite, 1, 1, 1},
+        "TTL":            {func(cmd []string, c *client) string { return ttlResponse(cmd) }, 2, 0, 1, 1, 1},
+        "PTTL":           {func(cmd []string, c *client) string { return ttlResponse(cmd) }, 2, 0, 1, 1, 1},
+        "EXPIRETIME":     {func(cmd []string, c *client) string { return expiretimeResponse(cmd) }, 2, 0, 1, 1, 1},
+        "PEXPIRETIME":    {func(cmd []string, c *client) string { return expiretimeResponse(cmd) }, 2, 0, 1, 1, 1},
+        "PERSIST":        {func(cmd []string, c *client) string { return persistResponse(cmd) }, 2, cmdWrite, 1, 1, 1},
+        "SCAN":           {func(cmd []string, c *client) string { return scanResponse(cmd, c) }, -2, 0, 0, 0, 0},
+        "SSCAN":          {func(cmd []string, c *client) string { return collectionScanResponse(cmd, c) }, -3, 0, 1, 1, 1},
+        "HSCAN":          {func(cmd []string, c *client) string { return collectionScanResponse(cmd, c) }, -3, 0, 1, 1, 1},
+        "ZSCAN":          {func(cmd []string, c *client) string { return collectionScanResponse(cmd, c) }, -3, 0, 1, 1, 1},
+        "DEL":            {func(cmd []string, c *client) string { return delResponse(cmd, false) }, -2, cmdWrite, 1, -1, 1},
+        "UNLINK":         {func(cmd []string, c *client) string { return delResponse(cmd, true) }, -2, cmdWrite, 1, -1, 1},
+        "EXISTS":         {func(cmd []string, c *client) string { return existsResponse(cmd) }, -2, 0, 1, -1, 1},
+        "TOUCH":          {func(cmd []string, c *client) string { return existsResponse(cmd) }, -2, 0, 1, -1, 1},
+        "RENAME":         {func(cmd []string, c *client) string { return renameResponse(cmd, false) }, 3, cmdWrite, 1, 2, 1},
+        "RENAMENX":       {func(cmd []string, c *client) string { return renameResponse(cmd, true) }, 3, cmdWrite, 1, 2, 1},
+        "COPY":           {func(cmd []string, c *client) string { return copyResponse(cmd) }, -3, cmdWrite, 1, 2, 1},
+        "RANDOMKEY":      {func(cmd []string, c *client) string { return randomkeyResponse() }, 1, 0, 0, 0, 0},
+        "DBSIZE":         {func(cmd []string, c *client) string { return dbsizeResponse() }, 1, 0, 0, 0, 0},
+        "FLUSHALL":       {func(cmd []string, c *client) string { return flushallResponse(cmd) }, -1, cmdWrite, 0, 0, 0},
+        "FLUSHDB":        {func(cmd []string, c *client) string { return flushallResponse(cmd) }, -1, cmdWrite, 0, 0, 0},
+        "CLUSTER":        {func(cmd []string, c *client) string { return clusterResponse(cmd, c) }, -2, 0, 0, 0, 0},
+        "ASKING":         {func(cmd []string, c *client) string { return askingResponse(c) }, 1, 0, 0, 0, 0},
+        "DUMP":           {func(cmd []string, c *client) string { return dumpResponse(cmd) }, 2, 0, 1, 1, 1},
+        "RESTORE":        {func(cmd []string, c *client) string { return restoreResponse(cmd) }, -4, cmdWrite, 1, 1, 1},
+        "RESTORE-ASKING": {func(cmd []string, c *client) string { return restoreResponse(cmd) }, -4, cmdWrite | cmdAsking, 1, 1, 1},
+        "MIGRATE":        {func(cmd []string, c *client) string { return migrateResponse(cmd) }, -6, cmdWrite, 0, 0, 0},
+    }
+
+    subscriberCommandHandlers = map[string]func([]string, *client) string{
+        "SUBSCRIBE":    func(cmd []string, c *client) string { return subscribeResponse(cmd, c) },
+        "UNSUBSCRIBE":  func(cmd []string, c *client) string { return unsubscribeResponse(cmd, c) },
         // TODO: Implement the below cmds
-        "PSUBSCRIBE":   func(cmd []string, conn net.Conn) (string, bool) { return pingResponse(true), false },
-        "PUNSUBSCRIBE": func(cmd []string, conn net.Conn) (string, bool) { return pingResponse(true), false },
-        "PING":         func(cmd []string, conn net.Conn) (string, bool) { return pingResponse(true), false },
-        "QUIT":         func(cmd []string, conn net.Conn) (string, bool) { return pingResponse(true), false },
+        "PSUBSCRIBE":   func(cmd []string, c *client) string { return pingResponse(true) },
+        "PUNSUBSCRIBE": func(cmd []string, c *client) string { return pingResponse(true) },
+        "PING":         func(cmd []string, c *client) string { return pingResponse(true) },
+        "QUIT":         func(cmd []string, c *client) string { return pingResponse(true) },
     }
 }
 
@@ -126,13 +205,106 @@ func main() {
 	flag.IntVar(&config.Port, "port", 6379, "Listen on specified port")
 	flag.StringVar(&config.ReplicaofHost, "replicaof", "", "Start server in replica mode of given host and port")
 	flag.StringVar(&config.Dir, "dir", defaultDir, "The base directory where Redis stores its data files")
-	flag.StringVar(&config.Dbfilename, "dbfilename", "", "	The subdirectory under dir where the RDB file is stored")
+	flag.StringVar(&config.Dbfilename, "dbfilename", "dump.rdb", "The name of the RDB file stored under dir")
 	flag.StringVar(&config.AppendOnly, "appendonly", "no", "Controls whether AOF persistence is enabled or disabled")
 	flag.StringVar(&config.AppendDirName, "appenddirname", "appendonlydir", "The subdirectory under dir where AOF and manifest files are stored")
 	flag.StringVar(&config.AppendFilename, "appendfilename", "appendonly.aof", "The name of the append-only file that records write operations")
 	flag.StringVar(&config.AppendFSync, "appendfsync", "everysec", "How often buffered writes are flushed to the AOF file on disk")
+	protoMaxBulkLen := flag.String("proto-max-bulk-len", "512mb", "Maximum size of a single bulk string in a client request")
+	flag.IntVar(&config.AutoAofRewritePercentage, "auto-aof-rewrite-percentage", 100, "Rewrite the AOF once it has grown by this percentage since the last rewrite, 0 disables it")
+	autoAofRewriteMinSize := flag.String("auto-aof-rewrite-min-size", "64mb", "Smallest AOF size that triggers an automatic rewrite")
+	replBacklogSize := flag.String("repl-backlog-size", "1mb", "Size of the replication backlog kept for partial resynchronisation")
+	flag.IntVar(&config.ReplBacklogTTL, "repl-backlog-ttl", 3600, "Seconds without replicas after which the backlog is freed, 0 keeps it forever")
+	flag.StringVar(&config.ReplicaReadOnly, "replica-read-only", "yes", "Refuse writes from clients while running as a replica")
+	flag.IntVar(&config.MinReplicasToWrite, "min-replicas-to-write", 0, "Refuse writes unless this many replicas are connected with an acceptable lag, 0 disables the check")
+	flag.IntVar(&config.MinReplicasMaxLag, "min-replicas-max-lag", 10, "Seconds since its last ACK after which a replica no longer counts towards min-replicas-to-write")
+	flag.IntVar(&config.ReplPingReplicaPeriod, "repl-ping-replica-period", 10, "Seconds between the PINGs a master sends its replicas")
+	flag.IntVar(&config.ReplTimeout, "repl-timeout", 60, "Seconds without traffic after which a replication link is considered broken")
+	flag.StringVar(&config.ReplDisklessSync, "repl-diskless-sync", "no", "Stream the RDB of a full resync straight to the replicas' sockets")
+	flag.IntVar(&config.ReplDisklessSyncDelay, "repl-diskless-sync-delay", 5, "Seconds to wait for more replicas before starting a diskless sync")
+	flag.StringVar(&config.ReplDisklessLoad, "repl-diskless-load", "disabled", "How a replica loads the RDB of a full resync: disabled, on-empty-db or swapdb")
+	flag.StringVar(&config.Masteruser, "masteruser", "", "The ACL user a replica authenticates as with its master")
+	flag.StringVar(&config.Masterauth, "masterauth", "", "The password a replica authenticates to its master with")
+	flag.StringVar(&config.ClusterEnabled, "cluster-enabled", "no", "Run as a cluster node that serves a share of the 16384 hash slots")
+	flag.StringVar(&config.ClusterConfigFile, "cluster-config-file", "nodes.conf", "The file under dir where a cluster node persists its view of the cluster")
+	flag.IntVar(&config.ClusterNodeTimeout, "cluster-node-timeout", 15000, "Milliseconds a cluster node can be unreachable before it's considered failing")
+	flag.BoolVar(&sentinelMode, "sentinel", false, "Run as a sentinel that monitors masters and fails them over")
+	flag.Var(&sentinelMonitors, "sentinel-monitor", "Monitor a master as \"<name> <host> <port> <quorum>\", can be repeated")
+	flag.IntVar(&sentinelDownAfter, "sentinel-down-after-milliseconds", 30000, "Milliseconds without a valid reply after which a sentinel considers an instance down")
+	flag.IntVar(&sentinelFailoverTimeout, "sentinel-failover-timeout", 180000, "Milliseconds a sentinel gives each failover step, failed attempts are retried after twice this")
+	save := flag.String("save", "3600 1 300 100 60 10000", "Save the DB after <seconds> if at least <changes> writes happened, as pairs of <seconds> <changes>")
 	flag.Parse()
 
+    var err error
+    config.ProtoMaxBulkLen, err = parseMemorySize(*protoMaxBulkLen)
+    if err != nil {
+        fmt.Printf("Invalid proto-max-bulk-len %q\n", *protoMaxBulkLen)
+        os.Exit(1)
+    }
+    config.AutoAofRewriteMinSize, err = parseMemorySize(*autoAofRewriteMinSize)
+    if err != nil {
+        fmt.Printf("Invalid auto-aof-rewrite-min-size %q\n", *autoAofRewriteMinSize)
+        os.Exit(1)
+    }
+    config.ReplBacklogSize, err = parseMemorySize(*replBacklogSize)
+    if err != nil || config.ReplBacklogSize < 16*1024 {
+        fmt.Printf("Invalid repl-backlog-size %q\n", *replBacklogSize)
+        os.Exit(1)
+    }
+    config.SavePoints, err = parseSavePoints(*save)
+    if err != nil {
+        fmt.Printf("Invalid save %q\n", *save)
+        os.Exit(1)
+    }
+
+    if config.ReplPingReplicaPeriod <= 0 || config.ReplTimeout <= 0 {
+        fmt.Println("repl-ping-replica-period and repl-timeout must be positive")
+        os.Exit(1)
+    }
+    if config.ReplDisklessSync != "yes" && config.ReplDisklessSync != "no" {
+        fmt.Printf("Invalid repl-diskless-sync %q, expected yes or no\n", config.ReplDisklessSync)
+        os.Exit(1)
+    }
+    if !isDisklessLoadMode(config.ReplDisklessLoad) {
+        fmt.Printf("Invalid repl-diskless-load %q, expected disabled, on-empty-db or swapdb\n", config.ReplDisklessLoad)
+        os.Exit(1)
+    }
+    if config.ReplDisklessSyncDelay < 0 {
+        fmt.Println("repl-diskless-sync-delay can't be negative")
+        os.Exit(1)
+    }
+    if config.ReplicaReadOnly != "yes" && config.ReplicaReadOnly != "no" {
+        fmt.Printf("Invalid replica-read-only %q, expected yes or no\n", config.ReplicaReadOnly)
+        os.Exit(1)
+    }
+
+    if config.ClusterEnabled != "yes" && config.ClusterEnabled != "no" {
+        fmt.Printf("Invalid cluster-enabled %q, expected yes or no\n", config.ClusterEnabled)
+        os.Exit(1)
+    }
+    if config.ClusterNodeTimeout <= 0 {
+        fmt.Println("cluster-node-timeout must be positive")
+        os.Exit(1)
+    }
+
+    switch config.AppendFSync {
+    case "always", "everysec", "no":
+    default:
+        fmt.Printf("Invalid appendfsync %q, expected always, everysec or no\n", config.AppendFSync)
+        os.Exit(1)
+    }
+
+    if sentinelMode {
+        // sentinels listen on 26379 unless told otherwise
+        portSet := false
+        flag.Visit(func(f *flag.Flag) { portSet = portSet || f.Name == "port" })
+        if !portSet {
+            config.Port = 26379
+        }
+        runSentinel()
+        return
+    }
+
     fmt.Printf("Dir=%q AppendOnly=%q AppendDirName=%q AofIncrFileCount=%d\n", config.Dir, config.AppendOnly, config.AppendDirName, config.AofIncrFileCount)
 
     handleReplicaConfig()
@@ -140,37 +312,59 @@ func main() {
 
     newAclUser("default")
 
-    config.AofIncrFileCount = 1
-    if config.AppendOnly == "yes" {
-        aofDir, err := createAofDir()
-        if err != nil {
-            fmt.Println(err)
-            os.Exit(1)
-        }
-        
-        createManifestFile(aofDir)
-        createEmptyIncFile(aofDir)
-    }
 
 	config.ListeningPort = strconv.Itoa(config.Port)
 	config.MasterReplOffset = 0
-    config.MasterReplid = randStringWithCharset(40, charset)
     config.ReplOffset = 0
-    ackReceived = make(chan bool)
+    config.SecondReplOffset = -1
 
-    if len(config.Dir) > 0 && len(config.Dbfilename) > 0 {
+    // with AOF enabled the dataset comes from the AOF and the RDB file is ignored
+    config.AofIncrFileCount = 1
+    if config.AppendOnly == "yes" {
+        if err := setupAppendOnly(); err != nil {
+            fmt.Printf("Failed to load the append only file: %v\n", err)
+            os.Exit(1)
+        }
+    } else if len(config.Dir) > 0 && len(config.Dbfilename) > 0 {
 		rdbPath := filepath.Join(config.Dir, config.Dbfilename)
 		err := readRDB(rdbPath)
-		if err != nil {
+		if err != nil && !os.IsNotExist(err) {
+			// starting with half a dataset would be worse than not starting
 			fmt.Printf("Failed to load '%s': %v\n", rdbPath, err)
+			os.Exit(1)
 		}
 	}
+    // replaying the AOF counts its writes as changes, they are already on disk
+    rdbDirty = 0
+    // a replica restarted from its own RDB can try to continue where it left off
+    if config.Role == "slave" && rdbLoadedReplInfo.replid != "" {
+        config.Replid = rdbLoadedReplInfo.replid
+        config.ReplOffset = rdbLoadedReplInfo.offset
+        config.MasterReplOffset = rdbLoadedReplInfo.offset
+    }
+
+    startExecutor()
+    startLazyfree()
+    startAofFsync()
+    startSaveScheduler()
+    startReplicationCron()
+    if clusterEnabled() {
+        runOnExecutor(func() { err = clusterInit() })
+        if err != nil {
+            fmt.Printf("Failed to start the cluster bus: %v\n", err)
+            os.Exit(1)
+        }
+    }
 
+	// the link connects in the background so a master that is down doesn't stop us starting
 	if config.Role == "slave" {
-		masterConn, reader := connectToMaster()
-		handleMasterConnection(masterConn, reader)
+		startMasterLink(config.ReplicaofHost, config.ReplicaofPort)
 	}
 
+	listenAndServe()
+}
+
+func listenAndServe() {
 	listener, err := net.Listen("tcp", fmt.Sprintf("0.0.0.0:%d", config.Port))
 	if err != nil {
 		fmt.Printf("Failed to bind to port %d\n", config.Port)
@@ -205,7 +399,10 @@ func setRole() {
         config.Role = "slave"
         switch flag.NArg() {
         case 0:
-            config.ReplicaofPort = 6379
+            // --replicaof "host port" already set the port
+            if config.ReplicaofPort == 0 {
+                config.ReplicaofPort = 6379
+            }
         case 1:
             config.ReplicaofPort, _ = strconv.Atoi(flag.Arg(0))
         default:
@@ -215,164 +412,144 @@ func setRole() {
 }
 
 func manageClientConnection(id int, conn net.Conn) {
+    c := newClient(id, conn)
+    go c.writeLoop()
     defer conn.Close()
-    
-    defer delete(loggedInUsers, conn)
-    defer clearWatchedState(conn)
-    
-    user := config.Users["default"]
-    user.authenticate(conn, "")
+    defer c.closeOutput()
+    defer runOnExecutor(c.cleanup)
+
+    runOnExecutor(func() {
+        clients[c.id] = c
+        user := config.Users["default"]
+        user.authenticate(c, "")
+    })
     
     fmt.Printf("[#%d] Client connected: %v\n", id, conn.RemoteAddr().String())
-    scanner := bufio.NewScanner(conn)
-
-    handshakeCommands := [][]string{
-        {"PING"},
-        {"REPLCONF", "listening-port", strconv.Itoa(config.Port)},
-        {"REPLCONF", "capa", "psync2"},
-        {"PSYNC", "?", "-1"},
-    }
-    handshakeIndex := 0
+    reader := bufio.NewReader(conn)
 
     for {
-        cmd, err := readCommand(scanner)
+        cmd, err := readCommand(reader)
         if err != nil {
+            if protoErr, ok := err.(protocolError); ok {
+                c.queueReply(encodeSimpleErrorResponse(protoErr.Error()))
+            }
             fmt.Printf("[#%d] Error reading command: %v\n", id, err.Error())
             break
         }
 
-        if len(cmd) == 0 {
-            break
-        }
-
-        // Check if the command matches the current handshake command
-        if handshakeIndex < len(handshakeCommands) && reflect.DeepEqual(cmd, handshakeCommands[handshakeIndex]) {
-            handshakeIndex++
-            // once handshake index reaches the same length as the commands, the handshake is complete and the replica is added to the list
-            if handshakeIndex == len(handshakeCommands) {
-                fmt.Printf("[#%d] Handshake completed\n", id)
-                config.Replicas = append(config.Replicas, conn)
-            }
-        }
-
         fmt.Printf("[#%d] Command = %v\n", id, cmd)
-        response, resynch := handleCommand(cmd, conn)
-
-        bytesSent, err := conn.Write([]byte(response))
-        if err != nil {
-            fmt.Printf("[#%d] Error writing response: %v\n", id, err.Error())
-            break
-        }
-        fmt.Printf("[#%d] Bytes sent: %d %q\n", id, bytesSent, response)
+        response := executeCommand(cmd, c)
 
-        if resynch {
-            sendEmptyRDB(id, conn)
-        }
+        c.reply(response)
+        fmt.Printf("[#%d] Bytes queued: %d %q\n", id, len(response), response)
     }
 
     fmt.Printf("[#%d] Client closing\n", id)
 }
 
-func readCommand(scanner *bufio.Scanner) ([]string, error) {
-    cmd := []string{}
-    var arrSize int
-    for scanner.Scan() {
-        token := scanner.Text()
-        if len(token) == 0 {
-            continue
-        }
-        switch token[0] {
-        case '*':
-            arrSize, _ = strconv.Atoi(token[1:])
-        case '$':
-            if !scanner.Scan() {
-                return nil, fmt.Errorf("unexpected end of input after $")
-            }
-            strToken := scanner.Text()
-            cmd = append(cmd, strToken)
-            arrSize--
-        default:
-            cmd = append(cmd, token)
-            arrSize--
-        }
-        if arrSize == 0 {
-            break
-        }
-    }
-    return cmd, nil
-}
-
-func handleCommand(cmd []string, conn net.Conn) (response string, resynch bool) {
+func handleCommand(cmd []string, c *client) string {
     command := strings.ToUpper(strings.TrimSpace(cmd[0]))
 
-    if isSubscriber(conn) {
+    // RESP3 clients get pushes out of band, so they may keep issuing any command
+    if isSubscriber(c) && c.protocol == 2 {
         handler, ok := subscriberCommandHandlers[command]
         if !ok {
-            return encodeSimpleErrorResponse(fmt.Sprintf("Can't execute '%s': only (P|S)SUBSCRIBE / (P|S)UNSUBSCRIBE / PING / QUIT / RESET are allowed in this context", command)), false
+            return encodeSimpleErrorResponse(fmt.Sprintf("Can't execute '%s': only (P|S)SUBSCRIBE / (P|S)UNSUBSCRIBE / PING / QUIT / RESET are allowed in this context", command))
+        }
+        if entry, ok := commandTable[command]; ok && !entry.arityMatches(len(cmd)) {
+            return encodeSimpleErrorResponse(fmt.Sprintf("wrong number of arguments for '%s' command", strings.ToLower(command)))
         }
-        return handler(cmd, conn)
+        return handler(cmd, c)
     }
 
-    if isWriteCommand(command) {
-        for i := 1; i < len(cmd); i++ {
-            watchers, ok := watchedKeys[cmd[i]]
-            if !ok {
-                continue
-            }
-            
-            for watchedConn := range watchers {
-                dirtyWatchedConns[watchedConn] = true
-            }
+    entry, ok := commandTable[command]
+    if !ok {
+        return encodeSimpleErrorResponse("Unknown command")
+    }
+    if rejection := aclRejection(command, c); rejection != "" {
+        return rejection
+    }
+    if !entry.arityMatches(len(cmd)) {
+        return encodeSimpleErrorResponse(fmt.Sprintf("wrong number of arguments for '%s' command", strings.ToLower(command)))
+    }
+    // the master's stream and the AOF only hold what was ours to run
+    if clusterEnabled() && !c.internal {
+        if rejection := clusterRejection(command, entry, cmd, c); rejection != "" {
+            return rejection
         }
     }
-
-    if isInMulti(conn) && command != "EXEC" && command != "MULTI" && command != "DISCARD" && command != "WATCH" && command != "UNWATCH" {
-        queuedCommands[conn] = append(queuedCommands[conn], cmd)
-        return encodeSimpleString("QUEUED"), false
+    isWrite := entry.flags&cmdWrite != 0
+    if isWrite {
+        if rejection := writeRejection(c); rejection != "" {
+            return rejection
+        }
     }
 
-    handler, ok := commandHandlers[command]
-    if !ok {
-        return encodeSimpleErrorResponse("Unknown command"), false
+    if c.inMulti && command != "EXEC" && command != "MULTI" && command != "DISCARD" && command != "WATCH" && command != "UNWATCH" {
+        c.multiQueue = append(c.multiQueue, cmd)
+        return encodeSimpleString("QUEUED")
     }
-    response, resynch = handler(cmd, conn)
 
-    rawCmd := encodeStringArray(cmd)
-    config.ReplOffset += len(rawCmd)
-
-    // If the command is a write, propagate
-    if isWriteCommand(command) {
-        config.WriteOffset++
-        propagate(cmd)
+    if isWrite {
+        keys := commandKeys(command, entry, cmd)
+        for _, key := range keys {
+            touchWatchedKey(key)
+        }
+        preserveForSnapshots(keys)
     }
-    return
-}
 
-func isWriteCommand(command string) bool {
-    switch command {
-    case "SET", "XADD", "RPUSH", "LPUSH", "LPOP", "INCR":
-        return true
-    default:
-        return false
+    prevClient := currentClient
+    currentClient = c
+    hidden := expireCommandKeys(command, entry, cmd)
+    response := entry.handler(cmd, c)
+    restoreHiddenKeys(hidden)
+    currentClient = prevClient
+
+    // If the command is a write that succeeded, propagate it and log it to the AOF
+    if isWrite && !strings.HasPrefix(response, "-") {
+        if propagationRewritten {
+            for _, rewritten := range propagationRewrite {
+                propagateWrite(rewritten)
+            }
+        } else {
+            propagateWrite(cmd)
+        }
     }
+    propagationRewritten, propagationRewrite = false, nil
+    flushPropagation()
+    return response
 }
 
-func isSubscriber(conn net.Conn) bool {
-    return subscriberCount(conn) > 0
+// writeRejection is the READONLY or NOREPLICAS error for a client that can't write here
+func writeRejection(c *client) string {
+    // the master's stream and the AOF are always applied, only clients are refused
+    if config.Role == "slave" && config.ReplicaReadOnly == "yes" && !c.isMaster && !c.internal {
+        return encodeErrorResponseWithMsg("READONLY", "You can't write against a read only replica.")
+    }
+    if config.Role == "master" && config.MinReplicasToWrite > 0 && !c.internal && goodReplicasCount() < config.MinReplicasToWrite {
+        return encodeErrorResponseWithMsg("NOREPLICAS", "Not enough good replicas to write.")
+    }
+    return ""
 }
 
-func sendAndCheckResponse(conn net.Conn, reader *bufio.Reader, command []string, expectedResponse string) (bool, error) {
-    conn.Write([]byte(encodeStringArray(command)))
-    response, err := reader.ReadString('\n')
-    if err != nil {
-        fmt.Printf("Error reading response: %v\n", err)
-        return false, err
+// aclRejection is the NOAUTH or NOPERM error for a client that can't run command
+func aclRejection(command string, c *client) string {
+    // like redis AUTH and HELLO skip the ACL too, so a client whose user can't
+    // run anything can still switch to another one
+    if c.internal || command == "AUTH" || command == "HELLO" {
+        return ""
     }
-    if !strings.Contains(response, expectedResponse) {
-        fmt.Printf("Error: Expected %s but got %s\n", expectedResponse, response)
-        return false, nil
+    if c.user == "" {
+        return encodeErrorResponseWithMsg("NOAUTH", "Authentication required.")
     }
-    return true, nil
+    if user, ok := config.Users[c.user]; c.user != "" && (!ok || !user.canRun(command)) {
+        return encodeErrorResponseWithMsg("NOPERM", fmt.Sprintf("User %s has no permissions to run the '%s' command", c.user, strings.ToLower(command)))
+    }
+    return ""
+}
+
+func isSubscriber(c *client) bool {
+    return len(c.subscriptions) > 0
 }
 
 func randReplid() string {